@@ -0,0 +1,256 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//Access modes as passed to access(2)
+const (
+	ACCESS_EXEC  = 1
+	ACCESS_WRITE = 2
+	ACCESS_READ  = 4
+)
+
+//procStatus returns a field of /proc/<pid>/status of the calling process, empty if it can
+//not be read
+func procStatus(context *fuse.Context, field string) string {
+	if context == nil || context.Pid == 0 {
+		return ""
+	}
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", context.Pid))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimSpace(line[len(field)+1:])
+		}
+	}
+	return ""
+}
+
+//inGroup reports whether gid is the primary or one of the supplementary groups of the caller
+func inGroup(gid uint32, context *fuse.Context) bool {
+	if context.Gid == gid {
+		return true
+	}
+	for _, g := range strings.Fields(procStatus(context, "Groups")) {
+		n, err := strconv.ParseUint(g, 10, 32)
+		if err == nil && uint32(n) == gid {
+			return true
+		}
+	}
+	return false
+}
+
+//checkAccess checks the permission bits of attr for the caller, mode is a mask of the
+//ACCESS_ constants
+func checkAccess(attr *fuse.Attr, mode uint32, context *fuse.Context) fuse.Status {
+	mode &= ACCESS_READ | ACCESS_WRITE | ACCESS_EXEC
+	if context == nil || mode == 0 {
+		return fuse.OK
+	}
+	if context.Uid == 0 {
+		//root is only refused executing a file no one is allowed to execute
+		if mode&ACCESS_EXEC != 0 && attr.Mode&syscall.S_IFMT != syscall.S_IFDIR && attr.Mode&0111 == 0 {
+			return fuse.EACCES
+		}
+		return fuse.OK
+	}
+	var perm uint32
+	switch {
+	case context.Uid == attr.Uid:
+		perm = attr.Mode >> 6
+	case inGroup(attr.Gid, context):
+		perm = attr.Mode >> 3
+	default:
+		perm = attr.Mode
+	}
+	if perm&mode != mode {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+//openAccess converts the flags of open(2) into the access they need
+func openAccess(flags uint32) uint32 {
+	var mode uint32
+	switch int(flags) & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mode = ACCESS_READ
+	case syscall.O_WRONLY:
+		mode = ACCESS_WRITE
+	case syscall.O_RDWR:
+		mode = ACCESS_READ | ACCESS_WRITE
+	}
+	if int(flags)&syscall.O_TRUNC != 0 {
+		mode |= ACCESS_WRITE
+	}
+	return mode
+}
+
+//parentPath returns the directory holding name, the root is ""
+func parentPath(name string) string {
+	idx := strings.LastIndex(strings.TrimSuffix(name, "/"), "/")
+	if idx < 0 {
+		return ""
+	}
+	return name[:idx]
+}
+
+//permitted checks that the caller has mode access to name, everything is permitted when
+//permission checks are turned off
+func (c *CassFs) permitted(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if !c.options.CheckPermissions {
+		return fuse.OK
+	}
+	if status := c.searchPermitted(name, context); status != fuse.OK {
+		return status
+	}
+	attr, status := c.GetAttr(name, context)
+	if status != fuse.OK {
+		return status
+	}
+	return checkAccess(attr, mode, context)
+}
+
+//searchPermitted checks that the caller may search every directory above name
+func (c *CassFs) searchPermitted(name string, context *fuse.Context) fuse.Status {
+	for dir := name; dir != ""; {
+		dir = parentPath(dir)
+		attr, status := c.GetAttr(dir, context)
+		if status != fuse.OK {
+			return status
+		}
+		if status = checkAccess(attr, ACCESS_EXEC, context); status != fuse.OK {
+			return status
+		}
+	}
+	return fuse.OK
+}
+
+//ownerPermitted checks that the caller owns name or is root, which changing its mode,
+//times or extended attributes needs
+func (c *CassFs) ownerPermitted(name string, context *fuse.Context) fuse.Status {
+	if !c.options.CheckPermissions || context == nil {
+		return fuse.OK
+	}
+	if status := c.searchPermitted(name, context); status != fuse.OK {
+		return status
+	}
+	attr, status := c.GetAttr(name, context)
+	if status != fuse.OK {
+		return status
+	}
+	if context.Uid != 0 && context.Uid != attr.Uid {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+//chownPermitted checks that the caller may give name to uid and gid, -1 keeps either.
+//Only root gives a file away, the owner may only change its group to one of their own.
+func (c *CassFs) chownPermitted(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if status := c.ownerPermitted(name, context); status != fuse.OK {
+		return status
+	}
+	if !c.options.CheckPermissions || context == nil || context.Uid == 0 {
+		return fuse.OK
+	}
+	attr, status := c.GetAttr(name, context)
+	if status != fuse.OK {
+		return status
+	}
+	if int32(uid) >= 0 && uid != attr.Uid {
+		return fuse.EPERM
+	}
+	if int32(gid) >= 0 && gid != attr.Gid && !inGroup(gid, context) {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+//timesPermitted checks that the caller may set the times of name.  The current time only
+//needs write access, any other time needs the caller to own name.  go-fuse passes
+//UTIME_NOW as the current time, so times within a second of it count as now.
+func (c *CassFs) timesPermitted(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	status := c.ownerPermitted(name, context)
+	if status == fuse.EPERM && isNow(atime) && isNow(mtime) {
+		return c.permitted(name, ACCESS_WRITE, context)
+	}
+	return status
+}
+
+//isNow reports whether t is left unchanged or is the current time
+func isNow(t *time.Time) bool {
+	if t == nil {
+		return true
+	}
+	diff := time.Since(*t)
+	return diff > -time.Second && diff < time.Second
+}
+
+//removePermitted checks that the caller may remove or replace name.  In a directory with
+//the sticky bit only the owner of the entry or of the directory (or root) may.
+func (c *CassFs) removePermitted(name string, context *fuse.Context) fuse.Status {
+	if status := c.parentPermitted(name, context); status != fuse.OK {
+		return status
+	}
+	if !c.options.CheckPermissions || context == nil || context.Uid == 0 {
+		return fuse.OK
+	}
+	dir, status := c.GetAttr(parentPath(name), context)
+	if status != fuse.OK {
+		return status
+	}
+	if dir.Mode&syscall.S_ISVTX == 0 || dir.Uid == context.Uid {
+		return fuse.OK
+	}
+	attr, status := c.GetAttr(name, context)
+	if status == fuse.ENOENT {
+		return fuse.OK
+	}
+	if status != fuse.OK {
+		return status
+	}
+	if attr.Uid != context.Uid {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+//parentPermitted checks that the caller may add or remove entries in the directory
+//holding name
+func (c *CassFs) parentPermitted(name string, context *fuse.Context) fuse.Status {
+	if c.virtual[name] || c.virtual[parentPath(name)] {
+		return fuse.EPERM
+	}
+	return c.permitted(parentPath(name), ACCESS_WRITE|ACCESS_EXEC, context)
+}
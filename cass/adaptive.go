@@ -0,0 +1,128 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"math"
+	"path"
+	"sync"
+	"time"
+)
+
+//ADAPTIVE_CHANGES is the number of changes a directory is expected to see while its
+//entries are cached, the cache time of a directory is this divided by its change rate
+const ADAPTIVE_CHANGES = 0.1
+
+//ADAPTIVE_HALF_LIFE is how long it takes for a change to count half as much
+const ADAPTIVE_HALF_LIFE = 10 * time.Minute
+
+//ADAPTIVE_MAX_DIRS is the number of directories tracked before the quiet ones are dropped
+const ADAPTIVE_MAX_DIRS = 10000
+
+//AdaptiveTTL picks the time metadata is cached for from how often the directory it is in
+//changes.  Directories that are never seen changing, like vendor code, get Max and
+//directories that change all the time, like uploads and caches, get Min.  Changes are
+//counted from the invalidation feed and from the writes of the client itself.  Changed
+//can be called on a nil AdaptiveTTL.
+type AdaptiveTTL struct {
+	lock sync.Mutex
+	Min  int64
+	Max  int64
+	dirs map[string]*dirRate
+}
+
+//dirRate is the decaying count of the changes of a directory
+type dirRate struct {
+	score   float64
+	updated time.Time
+}
+
+//decayed returns the score of r at now
+func (r *dirRate) decayed(now time.Time) float64 {
+	return r.score * math.Pow(0.5, float64(now.Sub(r.updated))/float64(ADAPTIVE_HALF_LIFE))
+}
+
+//NewAdaptiveTTL returns cache times between min and max seconds
+func NewAdaptiveTTL(min int64, max int64) *AdaptiveTTL {
+	return &AdaptiveTTL{Min: min, Max: max, dirs: make(map[string]*dirRate)}
+}
+
+//Changed counts a change of the entry name against the directory it is in
+func (a *AdaptiveTTL) Changed(name string) {
+	if a == nil {
+		return
+	}
+	dir := path.Dir(name)
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	r, ok := a.dirs[dir]
+	if !ok {
+		if len(a.dirs) >= ADAPTIVE_MAX_DIRS {
+			a.prune(now)
+		}
+		r = &dirRate{}
+		a.dirs[dir] = r
+	}
+	r.score = r.decayed(now) + 1
+	r.updated = now
+}
+
+//prune drops the directories that have not changed in a long time, they get Max again
+func (a *AdaptiveTTL) prune(now time.Time) {
+	for dir, r := range a.dirs {
+		if r.decayed(now) < ADAPTIVE_CHANGES {
+			delete(a.dirs, dir)
+		}
+	}
+}
+
+//TTL returns the seconds the metadata of name is cached for
+func (a *AdaptiveTTL) TTL(name string) int64 {
+	a.lock.Lock()
+	r, ok := a.dirs[path.Dir(name)]
+	var score float64
+	if ok {
+		score = r.decayed(time.Now())
+	}
+	a.lock.Unlock()
+	if score <= 0 {
+		return a.Max
+	}
+	//The score of a steady rate settles at rate * half life / ln 2
+	rate := score * math.Ln2 / ADAPTIVE_HALF_LIFE.Seconds()
+	ttl := int64(ADAPTIVE_CHANGES / rate)
+	if ttl < a.Min {
+		return a.Min
+	}
+	if ttl > a.Max {
+		return a.Max
+	}
+	return ttl
+}
+
+//cacheTTL returns the seconds the metadata of name is cached for
+func (c *Cass) cacheTTL(name string) int64 {
+	if c.AdaptiveTTL == nil {
+		return c.FcacheDuration
+	}
+	return c.AdaptiveTTL.TTL(name)
+}
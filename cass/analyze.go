@@ -0,0 +1,251 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cass
+
+import (
+	"fmt"
+	"sort"
+	"syscall"
+
+	"github.com/gocql/gocql"
+)
+
+//Every directory is a single partition of the filesystem table and every chunk a row of
+//filedata, so very large directories and files with many chunks are the hot spots of an
+//environment.  Analyze finds them and suggests changes based on what is stored.
+
+//Defaults of AnalyzeOptions
+const (
+	ANALYZE_TOP         = 10
+	ANALYZE_DIR_ENTRIES = 10000
+	ANALYZE_FILE_CHUNKS = 1024
+)
+
+//AnalyzeOptions are the limits the report is made with
+type AnalyzeOptions struct {
+	//Top is the number of directories, files and blobs listed
+	Top int
+	//DirEntries and FileChunks are the sizes above which a directory or file is a problem
+	DirEntries int
+	FileChunks int
+}
+
+type AnalyzeDir struct {
+	Path    string
+	Entries int
+}
+
+type AnalyzeFile struct {
+	Path      string
+	Size      uint64
+	Chunks    int
+	BlockSize int64
+}
+
+type AnalyzeBlob struct {
+	Hash []byte
+	//Refs are the references from the environment, StoreRefs the reference count of
+	//the blob in the store, which includes other environments
+	Refs      int
+	StoreRefs int64
+}
+
+//AnalyzeReport describes the distribution of the data of an environment
+type AnalyzeReport struct {
+	Entries         int
+	Dirs            int
+	Files           int
+	Bytes           uint64
+	LargeDirs       []AnalyzeDir
+	LargeFiles      []AnalyzeFile
+	Blobs           []AnalyzeBlob
+	Recommendations []string
+}
+
+type analyzeEntry struct {
+	parent string
+	name   string
+}
+
+//Analyze scans the environment and reports its largest directories and files and its
+//most referenced blobs
+func (c *Cass) Analyze(opts AnalyzeOptions) (*AnalyzeReport, error) {
+	if opts.Top <= 0 {
+		opts.Top = ANALYZE_TOP
+	}
+	if opts.DirEntries <= 0 {
+		opts.DirEntries = ANALYZE_DIR_ENTRIES
+	}
+	if opts.FileChunks <= 0 {
+		opts.FileChunks = ANALYZE_FILE_CHUNKS
+	}
+	report := &AnalyzeReport{}
+	entries := make(map[string]int)
+	dirs := make(map[string]analyzeEntry)
+	refs := make(map[string]int)
+	var files []AnalyzeFile
+	var parents []analyzeEntry
+	inodes := make(map[string]bool)
+	err := c.scanEnvironment(func(dir string, name string, hash []byte, meta *CassMetadata) error {
+		report.Entries++
+		entries[dir]++
+		if meta.Inode != "" {
+			//The content of a hard linked file is counted once
+			if inodes[meta.Inode] {
+				return nil
+			}
+			inodes[meta.Inode] = true
+			var inode CassMetadata
+			var err error
+			hash, inode, err = c.readInode(meta.Inode)
+			if err != nil {
+				return nil
+			}
+			meta = &inode
+		}
+		if meta.Attr == nil {
+			return nil
+		}
+		switch meta.Attr.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			report.Dirs++
+			if uuid, err := gocql.UUIDFromBytes(hash); err == nil {
+				dirs[uuid.String()] = analyzeEntry{parent: dir, name: name}
+			}
+		case syscall.S_IFREG:
+			report.Files++
+			report.Bytes += meta.Attr.Size
+			chunks := len(meta.Chunks)
+			if chunks == 0 && len(hash) > 0 {
+				chunks = 1
+			}
+			files = append(files, AnalyzeFile{Size: meta.Attr.Size, Chunks: chunks, BlockSize: meta.ChunkSize()})
+			parents = append(parents, analyzeEntry{parent: dir, name: name})
+		}
+		for _, ref := range dataRefs(hash, meta) {
+			refs[string(ref)]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	path := func(dir string, name string) string {
+		full := name
+		for dir != "" {
+			entry, ok := dirs[dir]
+			if !ok {
+				return "?/" + full
+			}
+			full = entry.name + "/" + full
+			dir = entry.parent
+		}
+		return full
+	}
+
+	for id, count := range entries {
+		name := "/"
+		if id != "" {
+			entry := dirs[id]
+			name = path(entry.parent, entry.name)
+		}
+		report.LargeDirs = append(report.LargeDirs, AnalyzeDir{Path: name, Entries: count})
+	}
+	sort.Sort(largeDirs(report.LargeDirs))
+
+	for i := range files {
+		files[i].Path = path(parents[i].parent, parents[i].name)
+	}
+	sort.Sort(largeFiles(files))
+	report.LargeFiles = files
+
+	for hash, count := range refs {
+		report.Blobs = append(report.Blobs, AnalyzeBlob{Hash: []byte(hash), Refs: count})
+	}
+	sort.Sort(hotBlobs(report.Blobs))
+	if len(report.Blobs) > opts.Top {
+		report.Blobs = report.Blobs[:opts.Top]
+	}
+	for i := range report.Blobs {
+		report.Blobs[i].StoreRefs, _ = c.blobRefCount(c.OwnerId, report.Blobs[i].Hash)
+	}
+
+	report.Recommendations = c.recommend(report, opts)
+	if len(report.LargeDirs) > opts.Top {
+		report.LargeDirs = report.LargeDirs[:opts.Top]
+	}
+	if len(report.LargeFiles) > opts.Top {
+		report.LargeFiles = report.LargeFiles[:opts.Top]
+	}
+	return report, nil
+}
+
+//recommend turns the problems found in the report into suggestions
+func (c *Cass) recommend(report *AnalyzeReport, opts AnalyzeOptions) []string {
+	var recs []string
+	for _, dir := range report.LargeDirs {
+		if dir.Entries <= opts.DirEntries {
+			break
+		}
+		recs = append(recs, fmt.Sprintf("%s has %d entries in a single partition, spread them over subdirectories (e.g. by a prefix of the name)", dir.Path, dir.Entries))
+	}
+	large := 0
+	var largest uint64
+	for _, file := range report.LargeFiles {
+		if file.Chunks <= opts.FileChunks {
+			break
+		}
+		large++
+		if file.Size > largest {
+			largest = file.Size
+		}
+	}
+	if large > 0 {
+		//The smallest block size that keeps the largest file within the limit
+		size := c.NewBlockSize()
+		for size < BLOCKSIZE_MAX && numChunks(largest, size) > int64(opts.FileChunks) {
+			size *= 2
+		}
+		if size > c.NewBlockSize() {
+			recs = append(recs, fmt.Sprintf("%d files have more than %d chunks, raise the block size for new files with `cassfs defaults --block-size %dK`", large, opts.FileChunks, size/1024))
+		} else {
+			recs = append(recs, fmt.Sprintf("%d files have more than %d chunks even at the largest block size, keep files that large out of the environment", large, opts.FileChunks))
+		}
+	}
+	return recs
+}
+
+type largeDirs []AnalyzeDir
+
+func (d largeDirs) Len() int           { return len(d) }
+func (d largeDirs) Less(i, j int) bool { return d[i].Entries > d[j].Entries }
+func (d largeDirs) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+type largeFiles []AnalyzeFile
+
+func (f largeFiles) Len() int           { return len(f) }
+func (f largeFiles) Less(i, j int) bool { return f[i].Chunks > f[j].Chunks }
+func (f largeFiles) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+type hotBlobs []AnalyzeBlob
+
+func (b hotBlobs) Len() int           { return len(b) }
+func (b hotBlobs) Less(i, j int) bool { return b[i].Refs > b[j].Refs }
+func (b hotBlobs) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,128 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//With Policy.Audit set the destructive operations made to an environment are recorded in
+//the audit table for that long, with the uid of the caller, the host and the id of the
+//client (mount or command) that made them.  Failing to record an operation is logged but
+//does not fail the operation.
+
+//Operations recorded in the audit log
+const (
+	AUDIT_DELETE = "delete"
+	AUDIT_RMDIR  = "rmdir"
+	AUDIT_CHMOD  = "chmod"
+	AUDIT_CHOWN  = "chown"
+	AUDIT_RENAME = "rename"
+)
+
+//AuditRecord is an operation recorded in the audit log.  Detail is the new path of a
+//rename, the mode of a chmod or the owner of a chown.
+type AuditRecord struct {
+	Id     gocql.UUID
+	Op     string
+	Path   string
+	Detail string
+	Uid    int64
+	Host   string
+	Mount  string
+}
+
+//Time returns when the operation was made
+func (r *AuditRecord) Time() time.Time {
+	return r.Id.Time()
+}
+
+//auditHost is the host name recorded with every operation
+var auditHost = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}()
+
+//Audit records that uid made op on path.  It does nothing when the environment keeps no
+//audit log.
+func (c *Cass) Audit(op string, uid uint32, path string, detail string) {
+	if c.Config == nil || c.Config.Policy.Audit <= 0 || c.session == nil {
+		return
+	}
+	ttl := int(c.Config.Policy.Audit / time.Second)
+	err := c.session.Query("INSERT INTO audit (cust_id, environment, id, op, path, detail, uid, host, mount) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?", c.OwnerId, c.Environment, gocql.TimeUUID(), op, strings.Trim(path, "/"), detail, int64(uid), auditHost, c.origin, ttl).Exec()
+	if err != nil {
+		log.Println("Unable to record", op, "of", path, "in the audit log:", err)
+	}
+}
+
+//AuditFilter selects the records AuditLog returns, empty fields match everything
+type AuditFilter struct {
+	Since time.Time
+	Op    string
+	Path  string
+	Uid   int64
+	Limit int
+}
+
+func (f *AuditFilter) match(r *AuditRecord) bool {
+	if f.Op != "" && r.Op != f.Op {
+		return false
+	}
+	if f.Uid >= 0 && r.Uid != f.Uid {
+		return false
+	}
+	path := strings.Trim(f.Path, "/")
+	return path == "" || r.Path == path || strings.HasPrefix(r.Path, path+"/")
+}
+
+//AuditLog returns the recorded operations that match filter, the newest first
+func (c *Cass) AuditLog(filter *AuditFilter) ([]*AuditRecord, error) {
+	var records []*AuditRecord
+	r := &AuditRecord{}
+	iter := c.session.Query("SELECT id, op, path, detail, uid, host, mount FROM audit WHERE cust_id = ? AND environment = ? AND id > minTimeuuid(?)", c.OwnerId, c.Environment, filter.Since).Iter()
+	for iter.Scan(&r.Id, &r.Op, &r.Path, &r.Detail, &r.Uid, &r.Host, &r.Mount) {
+		if filter.match(r) {
+			records = append(records, r)
+			if filter.Limit > 0 && len(records) >= filter.Limit {
+				break
+			}
+		}
+		r = &AuditRecord{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+//MountId returns the id this client records in the audit log
+func (c *Cass) MountId() string {
+	return c.origin
+}
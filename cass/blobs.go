@@ -0,0 +1,166 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//Data is kept in a single pool shared by every owner unless IsolatedBlobs is set, in
+//which case every owner has its own data and references in the owner_filedata and
+//owner_fileref tables.  Content is then only deduplicated within an owner, but one
+//owner can never reference data stored by another by knowing its hash.
+//
+//Every access to the data goes through the rate limiter of the store, which only limits
+//anything for batch commands that were given a budget.
+
+//blobExists checks if owner has the data for hash
+func (c *Cass) blobExists(owner int64, hash []byte) (bool, error) {
+	var h []byte
+	var err error
+	c.Limiter.Wait(1, 0)
+	if c.IsolatedBlobs {
+		err = c.session.Query("SELECT hash FROM owner_filedata WHERE cust_id = ? AND hash = ?", owner, hash).Scan(&h)
+	} else {
+		err = c.session.Query("SELECT hash FROM filedata WHERE hash = ?", hash).Scan(&h)
+	}
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//insertBlob stores data that was encoded with codec for owner
+func (c *Cass) insertBlob(owner int64, hash []byte, codec int, data []byte) error {
+	c.Limiter.Wait(1, len(data))
+	if c.IsolatedBlobs {
+		return c.session.Query("INSERT INTO owner_filedata (cust_id, hash, location, data, codec) VALUES(?, ?, ?, ?, ?)", owner, hash, 0, data, codec).Exec()
+	}
+	return c.session.Query("INSERT INTO filedata (hash, location, data, codec) VALUES(?, ?, ?, ?)", hash, 0, data, codec).Exec()
+}
+
+//selectBlob returns an iterator over the location, data and codec of hash
+func (c *Cass) selectBlob(owner int64, hash []byte) *gocql.Iter {
+	c.Limiter.Wait(1, 0)
+	if c.IsolatedBlobs {
+		return c.session.Query("SELECT location, data, codec FROM owner_filedata WHERE cust_id = ? AND hash = ?", owner, hash).Iter()
+	}
+	return c.session.Query("SELECT location, data, codec FROM filedata WHERE hash = ?", hash).Iter()
+}
+
+//blobSize returns the stored size of the data for hash, 0 when it can not be read
+func (c *Cass) blobSize(owner int64, hash []byte) int64 {
+	var loc, codec int
+	var data []byte
+	var size int64
+	iter := c.selectBlob(owner, hash)
+	for iter.Scan(&loc, &data, &codec) {
+		size += int64(len(data))
+	}
+	if err := iter.Close(); err != nil {
+		log.Println("Unable to read data:", err)
+		return 0
+	}
+	return size
+}
+
+//deleteBlob removes the data for hash that was written before at, data written again
+//later survives the delete whichever reaches the nodes first
+func (c *Cass) deleteBlob(owner int64, hash []byte, at time.Time) error {
+	c.Limiter.Wait(1, 0)
+	stamp := at.UnixNano() / int64(time.Microsecond)
+	if c.IsolatedBlobs {
+		return c.session.Query("DELETE FROM owner_filedata USING TIMESTAMP ? WHERE cust_id = ? AND hash = ?", stamp, owner, hash).Exec()
+	}
+	return c.session.Query("DELETE FROM filedata USING TIMESTAMP ? WHERE hash = ?", stamp, hash).Exec()
+}
+
+//reuseBlob checks if owner has the data for hash before it is referenced again.  Data that
+//is a garbage collection candidate gets a new grace period, or is reported missing when a
+//sweep already claimed it so the caller writes it again.
+func (c *Cass) reuseBlob(owner int64, hash []byte) (bool, error) {
+	exists, err := c.blobExists(owner, hash)
+	if err != nil || !exists {
+		return exists, err
+	}
+	swept, err := c.touch(owner, hash)
+	if err != nil {
+		return false, err
+	}
+	return !swept, nil
+}
+
+//addBlobRef changes the reference count of hash by delta
+func (c *Cass) addBlobRef(owner int64, hash []byte, delta int64) error {
+	c.Limiter.Wait(1, 0)
+	if c.IsolatedBlobs {
+		return c.session.Query("UPDATE owner_fileref SET refs = refs + ? WHERE cust_id = ? AND hash = ?", delta, owner, hash).Exec()
+	}
+	return c.session.Query("UPDATE fileref SET refs = refs + ? WHERE hash = ?", delta, hash).Exec()
+}
+
+//blobRefCount returns the reference count of hash, data that was never referenced has 0
+func (c *Cass) blobRefCount(owner int64, hash []byte) (int64, error) {
+	var refs int64
+	var err error
+	c.Limiter.Wait(1, 0)
+	if c.IsolatedBlobs {
+		err = c.session.Query("SELECT refs FROM owner_fileref WHERE cust_id = ? AND hash = ?", owner, hash).Scan(&refs)
+	} else {
+		err = c.session.Query("SELECT refs FROM fileref WHERE hash = ?", hash).Scan(&refs)
+	}
+	if err == gocql.ErrNotFound {
+		return 0, nil
+	}
+	return refs, err
+}
+
+//copyBlobs makes sure target has the data for every hash in refs, used when entries are
+//copied to another owner while data is isolated
+func (c *Cass) copyBlobs(target *Cass, refs [][]byte) error {
+	if !c.IsolatedBlobs || c.OwnerId == target.OwnerId {
+		return nil
+	}
+	for _, hash := range refs {
+		ok, err := target.reuseBlob(target.OwnerId, hash)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		var loc, codec int
+		var data []byte
+		err = c.session.Query("SELECT location, data, codec FROM owner_filedata WHERE cust_id = ? AND hash = ?", c.OwnerId, hash).Scan(&loc, &data, &codec)
+		if err != nil {
+			return err
+		}
+		c.Limiter.Wait(1, len(data))
+		err = target.insertBlob(target.OwnerId, hash, codec, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -21,9 +21,10 @@
 package cass
 
 import (
-	"bytes"
+	"fmt"
 	"log"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -31,21 +32,40 @@ import (
 )
 
 type CassFileHandle struct {
-	at       int64
-	closed   bool
-	fileData *CassFileData
+	at        int64
+	closed    bool
+	fileData  *CassFileData
+	cache     *chunkCache
+	readahead readahead
 }
 
 type CassFileData struct {
 	sync.Mutex
-	Fs    *CassFs
-	Refs  int32
-	Name  *string
-	Data  []byte
-	Hash  []byte
-	Dirty bool
-	lign  bool
-	Attr  *fuse.Attr
+	Fs       *CassFs
+	Refs     int32
+	Name     *string
+	Hash     []byte
+	Chunks   [][]byte
+	Dirty    bool
+	Orphaned bool
+	lign     bool
+	orphanId string
+	dirty    map[int64][]byte
+	Attr     *fuse.Attr
+	//XAttr and XAttrBinary are written back along with the content
+	XAttr       map[string]string
+	XAttrBinary map[string][]byte
+	//Inode is set when the file has hard links and its content is shared with them
+	Inode string
+	//BlockSize is the size of the chunks of the file, 0 is BLOBSIZE
+	BlockSize int64
+	//Inline is the stored content of a file that is kept in its row
+	Inline []byte
+	//saved is the encoded metadata the file was read with or last saved with
+	saved []byte
+	//held are the references of the stored entry once Truncate cut its chunk list
+	held    [][]byte
+	trimmed bool
 }
 
 func NewFileHandle(f *CassFileData) *CassFileHandle {
@@ -56,6 +76,7 @@ func NewFileHandle(f *CassFileData) *CassFileHandle {
 		at:       0,
 		closed:   false,
 		fileData: f,
+		cache:    newChunkCache(handleCacheSize(f.readaheadWindow())),
 	}
 }
 
@@ -66,15 +87,15 @@ func NewEmptyFileData(path *string) *CassFileData {
 	}
 }
 
-func NewFileData(path *string, fs *CassFs, hash []byte, data []byte, attr *fuse.Attr) *CassFileData {
+func NewFileData(path *string, fs *CassFs, hash []byte, chunks [][]byte, attr *fuse.Attr) *CassFileData {
 	return &CassFileData{
-		Refs:  0,
-		Fs:    fs,
-		Name:  path,
-		Data:  data,
-		Hash:  hash,
-		Dirty: false,
-		Attr:  attr,
+		Refs:   0,
+		Fs:     fs,
+		Name:   path,
+		Hash:   hash,
+		Chunks: chunks,
+		Dirty:  false,
+		Attr:   attr,
 	}
 }
 
@@ -82,50 +103,37 @@ func (c *CassFileHandle) String() string {
 	return *c.fileData.Name
 }
 
+//pathfs hands attribute changes to any handle that has the file open for writing without
+//the context of the caller, so the handle leaves them to the checked calls of CassFs, which
+//change the open file
 func (c *CassFileHandle) Chmod(mode uint32) fuse.Status {
-	permMask := uint32(07777)
-	c.fileData.Attr.Mode = (c.fileData.Attr.Mode &^ permMask) | mode
-	err := c.fileData.Fs.FlushFile(c.fileData)
-	if err != nil {
-		log.Println("Error flushing file to data store:", err)
-		return fuse.EIO
-	}
-	return fuse.OK
+	return fuse.ENOSYS
 }
 
 func (c *CassFileHandle) Chown(uid uint32, gid uint32) fuse.Status {
-	if c.fileData.Attr.Uid != uid {
-		c.fileData.Attr.Uid = uid
-		c.fileData.Dirty = true
-	}
-	if c.fileData.Attr.Gid != gid {
-		c.fileData.Attr.Gid = gid
-		c.fileData.Dirty = true
-	}
-	err := c.fileData.Fs.FlushFile(c.fileData)
-	if err != nil {
-		return fuse.EIO
-	}
-	return fuse.OK
+	return fuse.ENOSYS
 }
 
 func (c *CassFileHandle) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
-	end := int(off) + int(len(buf))
-	if end > len(c.fileData.Data) {
-		end = len(c.fileData.Data)
+	data, err := c.fileData.ReadAt(off, len(buf), c.cache)
+	if err != nil {
+		log.Println("Error reading file:", err)
+		return nil, fuse.EIO
 	}
-	return fuse.ReadResultData(c.fileData.Data[off:end]), fuse.OK
+	c.readahead.follow(c.fileData, off, len(data), c.cache)
+	return fuse.ReadResultData(data), fuse.OK
 }
 
 func (c *CassFileHandle) Write(data []byte, offset int64) (uint32, fuse.Status) {
-	if int(offset) > len(c.fileData.Data) {
-		c.fileData.Data = append(c.fileData.Data, bytes.Repeat([]byte{0}, int(offset)-len(c.fileData.Data))...)
-		c.fileData.Data = append(c.fileData.Data, data...)
-		return uint32(len(data)), fuse.OK
-	}
-	c.fileData.Dirty = true
-	c.fileData.Data = append(c.fileData.Data[0:offset], data...)
-	c.fileData.Attr.Size = uint64(len(c.fileData.Data))
+	if err := c.fileData.Fs.store.CheckSize(uint64(offset) + uint64(len(data))); err != nil {
+		return 0, errorStatus(err)
+	}
+	err := c.fileData.WriteAt(data, offset)
+	if err != nil {
+		log.Println("Error writing file:", err)
+		return 0, fuse.EIO
+	}
+	c.fileData.Fs.checkpoint(c.fileData, offset, int64(len(data)))
 	return uint32(len(data)), fuse.OK
 }
 
@@ -134,30 +142,91 @@ func (c *CassFileHandle) Flush() fuse.Status {
 	if !c.fileData.Dirty {
 		return fuse.OK
 	}
+	if c.fileData.Fs.deferSave(c.fileData) {
+		return fuse.OK
+	}
 	err := c.fileData.Fs.FlushFile(c.fileData)
 	if err != nil {
 		log.Println("Error updating file:", err)
-		return fuse.EIO
+		return errorStatus(err)
 	}
+	c.fileData.Dirty = false
+	c.fileData.Fs.forget(c.fileData)
 	return fuse.OK
 }
 
+//Modes of fallocate(2)
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x01
+	FALLOC_FL_PUNCH_HOLE = 0x02
+	FALLOC_FL_ZERO_RANGE = 0x10
+)
+
 func (c *CassFileHandle) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	if mode&^(FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE|FALLOC_FL_ZERO_RANGE) != 0 {
+		return fuse.Status(syscall.EOPNOTSUPP)
+	}
+	keepSize := mode&FALLOC_FL_KEEP_SIZE != 0
+	if !keepSize {
+		if err := c.fileData.Fs.store.CheckSize(off + size); err != nil {
+			return errorStatus(err)
+		}
+	}
+	var err error
+	switch {
+	case mode&FALLOC_FL_PUNCH_HOLE != 0:
+		//A hole can only be punched without changing the size
+		if !keepSize {
+			return fuse.EINVAL
+		}
+		err = c.fileData.PunchHole(off, size)
+	case mode&FALLOC_FL_ZERO_RANGE != 0:
+		err = c.fileData.PunchHole(off, size)
+		if err == nil {
+			err = c.fileData.Allocate(off, size, keepSize)
+		}
+	default:
+		err = c.fileData.Allocate(off, size, keepSize)
+	}
+	if err != nil {
+		log.Println("Error allocating file:", err)
+		return fuse.EIO
+	}
+	c.fileData.Fs.checkpoint(c.fileData, int64(off), int64(size))
 	return fuse.OK
 }
 
 func (c *CassFileHandle) Release() {
 	c.fileData.Lock()
 	c.fileData.Refs--
+	refs := c.fileData.Refs
 	c.fileData.Unlock()
-	if c.fileData.Refs == 0 {
-		c.fileData.Fs.Release(*c.fileData.Name)
+	if refs == 0 {
+		c.fileData.Fs.Release(c.fileData)
 	}
 	c.closed = true
 	return
 }
 
+//Fsync writes the changes of the file that are held back or not flushed yet, so they are
+//in the store when it returns
 func (c *CassFileHandle) Fsync(flags int) fuse.Status {
+	fs := c.fileData.Fs
+	if fd := fs.takePending(*c.fileData.Name); fd != nil {
+		if err := fs.saveNow(fd); err != nil {
+			return errorStatus(err)
+		}
+	}
+	if !c.fileData.Dirty {
+		return fuse.OK
+	}
+	err := fs.FlushFile(c.fileData)
+	if err != nil {
+		log.Println("Error updating file:", err)
+		return errorStatus(err)
+	}
+	c.fileData.Dirty = false
+	fs.forget(c.fileData)
 	return fuse.OK
 }
 
@@ -190,24 +259,46 @@ func (c *CassFileHandle) SetInode(i *nodefs.Inode) {
 }
 
 func (c *CassFileHandle) Truncate(size uint64) fuse.Status {
-	c.fileData.Data = c.fileData.Data[:size]
-	return fuse.OK
+	return fuse.ENOSYS
 }
 
-func (c *CassFileHandle) Flock(flags int) fuse.Status {
-	return fuse.ENOSYS
+//lockHolder returns the holder of the locks of a lock owner, flock locks belong to the
+//open file and POSIX locks to the process
+func (c *CassFileHandle) lockHolder(owner uint64, flags uint32) string {
+	if flags&fuse.FUSE_LK_FLOCK != 0 {
+		return c.fileData.Fs.store.LockHolder(fmt.Sprintf("flock-%x", owner))
+	}
+	return c.fileData.Fs.store.LockHolder(fmt.Sprintf("posix-%x", owner))
 }
 
-func (c *CassFileHandle) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
-	c.fileData.Attr.Atime = uint64(atime.Unix())
-	c.fileData.Attr.Atimensec = uint32(atime.Nanosecond())
-	c.fileData.Attr.Mtime = uint64(mtime.Unix())
-	c.fileData.Attr.Mtimensec = uint32(mtime.Nanosecond())
-	err := c.fileData.Fs.FlushFile(c.fileData)
-	if err != nil {
-		log.Println("Error updating file:", err)
-		return fuse.EIO
+func (c *CassFileHandle) GetLk(owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) fuse.Status {
+	return c.fileData.Fs.getLock(*c.fileData.Name, c.lockHolder(owner, flags), lk, out)
+}
+
+func (c *CassFileHandle) SetLk(owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	return c.fileData.Fs.setLock(*c.fileData.Name, c.lockHolder(owner, flags), lk, false)
+}
+
+func (c *CassFileHandle) SetLkw(owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	return c.fileData.Fs.setLock(*c.fileData.Name, c.lockHolder(owner, flags), lk, true)
+}
+
+func (c *CassFileHandle) Flock(flags int) fuse.Status {
+	lk := &fuse.FileLock{Start: 0, End: ^uint64(0)}
+	switch flags &^ syscall.LOCK_NB {
+	case syscall.LOCK_SH:
+		lk.Typ = syscall.F_RDLCK
+	case syscall.LOCK_EX:
+		lk.Typ = syscall.F_WRLCK
+	case syscall.LOCK_UN:
+		lk.Typ = syscall.F_UNLCK
+	default:
+		return fuse.EINVAL
 	}
-	return fuse.OK
+	holder := c.fileData.Fs.store.LockHolder(fmt.Sprintf("flock-%p", c))
+	return c.fileData.Fs.setLock(*c.fileData.Name, holder, lk, flags&syscall.LOCK_NB == 0)
+}
 
+func (c *CassFileHandle) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	return fuse.ENOSYS
 }
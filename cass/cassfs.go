@@ -22,9 +22,14 @@
 package cass
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -38,16 +43,56 @@ type CassFsOptions struct {
 	Owner    fuse.Owner
 	Mode     uint32
 	ReadOnly bool
-	mount    bool
+	Journal  *Journal
+	//Transactional holds back the save of a flushed file for SaveWindow so a rename that
+	//follows is applied together with the new content
+	Transactional bool
+	SaveWindow    time.Duration
+	//FlushInterval holds back the save of flushed files for the flusher that runs this
+	//often, 0 saves them when they are flushed.  MaxDirtyBytes of held back changes make
+	//the flusher run early, see writeback.go
+	FlushInterval time.Duration
+	MaxDirtyBytes int64
+	//Readahead is the number of chunks read in the background ahead of a sequential read
+	Readahead int
+	//CheckPermissions enforces the Owner and Mode of entries against the caller
+	CheckPermissions bool
+	//Manifest is a verified signed manifest everything that is served has to match
+	Manifest *EnvManifest
+	//Scanner checks new content saved below ScanPaths (everywhere if empty) before it is
+	//published
+	Scanner   Scanner
+	ScanPaths []string
+	//SLO tracks the latencies of the mount, its state is served on the control socket
+	SLO *SLOTracker
+	//Subpath is the directory of the environment that is the root of the mount, the file
+	//system has to be wrapped with pathfs.NewPrefixFileSystem for it
+	Subpath string
+	//VirtualDirs are served without going to the store, see virtual.go
+	VirtualDirs []string
+	mount       bool
 }
 
 type CassFs struct {
 	pathfs.FileSystem
 	Mount     *string
 	cacheLock sync.RWMutex
+	//fileCache holds the files that are open on the mount, an entry is dropped when the
+	//last handle is released so it cannot be bounded without losing writes
 	fileCache map[string]*CassFileData
 	store     *Cass
 	options   *CassFsOptions
+	nodeFs    *pathfs.PathNodeFs
+	//Files flushed in transactional mode that are waiting for a rename
+	pendingLock sync.Mutex
+	pending     map[string]*pendingSave
+	//Files this mount holds locks on and the holders of the locks
+	lockLock sync.Mutex
+	held     map[string]map[string]bool
+	virtual  map[string]bool
+	flushNow chan struct{}
+	//degraded is set by Degrade, it is read without a lock by every operation
+	degraded int32
 }
 
 func NewCassFs(s *Cass, opts *CassFsOptions) *CassFs {
@@ -55,13 +100,114 @@ func NewCassFs(s *Cass, opts *CassFsOptions) *CassFs {
 		store:     s,
 		options:   opts,
 		fileCache: make(map[string]*CassFileData),
+		pending:   make(map[string]*pendingSave),
+		held:      make(map[string]map[string]bool),
+		virtual:   virtualDirs(opts.VirtualDirs),
+		flushNow:  make(chan struct{}, 1),
 	}
 }
 
 func (c *CassFs) OnMount(nodefs *pathfs.PathNodeFs) {
+	c.nodeFs = nodefs
+	c.recoverJournal()
+	go c.renewLocks()
+	if c.options.FlushInterval > 0 {
+		go c.writeBack()
+	}
+}
+
+//recoverJournal writes back any dirty files that were left in the journal by a previous mount
+func (c *CassFs) recoverJournal() {
+	if c.options.Journal == nil {
+		return
+	}
+	entries, err := c.options.Journal.Entries()
+	if err != nil {
+		log.Println("Unable to read the journal:", err)
+		return
+	}
+	for _, entry := range entries {
+		if c.options.ReadOnly {
+			log.Println("Not recovering", entry.Name, "on a read only mount")
+			continue
+		}
+		name := entry.Name
+		fd := NewFileData(&name, c, entry.Hash, entry.Chunks, entry.Attr)
+		fd.XAttr = entry.XAttr
+		fd.XAttrBinary = entry.XAttrBinary
+		fd.Inode = entry.Inode
+		fd.BlockSize = entry.BlockSize
+		fd.Inline = entry.Inline
+		fd.held = entry.Held
+		fd.trimmed = entry.Trimmed
+		fd.dirty = entry.Dirty
+		err = c.scanFile(fd, name)
+		if err == ErrQuarantined {
+			c.options.Journal.Remove(name)
+			continue
+		}
+		if err == nil {
+			err = c.store.UpdateFile(fd)
+		}
+		if err != nil {
+			log.Println("Unable to recover", name, ":", err)
+			continue
+		}
+		log.Println("Recovered", name, "from the journal")
+		c.options.Journal.Remove(name)
+	}
+}
+
+//checkpoint saves the state of a dirty file whose size bytes at off changed to the
+//journal if one is configured
+func (c *CassFs) checkpoint(fd *CassFileData, off int64, size int64) {
+	if c.options.Journal == nil || fd.Orphaned {
+		return
+	}
+	fd.Lock()
+	err := c.options.Journal.Save(fd, off, size)
+	fd.Unlock()
+	if err != nil {
+		log.Println("Unable to checkpoint", *fd.Name, ":", err)
+	}
+}
+
+//forget removes the journal entry for a file that no longer needs recovery
+func (c *CassFs) forget(fd *CassFileData) {
+	if c.options.Journal == nil {
+		return
+	}
+	err := c.options.Journal.Remove(*fd.Name)
+	if err != nil {
+		log.Println("Unable to remove journal entry for", *fd.Name, ":", err)
+	}
+}
+
+//Degrade switches the mount to read only.  New changes, opening files for writing and
+//creating or removing entries are refused, files that are open already keep being written
+//and are flushed as usual so nothing that was accepted is lost.
+func (c *CassFs) Degrade() {
+	c.flushPending()
+	atomic.StoreInt32(&c.degraded, 1)
+	log.Println("The mount is read only now")
+}
+
+//readOnly checks if changes are refused, because the mount is read only or degraded
+func (c *CassFs) readOnly() bool {
+	return c.options.ReadOnly || atomic.LoadInt32(&c.degraded) != 0
 }
 
 func (c *CassFs) OnUnmount() {
+	c.flushPending()
+	c.lockLock.Lock()
+	var names []string
+	for name := range c.held {
+		names = append(names, name)
+	}
+	c.lockLock.Unlock()
+	for _, name := range names {
+		c.releaseLocks(name)
+	}
 }
 
 func (c *CassFs) StatFs(name string) *fuse.StatfsOut {
@@ -76,26 +222,77 @@ func (c *CassFs) StatFs(name string) *fuse.StatfsOut {
 }
 
 func (c *CassFs) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
-	//For now we are just going to allow all access
-	return fuse.OK
+	if mode&ACCESS_WRITE != 0 && c.readOnly() {
+		return fuse.EROFS
+	}
+	return c.permitted(name, mode, context)
 }
 
 func (c *CassFs) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
-	if c.options.ReadOnly {
+	if c.readOnly() {
 		return fuse.EROFS
 	}
 	_, status := c.GetAttr(oldName, context)
 	if status != fuse.OK {
 		return status
 	}
+	if status := c.removePermitted(oldName, context); status != fuse.OK {
+		return status
+	}
+	if status := c.removePermitted(newName, context); status != fuse.OK {
+		return status
+	}
+	if done, err := c.renamePending(oldName, newName); done {
+		return errorStatus(err)
+	}
 	err := c.store.Rename(oldName, newName)
 	if err != nil {
-		return fuse.EIO
+		return errorStatus(err)
 	}
+	c.store.Audit(AUDIT_RENAME, context.Uid, oldName, newName)
 	return fuse.OK
 }
 
+//errorStatus converts an error from the store into the status returned to fuse
+func errorStatus(err error) fuse.Status {
+	switch err {
+	case nil:
+		return fuse.OK
+	case gocql.ErrNotFound:
+		return fuse.ENOENT
+	case ErrDenied:
+		return fuse.EPERM
+	case ErrTooLarge:
+		return fuse.Status(syscall.EFBIG)
+	case ErrNotEmpty:
+		return fuse.Status(syscall.ENOTEMPTY)
+	case ErrLoop:
+		return fuse.Status(syscall.ELOOP)
+	case ErrNotDir:
+		return fuse.Status(syscall.ENOTDIR)
+	case ErrIsDir:
+		return fuse.Status(syscall.EISDIR)
+	case ErrNoAttr:
+		return fuse.ENODATA
+	case ErrAttrExists, ErrExists:
+		return fuse.Status(syscall.EEXIST)
+	case ErrLinkDir:
+		return fuse.EPERM
+	case ErrLocked, ErrInodeBusy:
+		return fuse.Status(syscall.EAGAIN)
+	case ErrQuarantined:
+		return fuse.EACCES
+	}
+	return fuse.EIO
+}
+
 func (c *CassFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if status := c.permitted(name, ACCESS_READ, context); status != fuse.OK {
+		return nil, status
+	}
+	if name != "" && c.isVirtual(name) {
+		return sortEntries(c.virtualEntries(name, nil)), fuse.OK
+	}
 	res, err := c.store.OpenDir(name)
 	if err != nil {
 		if err == gocql.ErrNotFound {
@@ -104,18 +301,48 @@ func (c *CassFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, f
 		log.Println("There was some kind of other error")
 		return nil, fuse.EIO
 	}
-	return res, fuse.OK
+	//The listing is shared with the directory cache, so it is changed in a copy
+	res = append([]fuse.DirEntry(nil), res...)
+	if c.options.Manifest != nil {
+		//Entries that were added after the manifest was signed are not served
+		signed := res[:0]
+		for _, e := range res {
+			full := e.Name
+			if name != "" {
+				full = name + "/" + e.Name
+			}
+			if _, ok := c.options.Manifest.Entries[full]; ok {
+				signed = append(signed, e)
+			} else {
+				log.Println("Entry not in the signed manifest:", full)
+			}
+		}
+		res = signed
+	}
+	return sortEntries(c.virtualEntries(name, res)), fuse.OK
+}
+
+//verified checks an entry against the signed manifest when the mount verifies content
+func (c *CassFs) verified(name string, meta *CassFsMetadata) fuse.Status {
+	if c.options.Manifest == nil {
+		return fuse.OK
+	}
+	if err := c.options.Manifest.Check(name, meta.Hash, &meta.Metadata); err != nil {
+		log.Println("Refusing to serve", name, ":", err)
+		return fuse.EIO
+	}
+	return fuse.OK
 }
 
 func (c *CassFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
-	if name == "" {
-		return &fuse.Attr{
-			Mode: fuse.S_IFDIR | c.options.Mode,
-			Owner: fuse.Owner{
-				Uid: c.options.Owner.Uid,
-				Gid: c.options.Owner.Gid,
-			},
-		}, fuse.OK
+	if c.isVirtual(name) {
+		return c.virtualAttr(), fuse.OK
+	}
+	if fd := c.pendingFile(name); fd != nil {
+		fd.Lock()
+		attr := *fd.Attr
+		fd.Unlock()
+		return &attr, fuse.OK
 	}
 	meta, err := c.store.GetFiledata(name)
 	if err != nil {
@@ -125,25 +352,55 @@ func (c *CassFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.S
 		log.Println("I/O Error:", err)
 		return nil, fuse.EIO
 	}
+	if status := c.verified(name, meta); status != fuse.OK {
+		return nil, status
+	}
 	return meta.Metadata.Attr, fuse.OK
 }
 
 // This is the start of the FS Interface implementation
 func (c *CassFs) Link(orig string, newName string, context *fuse.Context) fuse.Status {
-	if c.options.ReadOnly {
+	if c.readOnly() {
 		return fuse.EROFS
 	}
-	err := c.store.CopyFile(orig, newName)
+	if status := c.parentPermitted(newName, context); status != fuse.OK {
+		return status
+	}
+	//Changes that only live in an open handle are saved first so both names see them
+	c.cacheLock.RLock()
+	fd, open := c.fileCache[orig]
+	c.cacheLock.RUnlock()
+	if pending := c.takePending(orig); pending != nil {
+		c.saveNow(pending)
+	} else if open && fd.Dirty {
+		err := c.FlushFile(fd)
+		if err != nil {
+			log.Println("Error updating file:", err)
+			return errorStatus(err)
+		}
+		fd.Dirty = false
+		c.forget(fd)
+	}
+	id, err := c.store.Link(orig, newName)
 	if err != nil {
-		return -1
+		return errorStatus(err)
 	}
-	return 0
+	if open {
+		//Later writes through the open handle go to the shared inode
+		fd.Lock()
+		fd.Inode = id
+		fd.Unlock()
+	}
+	return fuse.OK
 }
 
 func (c *CassFs) Rmdir(path string, context *fuse.Context) fuse.Status {
-	if c.options.ReadOnly {
+	if c.readOnly() {
 		return fuse.EROFS
 	}
+	if status := c.removePermitted(path, context); status != fuse.OK {
+		return status
+	}
 	data, err := c.store.GetFiledata(path)
 	if err != nil {
 		log.Println("Unable to get information for %s: %s", path, err)
@@ -153,29 +410,32 @@ func (c *CassFs) Rmdir(path string, context *fuse.Context) fuse.Status {
 		return fuse.Status(syscall.ENOTDIR)
 	}
 
-	dirlist, err := c.store.OpenDir(path)
-	if len(dirlist) > 0 {
-		return fuse.Status(syscall.ENOTEMPTY)
-	}
-	err = c.store.DeleteFile(path)
+	err = c.store.RemoveDirectory(path, false)
 	if err != nil {
+		if err == ErrNotEmpty {
+			return fuse.Status(syscall.ENOTEMPTY)
+		}
 		if err == gocql.ErrNotFound {
 			return fuse.ENOENT
 		}
 		return fuse.EIO
 	}
+	c.store.Audit(AUDIT_RMDIR, context.Uid, path, "")
 	return 0
 }
 
 func (c *CassFs) Mkdir(path string, mode uint32, context *fuse.Context) fuse.Status {
-	if c.options.ReadOnly {
+	if c.readOnly() {
 		return fuse.EROFS
 	}
+	if status := c.parentPermitted(path, context); status != fuse.OK {
+		return status
+	}
 	_, err := c.store.GetFiledata(path)
 	if err == nil {
 		return fuse.Status(syscall.EEXIST)
 	}
-	err = c.store.MakeDirectory(path, &fuse.Attr{Mode: fuse.S_IFDIR | mode})
+	err = c.store.MakeDirectory(path, newAttr(fuse.S_IFDIR|(mode&^callerUmask(context)), context))
 	if err != nil {
 		log.Println("There was an error making directory (%s): %s", path, err)
 		return fuse.EIO
@@ -184,43 +444,91 @@ func (c *CassFs) Mkdir(path string, mode uint32, context *fuse.Context) fuse.Sta
 }
 
 func (c *CassFs) Symlink(pointedTo string, linkName string, context *fuse.Context) fuse.Status {
-	if c.options.ReadOnly {
+	if c.readOnly() {
 		return fuse.EROFS
 	}
-	ctime := time.Now()
-	attr := fuse.Attr{
-		Mode:      fuse.S_IFLNK | 0777,
-		Ctime:     uint64(ctime.Unix()),
-		Ctimensec: uint32(ctime.Nanosecond()),
+	if status := c.parentPermitted(linkName, context); status != fuse.OK {
+		return status
 	}
-	err := c.store.CreateFile(linkName, &attr, []byte(pointedTo))
+	//The umask does not apply to symbolic links
+	err := c.store.CreateSymlink(linkName, newAttr(fuse.S_IFLNK|0777, context), pointedTo)
 	if err != nil {
 		log.Println("Error creating symlink (%s): %s", linkName, err)
-		return fuse.EIO
+		return errorStatus(err)
 	}
 	return fuse.OK
 }
 
 func (c *CassFs) Truncate(path string, size uint64, context *fuse.Context) fuse.Status {
-	if c.options.ReadOnly {
+	if c.readOnly() {
 		return fuse.EROFS
 	}
-	return fuse.EINVAL
+	if status := c.permitted(path, ACCESS_WRITE, context); status != fuse.OK {
+		return status
+	}
+	c.cacheLock.RLock()
+	fd, open := c.fileCache[path]
+	c.cacheLock.RUnlock()
+	if !open {
+		var err error
+		fd, err = c.loadFile(path)
+		if err != nil {
+			return errorStatus(err)
+		}
+	}
+	if fd.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		return fuse.Status(syscall.EISDIR)
+	}
+	if err := c.store.CheckSize(size); err != nil {
+		return errorStatus(err)
+	}
+	err := fd.Truncate(size)
+	if err != nil {
+		log.Println("Error truncating file:", err)
+		return fuse.EIO
+	}
+	now := time.Now()
+	fd.Lock()
+	fd.Attr.SetTimes(nil, &now, &now)
+	fd.Unlock()
+	//A save waiting for a rename is replaced by this one
+	c.takePending(path)
+	err = c.FlushFile(fd)
+	if err != nil {
+		log.Println("Error updating file:", err)
+		return errorStatus(err)
+	}
+	fd.Dirty = false
+	c.forget(fd)
+	if open {
+		c.dropReleased(fd)
+	}
+	return fuse.OK
 }
 
 func (c *CassFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
-	if c.options.ReadOnly {
+	if c.readOnly() {
 		return fuse.EROFS
 	}
+	if status := c.timesPermitted(name, atime, mtime, context); status != fuse.OK {
+		return status
+	}
+	open, err := c.changeOpen(name, func(attr *fuse.Attr) {
+		attr.SetTimes(atime, mtime, nil)
+	})
+	if open {
+		if err != nil {
+			log.Println("Error updating file:", err)
+			return errorStatus(err)
+		}
+		return fuse.OK
+	}
 	meta, err := c.store.GetFiledata(name)
 	if err != nil {
 		log.Println("Error getting (%s) metadata: %s", name, err)
 		return fuse.EIO
 	}
-	meta.Metadata.Attr.Atime = uint64(atime.Unix())
-	meta.Metadata.Attr.Atimensec = uint32(atime.Nanosecond())
-	meta.Metadata.Attr.Mtime = uint64(mtime.Unix())
-	meta.Metadata.Attr.Mtimensec = uint32(mtime.Nanosecond())
+	meta.Metadata.Attr.SetTimes(atime, mtime, nil)
 	err = c.store.WriteMetadata(name, meta.Metadata)
 	if err != nil {
 		log.Println("Error updating file:", err)
@@ -229,10 +537,28 @@ func (c *CassFs) Utimens(name string, atime *time.Time, mtime *time.Time, contex
 	return fuse.OK
 }
 
+//changeOpen applies change to the attributes of name and saves it when name is open, so
+//the open file does not write its old attributes back later.  It reports whether name was open.
+func (c *CassFs) changeOpen(name string, change func(attr *fuse.Attr)) (bool, error) {
+	c.cacheLock.RLock()
+	fd, open := c.fileCache[name]
+	c.cacheLock.RUnlock()
+	if !open {
+		return false, nil
+	}
+	fd.Lock()
+	change(fd.Attr)
+	fd.Unlock()
+	return true, c.FlushFile(fd)
+}
+
 func (c *CassFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
-	if c.options.ReadOnly {
+	if c.readOnly() {
 		return fuse.EROFS
 	}
+	if status := c.chownPermitted(name, uid, gid, context); status != fuse.OK {
+		return status
+	}
 	log.Println("Changing ownership of \"" + name + "\"")
 	if name == "" {
 		log.Println("Changing ownership of root mountpoint")
@@ -240,29 +566,40 @@ func (c *CassFs) Chown(name string, uid uint32, gid uint32, context *fuse.Contex
 		c.options.Owner.Gid = gid
 		return fuse.OK
 	}
-	meta, err := c.store.GetFiledata(name)
-	if err != nil {
-		log.Println("Error getting (%s) metadata: %s", name, err)
-		return fuse.EIO
-	}
-	if int32(uid) > 0 {
-		meta.Metadata.Attr.Owner.Uid = uid
+	chown := func(attr *fuse.Attr) {
+		if int32(uid) > 0 {
+			attr.Owner.Uid = uid
+		}
+		if int32(gid) > 0 {
+			attr.Owner.Gid = gid
+		}
 	}
-	if int32(gid) > 0 {
-		meta.Metadata.Attr.Owner.Gid = gid
+	open, err := c.changeOpen(name, chown)
+	if !open {
+		var meta *CassFsMetadata
+		meta, err = c.store.GetFiledata(name)
+		if err != nil {
+			log.Println("Error getting (%s) metadata: %s", name, err)
+			return fuse.EIO
+		}
+		chown(meta.Metadata.Attr)
+		err = c.store.WriteMetadata(name, meta.Metadata)
 	}
-	err = c.store.WriteMetadata(name, meta.Metadata)
 	if err != nil {
 		log.Println("Error writing (%s) metadata: %s", name, err)
 		return fuse.EIO
 	}
+	c.store.Audit(AUDIT_CHOWN, context.Uid, name, fmt.Sprintf("%d:%d", int32(uid), int32(gid)))
 	return fuse.OK
 }
 
 func (c *CassFs) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
-	if c.options.ReadOnly {
+	if c.readOnly() {
 		return fuse.EROFS
 	}
+	if status := c.ownerPermitted(name, context); status != fuse.OK {
+		return status
+	}
 	permMask := uint32(07777)
 
 	if name == "" {
@@ -270,25 +607,76 @@ func (c *CassFs) Chmod(name string, mode uint32, context *fuse.Context) fuse.Sta
 		return fuse.OK
 	}
 
-	meta, err := c.store.GetFiledata(name)
-	if err != nil {
-		log.Println("Could not get metadata for file:", name)
-		return fuse.EIO
+	chmod := func(attr *fuse.Attr) {
+		attr.Mode = (attr.Mode &^ permMask) | mode
+	}
+	open, err := c.changeOpen(name, chmod)
+	if !open {
+		var meta *CassFsMetadata
+		meta, err = c.store.GetFiledata(name)
+		if err != nil {
+			log.Println("Could not get metadata for file:", name)
+			return fuse.EIO
+		}
+		chmod(meta.Metadata.Attr)
+		//There needs to be a set filedata function in the store, which there is not
+		err = c.store.WriteMetadata(name, meta.Metadata)
 	}
-	meta.Metadata.Attr.Mode = (meta.Metadata.Attr.Mode &^ permMask) | mode
-	//There needs to be a set filedata function in the store, which there is not
-	err = c.store.WriteMetadata(name, meta.Metadata)
 	if err != nil {
 		log.Println("Error writing (%s) metadata: %s", name, err)
 		return fuse.EIO
 	}
+	c.store.Audit(AUDIT_CHMOD, context.Uid, name, fmt.Sprintf("%04o", mode&permMask))
 	return fuse.OK
 }
 
 func (c *CassFs) Unlink(name string, context *fuse.Context) fuse.Status {
-	if c.options.ReadOnly {
+	status := c.unlink(name, context)
+	if status == fuse.OK {
+		c.store.Audit(AUDIT_DELETE, context.Uid, name, "")
+	}
+	return status
+}
+
+func (c *CassFs) unlink(name string, context *fuse.Context) fuse.Status {
+	if c.readOnly() {
 		return fuse.EROFS
 	}
+	if status := c.removePermitted(name, context); status != fuse.OK {
+		return status
+	}
+	//A save that is still pending is dropped along with the file
+	if fd := c.takePending(name); fd != nil {
+		c.forget(fd)
+		c.dropReleased(fd)
+	}
+	//If the file is still open the data has to stay around until the last handle is released
+	c.cacheLock.Lock()
+	fd, open := c.fileCache[name]
+	if open {
+		delete(c.fileCache, name)
+	}
+	c.cacheLock.Unlock()
+	if open {
+		id, err := c.store.OrphanFile(name)
+		if err != nil {
+			log.Println("Unable to unlink open file:", err)
+			c.cacheLock.Lock()
+			c.fileCache[name] = fd
+			c.cacheLock.Unlock()
+			return fuse.EIO
+		}
+		if id == "" {
+			//Other links still hold the content, the open handle keeps writing to it
+			return fuse.OK
+		}
+		fd.Lock()
+		fd.Orphaned = true
+		fd.orphanId = id
+		fd.Unlock()
+		c.forget(fd)
+		return fuse.OK
+	}
 	err := c.store.DeleteFile(name)
 	if err != nil {
 		return fuse.EIO
@@ -302,17 +690,35 @@ func (c *CassFs) Readlink(name string, context *fuse.Context) (string, fuse.Stat
 		log.Println("could not get metadata for:", name)
 		return "", fuse.EIO
 	}
-	return string(meta.Hash), fuse.OK
+	if status := c.verified(name, meta); status != fuse.OK {
+		return "", status
+	}
+	return meta.Metadata.SymlinkTarget(meta.Hash), fuse.OK
 }
 
 func (c *CassFs) FlushFile(fd *CassFileData) error {
 	if c.options.ReadOnly {
 		return errors.New("Read-Only filesystem")
 	}
+	if fd.Orphaned {
+		//The file was unlinked, changes only live in memory until it is released
+		return nil
+	}
+	fd.Lock()
+	defer fd.Unlock()
+	if err := c.scanFile(fd, *fd.Name); err != nil {
+		return err
+	}
 	return c.store.UpdateFile(fd)
 }
 
 func (c *CassFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if openAccess(flags)&ACCESS_WRITE != 0 && c.readOnly() {
+		return nil, fuse.EROFS
+	}
+	if status := c.permitted(name, openAccess(flags), context); status != fuse.OK {
+		return nil, status
+	}
 	c.cacheLock.RLock()
 	if entry, ok := c.fileCache[name]; ok {
 		fh := NewFileHandle(entry)
@@ -320,18 +726,13 @@ func (c *CassFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.
 		return fh, fuse.OK
 	}
 	c.cacheLock.RUnlock()
-	mdata, err := c.store.GetFiledata(name)
+	fd, err := c.loadFile(name)
 	if err != nil {
 		if err == gocql.ErrNotFound {
 			return nil, fuse.ENOENT
 		}
 		return nil, fuse.EIO
 	}
-	data, err := c.store.Read(mdata.Hash)
-	if err != nil {
-		return nil, fuse.EIO
-	}
-	fd := NewFileData(&name, c, mdata.Hash, data, mdata.Metadata.Attr)
 	c.cacheLock.Lock()
 	c.fileCache[name] = fd
 	c.cacheLock.Unlock()
@@ -339,31 +740,96 @@ func (c *CassFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.
 	return fh, fuse.OK
 }
 
-func (c *CassFs) Release(name string) {
+//loadFile creates the file data for name from the store
+func (c *CassFs) loadFile(name string) (*CassFileData, error) {
+	mdata, err := c.store.GetFiledata(name)
+	if err != nil {
+		return nil, err
+	}
+	if c.verified(name, mdata) != fuse.OK {
+		return nil, ErrTampered
+	}
+	return c.fileData(name, mdata)
+}
+
+//fileData creates the file data of name for a stored entry
+func (c *CassFs) fileData(name string, mdata *CassFsMetadata) (*CassFileData, error) {
+	//Files stored as chunks are read a chunk at a time as they are used
+	attr := *mdata.Metadata.Attr
+	fd := NewFileData(&name, c, mdata.Hash, mdata.Metadata.Chunks, &attr)
+	fd.XAttr = mdata.Metadata.XAttr
+	fd.XAttrBinary = mdata.Metadata.XAttrBinary
+	fd.Inode = mdata.Metadata.Inode
+	fd.Inline = mdata.Metadata.Inline
+	//The chunks are read with the block size they were written with, a file without any
+	//takes the block size of new files
+	fd.BlockSize = mdata.Metadata.ChunkSize()
+	if len(mdata.Metadata.Chunks) == 0 {
+		fd.BlockSize = c.store.NewBlockSize()
+	}
+	//A flush that does not change anything is not written, see UpdateFile
+	if fd.Inode == "" && len(mdata.Metadata.Chunks) > 0 {
+		fd.saved, _ = json.Marshal(fd.metadata(fd.Chunks, fd.Inline))
+	}
+	if len(mdata.Metadata.Chunks) == 0 && len(mdata.Hash) > 0 && attr.Mode&syscall.S_IFMT == syscall.S_IFREG {
+		//Older files are stored as a single blob and have to be read whole
+		data, err := c.store.ReadFile(mdata)
+		if err != nil {
+			return nil, err
+		}
+		fd.setData(data)
+	}
+	return fd, nil
+}
+
+//Release is called when the last handle on fd is closed
+func (c *CassFs) Release(fd *CassFileData) {
+	//Locks do not outlive the last handle of the file on this mount
+	c.releaseLocks(*fd.Name)
+	if c.pendingFile(*fd.Name) == fd {
+		//The pending save drops the file from the cache once it is written
+		return
+	}
 	c.cacheLock.Lock()
-	defer c.cacheLock.Unlock()
-	if _, ok := c.fileCache[name]; ok {
-		delete(c.fileCache, name)
+	if entry, ok := c.fileCache[*fd.Name]; ok && entry == fd {
+		delete(c.fileCache, *fd.Name)
+	}
+	c.cacheLock.Unlock()
+	if !fd.Dirty {
+		c.forget(fd)
+	}
+	if fd.Orphaned {
+		err := c.store.ReleaseOrphan(fd.orphanId)
+		if err != nil {
+			log.Println("Unable to release orphaned file data:", err)
+		}
 	}
 }
 
 //This needs to be fixed
 func (c *CassFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
-	if c.options.ReadOnly {
+	if c.readOnly() {
 		return nil, fuse.EROFS
 	}
+	if status := c.parentPermitted(name, context); status != fuse.OK {
+		return nil, status
+	}
 	_, err := c.store.GetFiledata(name)
 	if err != nil {
 		if err == gocql.ErrNotFound {
-			attr := fuse.Attr{
-				Mode: fuse.S_IFREG | mode,
-			}
-			err = c.store.CreateFile(name, &attr, []byte{})
+			attr := newAttr(fuse.S_IFREG|(mode&^callerUmask(context)), context)
+			err = c.store.CreateFile(name, attr, nil)
 			if err != nil {
 				log.Println("Error creating file:", err)
-				return nil, fuse.EIO
+				return nil, errorStatus(err)
+			}
+			fd := NewFileData(&name, c, nil, nil, attr)
+			fd.BlockSize = c.store.NewBlockSize()
+			//Pick up the attributes the environment defaults added
+			if meta, err := c.store.GetFiledata(name); err == nil {
+				fd.XAttr = meta.Metadata.XAttr
+				fd.XAttrBinary = meta.Metadata.XAttrBinary
 			}
-			fd := NewFileData(&name, c, []byte{}, []byte{}, &attr)
 			c.cacheLock.Lock()
 			c.fileCache[name] = fd
 			c.cacheLock.Unlock()
@@ -377,18 +843,141 @@ func (c *CassFs) Create(name string, flags uint32, mode uint32, context *fuse.Co
 	return nil, fuse.Status(syscall.EEXIST)
 }
 
+//newAttr returns the attributes for a new entry owned by the caller with the times set
+//to now
+func newAttr(mode uint32, context *fuse.Context) *fuse.Attr {
+	now := time.Now()
+	attr := &fuse.Attr{
+		Mode: mode,
+	}
+	attr.SetTimes(&now, &now, &now)
+	if context != nil {
+		attr.Owner = context.Owner
+	}
+	return attr
+}
+
+//callerUmask reads the umask of the calling process.  The kernel has usually applied it
+//already, it is applied again for kernels that pass the mode through unmasked
+func callerUmask(context *fuse.Context) uint32 {
+	mask, err := strconv.ParseUint(procStatus(context, "Umask"), 8, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(mask) & 0777
+}
+
+//XATTR_TTL is the attribute used to schedule the removal of a file, it takes a duration
+//(e.g. 3600 or 1h) and reads back the number of seconds left
+const XATTR_TTL = "user.cassfs.ttl"
+
 func (c *CassFs) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
-	return []byte{}, fuse.OK
+	if attribute == XATTR_TTL {
+		expires, err := c.store.GetExpiry(name)
+		if err == gocql.ErrNotFound {
+			return nil, fuse.ENODATA
+		} else if err != nil {
+			return nil, fuse.EIO
+		}
+		left := int64(expires.Sub(time.Now()) / time.Second)
+		if left < 0 {
+			left = 0
+		}
+		return []byte(strconv.FormatInt(left, 10)), fuse.OK
+	}
+	if name == "" {
+		//The root of the environment has no entry to keep attributes in
+		return nil, fuse.ENODATA
+	}
+	value, err := c.store.GetXAttr(name, attribute)
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	return value, fuse.OK
 }
 
 func (c *CassFs) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if c.readOnly() {
+		return fuse.EROFS
+	}
+	if status := c.ownerPermitted(name, context); status != fuse.OK {
+		return status
+	}
+	if attr == XATTR_TTL {
+		return errorStatus(c.store.ClearExpiry(name))
+	}
+	if name == "" {
+		return fuse.ENODATA
+	}
+	err := c.store.RemoveXAttr(name, attr)
+	if err != nil {
+		return errorStatus(err)
+	}
+	c.updateOpenXAttr(name, func(m *CassMetadata) { m.removeXAttr(attr) })
 	return fuse.OK
 }
 
 func (c *CassFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if c.readOnly() {
+		return fuse.EROFS
+	}
+	if status := c.ownerPermitted(name, context); status != fuse.OK {
+		return status
+	}
+	if attr == XATTR_TTL {
+		ttl, err := parseTTL(strings.TrimSpace(string(data)))
+		if err != nil || ttl <= 0 {
+			return fuse.EINVAL
+		}
+		return errorStatus(c.store.SetExpiry(name, ttl))
+	}
+	if name == "" {
+		return fuse.Status(syscall.ENOTSUP)
+	}
+	err := c.store.SetXAttr(name, attr, data, flags)
+	if err != nil {
+		return errorStatus(err)
+	}
+	c.updateOpenXAttr(name, func(m *CassMetadata) { m.setXAttr(attr, data, 0) })
 	return fuse.OK
 }
 
 func (c *CassFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	return []string{}, fuse.OK
+	var names []string
+	if name != "" {
+		var err error
+		names, err = c.store.ListXAttr(name)
+		if err != nil {
+			return nil, errorStatus(err)
+		}
+	}
+	if _, err := c.store.GetExpiry(name); err == nil {
+		names = append(names, XATTR_TTL)
+	}
+	return names, fuse.OK
+}
+
+//updateOpenXAttr applies a change of the extended attributes to the open copy of name,
+//so writing back the content of the file does not undo it
+func (c *CassFs) updateOpenXAttr(name string, change func(m *CassMetadata)) {
+	c.cacheLock.RLock()
+	fd, open := c.fileCache[name]
+	c.cacheLock.RUnlock()
+	if !open {
+		return
+	}
+	fd.Lock()
+	m := &CassMetadata{XAttr: fd.XAttr, XAttrBinary: fd.XAttrBinary}
+	change(m)
+	fd.XAttr = m.XAttr
+	fd.XAttrBinary = m.XAttrBinary
+	fd.Unlock()
+}
+
+//parseTTL accepts either a number of seconds or a duration
+func parseTTL(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(s)
 }
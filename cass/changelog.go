@@ -0,0 +1,143 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//With Policy.Changelog set every change made to the namespace through any client is
+//recorded in the changelog table for that long, so other systems can follow them with
+//ChangesSince.  Unlike the invalidation feed it names the operation and is kept for as
+//long as the policy says.  Failing to record a change does not fail the change itself.
+
+//Operations recorded in the changelog
+const (
+	CHANGE_CREATE = "create"
+	CHANGE_UPDATE = "update"
+	CHANGE_DELETE = "delete"
+	CHANGE_RENAME = "rename"
+)
+
+//LogEntry is a change recorded in the changelog, Source is the old path of a rename
+type LogEntry struct {
+	Id     gocql.UUID
+	Op     string
+	Path   string
+	Source string `json:",omitempty"`
+}
+
+//Time returns when the change was made
+func (e *LogEntry) Time() time.Time {
+	return e.Id.Time()
+}
+
+//logChange records an operation on paths in the changelog.  A rename is recorded with the
+//old path first and the new one second.
+func (c *Cass) logChange(op string, paths ...string) {
+	if c.Config == nil || c.Config.Policy.Changelog <= 0 || !c.AsOf.IsZero() || c.session == nil {
+		return
+	}
+	ttl := int(c.Config.Policy.Changelog / time.Second)
+	if op == CHANGE_RENAME {
+		if len(paths) != 2 {
+			return
+		}
+		c.insertChange(op, paths[1], paths[0], ttl)
+		return
+	}
+	for _, p := range paths {
+		c.insertChange(op, p, "", ttl)
+	}
+}
+
+func (c *Cass) insertChange(op string, path string, source string, ttl int) {
+	err := c.session.Query("INSERT INTO changelog (cust_id, environment, id, op, path, source, origin) VALUES(?, ?, ?, ?, ?, ?, ?) USING TTL ?", c.OwnerId, c.Environment, gocql.TimeUUID(), op, strings.Trim(path, "/"), strings.Trim(source, "/"), c.origin, ttl).Exec()
+	if err != nil {
+		log.Println("Unable to record the change to", path, "in the changelog:", err)
+	}
+}
+
+//ChangesSince returns the changes recorded after since, oldest first.  Unlike Changes the
+//changes made by this client are included.
+func (c *Cass) ChangesSince(since time.Time) ([]*LogEntry, error) {
+	var changes []*LogEntry
+	var id gocql.UUID
+	var op, path, source string
+	iter := c.session.Query("SELECT id, op, path, source FROM changelog WHERE cust_id = ? AND environment = ? AND id > minTimeuuid(?)", c.OwnerId, c.Environment, since).Iter()
+	for iter.Scan(&id, &op, &path, &source) {
+		changes = append(changes, &LogEntry{Id: id, Op: op, Path: path, Source: source})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+//Below checks if the change touches path or anything under it
+func (e *LogEntry) Below(path string) bool {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return true
+	}
+	for _, p := range []string{e.Path, e.Source} {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+//WatchChangelog calls fn for every change recorded after since, polling the changelog
+//every interval.  A change is passed once even when the polls overlap to cover clock
+//differences between clients.  It returns when fn or reading the changelog fails.
+func (c *Cass) WatchChangelog(since time.Time, interval time.Duration, fn func(*LogEntry) error) error {
+	seen := make(map[gocql.UUID]time.Time)
+	last := since
+	for {
+		start := time.Now()
+		changes, err := c.ChangesSince(last.Add(-FEED_OVERLAP))
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if _, ok := seen[change.Id]; ok || change.Time().Before(since) {
+				continue
+			}
+			seen[change.Id] = change.Time()
+			if err = fn(change); err != nil {
+				return err
+			}
+		}
+		//Only the changes that the next poll can return again need to be remembered
+		for id, t := range seen {
+			if t.Before(start.Add(-2 * FEED_OVERLAP)) {
+				delete(seen, id)
+			}
+		}
+		last = start
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"log"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//ATTR_PAGE_SIZE is the default number of entries read at a time by ChangeAttrs
+const ATTR_PAGE_SIZE = 1000
+
+//ATTR_BATCH_SIZE is the number of changed entries written in one batch, it keeps the
+//batches below the size Cassandra warns about
+const ATTR_BATCH_SIZE = 50
+
+//AttrOptions select the entries ChangeAttrs changes and how they are changed
+type AttrOptions struct {
+	Root      string
+	Recursive bool
+	//Patterns are matched against the name of an entry, or its path when they hold a /
+	Patterns []string
+	//Uid and Gid only select entries with that owner or group, -1 selects any
+	Uid int64
+	Gid int64
+	//Type only selects entries of a type (syscall.S_IFREG, S_IFDIR, ...), 0 selects any
+	Type uint32
+	//Mode returns the new mode of an entry, nil keeps the mode
+	Mode func(mode uint32) uint32
+	//NewUid and NewGid are the new owner and group, -1 keeps them
+	NewUid   int64
+	NewGid   int64
+	PageSize int
+	DryRun   bool
+	Progress *Progress
+}
+
+//AttrReport holds the results of ChangeAttrs
+type AttrReport struct {
+	Checked int
+	Matched int
+	Changed int
+	Errors  int
+}
+
+//attrChange is a changed entry waiting to be written
+type attrChange struct {
+	path string
+	name string
+	meta CassMetadata
+}
+
+//matches checks if the entry at p is selected by the filters
+func (o *AttrOptions) matches(p string, attr *fuse.Attr) bool {
+	if o.Uid >= 0 && int64(attr.Uid) != o.Uid {
+		return false
+	}
+	if o.Gid >= 0 && int64(attr.Gid) != o.Gid {
+		return false
+	}
+	if o.Type != 0 && attr.Mode&syscall.S_IFMT != o.Type {
+		return false
+	}
+	if len(o.Patterns) == 0 {
+		return true
+	}
+	for _, pattern := range o.Patterns {
+		target := path.Base(p)
+		if strings.Contains(pattern, "/") {
+			target = p
+		}
+		if ok, _ := path.Match(strings.Trim(pattern, "/"), target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//apply changes attr as requested and reports whether anything changed
+func (o *AttrOptions) apply(attr *fuse.Attr) bool {
+	changed := false
+	if o.Mode != nil {
+		mode := (attr.Mode &^ 07777) | (o.Mode(attr.Mode) & 07777)
+		if mode != attr.Mode {
+			attr.Mode = mode
+			changed = true
+		}
+	}
+	if o.NewUid >= 0 && int64(attr.Uid) != o.NewUid {
+		attr.Uid = uint32(o.NewUid)
+		changed = true
+	}
+	if o.NewGid >= 0 && int64(attr.Gid) != o.NewGid {
+		attr.Gid = uint32(o.NewGid)
+		changed = true
+	}
+	if changed {
+		now := time.Now()
+		attr.SetTimes(nil, nil, &now)
+	}
+	return changed
+}
+
+//ChangeAttrs changes the mode and owner of the entries selected by opts directly in the
+//store.  The entries of a directory are read a page at a time and written in batches,
+//so it is much faster than going through a mount.  Entries that already have the requested
+//attributes are not written, so an interrupted run is simply started again.
+func (c *Cass) ChangeAttrs(opts *AttrOptions) (*AttrReport, error) {
+	if opts.PageSize <= 0 {
+		opts.PageSize = ATTR_PAGE_SIZE
+	}
+	report := &AttrReport{}
+	root := strings.Trim(opts.Root, "/")
+	inodes := make(map[string]bool)
+	if root != "" {
+		entry, err := c.GetFiledata(root)
+		if err != nil {
+			return nil, err
+		}
+		meta := entry.Metadata
+		if meta.Attr == nil {
+			return nil, gocql.ErrNotFound
+		}
+		report.Checked++
+		opts.Progress.Add(1, 0)
+		attr := *meta.Attr
+		meta.Attr = &attr
+		if opts.matches(root, meta.Attr) {
+			report.Matched++
+			if meta.Inode != "" {
+				inodes[meta.Inode] = true
+			}
+			if opts.apply(meta.Attr) {
+				report.Changed++
+				if !opts.DryRun {
+					err = c.WriteMetadata(root, meta)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		if !opts.Recursive || meta.Attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return report, nil
+		}
+	}
+	dirId, err := c.FindDir(root)
+	if err != nil {
+		return nil, err
+	}
+	err = c.changeDirAttrs(root, dirId, opts, report, inodes)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (c *Cass) changeDirAttrs(p string, dirId string, opts *AttrOptions, report *AttrReport, inodes map[string]bool) error {
+	var name string
+	var hash, metajson []byte
+	type subdir struct {
+		path string
+		id   string
+	}
+	var dirs []subdir
+	var pending []attrChange
+	iter := c.session.Query("SELECT name, hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).PageSize(opts.PageSize).Iter()
+	for iter.Scan(&name, &hash, &metajson) {
+		meta := CassMetadata{}
+		err := json.Unmarshal(metajson, &meta)
+		linked := err == nil && meta.Inode != ""
+		if linked {
+			_, meta, err = c.readInode(meta.Inode)
+		}
+		if err != nil || meta.Attr == nil {
+			log.Println("Error decoding metadata for", name, ":", err)
+			report.Errors++
+			continue
+		}
+		full := name
+		if p != "" {
+			full = p + "/" + name
+		}
+		report.Checked++
+		opts.Progress.Add(1, 0)
+		if meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			uuid, err := gocql.UUIDFromBytes(hash)
+			if err != nil {
+				log.Println("Invalid directory id for", full, ":", err)
+				report.Errors++
+			} else {
+				dirs = append(dirs, subdir{path: full, id: uuid.String()})
+			}
+		}
+		//Every link of a file shares the attributes, they are only changed once
+		if !opts.matches(full, meta.Attr) || (linked && inodes[meta.Inode]) {
+			continue
+		}
+		report.Matched++
+		if linked {
+			inodes[meta.Inode] = true
+		}
+		if !opts.apply(meta.Attr) {
+			continue
+		}
+		report.Changed++
+		if opts.DryRun {
+			continue
+		}
+		pending = append(pending, attrChange{path: full, name: name, meta: meta})
+		if len(pending) >= ATTR_BATCH_SIZE {
+			c.writeAttrs(dirId, pending, report)
+			pending = nil
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		c.writeAttrs(dirId, pending, report)
+	}
+	if !opts.Recursive {
+		return nil
+	}
+	for _, d := range dirs {
+		err := c.changeDirAttrs(d.path, d.id, opts, report, inodes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//writeAttrs writes a batch of changed entries of the directory dirId in one batch, the
+//attributes of linked files belong to their inodes and are written one at a time
+func (c *Cass) writeAttrs(dirId string, changes []attrChange, report *AttrReport) {
+	batch := c.session.NewBatch(gocql.UnloggedBatch)
+	batch.SetConsistency(c.Consistency)
+	var batched, paths []string
+	for _, change := range changes {
+		stored := change.meta
+		stored.Inode = ""
+		metab, err := json.Marshal(stored)
+		if err != nil {
+			log.Println("Error encoding metadata for", change.path, ":", err)
+			report.Errors++
+			continue
+		}
+		if change.meta.Inode != "" {
+			err = c.writeInodeMetadata(change.meta.Inode, metab)
+			if err != nil {
+				log.Println("Unable to change", change.path, ":", err)
+				report.Errors++
+				continue
+			}
+			paths = append(paths, change.path)
+			continue
+		}
+		batch.Query("UPDATE filesystem SET metadata = ? WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", metab, c.OwnerId, c.Environment, dirId, change.name)
+		batched = append(batched, change.path)
+	}
+	c.Limiter.Wait(len(changes), 0)
+	if len(batched) > 0 {
+		err := c.session.ExecuteBatch(batch)
+		if err != nil {
+			log.Println("Unable to change a batch of entries:", err)
+			report.Errors += len(batched)
+		} else {
+			paths = append(paths, batched...)
+		}
+	}
+	for _, p := range paths {
+		c.invalidateMetadata(p)
+	}
+	c.dirChanged(dirId)
+	c.publish(paths...)
+	c.logChange(CHANGE_UPDATE, paths...)
+}
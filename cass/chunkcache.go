@@ -0,0 +1,75 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"sync"
+)
+
+//Number of clean chunks each open file handle keeps around
+const HANDLE_CACHE_CHUNKS = 4
+
+//chunkCache is a small LRU of chunks read by a file handle
+type chunkCache struct {
+	lock    sync.Mutex
+	size    int
+	keys    []string
+	entries map[string][]byte
+}
+
+func newChunkCache(size int) *chunkCache {
+	return &chunkCache{
+		size:    size,
+		entries: make(map[string][]byte, size),
+	}
+}
+
+func (c *chunkCache) get(hash []byte) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := string(hash)
+	data, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	for i, k := range c.keys {
+		if k == key {
+			c.keys = append(append(c.keys[:i:i], c.keys[i+1:]...), key)
+			break
+		}
+	}
+	return data, true
+}
+
+func (c *chunkCache) put(hash []byte, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := string(hash)
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	if len(c.keys) >= c.size {
+		delete(c.entries, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	c.keys = append(c.keys, key)
+	c.entries[key] = data
+}
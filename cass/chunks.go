@@ -0,0 +1,315 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"syscall"
+)
+
+//manifestHash identifies the content of a file by the hash of its chunk manifest
+func (c *Cass) manifestHash(chunks [][]byte) []byte {
+	if len(chunks) == 0 {
+		return nil
+	}
+	return c.hash(bytes.Join(chunks, nil))
+}
+
+//isHole reports whether a chunk hash is a hole, a chunk that was never written or only
+//holds zeros.  Holes read as zeros and have no data stored.
+func isHole(hash []byte) bool {
+	return len(hash) == 0
+}
+
+//storedChunks returns the chunks of a manifest that have data stored
+func storedChunks(chunks [][]byte) [][]byte {
+	stored := make([][]byte, 0, len(chunks))
+	for _, hash := range chunks {
+		if !isHole(hash) {
+			stored = append(stored, hash)
+		}
+	}
+	return stored
+}
+
+//dataRefs returns the data hashes an entry holds a reference on.  Files written with a
+//chunk manifest reference every chunk, older files reference the single hash of the whole file.
+func dataRefs(hash []byte, meta *CassMetadata) [][]byte {
+	if meta != nil && meta.Attr != nil && meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		//The hash of a directory is its UUID
+		return nil
+	}
+	if meta != nil && meta.Attr != nil && meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		//Symbolic links have no data, older links kept their target in the hash
+		return nil
+	}
+	if meta != nil && meta.Inline != nil {
+		//The content is in the row, nothing in filedata belongs to it
+		return nil
+	}
+	if meta != nil && len(meta.Chunks) > 0 {
+		return storedChunks(meta.Chunks)
+	}
+	if len(hash) > 0 {
+		return [][]byte{hash}
+	}
+	return nil
+}
+
+//decodeRefs is dataRefs for metadata that is still encoded
+func decodeRefs(hash []byte, metajson []byte) [][]byte {
+	meta := &CassMetadata{}
+	if err := json.Unmarshal(metajson, meta); err != nil {
+		return dataRefs(hash, nil)
+	}
+	return dataRefs(hash, meta)
+}
+
+//incrementRefs adds a reference to every hash in refs
+func (c *Cass) incrementRefs(refs [][]byte) error {
+	for _, hash := range refs {
+		err := c.incrementDataRef(hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//decrementRefs removes a reference from every hash in refs
+func (c *Cass) decrementRefs(refs [][]byte) error {
+	var ret error
+	for _, hash := range refs {
+		err := c.decrementDataRef(hash)
+		if err != nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+//updateRefs moves the references from old to new only touching the hashes that changed
+func (c *Cass) updateRefs(old [][]byte, new [][]byte) error {
+	counts := make(map[string]int)
+	for _, hash := range storedChunks(new) {
+		counts[string(hash)]++
+	}
+	for _, hash := range storedChunks(old) {
+		counts[string(hash)]--
+	}
+	for hash, count := range counts {
+		for ; count > 0; count-- {
+			if err := c.incrementDataRef([]byte(hash)); err != nil {
+				return err
+			}
+		}
+		for ; count < 0; count++ {
+			c.decrementDataRef([]byte(hash))
+		}
+	}
+	return nil
+}
+
+//writeChunk stores a single chunk unless a chunk with the same hash already exists.  The
+//hash is always of the uncompressed data so compression does not affect deduplication.
+func (c *Cass) writeChunk(hash []byte, data []byte) error {
+	exists, err := c.reuseBlob(c.OwnerId, hash)
+	if err != nil {
+		return err
+	}
+	if exists {
+		//The data is already in the DB
+		return nil
+	}
+	codec, stored, err := c.encodeBlock(data)
+	if err != nil {
+		return err
+	}
+	return c.insertBlob(c.OwnerId, hash, codec, stored)
+}
+
+//chunkWorkers returns the number of chunk queries run at the same time for one file
+func (c *Cass) chunkWorkers() int {
+	if c.ChunkWorkers < 1 {
+		return 1
+	}
+	return c.ChunkWorkers
+}
+
+//forChunks runs fn for every index below count on up to ChunkWorkers goroutines, so the
+//chunks of a large file are spread over the connections of the session.  It returns the
+//first error, the indexes not started yet are skipped once a call failed.
+func (c *Cass) forChunks(count int, fn func(idx int) error) error {
+	workers := c.chunkWorkers()
+	if workers > count {
+		workers = count
+	}
+	if workers <= 1 {
+		for idx := 0; idx < count; idx++ {
+			if err := fn(idx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	jobs := make(chan int)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var failed error
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				if err := fn(idx); err != nil {
+					lock.Lock()
+					if failed == nil {
+						failed = err
+					}
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for idx := 0; idx < count; idx++ {
+		lock.Lock()
+		stop := failed != nil
+		lock.Unlock()
+		if stop {
+			break
+		}
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+	return failed
+}
+
+//WriteChunks splits data into chunks of blockSize, stores the ones that are not already in
+//the store and returns the ordered list of chunk hashes.  Chunks that match the same
+//position in old are not written again.
+func (c *Cass) WriteChunks(data []byte, old [][]byte, blockSize int64) ([][]byte, error) {
+	bs := int(blockSize)
+	chunks := make([][]byte, (len(data)+bs-1)/bs)
+	err := c.forChunks(len(chunks), func(idx int) error {
+		start := idx * bs
+		end := start + bs
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := c.hash(data[start:end])
+		if idx >= len(old) || !bytes.Equal(old[idx], hash) {
+			err := c.writeChunk(hash, data[start:end])
+			if err != nil {
+				return err
+			}
+		}
+		chunks[idx] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+//ReadChunk reads a single chunk
+func (c *Cass) ReadChunk(hash []byte) ([]byte, error) {
+	return c.Read(hash)
+}
+
+//readChunks reads chunks of blockSize on up to ChunkWorkers goroutines and assembles them
+//in order.  Holes are filled with zeros.
+func (c *Cass) readChunks(chunks [][]byte, blockSize int64) ([]byte, error) {
+	parts := make([][]byte, len(chunks))
+	err := c.forChunks(len(chunks), func(idx int) error {
+		if isHole(chunks[idx]) {
+			//Only the last chunk is short, the caller trims a hole at the end to the size
+			parts[idx] = make([]byte, blockSize)
+			return nil
+		}
+		chunk, err := c.ReadChunk(chunks[idx])
+		if err != nil {
+			return err
+		}
+		parts[idx] = chunk
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data, nil
+}
+
+//ReadChunks reads the chunks of blockSize and returns the assembled data
+func (c *Cass) ReadChunks(chunks [][]byte, blockSize int64) ([]byte, error) {
+	return c.readChunks(chunks, blockSize)
+}
+
+//ReadRange reads length bytes starting at offset from a file stored as chunks of
+//blockSize.  Only the chunks that cover the requested range are read.
+func (c *Cass) ReadRange(chunks [][]byte, blockSize int64, offset int64, length int) ([]byte, error) {
+	if offset < 0 || length <= 0 {
+		return []byte{}, nil
+	}
+	skip := int(offset % blockSize)
+	first := offset / blockSize
+	last := (offset + int64(length) + blockSize - 1) / blockSize
+	if last > int64(len(chunks)) {
+		last = int64(len(chunks))
+	}
+	if first >= last {
+		return []byte{}, nil
+	}
+	data, err := c.readChunks(chunks[first:last], blockSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) <= skip {
+		return []byte{}, nil
+	}
+	data = data[skip:]
+	if len(data) > length {
+		data = data[:length]
+	}
+	return data, nil
+}
+
+//ReadFile reads the whole content of the file described by meta in any format
+func (c *Cass) ReadFile(meta *CassFsMetadata) ([]byte, error) {
+	if meta.Metadata.Inline != nil {
+		return append([]byte(nil), meta.Metadata.Inline...), nil
+	}
+	if len(meta.Metadata.Chunks) > 0 {
+		data, err := c.ReadChunks(meta.Metadata.Chunks, meta.Metadata.ChunkSize())
+		if err == nil && meta.Metadata.Attr != nil && uint64(len(data)) > meta.Metadata.Attr.Size {
+			data = data[:meta.Metadata.Attr.Size]
+		}
+		return data, err
+	}
+	return c.Read(meta.Hash)
+}
@@ -0,0 +1,115 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cass
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+var ErrClusterCA = errors.New("No certificates found in the CA file")
+
+//ClusterAuth holds the credentials and TLS settings used to connect to a secured cluster
+type ClusterAuth struct {
+	//Username and Password are sent to the password authenticator of the nodes, the password
+	//is read from PasswordFile when it is not given
+	Username     string
+	Password     string
+	PasswordFile string
+	//TLS encrypts the connections, it is implied by any of the files below
+	TLS bool
+	//CertFile and KeyFile are the client certificate, CAFile the certificates the nodes are
+	//verified with (the system pool if not set)
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	//ServerName is sent with SNI and checked against the certificates of the nodes, the
+	//address of each node is used if not set
+	ServerName string
+	//SkipVerify accepts any certificate, only for test clusters
+	SkipVerify bool
+}
+
+//secure reports whether the connections are encrypted
+func (a *ClusterAuth) secure() bool {
+	return a.TLS || a.CertFile != "" || a.CAFile != "" || a.ServerName != ""
+}
+
+//configure sets the authenticator and TLS options of the cluster
+func (a *ClusterAuth) configure(cluster *gocql.ClusterConfig) error {
+	if a.Username != "" {
+		password := a.Password
+		if password == "" && a.PasswordFile != "" {
+			data, err := ioutil.ReadFile(a.PasswordFile)
+			if err != nil {
+				return err
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: a.Username,
+			Password: password,
+		}
+	}
+	if !a.secure() {
+		return nil
+	}
+	config, err := loadTLS(a.CertFile, a.KeyFile, a.CAFile)
+	if err != nil {
+		return err
+	}
+	config.ServerName = a.ServerName
+	//gocql turns host verification off unless it is enabled here
+	cluster.SslOpts = &gocql.SslOptions{
+		Config:                 config,
+		EnableHostVerification: !a.SkipVerify,
+	}
+	return nil
+}
+
+//loadTLS returns a TLS configuration with the certificate of certFile and the CAs of caFile,
+//either can be empty
+func loadTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrClusterCA
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
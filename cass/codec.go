@@ -0,0 +1,88 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+//Codecs stored with every chunk in filedata, data written before compression was
+//available has no codec which reads as CODEC_NONE.  Codecs share their ids with the
+//transforms of the pipeline, 2 is taken by aes-gcm.
+const (
+	CODEC_NONE   = 0
+	CODEC_SNAPPY = 1
+	CODEC_ZSTD   = 3
+)
+
+var ErrUnknownCodec = errors.New("Unknown compression codec")
+
+//The zstd encoder and decoder are safe for concurrent use of EncodeAll and DecodeAll
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+//ParseCodec converts the name of a compression algorithm into its codec
+func ParseCodec(name string) (int, error) {
+	switch name {
+	case "", "none":
+		return CODEC_NONE, nil
+	case "snappy":
+		return CODEC_SNAPPY, nil
+	case "zstd":
+		return CODEC_ZSTD, nil
+	}
+	return CODEC_NONE, fmt.Errorf("Unsupported compression algorithm: %s", name)
+}
+
+//compress encodes data with codec and returns the codec that was actually used, data that
+//does not get smaller is stored uncompressed
+func compress(codec int, data []byte) (int, []byte) {
+	switch codec {
+	case CODEC_SNAPPY:
+		encoded := snappy.Encode(nil, data)
+		if len(encoded) < len(data) {
+			return CODEC_SNAPPY, encoded
+		}
+	case CODEC_ZSTD:
+		encoded := zstdEncoder.EncodeAll(data, nil)
+		if len(encoded) < len(data) {
+			return CODEC_ZSTD, encoded
+		}
+	}
+	return CODEC_NONE, data
+}
+
+//decompress decodes data that was stored with codec
+func decompress(codec int, data []byte) ([]byte, error) {
+	switch codec {
+	case CODEC_NONE:
+		return data, nil
+	case CODEC_SNAPPY:
+		return snappy.Decode(nil, data)
+	case CODEC_ZSTD:
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, ErrUnknownCodec
+}
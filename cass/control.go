@@ -0,0 +1,151 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//Invalidate drops everything the store has cached about name, the listing of its parent
+//and, for a directory, everything cached below it
+func (c *Cass) Invalidate(name string) {
+	name = strings.Trim(name, "/")
+	parent := path.Dir(name)
+	if parent == "." {
+		parent = ""
+	}
+	//The listings are cached by directory id so they have to go before the ids are dropped
+	c.InvalidateDir(parent)
+	c.InvalidateDir(name)
+	c.invalidatePrefix(name)
+}
+
+//Invalidate drops the cached state for name in the store and asks the kernel to forget
+//the entry and its attributes so the next lookup goes back to the store
+func (c *CassFs) Invalidate(name string) fuse.Status {
+	name = strings.Trim(name, "/")
+	c.store.Invalidate(name)
+	if c.nodeFs == nil {
+		return fuse.OK
+	}
+	//The kernel knows the entries of a subtree mount by their path below the subpath
+	if sub := c.options.Subpath; sub != "" {
+		switch {
+		case name == sub:
+			name = ""
+		case strings.HasPrefix(name, sub+"/"):
+			name = name[len(sub)+1:]
+		default:
+			return fuse.OK
+		}
+	}
+	dir, file := path.Split(name)
+	status := c.nodeFs.EntryNotify(strings.TrimSuffix(dir, "/"), file)
+	if status != fuse.OK && status != fuse.ENOENT {
+		return status
+	}
+	//The kernel may not know about name at all which is not an error here
+	if status = c.nodeFs.Notify(name); status == fuse.ENOENT {
+		return fuse.OK
+	}
+	return status
+}
+
+//Flush writes the files whose saves are held back by a transactional mount
+func (c *CassFs) Flush() {
+	c.flushPending()
+}
+
+//ServeControl listens on the unix socket for control requests to the mount.  A POST to
+//invalidate?path=<path> calls Invalidate for every path given, a POST to flush calls Flush.
+//A GET of slo returns the state of the latency SLOs of the mount, a GET of hedge the
+//counters of the hedged reads and a GET of cache those of the metadata cache.  Only the
+//user the mount runs as can connect to the socket.
+func (c *CassFs) ServeControl(socket string) error {
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(socket, os.FileMode(0600))
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/invalidate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, name := range r.URL.Query()["path"] {
+			status := c.Invalidate(name)
+			if status != fuse.OK {
+				log.Println("Unable to invalidate", name, ":", status)
+				http.Error(w, status.String(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/flush", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		c.Flush()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/slo", func(w http.ResponseWriter, r *http.Request) {
+		if c.options.SLO == nil {
+			http.Error(w, "No SLOs configured", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Degraded bool
+			SLOs     []SLOStatus
+		}{c.options.SLO.Degraded(), c.options.SLO.Status()})
+	})
+	mux.HandleFunc("/hedge", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.store.HedgeStats())
+	})
+	mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.store.MetadataCacheStats())
+	})
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			log.Println("Control endpoint stopped:", err)
+		}
+	}()
+	return nil
+}
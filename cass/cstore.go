@@ -24,6 +24,7 @@ import (
 	"bytes"
 	"crypto/sha512"
 	"encoding/json"
+	"errors"
 	"log"
 	"strconv"
 	"strings"
@@ -36,11 +37,89 @@ import (
 )
 
 //Setting the blocksize to 1M for now
+//BLOBSIZE is the default block size files are split into, files stored without a block
+//size use it
 const BLOBSIZE = 1024 * 1024
 
+//Limits of the block size, it also has to be a power of two
+const (
+	BLOCKSIZE_MIN = 4 * 1024
+	BLOCKSIZE_MAX = 16 * 1024 * 1024
+)
+
+//INLINE_MAX is the largest size files can be kept in their row with
+const INLINE_MAX = 64 * 1024
+
+//PREPARED_STMTS is the size of the prepared statement cache of the driver.  gocql prepares
+//a statement with bind values on a host the first time it is run there and reuses it from
+//then on, so the store never has to prepare its statements itself.  The cache is shared by
+//every session of the process, it holds the statements of all of them for every host.
+const PREPARED_STMTS = 4096
+
+//DefaultChunkWorkers is the number of chunk queries of one file that run at the same time
+const DefaultChunkWorkers = 4
+
+var ErrBlockSize = errors.New("Block size must be a power of two between 4K and 16M")
+
+var ErrInlineSize = errors.New("Inline size must be at most 64K")
+
+var ErrNotEmpty = errors.New("Directory not empty")
+
 type CassMetadata struct {
-	Attr  *fuse.Attr
-	XAttr map[string]string
+	Attr        *fuse.Attr
+	XAttr       map[string]string
+	XAttrBinary map[string][]byte
+	Chunks      [][]byte
+	//Inode is set on the entries of a file with hard links, the content is in the inodes table
+	Inode string `json:",omitempty"`
+	//Target is the destination of a symbolic link
+	Target string `json:",omitempty"`
+	//BlockSize is the size of the chunks of the file, it is not set for BLOBSIZE
+	BlockSize int64 `json:",omitempty"`
+	//Inline is the content of a small file kept in its row, Chunks still lists the hash
+	//of the content as its only chunk but the chunk is not in filedata
+	Inline []byte `json:",omitempty"`
+}
+
+//ChunkSize returns the size of the chunks the file is stored in
+func (m *CassMetadata) ChunkSize() int64 {
+	if m.BlockSize > 0 {
+		return m.BlockSize
+	}
+	return BLOBSIZE
+}
+
+//CheckBlockSize verifies that files can be split into chunks of size bytes
+func CheckBlockSize(size int64) error {
+	if size < BLOCKSIZE_MIN || size > BLOCKSIZE_MAX || size&(size-1) != 0 {
+		return ErrBlockSize
+	}
+	return nil
+}
+
+//CheckInlineSize verifies that files up to size bytes can be kept in their row
+func CheckInlineSize(size int64) error {
+	if size < 0 || size > INLINE_MAX {
+		return ErrInlineSize
+	}
+	return nil
+}
+
+//storedBlockSize is the block size recorded in the metadata of a file, the default is
+//left out so the metadata stays readable by older clients
+func storedBlockSize(size int64) int64 {
+	if size == BLOBSIZE {
+		return 0
+	}
+	return size
+}
+
+//SymlinkTarget returns the destination of a symbolic link, older links kept it in the hash
+func (m *CassMetadata) SymlinkTarget(hash []byte) string {
+	if m.Target != "" {
+		return m.Target
+	}
+	return string(hash)
 }
 
 type CassFsMetadata struct {
@@ -60,13 +139,36 @@ type Cass struct {
 	CacheEnabled   bool
 	CacheSize      int64
 	FcacheDuration int64
+	AdaptiveTTL    *AdaptiveTTL
+	SymlinkDepth   int
+	Compression    int
+	Hasher         Hasher
+	IsolatedBlobs  bool
+	PublishChanges bool
+	Limiter        *RateLimiter
+	Keys           KeyProvider
+	VerifyData     bool
+	BlockSize      int64
+	Config         *EnvConfig
+	HedgeDelay     time.Duration
+	LocalDC        string
+	Auth           *ClusterAuth
+	ChunkWorkers   int
+	MetaCacheSize  int
+	AsOf           time.Time
+	features       *EnvFeatures
+	featureLock    sync.Mutex
 	Root           *fuse.Attr
 	cache          *groupcache.Group
 	cluster        *gocql.ClusterConfig
-	cacheLock      sync.RWMutex
-	fileCache      map[string]*CassFsMetadata
+	fileCache      *metaCache
 	uuidLock       sync.RWMutex
 	uuidCache      map[string]string
+	transformLock  sync.Mutex
+	transforms     map[int]Transform
+	hedgeStats     HedgeStats
+	dirCache       *DirCache
+	origin         string
 	session        *gocql.Session
 }
 
@@ -79,6 +181,11 @@ func NewDefaultCass() *Cass {
 		OwnerId:        1,
 		Environment:    "prod",
 		FcacheDuration: 60,
+		SymlinkDepth:   DefaultSymlinkDepth,
+		Hasher:         DefaultHasher,
+		PublishChanges: true,
+		ChunkWorkers:   DefaultChunkWorkers,
+		MetaCacheSize:  DEFAULT_METADATA_CACHE,
 	}
 }
 
@@ -121,15 +228,37 @@ func (c *Cass) Init() error {
 	c.cluster = gocql.NewCluster(c.Host...)
 	c.cluster.ProtoVersion = 4
 	c.cluster.Keyspace = c.Keyspace
+	c.cluster.MaxPreparedStmts = PREPARED_STMTS
+	if c.Auth != nil {
+		if err := c.Auth.configure(c.cluster); err != nil {
+			return err
+		}
+	}
+	if c.LocalDC != "" {
+		//Round robin within the data center keeps hedged reads on different coordinators
+		c.cluster.PoolConfig.HostSelectionPolicy = gocql.DCAwareRoundRobinPolicy(c.LocalDC)
+	}
 	session, err := c.cluster.CreateSession()
 	if err != nil {
 		return err
 	}
-	c.fileCache = make(map[string]*CassFsMetadata, 1024)
+	c.fileCache = newMetaCache(c.MetaCacheSize)
 	c.uuidCache = make(map[string]string, 1024)
+	c.dirCache = NewDirCache(c.FcacheDuration)
+	c.origin = gocql.TimeUUID().String()
+	c.session = session
+	config, err := c.LoadEnvConfig()
+	if err != nil {
+		return err
+	}
+	c.Config = config
 	if c.CacheEnabled {
+		//Peers ask for chunks without a context, their chunks are read with this store
 		var getterFunc = func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
-			cass := ctx.(*Cass)
+			cass, ok := ctx.(*Cass)
+			if !ok {
+				cass = c
+			}
 			data, err := cass.ReadData([]byte(key))
 			if err != nil {
 				return err
@@ -144,7 +273,6 @@ func (c *Cass) Init() error {
 
 		c.cache = groupcache.NewGroup(groupName.String(), c.CacheSize, groupcache.GetterFunc(getterFunc))
 	}
-	c.session = session
 	return nil
 }
 
@@ -194,54 +322,76 @@ func (c *Cass) FindDir(dir string) (string, error) {
 
 //incrementDataRef updates the reference count on a data row when new files reference it
 func (c *Cass) incrementDataRef(hash []byte) error {
-	return c.session.Query("UPDATE fileref SET refs = refs + 1 WHERE hash = ?", hash).Exec()
+	return c.addBlobRef(c.OwnerId, hash, 1)
 }
 
 //decrementDataRef updates the reference count on a data row when files that reference it are deleted or modified
 func (c *Cass) decrementDataRef(hash []byte) error {
-	return c.session.Query("UPDATE fileref SET refs = refs - 1 WHERE hash = ?", hash).Exec()
+	return c.addBlobRef(c.OwnerId, hash, -1)
 }
 
 //GetFiledata looks up the file path in name and returns the Metadata or an error
 func (c *Cass) GetFiledata(name string) (*CassFsMetadata, error) {
 	var meta CassMetadata
 	var metajson, hash []byte
+	if !c.AsOf.IsZero() && name != "" {
+		return c.historyFiledata(name)
+	}
 	parent, file := c.splitPath(name)
-	c.cacheLock.RLock()
-	entry, ok := c.fileCache[name]
-	c.cacheLock.RUnlock()
+	entry, ok := c.fileCache.get(name)
 	if ok {
 		now := time.Now()
-		if now.Unix()-entry.Timestamp < c.FcacheDuration {
+		if now.Unix()-entry.Timestamp < c.cacheTTL(name) {
 			return entry, nil
 		} else {
-			c.cacheLock.Lock()
-			delete(c.fileCache, name)
-			c.cacheLock.Unlock()
+			c.fileCache.remove(name)
+		}
+	}
+	//A current manifest of the parent answers lookups without going to the store
+	if entry, current := c.dirCache.Lookup(parent, file, c.generationCheck(parent)); current {
+		if entry == nil {
+			return nil, gocql.ErrNotFound
+		}
+		//Linked files are read from their inode below
+		if entry.Metadata.Inode == "" {
+			return entry, nil
 		}
 	}
-	err := c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, parent, file).Scan(&hash, &metajson)
+	row, err := c.hedge(func() (interface{}, error) {
+		var hash, metajson []byte
+		err := c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, parent, file).Scan(&hash, &metajson)
+		return [][]byte{hash, metajson}, err
+	})
 	if err != nil {
 		return nil, err
 	}
+	hash, metajson = row.([][]byte)[0], row.([][]byte)[1]
 	err = json.Unmarshal(metajson, &meta)
 	ret := &CassFsMetadata{
 		Metadata:  meta,
 		Hash:      hash,
 		Timestamp: time.Now().Unix(),
 	}
-	c.cacheLock.Lock()
-	c.fileCache[name] = ret
-	c.cacheLock.Unlock()
+	ret, err = c.resolveInode(ret)
+	if err != nil {
+		return nil, err
+	}
+	c.fileCache.put(name, ret)
 	return ret, nil
 }
 
 //CreateFile creates the file that will be a reference to a data row it will store the path, attributes and the hash
 func (c *Cass) CreateFile(name string, attr *fuse.Attr, hash []byte) error {
-	meta, err := json.Marshal(CassMetadata{
+	err := c.CheckName(name)
+	if err != nil {
+		return err
+	}
+	xattr := c.applyDefaults(attr)
+	cmeta := CassMetadata{
 		Attr:  attr,
-		XAttr: nil,
-	})
+		XAttr: xattr,
+	}
+	meta, err := json.Marshal(cmeta)
 	if err != nil {
 		log.Println("Encoding error on metadata:", err)
 		return err
@@ -251,31 +401,81 @@ func (c *Cass) CreateFile(name string, attr *fuse.Attr, hash []byte) error {
 	if err != nil {
 		return err
 	}
-	if len(hash) > 0 {
-		err = c.incrementDataRef(hash)
+	c.cacheMetadata(name, cmeta, hash)
+	c.dirChanged(dir)
+	c.publish(name)
+	c.logChange(CHANGE_CREATE, name)
+	return c.incrementRefs(dataRefs(hash, &CassMetadata{Attr: attr}))
+}
+
+//CreateSymlink creates a symbolic link at name pointing to target.  The target is kept in
+//the metadata, a link has no data and holds no references.
+func (c *Cass) CreateSymlink(name string, attr *fuse.Attr, target string) error {
+	err := c.CheckName(name)
+	if err != nil {
+		return err
 	}
-	return err
+	attr.Size = uint64(len(target))
+	cmeta := CassMetadata{
+		Attr:   attr,
+		XAttr:  c.applyDefaults(attr),
+		Target: target,
+	}
+	meta, err := json.Marshal(cmeta)
+	if err != nil {
+		log.Println("Encoding error on metadata:", err)
+		return err
+	}
+	dir, file := c.splitPath(name)
+	err = c.session.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, dir, file, nil, meta).Consistency(c.Consistency).Exec()
+	if err != nil {
+		return err
+	}
+	c.cacheMetadata(name, cmeta, nil)
+	c.dirChanged(dir)
+	c.publish(name)
+	c.logChange(CHANGE_CREATE, name)
+	return nil
 }
 
-//Rename changes the filename in cassandra
+//Rename changes the filename in cassandra.  The new entry and the removal of the old one
+//are applied in a single logged batch, so other clients never see the file under both
+//names or under neither, even if the rename fails half way.
 func (c *Cass) Rename(oldName string, newName string) error {
 	var hash []byte
 	var meta []byte
+	err := c.CheckName(newName)
+	if err != nil {
+		return err
+	}
+	if oldName == newName {
+		//The insert and the delete would have the same timestamp, the delete wins
+		return nil
+	}
 	oldDir, oldFile := c.splitPath(oldName)
 	newDir, newFile := c.splitPath(newName)
 
-	err := c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, oldDir, oldFile).Scan(&hash, &meta)
+	err = c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, oldDir, oldFile).Scan(&hash, &meta)
 	if err != nil {
 		log.Println("Error finding file to move from:", err)
 		return err
 	}
-	err = c.session.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, newDir, newFile, hash, meta).Consistency(c.Consistency).Exec()
+	batch := gocql.NewBatch(gocql.LoggedBatch)
+	batch.Cons = c.Consistency
+	batch.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, newDir, newFile, hash, meta)
+	batch.Query("DELETE FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, oldDir, oldFile)
+	err = c.session.ExecuteBatch(batch)
 	if err != nil {
-		log.Println("Error inserting new file:", err)
+		log.Println("Error moving file:", err)
 		return err
 	}
-	err = c.session.Query("DELETE FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, oldDir, oldFile).Consistency(c.Consistency).Exec()
-	//Skipping an error, because at this point the rename was completed.
+	c.invalidateMetadata(oldName)
+	c.reparentDir(hash, meta, newDir)
+	c.dirChanged(oldDir)
+	c.dirChanged(newDir)
+	c.moveExpiry(oldName, newName)
+	c.publish(oldName, newName)
+	c.logChange(CHANGE_RENAME, oldName, newName)
 
 	return nil
 }
@@ -311,71 +511,145 @@ func (c *Cass) Rename(oldName string, newName string) error {
 func (c *Cass) WriteMetadata(path string, meta CassMetadata) error {
 	dir, file := c.splitPath(path)
 
-	metab, err := json.Marshal(meta)
+	stored := meta
+	stored.Inode = ""
+	metab, err := json.Marshal(stored)
 	if err != nil {
 		log.Println("Error encoding metadata:", err)
 		return err
 	}
 
-	c.cacheLock.RLock()
-	_, ok := c.fileCache[path]
-	c.cacheLock.RUnlock()
-	if ok {
-		c.cacheLock.Lock()
-		delete(c.fileCache, path)
-		c.cacheLock.Unlock()
+	if meta.Inode != "" {
+		//The metadata of a linked file belongs to its inode
+		err = c.writeInodeMetadata(meta.Inode, metab)
+	} else {
+		err = c.session.Query("UPDATE filesystem SET metadata = ? WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", metab, c.OwnerId, c.Environment, dir, file).Consistency(c.Consistency).Exec()
+	}
+	if err != nil {
+		c.invalidateMetadata(path)
+		return err
 	}
+	c.dirChanged(dir)
+	c.publish(path)
+	c.logChange(CHANGE_UPDATE, path)
 
-	err = c.session.Query("UPDATE filesystem SET metadata = ? WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", metab, c.OwnerId, c.Environment, dir, file).Consistency(c.Consistency).Exec()
-	return err
+	//Only the metadata changed, so keep the hash that is already cached
+	if entry, ok := c.fileCache.get(path); ok {
+		c.fileCache.replace(path, &CassFsMetadata{
+			Metadata:  meta,
+			Hash:      entry.Hash,
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	return nil
+}
+
+//cacheMetadata stores freshly written metadata for path so the next lookup does not go back to cassandra
+func (c *Cass) cacheMetadata(path string, meta CassMetadata, hash []byte) {
+	c.fileCache.put(path, &CassFsMetadata{
+		Metadata:  meta,
+		Hash:      hash,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+//invalidateMetadata drops any cached metadata for path
+func (c *Cass) invalidateMetadata(path string) {
+	c.fileCache.remove(path)
 }
 
 //UpdateFile Updates the attributes and data hash when a file changes
 func (c *Cass) UpdateFile(f *CassFileData) error {
+	err := c.CheckSize(f.Attr.Size)
+	if err != nil {
+		return err
+	}
 	parent, file := c.splitPath(*f.Name)
-	hash, err := c.WriteFileData(f.Data)
+	if f.Inode != "" {
+		//The link count is kept by Link and unlinkInode, not by the open handles
+		if _, inode, err := c.readInode(f.Inode); err == nil && inode.Attr != nil {
+			f.Attr.Nlink = inode.Attr.Nlink
+		}
+	}
+	chunks, inline, err := f.content(c)
 	if err != nil {
 		log.Println("Error writing Data:", err)
 		return err
 	}
-	old_hash := f.Hash
-	f.Hash = hash
-	meta, err := json.Marshal(CassMetadata{
-		Attr: f.Attr,
-	})
+	hash := c.manifestHash(chunks)
+	old_refs := f.storedRefs()
+	cmeta := f.metadata(chunks, inline)
+	meta, err := json.Marshal(cmeta)
 	if err != nil {
 		log.Println("Encoding error:", err)
 		return err
 	}
-	err = c.session.Query("UPDATE filesystem SET hash=?, metadata=? WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", f.Hash, meta, c.OwnerId, c.Environment, parent, file).Consistency(c.Consistency).Exec()
-	if err != nil {
-		return err
+	if f.saved != nil && bytes.Equal(f.Hash, hash) && bytes.Equal(f.saved, meta) {
+		//Nothing changed since the file was read or last saved, the entry and the
+		//references of its data stay as they are
+		f.stored(chunks, inline)
+		return nil
 	}
-	err = c.incrementDataRef(hash)
-	if len(old_hash) > 0 {
-		c.decrementDataRef(old_hash)
+	var prevHash, prevMeta []byte
+	if f.Inode != "" {
+		err = c.writeInode(f.Inode, hash, meta)
+	} else {
+		prevHash, prevMeta = c.currentEntry(parent, file)
+		err = c.session.Query("UPDATE filesystem SET hash=?, metadata=? WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", hash, meta, c.OwnerId, c.Environment, parent, file).Consistency(c.Consistency).Exec()
 	}
 	if err != nil {
+		c.invalidateMetadata(*f.Name)
 		return err
 	}
-	c.cacheLock.RLock()
-	_, ok := c.fileCache[*f.Name]
-	c.cacheLock.RUnlock()
-	if ok {
-		c.cacheLock.Lock()
-		delete(c.fileCache, *f.Name)
-		c.cacheLock.Unlock()
-	}
-	return nil
+	//Content that moves in or out of the row changes its references even with the same hash
+	unchanged := !f.trimmed && bytes.Equal(f.Hash, hash) && (f.Inline == nil) == (inline == nil)
+	f.Hash = hash
+	f.stored(chunks, inline)
+	f.saved = meta
+	if f.Inode == "" {
+		c.cacheMetadata(*f.Name, cmeta, hash)
+	}
+	c.dirChanged(parent)
+	c.publish(*f.Name)
+	c.logChange(CHANGE_UPDATE, *f.Name)
+	if prevMeta != nil && !bytes.Equal(prevHash, hash) && c.addVersion(parent, file, prevHash, prevMeta) {
+		//The references of the previous content moved to its version
+		old_refs = nil
+	} else if unchanged {
+		//Only the metadata changed, the data keeps its references
+		return nil
+	}
+	return c.updateRefs(old_refs, dataRefs(hash, &cmeta))
 }
 
 //read reads in the data for the hash blob and returns it as a byte array
 func (c *Cass) ReadData(hash []byte) ([]byte, error) {
+	data, err := c.hedge(func() (interface{}, error) {
+		return c.readBlob(hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	buffer := data.([]byte)
+	c.Limiter.Wait(0, len(buffer))
+	return buffer, nil
+}
+
+//readBlob reads and decodes every location of the blob hash
+func (c *Cass) readBlob(hash []byte) ([]byte, error) {
 	var buffer, data []byte
-	var loc int
-	iter := c.session.Query("SELECT location, data FROM filedata WHERE hash = ?", hash).Iter()
-	for iter.Scan(&loc, &data) {
-		buffer = append(buffer, data...)
+	var loc, codec int
+	iter := c.selectBlob(c.OwnerId, hash)
+	for iter.Scan(&loc, &data, &codec) {
+		plain, err := c.decodeBlock(codec, data)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		buffer = append(buffer, plain...)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
 	}
 	return buffer, nil
 }
@@ -384,9 +658,13 @@ func (c *Cass) ReadData(hash []byte) ([]byte, error) {
 func (c *Cass) Read(hash []byte) ([]byte, error) {
 	var data []byte
 	var err error
+	if len(hash) == 0 {
+		//Empty files do not have any data stored
+		return []byte{}, nil
+	}
 	if c.CacheEnabled {
 		err = c.cache.Get(c, string(hash), groupcache.AllocatingByteSliceSink(&data))
-		if err == nil {
+		if err == nil && (!c.VerifyData || matchesHash(hash, data)) {
 			return data, err
 		}
 	}
@@ -395,14 +673,18 @@ func (c *Cass) Read(hash []byte) ([]byte, error) {
 		log.Println(err)
 		return nil, err
 	}
+	if c.VerifyData && !matchesHash(hash, data) {
+		log.Printf("Data for %x does not match its hash\n", hash)
+		return nil, ErrTampered
+	}
 	return data, err
 }
 
 //DeleteFile removes a file from the filesystem and updates the reference count
 func (c *Cass) DeleteFile(name string) error {
-	var hash []byte
+	var hash, meta []byte
 	dir, file := c.splitPath(name)
-	err := c.session.Query("SELECT hash FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? and name = ?", c.OwnerId, c.Environment, dir, file).Scan(&hash)
+	err := c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? and name = ?", c.OwnerId, c.Environment, dir, file).Scan(&hash, &meta)
 	if err != nil {
 		return err
 	}
@@ -410,13 +692,14 @@ func (c *Cass) DeleteFile(name string) error {
 	if err != nil {
 		return err
 	}
-	if len(hash) > 0 {
-		err = c.decrementDataRef(hash)
-	}
-	//Check if there is an entry in the cache
-	if _, ok := c.fileCache[name]; ok {
-		delete(c.fileCache, name)
+	c.dirChanged(dir)
+	c.ClearExpiry(name)
+	c.publish(name)
+	c.logChange(CHANGE_DELETE, name)
+	if !c.moveToTrash(name, hash, meta) {
+		err = c.releaseEntry(hash, meta)
 	}
+	c.fileCache.remove(name)
 	return err
 }
 
@@ -426,6 +709,9 @@ func (c *Cass) OpenDir(dir string) ([]fuse.DirEntry, error) {
 	var meta, hash []byte
 	var file string
 
+	if !c.AsOf.IsZero() {
+		return c.historyDir(dir)
+	}
 	now := time.Now()
 
 	dirId, err := c.FindDir(dir)
@@ -437,6 +723,17 @@ func (c *Cass) OpenDir(dir string) ([]fuse.DirEntry, error) {
 			log.Println("Something bad happened about the lookup:", err)
 		}
 	}
+	if entries, ok := c.dirCache.Get(dirId, c.generationCheck(dirId)); ok {
+		return entries, nil
+	}
+	gen := c.dirCache.Generation(dirId)
+	//The generation in the store is read first so a change made during the listing is
+	//caught by the next check
+	remoteGen, err := c.dirGeneration(dirId)
+	if err != nil {
+		return nil, err
+	}
+	manifest := make(map[string]*CassFsMetadata)
 	iter := c.session.Query("SELECT name, metadata, hash FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Iter()
 	for iter.Scan(&file, &meta, &hash) {
 		finfo := &CassMetadata{}
@@ -450,86 +747,204 @@ func (c *Cass) OpenDir(dir string) ([]fuse.DirEntry, error) {
 		key.WriteString("/")
 		key.WriteString(file)
 
-		c.cacheLock.Lock()
-		c.fileCache[key.String()] = &CassFsMetadata{
+		entry := &CassFsMetadata{
 			Metadata:  *finfo,
 			Timestamp: now.Unix(),
 			Hash:      hash,
 		}
-		c.cacheLock.Unlock()
-		file_list = append(file_list, fuse.DirEntry{Mode: finfo.Attr.Mode, Name: file})
+		//The manifest keeps the link, the file cache the content of the inode
+		resolved, err := c.resolveInode(entry)
+		if err != nil {
+			log.Println("Error reading the inode of", file, ":", err)
+			continue
+		}
+		c.fileCache.put(key.String(), resolved)
+		manifest[file] = entry
+		file_list = append(file_list, fuse.DirEntry{Mode: resolved.Metadata.Attr.Mode, Name: file})
 	}
 	err = iter.Close()
 	if err != nil {
 		return nil, err
 	}
+	c.dirCache.Put(dirId, gen, remoteGen, file_list, manifest)
 	return file_list, nil
 }
 
-//CopyFile copies the file orig to newFile
-func (c *Cass) CopyFile(orig string, newFile string) error {
-	var hash, metadata []byte
-	dir, file := c.splitPath(orig)
-	newDir, newFile := c.splitPath(newFile)
-	err := c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Scan(&hash, &metadata)
+//InvalidateDir drops the cached listing for the directory at path, this is used when
+//another client reports a change in that directory
+func (c *Cass) InvalidateDir(path string) {
+	dirId, err := c.FindDir(path)
+	if err != nil {
+		return
+	}
+	c.dirCache.Invalidate(dirId)
+}
+
+//OrphanFile removes the directory entry for name while a client still has it open.  The
+//reference on the data is kept and recorded in the orphans table until ReleaseOrphan is
+//called, so the data stays readable until the last handle is closed.
+func (c *Cass) OrphanFile(name string) (string, error) {
+	var hash, meta []byte
+	dir, file := c.splitPath(name)
+	err := c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Scan(&hash, &meta)
+	if err != nil {
+		return "", err
+	}
+	if inode := linkedInode(meta); inode != "" {
+		return c.orphanLink(name, inode)
+	}
+	id := gocql.TimeUUID()
+	err = c.session.Query("INSERT INTO orphans (cust_id, environment, id, hash, metadata) VALUES(?, ?, ?, ?, ?)", c.OwnerId, c.Environment, id, hash, meta).Consistency(c.Consistency).Exec()
+	if err != nil {
+		return "", err
+	}
+	err = c.session.Query("DELETE FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Consistency(c.Consistency).Exec()
+	if err != nil {
+		c.session.Query("DELETE FROM orphans WHERE cust_id = ? AND environment = ? AND id = ?", c.OwnerId, c.Environment, id).Exec()
+		return "", err
+	}
+	c.dirChanged(dir)
+	c.invalidateMetadata(name)
+	c.ClearExpiry(name)
+	c.publish(name)
+	c.logChange(CHANGE_DELETE, name)
+	return id.String(), nil
+}
+
+//ReleaseOrphan drops the data reference held by an orphaned file once it is no longer open
+func (c *Cass) ReleaseOrphan(id string) error {
+	var hash, meta []byte
+	uuid, err := gocql.ParseUUID(id)
 	if err != nil {
 		return err
 	}
-	err = c.session.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, newDir, newFile, hash, metadata).Consistency(c.Consistency).Exec()
+	err = c.session.Query("SELECT hash, metadata FROM orphans WHERE cust_id = ? AND environment = ? AND id = ?", c.OwnerId, c.Environment, uuid).Scan(&hash, &meta)
 	if err != nil {
 		return err
 	}
-	err = c.incrementDataRef(hash)
+	err = c.decrementRefs(decodeRefs(hash, meta))
 	if err != nil {
-		//We need to remove the new file entry to prevent an unallocated reference from being kept
-		c.session.Query("DELETE FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, newDir, newFile).Consistency(c.Consistency).Exec()
 		return err
 	}
-	return nil
+	return c.session.Query("DELETE FROM orphans WHERE cust_id = ? AND environment = ? AND id = ?", c.OwnerId, c.Environment, uuid).Consistency(c.Consistency).Exec()
 }
 
-//WriteFileData writes the data passed in into the file data table in chunks of BLOBSIZE
-func (c *Cass) WriteFileData(data []byte) ([]byte, error) {
-	var h []byte
-	start := 0
-	end := BLOBSIZE
-	if end > len(data) {
-		end = len(data)
-	}
-	hash := ShaSum(data)
-	err := c.session.Query("SELECT hash FROM filedata WHERE hash = ?", hash).Scan(&h)
-	if err == nil {
-		//The data is already in the DB
-		return hash, nil
+//HasChildren checks if the directory at path has any entries without reading the whole listing
+func (c *Cass) HasChildren(path string) (bool, error) {
+	var name string
+	dirId, err := c.FindDir(path)
+	if err != nil {
+		return false, err
 	}
-	if err != gocql.ErrNotFound {
-		//The error was not a not found error, so there's a problem
-		return nil, err
+	iter := c.session.Query("SELECT name FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? LIMIT 1", c.OwnerId, c.Environment, dirId).Iter()
+	found := iter.Scan(&name)
+	if err := iter.Close(); err != nil {
+		return false, err
 	}
-	for {
-		err := c.session.Query("INSERT INTO filedata (hash, location, data) VALUES(?, ?, ?)", hash, start, data[start:end]).Exec()
+	return found, nil
+}
+
+//RemoveDirectory removes the directory at path.  Unless recursive is set the directory
+//has to be empty.  The recursive mode is meant for the admin commands and is never used
+//from the fuse filesystem.
+func (c *Cass) RemoveDirectory(path string, recursive bool) error {
+	if recursive {
+		entries, err := c.OpenDir(path)
 		if err != nil {
-			log.Println("Error writing data:", err)
-			return nil, err
+			return err
 		}
-		start += BLOBSIZE + 1
-		if start > len(data) {
-			break
+		for _, entry := range entries {
+			child := entry.Name
+			if path != "" {
+				child = path + "/" + entry.Name
+			}
+			if entry.Mode&fuse.S_IFDIR == fuse.S_IFDIR {
+				err = c.RemoveDirectory(child, true)
+			} else {
+				err = c.DeleteFile(child)
+			}
+			if err != nil {
+				log.Println("Unable to remove", child, ":", err)
+				return err
+			}
 		}
-		if (end + BLOBSIZE + 1) > len(data) {
-			end = len(data)
-		} else {
-			end += BLOBSIZE + 1
+	} else {
+		children, err := c.HasChildren(path)
+		if err != nil {
+			return err
 		}
+		if children {
+			return ErrNotEmpty
+		}
+	}
+	if path == "" {
+		//The root of the environment is not an entry that can be removed
+		return nil
+	}
+	err := c.DeleteFile(path)
+	if err != nil {
+		return err
 	}
-	return hash, nil
+	c.uuidLock.Lock()
+	delete(c.uuidCache, path)
+	c.uuidLock.Unlock()
+	return nil
+}
+
+//CopyFile copies the file orig to newFile.  The references of the copy are added before
+//its entry is written and taken back if the entry can not be, so the data of an entry is
+//never without them.  A copy that fails half way at worst leaves references to reclaim.
+func (c *Cass) CopyFile(orig string, newPath string) error {
+	var hash, metadata []byte
+	dir, file := c.splitPath(orig)
+	newDir, newFile := c.splitPath(newPath)
+	err := c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Scan(&hash, &metadata)
+	if err != nil {
+		return err
+	}
+	if id := linkedInode(metadata); id != "" {
+		//A copy of a linked file gets its own content
+		var meta CassMetadata
+		hash, meta, err = c.readInode(id)
+		if err != nil {
+			return err
+		}
+		meta.Inode = ""
+		meta.Attr.Nlink = 1
+		metadata, err = json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+	}
+	refs := decodeRefs(hash, metadata)
+	err = c.incrementRefs(refs)
+	if err != nil {
+		return err
+	}
+	err = c.session.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, newDir, newFile, hash, metadata).Consistency(c.Consistency).Exec()
+	if err != nil {
+		c.decrementRefs(refs)
+		return err
+	}
+	c.invalidateMetadata(newPath)
+	c.dirChanged(newDir)
+	c.publish(newPath)
+	c.logChange(CHANGE_CREATE, newPath)
+	return nil
+}
+
+//IsEmptyHash checks if hash refers to an empty file, either in the canonical form (no hash)
+//or as the hash of no data that older versions stored
+func IsEmptyHash(hash []byte) bool {
+	return len(hash) == 0 || bytes.Equal(hash, ShaSum([]byte{}))
 }
 
 //MakeDirectory creates a directory at path directory with attributes attr
 func (c *Cass) MakeDirectory(directory string, attr *fuse.Attr) error {
 	parent, child := c.splitPath(directory)
 
-	meta, err := json.Marshal(CassMetadata{Attr: attr})
+	xattr := c.applyDefaults(attr)
+	meta, err := json.Marshal(CassMetadata{Attr: attr, XAttr: xattr})
 	if err != nil {
 		log.Println("Encoding err:", err)
 		return err
@@ -537,7 +952,14 @@ func (c *Cass) MakeDirectory(directory string, attr *fuse.Attr) error {
 
 	uuid := gocql.TimeUUID()
 
-	return c.session.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, parent, child, uuid.Bytes(), meta).Consistency(c.Consistency).Exec()
+	err = c.session.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, parent, child, uuid.Bytes(), meta).Consistency(c.Consistency).Exec()
+	if err != nil {
+		return err
+	}
+	c.dirChanged(parent)
+	c.publish(directory)
+	c.logChange(CHANGE_CREATE, directory)
+	return nil
 }
 
 //GetFileCount returns the number of files in the environment
@@ -0,0 +1,127 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"sort"
+	"strings"
+	"syscall"
+)
+
+//A snapshot is the namespace below a path as manifest entries by path.  The current state
+//of two environments is compared with DiffTrees, which only reads the directories whose
+//Merkle hashes differ, and an environment with a manifest of it by DiffManifest, which
+//hashes the manifest the same way.  The state an environment had at a time, read from its
+//history, is not hashed and is compared entry by entry with DiffSnapshots.
+
+//Snapshot returns the entries below path as they are now, or at AsOf when it is set
+func (c *Cass) Snapshot(path string) (map[string]*ManifestEntry, error) {
+	entries := make(map[string]*ManifestEntry)
+	path = strings.Trim(path, "/")
+	err := c.Walk(path, func(p string, hash []byte, meta *CassMetadata) error {
+		entries[p] = manifestEntry(hash, meta)
+		return nil
+	})
+	return entries, err
+}
+
+//DiffManifest lists the differences from the manifest to the environment below path.  Only
+//the directories whose Merkle hashes differ from the manifest are read.
+func (c *Cass) DiffManifest(m *EnvManifest, path string) ([]TreeChange, error) {
+	path = strings.Trim(path, "/")
+	from := m.Below(path)
+	to := make(map[string]*ManifestEntry)
+	matched := make(map[string]bool)
+	err := c.WalkTree(path, m.matchingSubtrees(matched), func(p string, hash []byte, meta *CassMetadata) error {
+		to[p] = manifestEntry(hash, meta)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if matched[path] {
+		return nil, nil
+	}
+	//The entries of the subtrees that were skipped are the same on both sides
+	for p, e := range from {
+		if inSubtree(p, matched) {
+			to[p] = e
+		}
+	}
+	return DiffSnapshots(from, to), nil
+}
+
+//Below returns the entries of the manifest below path
+func (m *EnvManifest) Below(path string) map[string]*ManifestEntry {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return m.Entries
+	}
+	entries := make(map[string]*ManifestEntry)
+	for p, e := range m.Entries {
+		if strings.HasPrefix(p, path+"/") {
+			entries[p] = e
+		}
+	}
+	return entries
+}
+
+//DiffSnapshots lists the differences from one snapshot to another the same way DiffTrees
+//does, the contents of a directory that was added or removed are not reported
+func DiffSnapshots(from map[string]*ManifestEntry, to map[string]*ManifestEntry) []TreeChange {
+	paths := make([]string, 0, len(from)+len(to))
+	for p := range from {
+		paths = append(paths, p)
+	}
+	for p := range to {
+		if _, ok := from[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	var changes []TreeChange
+	//gone are the paths that were added or removed as a whole
+	gone := make(map[string]bool)
+	for _, p := range paths {
+		if gone[parentPath(p)] {
+			gone[p] = true
+			continue
+		}
+		f, inFrom := from[p]
+		t, inTo := to[p]
+		switch {
+		case !inTo:
+			changes = append(changes, TreeChange{Path: p, Kind: TREE_REMOVED})
+		case !inFrom:
+			changes = append(changes, TreeChange{Path: p, Kind: TREE_ADDED})
+		case !f.equal(t):
+			changes = append(changes, TreeChange{Path: p, Kind: TREE_CHANGED})
+			//A directory that became a file takes its contents with it
+			if (f.Mode^t.Mode)&syscall.S_IFMT == 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		gone[p] = true
+	}
+	return changes
+}
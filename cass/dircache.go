@@ -0,0 +1,146 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//dirListing is a cached result of OpenDir for a single directory along with the
+//metadata of every entry, so the directory manifest can answer lookups as well
+type dirListing struct {
+	generation uint64
+	remoteGen  int64
+	timestamp  int64
+	entries    []fuse.DirEntry
+	meta       map[string]*CassFsMetadata
+}
+
+//GenerationCheck reads the generation of a directory from the store
+type GenerationCheck func() (int64, error)
+
+//DirCache keeps directory listings keyed by the directory UUID.  Every
+//mutation inside a directory bumps its generation, which makes any listing
+//captured before the change unusable.  Once a listing is older than the cache
+//duration it is revalidated against the generation kept in the store, so an
+//unchanged directory costs a single read instead of a new listing.
+type DirCache struct {
+	lock        sync.Mutex
+	duration    int64
+	generations map[string]uint64
+	listings    map[string]*dirListing
+}
+
+func NewDirCache(duration int64) *DirCache {
+	return &DirCache{
+		duration:    duration,
+		generations: make(map[string]uint64, 1024),
+		listings:    make(map[string]*dirListing, 1024),
+	}
+}
+
+//Generation returns the current generation of the directory dirId
+func (d *DirCache) Generation(dirId string) uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.generations[dirId]
+}
+
+//current returns the listing for dirId if it is still current, check is only called
+//when the listing is older than the cache duration
+func (d *DirCache) current(dirId string, check GenerationCheck) *dirListing {
+	d.lock.Lock()
+	listing, ok := d.listings[dirId]
+	if !ok {
+		d.lock.Unlock()
+		return nil
+	}
+	if listing.generation != d.generations[dirId] {
+		delete(d.listings, dirId)
+		d.lock.Unlock()
+		return nil
+	}
+	if time.Now().Unix()-listing.timestamp < d.duration {
+		d.lock.Unlock()
+		return listing
+	}
+	d.lock.Unlock()
+	//The check goes to the store so it is done without holding the lock
+	remote, err := check()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err != nil || remote != listing.remoteGen || d.listings[dirId] != listing {
+		if d.listings[dirId] == listing {
+			delete(d.listings, dirId)
+		}
+		return nil
+	}
+	listing.timestamp = time.Now().Unix()
+	return listing
+}
+
+//Get returns the cached listing for dirId if it is still current
+func (d *DirCache) Get(dirId string, check GenerationCheck) ([]fuse.DirEntry, bool) {
+	listing := d.current(dirId, check)
+	if listing == nil {
+		return nil, false
+	}
+	return listing.entries, true
+}
+
+//Lookup finds name in the cached manifest of dirId.  The second value reports if the
+//manifest was current, in which case a missing entry means the name does not exist.
+func (d *DirCache) Lookup(dirId string, name string, check GenerationCheck) (*CassFsMetadata, bool) {
+	listing := d.current(dirId, check)
+	if listing == nil || listing.meta == nil {
+		return nil, false
+	}
+	return listing.meta[name], true
+}
+
+//Put stores a listing that was read while the directory was at generation gen locally
+//and remoteGen in the store.  If the directory changed while it was being read the
+//listing is dropped.
+func (d *DirCache) Put(dirId string, gen uint64, remoteGen int64, entries []fuse.DirEntry, meta map[string]*CassFsMetadata) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.generations[dirId] != gen {
+		return
+	}
+	d.listings[dirId] = &dirListing{
+		generation: gen,
+		remoteGen:  remoteGen,
+		timestamp:  time.Now().Unix(),
+		entries:    entries,
+		meta:       meta,
+	}
+}
+
+//Invalidate bumps the generation of dirId, used for both local mutations and remote invalidation events
+func (d *DirCache) Invalidate(dirId string) {
+	d.lock.Lock()
+	d.generations[dirId]++
+	delete(d.listings, dirId)
+	d.lock.Unlock()
+}
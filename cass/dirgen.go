@@ -0,0 +1,58 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+
+	"github.com/gocql/gocql"
+)
+
+//dirGeneration reads the generation of the directory dirId from the store.  The
+//generation is bumped by every client that changes the directory.
+func (c *Cass) dirGeneration(dirId string) (int64, error) {
+	var gen int64
+	err := c.session.Query("SELECT gen FROM dirgen WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Scan(&gen)
+	if err == gocql.ErrNotFound {
+		return 0, nil
+	}
+	return gen, err
+}
+
+//generationCheck returns the check the directory cache uses to revalidate dirId
+func (c *Cass) generationCheck(dirId string) GenerationCheck {
+	return func() (int64, error) {
+		return c.dirGeneration(dirId)
+	}
+}
+
+//dirChanged records a change to the directory dirId, both in the local cache and in
+//the generation other clients revalidate their cached manifests against.  The tree
+//generation of the directory and its parents invalidates their Merkle hashes.
+func (c *Cass) dirChanged(dirId string) {
+	c.dirCache.Invalidate(dirId)
+	err := c.session.Query("UPDATE dirgen SET gen = gen + 1, tree = tree + 1 WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Exec()
+	if err != nil {
+		log.Println("Unable to update the generation of directory", dirId, ":", err)
+		return
+	}
+	c.treeChanged(dirId)
+}
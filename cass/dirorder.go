@@ -0,0 +1,79 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//The offset of a readdir is the position of an entry in the listing of the directory.
+//Every listing is served in name order, which is the order the filesystem table clusters
+//the entries of a directory in, so the offset of an entry only depends on the names
+//before it and a listing resumed at an offset after opening the directory again, or from
+//another node, continues where it stopped.  ReadDirAfter resumes by name instead, which
+//also holds when entries before the cursor were added or removed in the meantime.
+
+type entriesByName []fuse.DirEntry
+
+func (s entriesByName) Len() int           { return len(s) }
+func (s entriesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s entriesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+//sortEntries puts a listing in name order
+func sortEntries(entries []fuse.DirEntry) []fuse.DirEntry {
+	if !sort.IsSorted(entriesByName(entries)) {
+		sort.Sort(entriesByName(entries))
+	}
+	return entries
+}
+
+//ReadDirAfter returns up to limit entries of dir whose names sort after the cursor, in name
+//order.  The name of the last entry is the cursor of the next call, an empty cursor starts
+//at the beginning and no entries are returned at the end.
+func (c *Cass) ReadDirAfter(dir string, after string, limit int) ([]fuse.DirEntry, error) {
+	var entries []fuse.DirEntry
+	var name string
+	var hash, metajson []byte
+	dirId, err := c.FindDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	iter := c.session.Query("SELECT name, hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name > ? LIMIT ?", c.OwnerId, c.Environment, dirId, after, limit).Iter()
+	for iter.Scan(&name, &hash, &metajson) {
+		meta := CassMetadata{}
+		err := json.Unmarshal(metajson, &meta)
+		if err != nil {
+			log.Println("Error decoding metadata for", name, ":", err)
+			continue
+		}
+		entry, err := c.resolveInode(&CassFsMetadata{Hash: hash, Metadata: meta})
+		if err != nil || entry.Metadata.Attr == nil {
+			log.Println("Error decoding metadata for", name, ":", err)
+			continue
+		}
+		entries = append(entries, fuse.DirEntry{Mode: entry.Metadata.Attr.Mode, Name: name})
+	}
+	return entries, iter.Close()
+}
@@ -0,0 +1,146 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"sort"
+	"strings"
+	"syscall"
+)
+
+//DirUsage is what the tree below a directory uses.  Logical is the sum of the sizes of the
+//files, Physical counts every chunk once however often it is referenced in the tree, which
+//is the data the tree keeps in the store.  Both are sizes before compression.
+type DirUsage struct {
+	Path     string
+	Files    int
+	Dirs     int
+	Logical  int64
+	Physical int64
+}
+
+//duDir collects the usage of a directory while the tree is walked
+type duDir struct {
+	usage  DirUsage
+	chunks map[string]int64
+}
+
+//Usage reports the usage of root and of every directory below it down to depth levels,
+//a negative depth lists every directory
+func (c *Cass) Usage(root string, depth int) ([]DirUsage, error) {
+	dirs := map[string]*duDir{root: &duDir{usage: DirUsage{Path: root}, chunks: make(map[string]int64)}}
+	err := c.Walk(root, func(path string, hash []byte, meta *CassMetadata) error {
+		d := dirs[parentPath(path)]
+		if d == nil {
+			return nil
+		}
+		if meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			d.usage.Dirs++
+			dirs[path] = &duDir{usage: DirUsage{Path: path}, chunks: make(map[string]int64)}
+			return nil
+		}
+		d.usage.Files++
+		if meta.Attr.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			return nil
+		}
+		d.usage.Logical += int64(meta.Attr.Size)
+		if len(meta.Chunks) == 0 {
+			if len(hash) > 0 {
+				d.chunks[string(hash)] = int64(meta.Attr.Size)
+			}
+			return nil
+		}
+		for idx, chunk := range meta.Chunks {
+			if !isHole(chunk) {
+				d.chunks[string(chunk)] = int64(chunkLen(int64(idx), meta.Attr.Size, meta.ChunkSize()))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	//The deepest directories are added to their parents first, so every directory holds
+	//the totals of its tree when it is added itself
+	paths := make([]string, 0, len(dirs))
+	for p := range dirs {
+		paths = append(paths, p)
+	}
+	sort.Sort(sort.Reverse(byDepth(paths)))
+	var usage []DirUsage
+	for _, p := range paths {
+		d := dirs[p]
+		for _, size := range d.chunks {
+			d.usage.Physical += size
+		}
+		if depth < 0 || pathDepth(root, p) <= depth {
+			usage = append(usage, d.usage)
+		}
+		if p == root {
+			continue
+		}
+		parent := dirs[parentPath(p)]
+		parent.usage.Files += d.usage.Files
+		parent.usage.Dirs += d.usage.Dirs
+		parent.usage.Logical += d.usage.Logical
+		for hash, size := range d.chunks {
+			parent.chunks[hash] = size
+		}
+		delete(dirs, p)
+	}
+	sort.Sort(usageByPath(usage))
+	return usage, nil
+}
+
+//pathDepth is the number of directories p is below root
+func pathDepth(root string, p string) int {
+	if p == root {
+		return 0
+	}
+	if root != "" {
+		p = strings.TrimPrefix(p, root+"/")
+	}
+	return strings.Count(p, "/") + 1
+}
+
+type byDepth []string
+
+func (s byDepth) Len() int      { return len(s) }
+func (s byDepth) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byDepth) Less(i, j int) bool {
+	di, dj := strings.Count(s[i], "/"), strings.Count(s[j], "/")
+	if s[i] == "" {
+		di = -1
+	}
+	if s[j] == "" {
+		dj = -1
+	}
+	if di != dj {
+		return di < dj
+	}
+	return s[i] < s[j]
+}
+
+type usageByPath []DirUsage
+
+func (s usageByPath) Len() int           { return len(s) }
+func (s usageByPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s usageByPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
@@ -0,0 +1,316 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+var ErrEnvExists = errors.New("Environment exists")
+var ErrHasClones = errors.New("Environment has copy-on-write clones")
+
+//ForEnvironment returns a store for another environment of the same owner that
+//shares the connection to the cluster
+func (c *Cass) ForEnvironment(env string) (*Cass, error) {
+	return c.ForOwner(c.OwnerId, env)
+}
+
+//ForOwner returns a store for any owner and environment that shares the connection to the cluster
+func (c *Cass) ForOwner(owner int64, env string) (*Cass, error) {
+	n := &Cass{
+		Host:           c.Host,
+		Port:           c.Port,
+		ProtoVersion:   c.ProtoVersion,
+		Keyspace:       c.Keyspace,
+		OwnerId:        owner,
+		Environment:    env,
+		Consistency:    c.Consistency,
+		CacheEnabled:   c.CacheEnabled,
+		CacheSize:      c.CacheSize,
+		FcacheDuration: c.FcacheDuration,
+		SymlinkDepth:   c.SymlinkDepth,
+		Compression:    c.Compression,
+		Hasher:         c.Hasher,
+		IsolatedBlobs:  c.IsolatedBlobs,
+		PublishChanges: c.PublishChanges,
+		Limiter:        c.Limiter,
+		Keys:           c.Keys,
+		VerifyData:     c.VerifyData,
+		BlockSize:      c.BlockSize,
+		HedgeDelay:     c.HedgeDelay,
+		LocalDC:        c.LocalDC,
+		Auth:           c.Auth,
+		ChunkWorkers:   c.ChunkWorkers,
+		origin:         c.origin,
+		cache:          c.cache,
+		cluster:        c.cluster,
+		session:        c.session,
+		MetaCacheSize:  c.MetaCacheSize,
+		fileCache:      newMetaCache(c.MetaCacheSize),
+		uuidCache:      make(map[string]string, 1024),
+		dirCache:       NewDirCache(c.FcacheDuration),
+	}
+	config, err := n.LoadEnvConfig()
+	if err != nil {
+		return nil, err
+	}
+	n.Config = config
+	return n, nil
+}
+
+//CloneEnvironment copies every entry of the environment into target.  The data is shared,
+//so only the metadata is copied and the data references are incremented.  When data is
+//isolated per owner and target belongs to another owner the data is copied as well.
+func (c *Cass) CloneEnvironment(target *Cass) (int, error) {
+	var dir, name string
+	var hash, meta []byte
+	count := 0
+	//The copies use the same features as the entries they come from
+	if err := c.copyFeatures(target); err != nil {
+		return count, err
+	}
+	iter := c.session.Query("SELECT directory, name, hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Iter()
+	for iter.Scan(&dir, &name, &hash, &meta) {
+		refs := decodeRefs(hash, meta)
+		err := c.copyBlobs(target, refs)
+		if err != nil {
+			log.Println("Unable to copy data for", name, ":", err)
+			iter.Close()
+			return count, err
+		}
+		err = target.session.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", target.OwnerId, target.Environment, dir, name, hash, meta).Consistency(target.Consistency).Exec()
+		if err != nil {
+			iter.Close()
+			return count, err
+		}
+		err = target.incrementRefs(refs)
+		if err != nil {
+			log.Println("Unable to add data reference for", name, ":", err)
+			iter.Close()
+			return count, err
+		}
+		count++
+	}
+	if err := iter.Close(); err != nil {
+		return count, err
+	}
+	if err := c.cloneInodes(target); err != nil {
+		return count, err
+	}
+	config := *c.Config
+	return count, target.SaveEnvConfig(&config)
+}
+
+//EnvironmentExists checks if the environment has entries or a configuration
+func (c *Cass) EnvironmentExists() (bool, error) {
+	var env string
+	err := c.session.Query("SELECT environment FROM envconfig WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Scan(&env)
+	if err == nil {
+		return true, nil
+	}
+	if err != gocql.ErrNotFound && !undefinedTable(err) {
+		return false, err
+	}
+	return c.HasChildren("")
+}
+
+//CreateEnvironment creates the empty environment of c with a root directory of mode owned
+//by owner.  The root is kept in the configuration, which is what makes the environment
+//exist before anything is stored in it.
+func (c *Cass) CreateEnvironment(mode uint32, owner fuse.Owner) error {
+	exists, err := c.EnvironmentExists()
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrEnvExists
+	}
+	now := time.Now()
+	root := &fuse.Attr{
+		Mode:  fuse.S_IFDIR | mode&07777,
+		Nlink: 2,
+		Owner: owner,
+	}
+	root.SetTimes(&now, &now, &now)
+	config := &EnvConfig{Root: root}
+	return c.SaveEnvConfig(config)
+}
+
+//DefaultCloneHistory is the history CloneShared records in a parent that did not record
+//any, the states its clones are pinned at are kept however old they are
+const DefaultCloneHistory = 24 * time.Hour
+
+//CloneShared makes target a copy-on-write clone of the environment as it is now.  Nothing
+//but the configuration is written, target is mounted as an overlay over this environment
+//read as of the time of the clone, so it starts out with every entry of it and only the
+//entries changed through it are stored in target.  The environment records its history
+//to serve that, and the recorded states hold references on their data, so later changes
+//to the environment neither show through nor free the data the clone shares.
+func (c *Cass) CloneShared(target *Cass) error {
+	config := *c.Config
+	if err := c.copyFeatures(target); err != nil {
+		return err
+	}
+	//Clients that do not know about parents would see an empty environment
+	if err := target.EnableFeature(FEATURE_PARENT, true); err != nil {
+		return err
+	}
+	if c.Config.Policy.History == 0 {
+		if err := c.EnableHistory(DefaultCloneHistory); err != nil {
+			return err
+		}
+	}
+	//The history of the environment is not the history of the clone, which starts out
+	//recording none
+	config.Policy.History = 0
+	config.Policy.HistorySince = time.Time{}
+	config.Parent = c.Environment
+	config.ParentAsOf = time.Now()
+	return target.SaveEnvConfig(&config)
+}
+
+//Layers opens the environments a copy-on-write clone is layered over, its parent first
+//and then the parent of that one, each read as of the time the layer above was cloned
+func (c *Cass) Layers() ([]*Cass, error) {
+	var layers []*Cass
+	seen := map[string]bool{c.Environment: true}
+	config := c.Config
+	for config.Parent != "" {
+		env := config.Parent
+		if seen[env] {
+			return nil, errors.New("Parents of " + c.Environment + " form a loop at " + env)
+		}
+		seen[env] = true
+		layer, err := c.ForEnvironment(env)
+		if err != nil {
+			return nil, err
+		}
+		//Clones made before they were pinned read their parent as it is now
+		layer.AsOf = config.ParentAsOf
+		layers = append(layers, layer)
+		config = layer.Config
+	}
+	return layers, nil
+}
+
+//Clones lists the copy-on-write clones whose parent is the environment
+func (c *Cass) Clones() ([]string, error) {
+	var clones []string
+	pins, err := c.clonePins()
+	for env := range pins {
+		clones = append(clones, env)
+	}
+	sort.Strings(clones)
+	return clones, err
+}
+
+//clonePins returns the time each copy-on-write clone of the environment reads it as of,
+//the zero time for clones that read it as it is now
+func (c *Cass) clonePins() (map[string]time.Time, error) {
+	var env string
+	var data []byte
+	pins := make(map[string]time.Time)
+	iter := c.session.Query("SELECT environment, config FROM envconfig WHERE cust_id = ?", c.OwnerId).Iter()
+	for iter.Scan(&env, &data) {
+		config := &EnvConfig{}
+		if len(data) > 0 && json.Unmarshal(data, config) == nil && config.Parent == c.Environment {
+			pins[env] = config.ParentAsOf
+		}
+	}
+	err := iter.Close()
+	if undefinedTable(err) {
+		//Keyspaces without configurations have no clones
+		return pins, nil
+	}
+	return pins, err
+}
+
+//envTables are the tables that hold a partition per environment.  The dirgen counters are
+//left in place since cassandra counters can not safely be reused once deleted, the locks
+//are partitioned by path and expire with their holders.  The audit log outlives the
+//environment and expires on its own.
+var envTables = []string{"filesystem", "inodes", "orphans", "dirtree", "manifests", "expirations", "invalidations", "client_metrics", "file_versions", "trash", "changelog"}
+
+//DeleteEnvironment removes every entry of the environment along with its configuration
+//and releases the data references the entries held.  The returned impact is computed
+//before anything is removed, with dryRun nothing else is done.
+func (c *Cass) DeleteEnvironment(dryRun bool) (*Impact, error) {
+	clones, err := c.Clones()
+	if err != nil {
+		return nil, err
+	}
+	if len(clones) > 0 {
+		//The clones read their unchanged entries and the data of them from this environment
+		return nil, ErrHasClones
+	}
+	impact, err := c.EnvironmentImpact()
+	if err != nil || dryRun {
+		return impact, err
+	}
+	var hash, meta []byte
+	for _, table := range []string{"filesystem", "inodes", "orphans", "file_versions", "trash"} {
+		iter := c.session.Query("SELECT hash, metadata FROM "+table+" WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Iter()
+		for iter.Scan(&hash, &meta) {
+			//Links hold no references themselves, the inode they point at does
+			err = c.decrementRefs(decodeRefs(hash, meta))
+			if err != nil {
+				log.Println("Unable to release data references:", err)
+				iter.Close()
+				return impact, err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return impact, err
+		}
+	}
+	//The history is partitioned by directory, each of them is dropped on its own
+	dirs, err := c.historyDirs()
+	if err != nil {
+		return impact, err
+	}
+	for _, dirId := range dirs {
+		refs, err := c.dropDirHistory(dirId)
+		if err == nil {
+			err = c.decrementRefs(refs)
+		}
+		if err != nil {
+			return impact, err
+		}
+	}
+	for _, table := range envTables {
+		err = c.session.Query("DELETE FROM "+table+" WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Consistency(c.Consistency).Exec()
+		if err != nil {
+			return impact, err
+		}
+	}
+	err = c.session.Query("DELETE FROM envconfig WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Consistency(c.Consistency).Exec()
+	if undefinedTable(err) {
+		err = nil
+	}
+	return impact, err
+}
@@ -0,0 +1,207 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//EnvDefaults are applied to every file and directory created in an environment
+type EnvDefaults struct {
+	FileMask uint32
+	DirMask  uint32
+	Owner    *fuse.Owner
+	XAttr    map[string]string
+	//BlockSize new files are split into, 0 is BLOBSIZE
+	BlockSize int64 `json:",omitempty"`
+	//Pipeline are the transforms new blocks go through, see pipeline.go
+	Pipeline []string `json:",omitempty"`
+	//InlineSize is the size up to which files are kept in their row, 0 does not inline
+	InlineSize int64 `json:",omitempty"`
+}
+
+//EnvPolicy limits what can be stored in an environment
+type EnvPolicy struct {
+	MaxFileSize uint64
+	DeniedNames []string
+	//History is how long the history of changes is kept, 0 when it is not recorded
+	History      time.Duration `json:",omitempty"`
+	HistorySince time.Time     `json:",omitempty"`
+	//Versions is the number of previous versions kept per file, see versions.go
+	Versions int `json:",omitempty"`
+	//VersionAge drops versions older than it however many are kept, see retention.go
+	VersionAge time.Duration `json:",omitempty"`
+	//ManifestAge drops signed manifests older than it, the latest one is kept
+	ManifestAge time.Duration `json:",omitempty"`
+	//Trash is how long deleted files are kept in the trash, 0 when they are removed, see trash.go
+	Trash time.Duration `json:",omitempty"`
+	//Changelog is how long changes are kept in the changelog, 0 when they are not recorded
+	Changelog time.Duration `json:",omitempty"`
+	//Audit is how long destructive operations are kept in the audit log, 0 when they are not recorded
+	Audit time.Duration `json:",omitempty"`
+}
+
+//EnvConfig is the per environment configuration stored in the envconfig table
+type EnvConfig struct {
+	Defaults  EnvDefaults
+	Policy    EnvPolicy
+	Lifecycle []LifecycleRule
+	//Root is the mode and owner of the root directory of an environment made with
+	//CreateEnvironment, mounts of other environments take them from the mount point
+	Root *fuse.Attr `json:",omitempty"`
+	//Parent is the environment of the same owner a copy-on-write clone is layered over,
+	//the clone only stores the entries that differ from it.  The parent is read as of
+	//ParentAsOf, the time of the clone.
+	Parent     string    `json:",omitempty"`
+	ParentAsOf time.Time `json:",omitempty"`
+}
+
+var ErrDenied = errors.New("Name is not allowed by the environment policy")
+var ErrTooLarge = errors.New("File is larger than the environment policy allows")
+
+//undefinedTable checks if err is cassandra refusing a query on a table the keyspace
+//does not have
+func undefinedTable(err error) bool {
+	reqErr, ok := err.(gocql.RequestError)
+	return ok && reqErr.Code() == gocql.ErrCodeInvalid && strings.Contains(reqErr.Message(), "unconfigured")
+}
+
+//LoadEnvConfig reads the configuration of the environment, an environment without
+//a configuration row gets an empty configuration.  So does every environment of a
+//keyspace created before the envconfig table, until the table is added.
+func (c *Cass) LoadEnvConfig() (*EnvConfig, error) {
+	var data []byte
+	config := &EnvConfig{}
+	err := c.session.Query("SELECT config FROM envconfig WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Scan(&data)
+	if err != nil {
+		if err == gocql.ErrNotFound || undefinedTable(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return config, nil
+	}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+//NewBlockSize returns the block size new files are written with
+func (c *Cass) NewBlockSize() int64 {
+	if c.BlockSize > 0 {
+		return c.BlockSize
+	}
+	if c.Config != nil && c.Config.Defaults.BlockSize > 0 {
+		return c.Config.Defaults.BlockSize
+	}
+	return BLOBSIZE
+}
+
+//inlines reports whether a file of size bytes is kept in its row instead of filedata.
+//Inline content is stored as it is, so environments whose blocks go through transforms
+//other than compression keep every file in filedata.
+func (c *Cass) inlines(size uint64) bool {
+	if c.Config == nil || size == 0 || size > uint64(c.Config.Defaults.InlineSize) {
+		return false
+	}
+	for _, name := range c.Pipeline() {
+		if name != "snappy" && name != "zstd" {
+			return false
+		}
+	}
+	return true
+}
+
+//SaveEnvConfig writes the configuration of the environment
+func (c *Cass) SaveEnvConfig(config *EnvConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	err = c.session.Query("INSERT INTO envconfig (cust_id, environment, config) VALUES(?, ?, ?)", c.OwnerId, c.Environment, data).Consistency(c.Consistency).Exec()
+	if err != nil {
+		return err
+	}
+	c.Config = config
+	return nil
+}
+
+//CheckName verifies that the file name is not denied by the environment policy
+func (c *Cass) CheckName(name string) error {
+	if c.Config == nil {
+		return nil
+	}
+	base := path.Base(name)
+	for _, pattern := range c.Config.Policy.DeniedNames {
+		if matched, _ := path.Match(pattern, base); matched {
+			return ErrDenied
+		}
+	}
+	return nil
+}
+
+//CheckSize verifies that a file of size bytes is allowed by the environment policy
+func (c *Cass) CheckSize(size uint64) error {
+	if c.Config == nil || c.Config.Policy.MaxFileSize == 0 {
+		return nil
+	}
+	if size > c.Config.Policy.MaxFileSize {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+//applyDefaults updates attr with the environment defaults and returns the extended attributes
+//a new entry should start with
+func (c *Cass) applyDefaults(attr *fuse.Attr) map[string]string {
+	if c.Config == nil {
+		return nil
+	}
+	defaults := c.Config.Defaults
+	switch attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		attr.Mode &^= defaults.FileMask & 07777
+	case syscall.S_IFDIR:
+		attr.Mode &^= defaults.DirMask & 07777
+	}
+	if defaults.Owner != nil {
+		attr.Owner = *defaults.Owner
+	}
+	if len(defaults.XAttr) == 0 {
+		return nil
+	}
+	xattr := make(map[string]string, len(defaults.XAttr))
+	for k, v := range defaults.XAttr {
+		xattr[k] = v
+	}
+	return xattr
+}
@@ -0,0 +1,107 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//ExpireReport holds the results of removing the files whose TTL has passed
+type ExpireReport struct {
+	Checked int
+	Expired []string
+	Errors  int
+}
+
+//SetExpiry schedules name to be removed by the reaper once ttl has passed
+func (c *Cass) SetExpiry(name string, ttl time.Duration) error {
+	_, err := c.GetFiledata(name)
+	if err != nil {
+		return err
+	}
+	return c.session.Query("INSERT INTO expirations (cust_id, environment, name, expires) VALUES(?, ?, ?, ?)", c.OwnerId, c.Environment, name, time.Now().Add(ttl)).Consistency(c.Consistency).Exec()
+}
+
+//GetExpiry returns the time name is scheduled to be removed
+func (c *Cass) GetExpiry(name string) (time.Time, error) {
+	var expires time.Time
+	err := c.session.Query("SELECT expires FROM expirations WHERE cust_id = ? AND environment = ? AND name = ?", c.OwnerId, c.Environment, name).Scan(&expires)
+	return expires, err
+}
+
+//ClearExpiry cancels the scheduled removal of name
+func (c *Cass) ClearExpiry(name string) error {
+	return c.session.Query("DELETE FROM expirations WHERE cust_id = ? AND environment = ? AND name = ?", c.OwnerId, c.Environment, name).Exec()
+}
+
+//moveExpiry keeps the schedule of a file that is renamed
+func (c *Cass) moveExpiry(oldName string, newName string) {
+	expires, err := c.GetExpiry(oldName)
+	if err != nil {
+		return
+	}
+	err = c.session.Query("INSERT INTO expirations (cust_id, environment, name, expires) VALUES(?, ?, ?, ?)", c.OwnerId, c.Environment, newName, expires).Exec()
+	if err != nil {
+		log.Println("Unable to move expiration of", oldName, ":", err)
+		return
+	}
+	c.ClearExpiry(oldName)
+}
+
+//ExpireFiles removes the files whose TTL has passed.  Entries for files that no longer
+//exist (e.g. removed or moved with their directory) are dropped from the index.
+func (c *Cass) ExpireFiles(dryRun bool) (*ExpireReport, error) {
+	var name string
+	var expires time.Time
+	var due []string
+	report := &ExpireReport{}
+	now := time.Now()
+	iter := c.session.Query("SELECT name, expires FROM expirations WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Iter()
+	for iter.Scan(&name, &expires) {
+		report.Checked++
+		if expires.Before(now) {
+			due = append(due, name)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	for _, name := range due {
+		if dryRun {
+			report.Expired = append(report.Expired, name)
+			continue
+		}
+		err := c.DeleteFile(name)
+		if err != nil && err != gocql.ErrNotFound {
+			log.Println("Unable to expire", name, ":", err)
+			report.Errors++
+			continue
+		}
+		if err == nil {
+			report.Expired = append(report.Expired, name)
+		}
+		c.ClearExpiry(name)
+	}
+	return report, nil
+}
@@ -0,0 +1,313 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cass
+
+import (
+	"archive/tar"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//Export streams a tree of the environment to an Exporter, which writes it to a local
+//directory or a tar stream.  Hard links are resolved, every link is exported as a file of
+//its own.
+
+//Exporter receives the entries of an export, parents always come before their contents
+type Exporter interface {
+	Dir(name string, meta *CassMetadata) error
+	File(name string, meta *CassMetadata, content io.Reader) error
+	Symlink(name string, meta *CassMetadata, target string) error
+	Close() error
+}
+
+//ExportReport holds the results of an export
+type ExportReport struct {
+	Dirs     int
+	Files    int
+	Symlinks int
+	Skipped  int
+	Bytes    int64
+	//Unchanged and Whiteouts are only counted for a layer exported over a base, see oci.go
+	Unchanged int
+	Whiteouts int
+}
+
+//Export writes the tree below root to exp with names relative to root
+func (c *Cass) Export(root string, exp Exporter, progress *Progress) (*ExportReport, error) {
+	report := &ExportReport{}
+	err := c.Walk(root, func(name string, hash []byte, meta *CassMetadata) error {
+		if root != "" {
+			name = strings.TrimPrefix(name, root+"/")
+		}
+		return c.exportEntry(exp, name, hash, meta, report, progress)
+	})
+	if err != nil {
+		exp.Close()
+		return report, err
+	}
+	return report, exp.Close()
+}
+
+//exportEntry writes a single entry to exp under name
+func (c *Cass) exportEntry(exp Exporter, name string, hash []byte, meta *CassMetadata, report *ExportReport, progress *Progress) error {
+	var err error
+	switch meta.Attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		err = exp.Dir(name, meta)
+		report.Dirs++
+	case syscall.S_IFLNK:
+		err = exp.Symlink(name, meta, meta.SymlinkTarget(hash))
+		report.Symlinks++
+	case syscall.S_IFREG:
+		err = exp.File(name, meta, c.contentReader(hash, meta))
+		report.Files++
+		report.Bytes += int64(meta.Attr.Size)
+		progress.Add(1, int64(meta.Attr.Size))
+	default:
+		log.Println("Skipping", name, "which is not a regular file, directory or symlink")
+		report.Skipped++
+	}
+	return err
+}
+
+//contentReader reads the content of a file one chunk at a time
+func (c *Cass) contentReader(hash []byte, meta *CassMetadata) io.Reader {
+	return &exportChunkReader{store: c, hash: hash, meta: meta, left: int64(meta.Attr.Size)}
+}
+
+type exportChunkReader struct {
+	store *Cass
+	hash  []byte
+	meta  *CassMetadata
+	next  int
+	buf   []byte
+	left  int64
+}
+
+func (r *exportChunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.left <= 0 {
+			return 0, io.EOF
+		}
+		var data []byte
+		var err error
+		switch {
+		case r.meta.Inline != nil:
+			if r.next > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			data = r.meta.Inline
+		case len(r.meta.Chunks) == 0:
+			//Files stored before chunking are a single blob
+			data, err = r.store.Read(r.hash)
+		case r.next >= len(r.meta.Chunks):
+			return 0, io.ErrUnexpectedEOF
+		case isHole(r.meta.Chunks[r.next]):
+			data = make([]byte, r.meta.ChunkSize())
+		default:
+			data, err = r.store.ReadChunk(r.meta.Chunks[r.next])
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.next++
+		if int64(len(data)) > r.left {
+			data = data[:r.left]
+		}
+		if len(data) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.left -= int64(len(data))
+		r.buf = data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func attrTimes(meta *CassMetadata) (time.Time, time.Time) {
+	attr := meta.Attr
+	return time.Unix(int64(attr.Atime), int64(attr.Atimensec)), time.Unix(int64(attr.Mtime), int64(attr.Mtimensec))
+}
+
+//DirExporter writes an export to a local directory.  Owners are only restored when
+//running as root, extended attributes when the local file system supports them.
+type DirExporter struct {
+	root  string
+	dirs  []string
+	metas []*CassMetadata
+}
+
+func NewDirExporter(root string) (*DirExporter, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &DirExporter{root: root}, nil
+}
+
+func (d *DirExporter) local(name string) string {
+	return filepath.Join(d.root, filepath.FromSlash(name))
+}
+
+//restore applies the owner, mode and extended attributes of meta to the local file
+func (d *DirExporter) restore(local string, meta *CassMetadata) error {
+	if os.Geteuid() == 0 {
+		err := os.Lchown(local, int(meta.Attr.Uid), int(meta.Attr.Gid))
+		if err != nil {
+			return err
+		}
+	}
+	if meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return nil
+	}
+	err := os.Chmod(local, os.FileMode(meta.Attr.Mode&0777))
+	if err != nil {
+		return err
+	}
+	for _, name := range meta.listXAttr() {
+		value, _ := meta.getXAttr(name)
+		err = syscall.Setxattr(local, name, value, 0)
+		if err != nil && err != syscall.ENOTSUP && err != syscall.EPERM {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DirExporter) Dir(name string, meta *CassMetadata) error {
+	local := d.local(name)
+	err := os.MkdirAll(local, 0700)
+	if err != nil {
+		return err
+	}
+	//Modes and times of directories are set at the end, writing the files in them would
+	//change the times and a read only mode would keep them from being written
+	d.dirs = append(d.dirs, local)
+	d.metas = append(d.metas, meta)
+	return nil
+}
+
+func (d *DirExporter) File(name string, meta *CassMetadata, content io.Reader) error {
+	local := d.local(name)
+	f, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = d.restore(local, meta)
+	if err != nil {
+		return err
+	}
+	atime, mtime := attrTimes(meta)
+	return os.Chtimes(local, atime, mtime)
+}
+
+func (d *DirExporter) Symlink(name string, meta *CassMetadata, target string) error {
+	local := d.local(name)
+	os.Remove(local)
+	err := os.Symlink(target, local)
+	if err != nil {
+		return err
+	}
+	return d.restore(local, meta)
+}
+
+func (d *DirExporter) Close() error {
+	for i := len(d.dirs) - 1; i >= 0; i-- {
+		err := d.restore(d.dirs[i], d.metas[i])
+		if err != nil {
+			return err
+		}
+		atime, mtime := attrTimes(d.metas[i])
+		err = os.Chtimes(d.dirs[i], atime, mtime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//TarExporter writes an export as a tar stream, extended attributes are kept as PAX records
+type TarExporter struct {
+	w *tar.Writer
+}
+
+func NewTarExporter(w io.Writer) *TarExporter {
+	return &TarExporter{w: tar.NewWriter(w)}
+}
+
+func (t *TarExporter) header(name string, meta *CassMetadata, typ byte) *tar.Header {
+	atime, mtime := attrTimes(meta)
+	hdr := &tar.Header{
+		Name:       name,
+		Mode:       int64(meta.Attr.Mode & 07777),
+		Uid:        int(meta.Attr.Uid),
+		Gid:        int(meta.Attr.Gid),
+		ModTime:    mtime,
+		AccessTime: atime,
+		Typeflag:   typ,
+	}
+	names := meta.listXAttr()
+	if len(names) > 0 {
+		hdr.Xattrs = make(map[string]string, len(names))
+		for _, name := range names {
+			value, _ := meta.getXAttr(name)
+			hdr.Xattrs[name] = string(value)
+		}
+	}
+	return hdr
+}
+
+func (t *TarExporter) Dir(name string, meta *CassMetadata) error {
+	return t.w.WriteHeader(t.header(name+"/", meta, tar.TypeDir))
+}
+
+func (t *TarExporter) File(name string, meta *CassMetadata, content io.Reader) error {
+	hdr := t.header(name, meta, tar.TypeReg)
+	hdr.Size = int64(meta.Attr.Size)
+	err := t.w.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t.w, content)
+	return err
+}
+
+func (t *TarExporter) Symlink(name string, meta *CassMetadata, target string) error {
+	hdr := t.header(name, meta, tar.TypeSymlink)
+	hdr.Linkname = target
+	return t.w.WriteHeader(hdr)
+}
+
+func (t *TarExporter) Close() error {
+	return t.w.Close()
+}
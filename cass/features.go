@@ -0,0 +1,214 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+//Features of the stored format that not every client understands.  A feature is recorded
+//in the environment the first time it is used.
+const (
+	FEATURE_COMPRESSION = "compression"
+	FEATURE_BLAKE3      = "blake3"
+	FEATURE_OWNER_BLOBS = "owner-blobs"
+	FEATURE_HARDLINKS   = "hardlinks"
+	FEATURE_SPARSE      = "sparse"
+	FEATURE_BLOCK_SIZE  = "block-size"
+	FEATURE_HISTORY     = "history"
+	FEATURE_ENCRYPTION  = "encryption"
+	FEATURE_PARENT      = "parent"
+	FEATURE_INLINE      = "inline"
+	FEATURE_ZSTD        = "zstd"
+)
+
+//KnownFeatures are the features this client understands
+var KnownFeatures = map[string]bool{
+	FEATURE_COMPRESSION: true,
+	FEATURE_BLAKE3:      true,
+	FEATURE_OWNER_BLOBS: true,
+	FEATURE_HARDLINKS:   true,
+	FEATURE_SPARSE:      true,
+	FEATURE_BLOCK_SIZE:  true,
+	FEATURE_HISTORY:     true,
+	FEATURE_ENCRYPTION:  true,
+	FEATURE_PARENT:      true,
+	FEATURE_INLINE:      true,
+	FEATURE_ZSTD:        true,
+}
+
+var ErrUnknownFeature = errors.New("Environment uses features this client does not support")
+
+//EnvFeatures are the features in use in an environment.  They are kept in their own
+//columns of the envconfig row so a client that rewrites the configuration can not drop them.
+type EnvFeatures struct {
+	Enabled []string
+	//Required features have to be understood by a client to change the environment
+	Required []string
+}
+
+func (f *EnvFeatures) has(list []string, name string) bool {
+	for _, n := range list {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+//Unknown returns the required features this client does not understand
+func (f *EnvFeatures) Unknown() []string {
+	var unknown []string
+	for _, name := range f.Required {
+		if !KnownFeatures[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown
+}
+
+//LoadFeatures reads the features of the environment
+func (c *Cass) LoadFeatures() (*EnvFeatures, error) {
+	f := &EnvFeatures{}
+	err := c.session.Query("SELECT features, required_features FROM envconfig WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Consistency(c.Consistency).Scan(&f.Enabled, &f.Required)
+	if err != nil && err != gocql.ErrNotFound && !undefinedTable(err) {
+		return nil, err
+	}
+	sort.Strings(f.Enabled)
+	sort.Strings(f.Required)
+	return f, nil
+}
+
+//CheckFeatures refuses a client that would change an environment using a required
+//feature it does not understand, reading is still allowed
+func (c *Cass) CheckFeatures(readOnly bool) error {
+	f, err := c.LoadFeatures()
+	if err != nil {
+		return err
+	}
+	c.featureLock.Lock()
+	c.features = f
+	c.featureLock.Unlock()
+	for _, name := range f.Enabled {
+		if !KnownFeatures[name] && !f.has(f.Required, name) {
+			log.Println("Environment uses the unknown optional feature", name)
+		}
+	}
+	if readOnly {
+		return nil
+	}
+	if unknown := f.Unknown(); len(unknown) > 0 {
+		log.Println("Unknown required features:", strings.Join(unknown, ", "))
+		return ErrUnknownFeature
+	}
+	c.useConfiguredFeatures()
+	return nil
+}
+
+//EnableFeature records that the environment uses a feature, a required feature keeps
+//clients that do not know it from changing the environment
+func (c *Cass) EnableFeature(name string, required bool) error {
+	var err error
+	if required {
+		err = c.session.Query("UPDATE envconfig SET features = features + ?, required_features = required_features + ? WHERE cust_id = ? AND environment = ?", []string{name}, []string{name}, c.OwnerId, c.Environment).Consistency(c.Consistency).Exec()
+	} else {
+		err = c.session.Query("UPDATE envconfig SET features = features + ?, required_features = required_features - ? WHERE cust_id = ? AND environment = ?", []string{name}, []string{name}, c.OwnerId, c.Environment).Consistency(c.Consistency).Exec()
+	}
+	if err != nil {
+		return err
+	}
+	c.featureLock.Lock()
+	c.features = nil
+	c.featureLock.Unlock()
+	return nil
+}
+
+//DisableFeature removes a feature from the environment, it is up to the caller to make
+//sure nothing stored uses it anymore
+func (c *Cass) DisableFeature(name string) error {
+	err := c.session.Query("UPDATE envconfig SET features = features - ?, required_features = required_features - ? WHERE cust_id = ? AND environment = ?", []string{name}, []string{name}, c.OwnerId, c.Environment).Consistency(c.Consistency).Exec()
+	if err != nil {
+		return err
+	}
+	c.featureLock.Lock()
+	c.features = nil
+	c.featureLock.Unlock()
+	return nil
+}
+
+//useFeature records a required feature the first time this client stores data using it
+func (c *Cass) useFeature(name string) {
+	c.featureLock.Lock()
+	defer c.featureLock.Unlock()
+	if c.features == nil {
+		f, err := c.LoadFeatures()
+		if err != nil {
+			log.Println("Unable to read the features of the environment:", err)
+			return
+		}
+		c.features = f
+	}
+	if c.features.has(c.features.Required, name) {
+		return
+	}
+	err := c.session.Query("UPDATE envconfig SET features = features + ?, required_features = required_features + ? WHERE cust_id = ? AND environment = ?", []string{name}, []string{name}, c.OwnerId, c.Environment).Consistency(c.Consistency).Exec()
+	if err != nil {
+		log.Println("Unable to record the use of", name, ":", err)
+		return
+	}
+	c.features.Enabled = append(c.features.Enabled, name)
+	c.features.Required = append(c.features.Required, name)
+}
+
+//useConfiguredFeatures records the features the configuration of this client writes with
+func (c *Cass) useConfiguredFeatures() {
+	for _, name := range c.Pipeline() {
+		if t, err := lookupTransform(name); err == nil {
+			c.useFeature(t.feature)
+		}
+	}
+	if c.Hasher != nil && c.Hasher.Name() == "blake3" {
+		c.useFeature(FEATURE_BLAKE3)
+	}
+	if c.IsolatedBlobs {
+		c.useFeature(FEATURE_OWNER_BLOBS)
+	}
+}
+
+//copyFeatures records the features of c in target, used when entries are copied
+func (c *Cass) copyFeatures(target *Cass) error {
+	f, err := c.LoadFeatures()
+	if err != nil {
+		return err
+	}
+	for _, name := range f.Enabled {
+		err = target.EnableFeature(name, f.has(f.Required, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//Seconds a change stays in the invalidation feed, clients that fall further behind
+//than this only catch up as their caches expire
+const FEED_TTL = 3600
+
+//How far back every poll of the feed reaches to cover clock differences between clients
+const FEED_OVERLAP = 5 * time.Second
+
+//Change is an entry of the invalidation feed
+type Change struct {
+	Id   gocql.UUID
+	Path string
+}
+
+//publish records changes to paths in the invalidation feed so other clients drop their
+//cached copies.  Failing to publish only delays other clients so errors are just logged.
+func (c *Cass) publish(paths ...string) {
+	for _, p := range paths {
+		c.AdaptiveTTL.Changed(p)
+		c.recordHistory(p)
+	}
+	if !c.PublishChanges || c.session == nil {
+		return
+	}
+	for _, p := range paths {
+		err := c.session.Query("INSERT INTO invalidations (cust_id, environment, id, path, origin) VALUES(?, ?, ?, ?, ?) USING TTL ?", c.OwnerId, c.Environment, gocql.TimeUUID(), p, c.origin, FEED_TTL).Exec()
+		if err != nil {
+			log.Println("Unable to publish change to", p, ":", err)
+		}
+	}
+}
+
+//Changes returns the changes other clients have published since the given time
+func (c *Cass) Changes(since time.Time) ([]Change, error) {
+	var changes []Change
+	var id gocql.UUID
+	var path, origin string
+	iter := c.session.Query("SELECT id, path, origin FROM invalidations WHERE cust_id = ? AND environment = ? AND id > minTimeuuid(?)", c.OwnerId, c.Environment, since).Iter()
+	for iter.Scan(&id, &path, &origin) {
+		if origin == c.origin {
+			continue
+		}
+		changes = append(changes, Change{Id: id, Path: path})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+//WatchChanges polls the invalidation feed every interval and invalidates the paths other
+//clients changed, both in the store and in the kernel.  It never returns.
+func (c *CassFs) WatchChanges(interval time.Duration) {
+	seen := make(map[gocql.UUID]time.Time)
+	last := time.Now()
+	for {
+		time.Sleep(interval)
+		start := time.Now()
+		changes, err := c.store.Changes(last.Add(-FEED_OVERLAP))
+		if err != nil {
+			log.Println("Unable to read the invalidation feed:", err)
+			continue
+		}
+		for _, change := range changes {
+			if _, ok := seen[change.Id]; ok {
+				continue
+			}
+			seen[change.Id] = change.Id.Time()
+			c.store.AdaptiveTTL.Changed(change.Path)
+			if status := c.Invalidate(change.Path); status != fuse.OK {
+				log.Println("Unable to invalidate", change.Path, ":", status)
+			}
+		}
+		//Only the changes that the next poll can return again need to be remembered
+		for id, t := range seen {
+			if t.Before(start.Add(-2 * FEED_OVERLAP)) {
+				delete(seen, id)
+			}
+		}
+		last = start
+	}
+}
@@ -0,0 +1,400 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bytes"
+)
+
+//chunkLen returns the length of chunk idx in a file of size bytes split into chunks of blockSize
+func chunkLen(idx int64, size uint64, blockSize int64) int {
+	start := uint64(idx) * uint64(blockSize)
+	if start >= size {
+		return 0
+	}
+	if size-start > uint64(blockSize) {
+		return int(blockSize)
+	}
+	return int(size - start)
+}
+
+//numChunks returns the number of chunks of blockSize a file of size bytes is stored in
+func numChunks(size uint64, blockSize int64) int64 {
+	return int64((size + uint64(blockSize) - 1) / uint64(blockSize))
+}
+
+//blockSize returns the size of the chunks of the file
+func (f *CassFileData) blockSize() int64 {
+	if f.BlockSize > 0 {
+		return f.BlockSize
+	}
+	return BLOBSIZE
+}
+
+//setData replaces the content of the file with data, this is used for files that were
+//stored before chunk manifests and have to be read as a whole
+func (f *CassFileData) setData(data []byte) {
+	bs := int(f.blockSize())
+	f.dirty = make(map[int64][]byte)
+	for start := 0; start < len(data); start += bs {
+		end := start + bs
+		if end > len(data) {
+			end = len(data)
+		}
+		f.dirty[int64(start/bs)] = append([]byte{}, data[start:end]...)
+	}
+	f.Attr.Size = uint64(len(data))
+}
+
+//chunk returns the current content of chunk idx, reading it from the store if it has not
+//been changed.  The returned slice can be shorter than the chunk, the rest is zeros.
+func (f *CassFileData) chunk(idx int64, cache *chunkCache) ([]byte, error) {
+	if data, ok := f.dirty[idx]; ok {
+		return data, nil
+	}
+	if idx >= int64(len(f.Chunks)) {
+		return nil, nil
+	}
+	if idx == 0 && f.Inline != nil {
+		return f.Inline, nil
+	}
+	hash := f.Chunks[idx]
+	if isHole(hash) {
+		return nil, nil
+	}
+	if cache != nil {
+		if data, ok := cache.get(hash); ok {
+			return data, nil
+		}
+	}
+	data, err := f.Fs.store.ReadChunk(hash)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		cache.put(hash, data)
+	}
+	return data, nil
+}
+
+//materialize makes chunk idx part of the dirty set sized to its length in the current file size
+func (f *CassFileData) materialize(idx int64) ([]byte, error) {
+	length := chunkLen(idx, f.Attr.Size, f.blockSize())
+	data, err := f.chunk(idx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.dirty[idx]; ok && len(data) == length {
+		return data, nil
+	}
+	buf := make([]byte, length)
+	copy(buf, data)
+	if f.dirty == nil {
+		f.dirty = make(map[int64][]byte)
+	}
+	f.dirty[idx] = buf
+	return buf, nil
+}
+
+//grow extends the file to size, the chunk that used to be the last one is padded
+//with zeros so every chunk but the last is always complete
+func (f *CassFileData) grow(size uint64) error {
+	old := f.Attr.Size
+	bs := uint64(f.blockSize())
+	f.Attr.Size = size
+	if old%bs != 0 {
+		_, err := f.materialize(int64(old / bs))
+		return err
+	}
+	return nil
+}
+
+//ReadAt returns up to length bytes of the file starting at off
+func (f *CassFileData) ReadAt(off int64, length int, cache *chunkCache) ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+	size := int64(f.Attr.Size)
+	if off < 0 || off >= size || length <= 0 {
+		return []byte{}, nil
+	}
+	if off+int64(length) > size {
+		length = int(size - off)
+	}
+	bs := f.blockSize()
+	out := make([]byte, 0, length)
+	for len(out) < length {
+		pos := off + int64(len(out))
+		idx := pos / bs
+		data, err := f.chunk(idx, cache)
+		if err != nil {
+			return nil, err
+		}
+		skip := int(pos % bs)
+		end := skip + length - len(out)
+		if clen := chunkLen(idx, f.Attr.Size, bs); end > clen {
+			end = clen
+		}
+		seg := make([]byte, end-skip)
+		if skip < len(data) {
+			copy(seg, data[skip:])
+		}
+		out = append(out, seg...)
+	}
+	return out, nil
+}
+
+//WriteAt writes data at off, only the chunks that are touched are read and changed
+func (f *CassFileData) WriteAt(data []byte, off int64) error {
+	f.Lock()
+	defer f.Unlock()
+	end := uint64(off) + uint64(len(data))
+	if end > f.Attr.Size {
+		if err := f.grow(end); err != nil {
+			return err
+		}
+	}
+	bs := f.blockSize()
+	written := 0
+	for written < len(data) {
+		pos := off + int64(written)
+		buf, err := f.materialize(pos / bs)
+		if err != nil {
+			return err
+		}
+		written += copy(buf[pos%bs:], data[written:])
+	}
+	f.Dirty = true
+	return nil
+}
+
+//Truncate changes the size of the file
+func (f *CassFileData) Truncate(size uint64) error {
+	f.Lock()
+	defer f.Unlock()
+	f.Dirty = true
+	if size >= f.Attr.Size {
+		return f.grow(size)
+	}
+	if !f.trimmed {
+		//The stored entry keeps its references until the file is saved
+		f.held = f.storedRefs()
+		f.trimmed = true
+	}
+	f.Attr.Size = size
+	bs := f.blockSize()
+	last := numChunks(size, bs)
+	for idx := range f.dirty {
+		if idx >= last {
+			delete(f.dirty, idx)
+		}
+	}
+	//The new last chunk is cut at the new size and inline content is moved to the
+	//dirty set, nothing past the end can come back when the file grows again
+	if size%uint64(bs) != 0 || (f.Inline != nil && last > 0) {
+		if _, err := f.materialize(last - 1); err != nil {
+			return err
+		}
+	}
+	if int64(len(f.Chunks)) > last {
+		f.Chunks = f.Chunks[:last]
+	}
+	f.Inline = nil
+	return nil
+}
+
+//storedRefs returns the data references held by the stored entry of the file
+func (f *CassFileData) storedRefs() [][]byte {
+	if f.trimmed {
+		return f.held
+	}
+	return dataRefs(f.Hash, &CassMetadata{Attr: f.Attr, Chunks: f.Chunks, Inline: f.Inline})
+}
+
+//stored records that chunks and inline are the content of the stored entry
+func (f *CassFileData) stored(chunks [][]byte, inline []byte) {
+	f.Chunks = chunks
+	f.Inline = inline
+	f.dirty = nil
+	f.held = nil
+	f.trimmed = false
+}
+
+//metadata returns the metadata stored for the file with the chunk list chunks
+func (f *CassFileData) metadata(chunks [][]byte, inline []byte) CassMetadata {
+	return CassMetadata{
+		Attr:        f.Attr,
+		XAttr:       f.XAttr,
+		XAttrBinary: f.XAttrBinary,
+		Chunks:      chunks,
+		BlockSize:   storedBlockSize(f.blockSize()),
+		Inline:      inline,
+	}
+}
+
+//content returns the chunk list of the file and its content when the file is kept inline,
+//the chunks of a file that is not are written to the store
+func (f *CassFileData) content(c *Cass) ([][]byte, []byte, error) {
+	inline, err := f.inlineData(c)
+	if err != nil || inline == nil {
+		chunks, err := f.manifest(c)
+		return chunks, nil, err
+	}
+	c.useFeature(FEATURE_INLINE)
+	f.Attr.Blocks = (f.Attr.Size + 511) / 512
+	return [][]byte{c.hash(inline)}, inline, nil
+}
+
+//inlineData returns the content of the file if it is small enough to be kept in its row
+func (f *CassFileData) inlineData(c *Cass) ([]byte, error) {
+	if !c.inlines(f.Attr.Size) || numChunks(f.Attr.Size, f.blockSize()) != 1 {
+		return nil, nil
+	}
+	data, err := f.chunk(0, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, f.Attr.Size)
+	copy(buf, data)
+	if isZero(buf) {
+		//A hole takes even less space
+		return nil, nil
+	}
+	return buf, nil
+}
+
+//manifest writes the changed chunks to the store and returns the chunk list of the file
+func (f *CassFileData) manifest(c *Cass) ([][]byte, error) {
+	bs := f.blockSize()
+	if bs != BLOBSIZE {
+		c.useFeature(FEATURE_BLOCK_SIZE)
+	}
+	n := numChunks(f.Attr.Size, bs)
+	chunks := make([][]byte, 0, n)
+	//The changed chunks are written once the list is known so they can go in parallel
+	var writes []int64
+	for idx := int64(0); idx < n; idx++ {
+		data, ok := f.dirty[idx]
+		if !ok && idx == 0 && f.Inline != nil {
+			data, ok = f.Inline, true
+		}
+		if !ok && idx < int64(len(f.Chunks)) {
+			chunks = append(chunks, f.Chunks[idx])
+			continue
+		}
+		if !ok || isZero(data) {
+			//A hole left by extending the file or a chunk of zeros, it takes no space
+			c.useFeature(FEATURE_SPARSE)
+			chunks = append(chunks, nil)
+			continue
+		}
+		hash := c.hash(data)
+		//Content that was inline has never been in the store as a chunk
+		if (idx == 0 && f.Inline != nil) || idx >= int64(len(f.Chunks)) || !bytes.Equal(f.Chunks[idx], hash) {
+			writes = append(writes, idx)
+		}
+		chunks = append(chunks, hash)
+	}
+	err := c.forChunks(len(writes), func(i int) error {
+		idx := writes[i]
+		data, ok := f.dirty[idx]
+		if !ok {
+			data = f.Inline
+		}
+		return c.writeChunk(chunks[idx], data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	//Holes take no space
+	var used uint64
+	for idx, hash := range chunks {
+		if !isHole(hash) {
+			used += uint64(chunkLen(int64(idx), f.Attr.Size, bs))
+		}
+	}
+	f.Attr.Blocks = (used + 511) / 512
+	return chunks, nil
+}
+
+//isZero reports whether data only holds zeros
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//Allocate makes room for size bytes at off.  Space is not reserved, the file is only
+//extended (unless keepSize is set) and the new range is a hole until it is written.
+func (f *CassFileData) Allocate(off uint64, size uint64, keepSize bool) error {
+	f.Lock()
+	defer f.Unlock()
+	end := off + size
+	if keepSize || end <= f.Attr.Size {
+		return nil
+	}
+	f.Dirty = true
+	return f.grow(end)
+}
+
+//PunchHole zeros size bytes at off without changing the size of the file, the chunks that
+//are completely covered become holes
+func (f *CassFileData) PunchHole(off uint64, size uint64) error {
+	f.Lock()
+	defer f.Unlock()
+	end := off + size
+	if end > f.Attr.Size {
+		end = f.Attr.Size
+	}
+	if off >= end {
+		return nil
+	}
+	if f.dirty == nil {
+		f.dirty = make(map[int64][]byte)
+	}
+	bs := f.blockSize()
+	for pos := off; pos < end; {
+		idx := int64(pos / uint64(bs))
+		start := pos % uint64(bs)
+		clen := uint64(chunkLen(idx, f.Attr.Size, bs))
+		stop := clen
+		if rest := end - pos + start; rest < stop {
+			stop = rest
+		}
+		if start == 0 && stop == clen {
+			//An empty chunk reads as zeros and is stored as a hole
+			f.dirty[idx] = []byte{}
+		} else {
+			buf, err := f.materialize(idx)
+			if err != nil {
+				return err
+			}
+			for i := start; i < stop; i++ {
+				buf[i] = 0
+			}
+		}
+		pos += stop - start
+	}
+	f.Dirty = true
+	return nil
+}
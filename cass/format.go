@@ -0,0 +1,181 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//Versions of the format of the stored metadata and data
+// 1 - whole file content, the layout before the format was recorded
+// 2 - chunked content, hard link inodes, sparse holes and directory trees
+const (
+	FORMAT_VERSION = 2
+	//FORMAT_MIN_VERSION is the oldest recorded format this binary can read
+	FORMAT_MIN_VERSION = 1
+	//FORMAT_LEGACY is assumed for a keyspace without a recorded format
+	FORMAT_LEGACY = 1
+)
+
+//formatMinimum is the oldest binary format that can change data written in a format
+//without corrupting it
+var formatMinimum = map[int]int{
+	1: 1,
+	2: 2,
+}
+
+var ErrFormatTooNew = errors.New("The stored data format is newer than this binary supports")
+var ErrFormatTooOld = errors.New("The stored data format is older than this binary writes, run cassfs format upgrade once every client is updated")
+var ErrFormatChanged = errors.New("The stored data format was changed by another client")
+var ErrFormatDowngrade = errors.New("The stored data can not be downgraded to that format")
+
+//Format is the data format recorded in the keyspace
+type Format struct {
+	Version int
+	//MinVersion is the oldest binary format that may change the data
+	MinVersion int
+	Updated    time.Time
+	//Recorded is false for a keyspace that predates the format record
+	Recorded bool
+}
+
+func (f *Format) String() string {
+	if !f.Recorded {
+		return fmt.Sprintf("version %d (not recorded)", f.Version)
+	}
+	return fmt.Sprintf("version %d, requires %d or newer, updated %s", f.Version, f.MinVersion, f.Updated.Format(time.RFC3339))
+}
+
+//LoadFormat reads the data format of the keyspace
+func (c *Cass) LoadFormat() (*Format, error) {
+	f := &Format{Recorded: true}
+	err := c.session.Query("SELECT version, min_version, updated FROM format WHERE name = ?", "cassfs").Consistency(gocql.Quorum).Scan(&f.Version, &f.MinVersion, &f.Updated)
+	if err == gocql.ErrNotFound {
+		return &Format{Version: FORMAT_LEGACY, MinVersion: formatMinimum[FORMAT_LEGACY]}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//CheckFormat refuses a binary that can not safely use the stored data.  A newer format
+//is only used when it allows this binary to change it, an older format is only read
+//until it is upgraded.  A keyspace without a recorded format gets the current format
+//when it is first used read-write.
+func (c *Cass) CheckFormat(readOnly bool) error {
+	f, err := c.LoadFormat()
+	if err != nil {
+		return err
+	}
+	if f.Version < FORMAT_MIN_VERSION {
+		log.Println("Data format", f.Version, "is older than the oldest supported format", FORMAT_MIN_VERSION)
+		return ErrFormatTooOld
+	}
+	if f.MinVersion > FORMAT_VERSION {
+		log.Println("Data format", f.Version, "requires format", f.MinVersion, "this binary writes format", FORMAT_VERSION)
+		return ErrFormatTooNew
+	}
+	if readOnly {
+		return nil
+	}
+	if !f.Recorded {
+		log.Println("Recording data format", FORMAT_VERSION)
+		return c.recordFormat(nil, FORMAT_VERSION)
+	}
+	if f.Version < FORMAT_VERSION {
+		log.Println("Data format", f.Version, "is older than format", FORMAT_VERSION, "written by this binary")
+		return ErrFormatTooOld
+	}
+	if f.Version > FORMAT_VERSION {
+		log.Println("Data format", f.Version, "is newer than format", FORMAT_VERSION, "but allows this binary to change it")
+	}
+	return nil
+}
+
+//UpgradeFormat records the format written by this binary, older binaries can no longer
+//change the data afterwards
+func (c *Cass) UpgradeFormat() (*Format, error) {
+	f, err := c.LoadFormat()
+	if err != nil {
+		return nil, err
+	}
+	if f.Version > FORMAT_VERSION {
+		return nil, ErrFormatTooNew
+	}
+	if f.Recorded && f.Version == FORMAT_VERSION {
+		return f, nil
+	}
+	err = c.recordFormat(f, FORMAT_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	return c.LoadFormat()
+}
+
+//DowngradeFormat records an older format so binaries writing it can be used again, it
+//is refused when the data already needs a newer format
+func (c *Cass) DowngradeFormat(version int) (*Format, error) {
+	f, err := c.LoadFormat()
+	if err != nil {
+		return nil, err
+	}
+	if f.Version > FORMAT_VERSION {
+		return nil, ErrFormatTooNew
+	}
+	if version > f.Version || version < FORMAT_MIN_VERSION || f.MinVersion > version {
+		return nil, ErrFormatDowngrade
+	}
+	err = c.recordFormat(f, version)
+	if err != nil {
+		return nil, err
+	}
+	return c.LoadFormat()
+}
+
+//recordFormat changes the recorded format from old (nil when none is recorded), the data
+//written so far keeps the minimum format it needs
+func (c *Cass) recordFormat(old *Format, version int) error {
+	var query *gocql.Query
+	now := time.Now()
+	min := formatMinimum[version]
+	if old == nil || !old.Recorded {
+		query = c.session.Query("INSERT INTO format (name, version, min_version, updated) VALUES('cassfs', ?, ?, ?) IF NOT EXISTS", version, min, now)
+	} else {
+		if old.MinVersion > min {
+			min = old.MinVersion
+		}
+		query = c.session.Query("UPDATE format SET version = ?, min_version = ?, updated = ? WHERE name = 'cassfs' IF version = ? AND min_version = ?", version, min, now, old.Version, old.MinVersion)
+	}
+	applied, err := query.Consistency(gocql.Quorum).SerialConsistency(gocql.Serial).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return ErrFormatChanged
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"log"
+	"syscall"
+)
+
+//FsckReport holds the results of checking an environment
+type FsckReport struct {
+	Checked     int
+	EmptyHashes int
+	OldSymlinks int
+	Repaired    int
+	Errors      int
+}
+
+//scanEnvironment calls fn for every entry stored in the environment
+func (c *Cass) scanEnvironment(fn func(dir string, name string, hash []byte, meta *CassMetadata) error) error {
+	var dir, name string
+	var hash, metajson []byte
+	iter := c.session.Query("SELECT directory, name, hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Iter()
+	for iter.Scan(&dir, &name, &hash, &metajson) {
+		meta := &CassMetadata{}
+		err := json.Unmarshal(metajson, meta)
+		if err != nil {
+			log.Println("Error decoding metadata for", name, ":", err)
+			continue
+		}
+		err = fn(dir, name, hash, meta)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+//repairSymlink moves the target of a symbolic link from the hash into the metadata
+func (c *Cass) repairSymlink(dir string, name string, hash []byte, meta *CassMetadata, report *FsckReport) {
+	meta.Target = string(hash)
+	metajson, err := json.Marshal(meta)
+	if err == nil {
+		err = c.session.Query("UPDATE filesystem SET hash = null, metadata = ? WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", metajson, c.OwnerId, c.Environment, dir, name).Consistency(c.Consistency).Exec()
+	}
+	if err != nil {
+		log.Println("Unable to repair", name, ":", err)
+		report.Errors++
+		return
+	}
+	//Older links took a reference on the target as if it was data
+	c.decrementDataRef(hash)
+	c.dirChanged(dir)
+	report.Repaired++
+}
+
+//Fsck checks the entries in the environment for problems, if repair is set the problems are fixed
+func (c *Cass) Fsck(repair bool) (*FsckReport, error) {
+	report := &FsckReport{}
+	err := c.scanEnvironment(func(dir string, name string, hash []byte, meta *CassMetadata) error {
+		report.Checked++
+		if meta.Attr != nil && meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFLNK && meta.Target == "" {
+			report.OldSymlinks++
+			if repair {
+				c.repairSymlink(dir, name, hash, meta, report)
+			}
+			return nil
+		}
+		if meta.Attr == nil || meta.Attr.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			return nil
+		}
+		//Empty files are stored without a hash, older rows reference the hash of no data
+		if len(hash) > 0 && IsEmptyHash(hash) {
+			report.EmptyHashes++
+			if !repair {
+				return nil
+			}
+			err := c.session.Query("UPDATE filesystem SET hash = null WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, name).Consistency(c.Consistency).Exec()
+			if err != nil {
+				log.Println("Unable to repair", name, ":", err)
+				report.Errors++
+				return nil
+			}
+			c.decrementDataRef(hash)
+			c.dirChanged(dir)
+			report.Repaired++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,328 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//GC_CHECKPOINT is the number of entries scanned between checkpoints of a garbage collection
+const GC_CHECKPOINT = 1000
+
+//The phases of a garbage collection
+const (
+	GC_SWEEP = iota
+	GC_MARK
+)
+
+//GCReport holds the results of a garbage collection run
+type GCReport struct {
+	Scanned int
+	Marked  int
+	Deleted int
+	Errors  int
+	//Bytes is the stored size of the data a dry run would delete
+	Bytes int64
+	//Survived counts candidates that were referenced again before they were swept
+	Survived int
+}
+
+//GCCheckpoint is the position of a garbage collection run, a run that was interrupted
+//continues after the last entry it recorded
+type GCCheckpoint struct {
+	Started time.Time
+	Phase   int
+	Owner   int64
+	Hash    []byte
+	Report  GCReport
+}
+
+//GCOptions controls a garbage collection run
+type GCOptions struct {
+	Grace  time.Duration
+	DryRun bool
+	//Resume continues the run the checkpoint was taken from
+	Resume *GCCheckpoint
+	//Checkpoint is called with the position of the run every GC_CHECKPOINT entries
+	Checkpoint func(*GCCheckpoint)
+	//Progress counts the entries scanned
+	Progress *Progress
+}
+
+//gcScan iterates over owner, hash and (for candidates) the time they were marked in either
+//the shared or the per owner tables
+type gcScan struct {
+	iter     *gocql.Iter
+	isolated bool
+	marked   bool
+}
+
+//scanTable scans the columns of table in token order.  When after is set the scan starts
+//after the entry of owner and after, so a run can pick up where an earlier one stopped.
+func (c *Cass) scanTable(table string, columns string, owner int64, after []byte) *gocql.Iter {
+	if after == nil {
+		return c.session.Query("SELECT " + columns + " FROM " + table).Iter()
+	}
+	if c.IsolatedBlobs {
+		return c.session.Query("SELECT "+columns+" FROM "+table+" WHERE token(cust_id, hash) > token(?, ?)", owner, after).Iter()
+	}
+	return c.session.Query("SELECT "+columns+" FROM "+table+" WHERE token(hash) > token(?)", after).Iter()
+}
+
+func (c *Cass) scanCandidates(owner int64, after []byte) *gcScan {
+	if c.IsolatedBlobs {
+		return &gcScan{iter: c.scanTable("owner_gc_candidates", "cust_id, hash, marked", owner, after), isolated: true, marked: true}
+	}
+	return &gcScan{iter: c.scanTable("gc_candidates", "hash, marked", owner, after), marked: true}
+}
+
+func (c *Cass) scanBlobs(owner int64, after []byte) *gcScan {
+	if c.IsolatedBlobs {
+		return &gcScan{iter: c.scanTable("owner_filedata", "cust_id, hash", owner, after), isolated: true}
+	}
+	return &gcScan{iter: c.scanTable("filedata", "hash", owner, after)}
+}
+
+func (s *gcScan) Scan(owner *int64, hash *[]byte, marked *time.Time) bool {
+	switch {
+	case s.isolated && s.marked:
+		return s.iter.Scan(owner, hash, marked)
+	case s.isolated:
+		return s.iter.Scan(owner, hash)
+	case s.marked:
+		return s.iter.Scan(hash, marked)
+	}
+	return s.iter.Scan(hash)
+}
+
+//mark records hash as unreferenced unless it already is
+func (c *Cass) mark(owner int64, hash []byte, now time.Time) error {
+	//IF NOT EXISTS keeps the time of the first mark
+	if c.IsolatedBlobs {
+		return c.session.Query("INSERT INTO owner_gc_candidates (cust_id, hash, marked) VALUES(?, ?, ?) IF NOT EXISTS", owner, hash, now).Exec()
+	}
+	return c.session.Query("INSERT INTO gc_candidates (hash, marked) VALUES(?, ?) IF NOT EXISTS", hash, now).Exec()
+}
+
+//unmark removes hash from the candidates
+func (c *Cass) unmark(owner int64, hash []byte) error {
+	if c.IsolatedBlobs {
+		return c.session.Query("DELETE FROM owner_gc_candidates WHERE cust_id = ? AND hash = ? IF EXISTS", owner, hash).Exec()
+	}
+	return c.session.Query("DELETE FROM gc_candidates WHERE hash = ? IF EXISTS", hash).Exec()
+}
+
+//claim records that the sweep started at is deleting the data of hash, unless a writer
+//touched the candidate since it was marked
+func (c *Cass) claim(owner int64, hash []byte, marked time.Time, at time.Time) (bool, error) {
+	var current time.Time
+	if c.IsolatedBlobs {
+		return c.session.Query("UPDATE owner_gc_candidates SET sweeping = ? WHERE cust_id = ? AND hash = ? IF marked = ?", at, owner, hash, marked).ScanCAS(&current)
+	}
+	return c.session.Query("UPDATE gc_candidates SET sweeping = ? WHERE hash = ? IF marked = ?", at, hash, marked).ScanCAS(&current)
+}
+
+//touch gives a candidate that is referenced again a new grace period.  It returns true when
+//a sweep claimed the candidate first, the data has to be written again then.
+func (c *Cass) touch(owner int64, hash []byte) (bool, error) {
+	var marked, sweeping time.Time
+	var err error
+	//Quorum reads see every committed mark and claim, a claim that is still running is
+	//caught by the condition of the update
+	if c.IsolatedBlobs {
+		err = c.session.Query("SELECT marked, sweeping FROM owner_gc_candidates WHERE cust_id = ? AND hash = ?", owner, hash).Consistency(gocql.Quorum).Scan(&marked, &sweeping)
+	} else {
+		err = c.session.Query("SELECT marked, sweeping FROM gc_candidates WHERE hash = ?", hash).Consistency(gocql.Quorum).Scan(&marked, &sweeping)
+	}
+	if err == gocql.ErrNotFound {
+		//Not a candidate, a later mark gives the new reference a full grace period
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !sweeping.IsZero() {
+		return true, nil
+	}
+	var applied bool
+	var current, claimed time.Time
+	if c.IsolatedBlobs {
+		applied, err = c.session.Query("UPDATE owner_gc_candidates SET marked = ? WHERE cust_id = ? AND hash = ? IF marked = ? AND sweeping = null", time.Now(), owner, hash, marked).ScanCAS(&current, &claimed)
+	} else {
+		applied, err = c.session.Query("UPDATE gc_candidates SET marked = ? WHERE hash = ? IF marked = ? AND sweeping = null", time.Now(), hash, marked).ScanCAS(&current, &claimed)
+	}
+	if err != nil {
+		return false, err
+	}
+	//Losing the race means a sweep claimed it or another writer touched it, writing the
+	//data again is safe either way
+	return !applied, nil
+}
+
+//GarbageCollect removes data that is no longer referenced.  The mark phase records every
+//unreferenced hash in gc_candidates, the sweep deletes the data of candidates that were
+//marked more than grace ago and are still unreferenced.  The grace period covers writers
+//that have stored a chunk but not yet taken the reference on it.  Writers that find the
+//data already stored touch its candidate, which starts the grace period again, and the
+//sweep only deletes data whose candidate it claimed with an LWT.  A writer that sees the
+//claim writes the data again, the sweep deletes with the time of its claim so the newer
+//write survives.  The reference counters
+//themselves are left in place since cassandra counters can not safely be reused once deleted.
+func (c *Cass) GarbageCollect(grace time.Duration, dryRun bool) (*GCReport, error) {
+	return c.RunGC(&GCOptions{Grace: grace, DryRun: dryRun})
+}
+
+//RunGC is GarbageCollect with checkpoints.  A run resumed from a checkpoint skips the
+//entries that were already handled and keeps the time the run was started at.
+func (c *Cass) RunGC(opts *GCOptions) (*GCReport, error) {
+	var owner int64
+	var hash []byte
+	var marked time.Time
+	cp := &GCCheckpoint{Started: time.Now(), Phase: GC_SWEEP}
+	if opts.Resume != nil {
+		cp = opts.Resume
+	}
+	report := &cp.Report
+	now := cp.Started
+	count := 0
+	//handled records hash as the last entry of the current phase that is done
+	handled := func(owner int64, hash []byte) {
+		opts.Progress.Add(1, 0)
+		cp.Owner = owner
+		cp.Hash = append([]byte{}, hash...)
+		count++
+		if opts.Checkpoint != nil && count%GC_CHECKPOINT == 0 {
+			opts.Checkpoint(cp)
+		}
+	}
+
+	//Sweep the candidates from earlier runs first so new marks always get a full grace period
+	if cp.Phase == GC_SWEEP {
+		scan := c.scanCandidates(cp.Owner, cp.Hash)
+		for scan.Scan(&owner, &hash, &marked) {
+			c.sweep(owner, hash, marked, now, opts, report)
+			handled(owner, hash)
+		}
+		if err := scan.iter.Close(); err != nil {
+			return nil, err
+		}
+		cp.Phase = GC_MARK
+		cp.Owner = 0
+		cp.Hash = nil
+		if opts.Checkpoint != nil {
+			opts.Checkpoint(cp)
+		}
+	}
+
+	//Mark everything that is currently unreferenced
+	scan := c.scanBlobs(cp.Owner, cp.Hash)
+	for scan.Scan(&owner, &hash, &marked) {
+		c.markUnreferenced(owner, hash, now, opts, report)
+		handled(owner, hash)
+	}
+	if err := scan.iter.Close(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+//markUnreferenced marks the data for hash as a candidate if it has no references
+func (c *Cass) markUnreferenced(owner int64, hash []byte, now time.Time, opts *GCOptions, report *GCReport) {
+	report.Scanned++
+	refs, err := c.blobRefCount(owner, hash)
+	if err != nil {
+		log.Println("Unable to read references:", err)
+		report.Errors++
+		return
+	}
+	if refs > 0 {
+		return
+	}
+	report.Marked++
+	if opts.DryRun {
+		return
+	}
+	err = c.mark(owner, hash, now)
+	if err != nil {
+		log.Println("Unable to mark data:", err)
+		report.Errors++
+	}
+}
+
+//sweep deletes the data of a candidate that was marked more than the grace period before
+//now and is still unreferenced
+func (c *Cass) sweep(owner int64, hash []byte, marked time.Time, now time.Time, opts *GCOptions, report *GCReport) {
+	if now.Sub(marked) < opts.Grace {
+		return
+	}
+	refs, err := c.blobRefCount(owner, hash)
+	if err != nil {
+		log.Println("Unable to read references:", err)
+		report.Errors++
+		return
+	}
+	if refs > 0 {
+		report.Survived++
+	}
+	if opts.DryRun {
+		if refs <= 0 {
+			report.Deleted++
+			report.Bytes += c.blobSize(owner, hash)
+		}
+		return
+	}
+	if refs <= 0 {
+		at := time.Now()
+		claimed, err := c.claim(owner, hash, marked, at)
+		if err != nil {
+			log.Println("Unable to claim data:", err)
+			report.Errors++
+			return
+		}
+		if !claimed {
+			//A writer reused the data, its candidate waits for the next run
+			report.Survived++
+			return
+		}
+		//A reference taken before the claim has to be seen now
+		refs, err = c.blobRefCount(owner, hash)
+		if err != nil {
+			log.Println("Unable to read references:", err)
+			report.Errors++
+			return
+		}
+		if refs > 0 {
+			report.Survived++
+		} else {
+			err = c.deleteBlob(owner, hash, at)
+			if err != nil {
+				log.Println("Unable to delete data:", err)
+				report.Errors++
+				return
+			}
+			report.Deleted++
+		}
+	}
+	c.unmark(owner, hash)
+}
@@ -0,0 +1,392 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//A file with more than one name keeps its hash and metadata in the inodes table and each
+//of its directory entries only holds the id of the inode.  The data references belong to
+//the inode, so they are only released when the last link is removed.  Every change of an
+//inode is a conditional update on the metadata it read, so clients linking and unlinking
+//the same file at once never lose a change of the link count.
+
+//INODE_RETRIES is how often a change of an inode is tried again after other clients changed it first
+const INODE_RETRIES = 20
+
+var ErrExists = errors.New("File exists")
+var ErrLinkDir = errors.New("Hard links to directories are not allowed")
+var ErrInodeBusy = errors.New("The inode kept being changed by other clients")
+
+//inodeEntry returns the metadata a directory entry points at when the entry is a link
+func inodeEntry(id string) ([]byte, error) {
+	return json.Marshal(CassMetadata{Inode: id})
+}
+
+//readInode reads the content of the inode id
+func (c *Cass) readInode(id string) ([]byte, CassMetadata, error) {
+	var hash, metajson []byte
+	var meta CassMetadata
+	uuid, err := gocql.ParseUUID(id)
+	if err != nil {
+		return nil, meta, err
+	}
+	err = c.session.Query("SELECT hash, metadata FROM inodes WHERE cust_id = ? AND environment = ? AND id = ?", c.OwnerId, c.Environment, uuid).Scan(&hash, &metajson)
+	if err != nil {
+		return nil, meta, err
+	}
+	err = json.Unmarshal(metajson, &meta)
+	if err != nil {
+		return nil, meta, err
+	}
+	meta.Inode = id
+	return hash, meta, nil
+}
+
+//updateInode applies change to the content of the inode id.  change returns the new hash
+//and metadata, nil metadata removes the inode.  It is called again with the current content
+//whenever another client changed the inode in between.
+func (c *Cass) updateInode(id string, change func(hash []byte, meta *CassMetadata) ([]byte, *CassMetadata, error)) error {
+	uuid, err := gocql.ParseUUID(id)
+	if err != nil {
+		return err
+	}
+	defer c.forgetInode(id)
+	for try := 0; try < INODE_RETRIES; try++ {
+		var hash, current []byte
+		err = c.session.Query("SELECT hash, metadata FROM inodes WHERE cust_id = ? AND environment = ? AND id = ?", c.OwnerId, c.Environment, uuid).Consistency(gocql.Consistency(gocql.Serial)).Scan(&hash, &current)
+		if err != nil {
+			return err
+		}
+		meta := &CassMetadata{}
+		if err = json.Unmarshal(current, meta); err != nil {
+			return err
+		}
+		hash, meta, err = change(hash, meta)
+		if err != nil {
+			return err
+		}
+		var query *gocql.Query
+		if meta == nil {
+			query = c.session.Query("DELETE FROM inodes WHERE cust_id = ? AND environment = ? AND id = ? IF metadata = ?", c.OwnerId, c.Environment, uuid, current)
+		} else {
+			metajson, err := json.Marshal(meta)
+			if err != nil {
+				return err
+			}
+			query = c.session.Query("UPDATE inodes SET hash = ?, metadata = ? WHERE cust_id = ? AND environment = ? AND id = ? IF metadata = ?", hash, metajson, c.OwnerId, c.Environment, uuid, current)
+		}
+		applied, err := query.SerialConsistency(gocql.Serial).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+		if applied {
+			return nil
+		}
+	}
+	return ErrInodeBusy
+}
+
+//keepLinks returns update with the link count of current, which only Link and unlinkInode change
+func keepLinks(update CassMetadata, current *CassMetadata) *CassMetadata {
+	if update.Attr != nil && current.Attr != nil {
+		attr := *update.Attr
+		attr.Nlink = current.Attr.Nlink
+		update.Attr = &attr
+	}
+	return &update
+}
+
+//writeInode stores the content of the inode id
+func (c *Cass) writeInode(id string, hash []byte, meta []byte) error {
+	update := CassMetadata{}
+	if err := json.Unmarshal(meta, &update); err != nil {
+		return err
+	}
+	return c.updateInode(id, func(_ []byte, current *CassMetadata) ([]byte, *CassMetadata, error) {
+		return hash, keepLinks(update, current), nil
+	})
+}
+
+//forgetInode drops every cached name of the inode id, so all of the links see a change
+//made through one of them
+func (c *Cass) forgetInode(id string) {
+	c.fileCache.removeIf(func(name string, entry *CassFsMetadata) bool {
+		return entry.Metadata.Inode == id
+	})
+}
+
+//writeInodeMetadata stores only the metadata of the inode id
+func (c *Cass) writeInodeMetadata(id string, meta []byte) error {
+	update := CassMetadata{}
+	if err := json.Unmarshal(meta, &update); err != nil {
+		return err
+	}
+	return c.updateInode(id, func(hash []byte, current *CassMetadata) ([]byte, *CassMetadata, error) {
+		return hash, keepLinks(update, current), nil
+	})
+}
+
+//linkedInode returns the inode an encoded directory entry points at, if any
+func linkedInode(metajson []byte) string {
+	meta := &CassMetadata{}
+	if json.Unmarshal(metajson, meta) != nil {
+		return ""
+	}
+	return meta.Inode
+}
+
+//resolveInode returns the content of entry, following the link if entry points at an inode
+func (c *Cass) resolveInode(entry *CassFsMetadata) (*CassFsMetadata, error) {
+	if entry.Metadata.Inode == "" || entry.Metadata.Attr != nil {
+		return entry, nil
+	}
+	hash, meta, err := c.readInode(entry.Metadata.Inode)
+	if err != nil {
+		return nil, err
+	}
+	return &CassFsMetadata{
+		Metadata:  meta,
+		Hash:      hash,
+		Timestamp: time.Now().Unix(),
+	}, nil
+}
+
+//Link adds newName as another name of the file orig and returns the id of the inode the
+//two share.  The first link moves the content of orig into a new inode.
+func (c *Cass) Link(orig string, newName string) (string, error) {
+	var hash, metajson []byte
+	err := c.CheckName(newName)
+	if err != nil {
+		return "", err
+	}
+	c.useFeature(FEATURE_HARDLINKS)
+	dir, file := c.splitPath(orig)
+	newDir, newFile := c.splitPath(newName)
+	var id string
+	done := false
+	for try := 0; try < INODE_RETRIES && !done; try++ {
+		err = c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Consistency(gocql.Consistency(gocql.Serial)).Scan(&hash, &metajson)
+		if err != nil {
+			return "", err
+		}
+		meta := CassMetadata{}
+		err = json.Unmarshal(metajson, &meta)
+		if err != nil {
+			return "", err
+		}
+		if meta.Inode != "" {
+			id = meta.Inode
+			done, err = c.addLink(id, newDir, newFile, metajson)
+		} else {
+			if meta.Attr == nil || meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+				return "", ErrLinkDir
+			}
+			id, done, err = c.firstLink(dir, file, newDir, newFile, hash, metajson, meta)
+		}
+		if err != nil {
+			return "", err
+		}
+		//When orig changed in between it is linked again as it is now
+	}
+	if !done {
+		return "", ErrInodeBusy
+	}
+	c.invalidateMetadata(orig)
+	c.forgetInode(id)
+	c.dirChanged(dir)
+	c.dirChanged(newDir)
+	c.publish(orig, newName)
+	c.logChange(CHANGE_CREATE, newName)
+	return id, nil
+}
+
+//firstLink moves the content of the entry dir/file into a new inode shared with the new
+//entry newDir/newFile.  Both entries change in one conditional batch, it is not applied
+//when the new name exists (ErrExists) or the entry changed since metajson was read (false).
+func (c *Cass) firstLink(dir, file, newDir, newFile string, hash []byte, metajson []byte, meta CassMetadata) (string, bool, error) {
+	uuid := gocql.TimeUUID()
+	id := uuid.String()
+	meta.Attr.Nlink = 2
+	inode, err := json.Marshal(meta)
+	if err != nil {
+		return "", false, err
+	}
+	link, err := inodeEntry(id)
+	if err != nil {
+		return "", false, err
+	}
+	err = c.session.Query("INSERT INTO inodes (cust_id, environment, id, hash, metadata) VALUES(?, ?, ?, ?, ?)", c.OwnerId, c.Environment, uuid, hash, inode).Consistency(c.Consistency).Exec()
+	if err != nil {
+		return "", false, err
+	}
+	//The directory entries of an environment are in one partition, so they can change together
+	batch := gocql.NewBatch(gocql.LoggedBatch)
+	batch.Cons = c.Consistency
+	batch.Query("UPDATE filesystem SET hash = null, metadata = ? WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ? IF metadata = ?", link, c.OwnerId, c.Environment, dir, file, metajson)
+	batch.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?) IF NOT EXISTS", c.OwnerId, c.Environment, newDir, newFile, nil, link)
+	applied, iter, err := c.session.ExecuteBatchCAS(batch)
+	if iter != nil {
+		iter.Close()
+	}
+	if err == nil && applied {
+		return id, true, nil
+	}
+	//The inode was never linked, nothing else knows about it
+	c.session.Query("DELETE FROM inodes WHERE cust_id = ? AND environment = ? AND id = ?", c.OwnerId, c.Environment, uuid).Exec()
+	if err != nil {
+		return "", false, err
+	}
+	if c.entryExists(newDir, newFile) {
+		return "", false, ErrExists
+	}
+	return "", false, nil
+}
+
+//addLink adds the entry newDir/newFile pointing at the inode id, link is the entry of an
+//existing name
+func (c *Cass) addLink(id string, newDir, newFile string, link []byte) (bool, error) {
+	applied, err := c.session.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?) IF NOT EXISTS", c.OwnerId, c.Environment, newDir, newFile, nil, link).SerialConsistency(gocql.Serial).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, err
+	}
+	if !applied {
+		return false, ErrExists
+	}
+	err = c.updateInode(id, func(hash []byte, meta *CassMetadata) ([]byte, *CassMetadata, error) {
+		meta.Attr.Nlink++
+		return hash, meta, nil
+	})
+	if err == gocql.ErrNotFound {
+		//The last other name was removed in between, the entry is linked again as it is now
+		c.session.Query("DELETE FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ? IF metadata = ?", c.OwnerId, c.Environment, newDir, newFile, link).SerialConsistency(gocql.Serial).MapScanCAS(map[string]interface{}{})
+		return false, nil
+	}
+	if err != nil {
+		c.session.Query("DELETE FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ? IF metadata = ?", c.OwnerId, c.Environment, newDir, newFile, link).SerialConsistency(gocql.Serial).MapScanCAS(map[string]interface{}{})
+		return false, err
+	}
+	return true, nil
+}
+
+//entryExists reports whether the entry dir/file exists
+func (c *Cass) entryExists(dir, file string) bool {
+	var hash []byte
+	err := c.session.Query("SELECT hash FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Consistency(gocql.Consistency(gocql.Serial)).Scan(&hash)
+	return err == nil
+}
+
+//unlinkInode removes a link from the inode id.  When it was the last link the inode is
+//removed as well and its hash and metadata are returned, so the caller can release the data.
+func (c *Cass) unlinkInode(id string) (bool, []byte, []byte, error) {
+	var last bool
+	var lastHash []byte
+	var lastMeta CassMetadata
+	err := c.updateInode(id, func(hash []byte, meta *CassMetadata) ([]byte, *CassMetadata, error) {
+		if meta.Attr != nil && meta.Attr.Nlink > 1 {
+			meta.Attr.Nlink--
+			last = false
+			return hash, meta, nil
+		}
+		last, lastHash, lastMeta = true, hash, *meta
+		return nil, nil, nil
+	})
+	if err != nil || !last {
+		return false, nil, nil, err
+	}
+	lastMeta.Inode = ""
+	if lastMeta.Attr != nil {
+		lastMeta.Attr.Nlink = 1
+	}
+	metajson, err := json.Marshal(lastMeta)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	return true, lastHash, metajson, nil
+}
+
+//releaseEntry drops the data held by a directory entry that was removed or replaced
+func (c *Cass) releaseEntry(hash []byte, metajson []byte) error {
+	if id := linkedInode(metajson); id != "" {
+		last, hash, metajson, err := c.unlinkInode(id)
+		if err != nil || !last {
+			return err
+		}
+		return c.decrementRefs(decodeRefs(hash, metajson))
+	}
+	return c.decrementRefs(decodeRefs(hash, metajson))
+}
+
+//orphanLink removes the name of a linked file that is still open.  The inode only turns
+//into an orphan when this was its last link, otherwise the other names keep the data and
+//no orphan id is returned.
+func (c *Cass) orphanLink(name string, inode string) (string, error) {
+	dir, file := c.splitPath(name)
+	err := c.session.Query("DELETE FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Consistency(c.Consistency).Exec()
+	if err != nil {
+		return "", err
+	}
+	c.dirChanged(dir)
+	c.invalidateMetadata(name)
+	c.ClearExpiry(name)
+	c.publish(name)
+	c.logChange(CHANGE_DELETE, name)
+	last, hash, meta, err := c.unlinkInode(inode)
+	if err != nil || !last {
+		return "", err
+	}
+	id := gocql.TimeUUID()
+	err = c.session.Query("INSERT INTO orphans (cust_id, environment, id, hash, metadata) VALUES(?, ?, ?, ?, ?)", c.OwnerId, c.Environment, id, hash, meta).Consistency(c.Consistency).Exec()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+//cloneInodes copies the inodes of the environment into target along with references on their data
+func (c *Cass) cloneInodes(target *Cass) error {
+	var id gocql.UUID
+	var hash, meta []byte
+	iter := c.session.Query("SELECT id, hash, metadata FROM inodes WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Iter()
+	for iter.Scan(&id, &hash, &meta) {
+		refs := decodeRefs(hash, meta)
+		err := c.copyBlobs(target, refs)
+		if err == nil {
+			err = target.session.Query("INSERT INTO inodes (cust_id, environment, id, hash, metadata) VALUES(?, ?, ?, ?, ?)", target.OwnerId, target.Environment, id, hash, meta).Consistency(target.Consistency).Exec()
+		}
+		if err == nil {
+			err = target.incrementRefs(refs)
+		}
+		if err != nil {
+			log.Println("Unable to copy inode", id, ":", err)
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
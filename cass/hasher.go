@@ -0,0 +1,105 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+
+	"lukechampine.com/blake3"
+)
+
+//Hasher computes the hashes data is stored under.  Every hash other than the original
+//SHA-512 starts with the id of its algorithm so hashes of different algorithms can be
+//stored side by side while data is migrated.
+type Hasher interface {
+	Name() string
+	Sum(data []byte) []byte
+}
+
+//Ids of the hash algorithms, SHA-512 hashes carry no id to stay compatible with existing data
+const (
+	HASH_SHA512 = 0
+	HASH_BLAKE3 = 1
+)
+
+//BLAKE3_SIZE is the length of a BLAKE3 sum without its id
+const BLAKE3_SIZE = 32
+
+type sha512Hasher struct{}
+
+func (h sha512Hasher) Name() string { return "sha512" }
+
+func (h sha512Hasher) Sum(data []byte) []byte {
+	return ShaSum(data)
+}
+
+type blake3Hasher struct{}
+
+func (h blake3Hasher) Name() string { return "blake3" }
+
+func (h blake3Hasher) Sum(data []byte) []byte {
+	sum := blake3.Sum256(data)
+	return append([]byte{HASH_BLAKE3}, sum[:]...)
+}
+
+//DefaultHasher is the algorithm used when none is configured
+var DefaultHasher Hasher = sha512Hasher{}
+
+//ParseHasher returns the hasher for the name of an algorithm
+func ParseHasher(name string) (Hasher, error) {
+	switch name {
+	case "", "sha512":
+		return sha512Hasher{}, nil
+	case "blake3":
+		return blake3Hasher{}, nil
+	}
+	return nil, fmt.Errorf("Unsupported hash algorithm: %s", name)
+}
+
+//HashAlgorithm returns the name of the algorithm that produced hash
+func HashAlgorithm(hash []byte) string {
+	if len(hash) == sha512.Size {
+		return "sha512"
+	}
+	if len(hash) == 1+BLAKE3_SIZE && hash[0] == HASH_BLAKE3 {
+		return "blake3"
+	}
+	return "unknown"
+}
+
+//matchesHash reports whether data hashes to hash with the algorithm hash was made with
+func matchesHash(hash []byte, data []byte) bool {
+	hasher, err := ParseHasher(HashAlgorithm(hash))
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(hasher.Sum(data), hash)
+}
+
+//hash computes the hash of data with the configured algorithm
+func (c *Cass) hash(data []byte) []byte {
+	if c.Hasher == nil {
+		return DefaultHasher.Sum(data)
+	}
+	return c.Hasher.Sum(data)
+}
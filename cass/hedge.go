@@ -0,0 +1,88 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cass
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//A read that has not returned after HedgeDelay is sent a second time.  The second request
+//goes through the host selection again, so it is coordinated by another node, and the
+//first answer wins.  This cuts the tail latency caused by a single slow node at the cost
+//of some extra reads.
+
+//HedgeStats counts the hedged reads of a store
+type HedgeStats struct {
+	//Reads is the number of reads that could be hedged, Hedged the ones that were sent
+	//twice and Won the ones where the second request answered first
+	Reads  uint64
+	Hedged uint64
+	Won    uint64
+}
+
+type hedgeResult struct {
+	value  interface{}
+	err    error
+	second bool
+}
+
+//HedgeStats returns the counters of the hedged reads
+func (c *Cass) HedgeStats() HedgeStats {
+	return HedgeStats{
+		Reads:  atomic.LoadUint64(&c.hedgeStats.Reads),
+		Hedged: atomic.LoadUint64(&c.hedgeStats.Hedged),
+		Won:    atomic.LoadUint64(&c.hedgeStats.Won),
+	}
+}
+
+//hedge runs read and runs it again when it takes longer than HedgeDelay.  A missing row is
+//an answer, any other error waits for the other request.
+func (c *Cass) hedge(read func() (interface{}, error)) (interface{}, error) {
+	if c.HedgeDelay <= 0 {
+		return read()
+	}
+	atomic.AddUint64(&c.hedgeStats.Reads, 1)
+	results := make(chan hedgeResult, 2)
+	run := func(second bool) {
+		value, err := read()
+		results <- hedgeResult{value: value, err: err, second: second}
+	}
+	go run(false)
+	timer := time.NewTimer(c.HedgeDelay)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.value, r.err
+	case <-timer.C:
+	}
+	atomic.AddUint64(&c.hedgeStats.Hedged, 1)
+	go run(true)
+	r := <-results
+	if r.err != nil && r.err != gocql.ErrNotFound {
+		r = <-results
+	}
+	if r.second && (r.err == nil || r.err == gocql.ErrNotFound) {
+		atomic.AddUint64(&c.hedgeStats.Won, 1)
+	}
+	return r.value, r.err
+}
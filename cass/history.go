@@ -0,0 +1,468 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cass
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//With history enabled every change to a directory entry also stores the new state of the
+//entry in the history table, keyed by the time of the change.  A client with AsOf set
+//reads the environment as it was at that time from those rows.  A state holds references
+//on the data it had, like a version does, so gc keeps the data of every state that can
+//still be read.  The references are released when the state is pruned, by the client that
+//records the next change of the entry or by the reaper, or with the environment.  States
+//recorded before the held column was added hold none and are dropped without releasing.
+
+var ErrNoHistory = errors.New("History is not recorded for the requested time")
+
+//EnableHistory starts recording the history of the environment and keeps it for retention.
+//Every current entry is recorded so the state at the time history starts can be read.
+func (c *Cass) EnableHistory(retention time.Duration) error {
+	config := *c.Config
+	since := config.Policy.HistorySince
+	config.Policy.History = retention
+	if config.Policy.HistorySince.IsZero() {
+		config.Policy.HistorySince = time.Now()
+	}
+	err := c.EnableFeature(FEATURE_HISTORY, true)
+	if err != nil {
+		return err
+	}
+	err = c.SaveEnvConfig(&config)
+	if err != nil {
+		return err
+	}
+	if !since.IsZero() {
+		return nil
+	}
+	return c.Walk("", func(path string, hash []byte, meta *CassMetadata) error {
+		dir, file := c.splitPath(path)
+		state := *meta
+		state.Inode = ""
+		return c.insertHistory(dir, file, hash, &state, false)
+	})
+}
+
+//DisableHistory stops recording history and drops the recorded history, which can no
+//longer be read, along with the data references it held.  The history of an environment
+//with copy-on-write clones is what they read, it is kept while they exist.
+func (c *Cass) DisableHistory() error {
+	pins, err := c.clonePins()
+	if err != nil {
+		return err
+	}
+	for _, pin := range pins {
+		if !pin.IsZero() {
+			return ErrHasClones
+		}
+	}
+	config := *c.Config
+	config.Policy.History = 0
+	config.Policy.HistorySince = time.Time{}
+	err = c.SaveEnvConfig(&config)
+	if err != nil {
+		return err
+	}
+	err = c.DisableFeature(FEATURE_HISTORY)
+	if err != nil {
+		return err
+	}
+	dirs, err := c.historyDirs()
+	if err != nil {
+		return err
+	}
+	for _, dirId := range dirs {
+		refs, err := c.dropDirHistory(dirId)
+		if err == nil {
+			err = c.releaseRefs(refs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//HistoryStart returns the earliest time the environment can be read at
+func (c *Cass) HistoryStart() (time.Time, error) {
+	if c.Config == nil || c.Config.Policy.History == 0 {
+		return time.Time{}, ErrNoHistory
+	}
+	start := time.Now().Add(-c.Config.Policy.History)
+	if start.Before(c.Config.Policy.HistorySince) {
+		start = c.Config.Policy.HistorySince
+	}
+	return start, nil
+}
+
+//recordHistory stores the current state of the entry name, an entry that no longer exists
+//is recorded as deleted.  Like publish, failing to record is only logged.
+func (c *Cass) recordHistory(name string) {
+	var hash, metajson []byte
+	if c.Config == nil || c.Config.Policy.History == 0 || !c.AsOf.IsZero() || c.session == nil {
+		return
+	}
+	dir, file := c.splitPath(name)
+	err := c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Consistency(c.Consistency).Scan(&hash, &metajson)
+	if err == gocql.ErrNotFound {
+		err = c.insertHistory(dir, file, nil, nil, true)
+	} else if err == nil {
+		meta := &CassMetadata{}
+		err = json.Unmarshal(metajson, meta)
+		if err == nil && meta.Inode != "" {
+			//The history of a link holds the content it had, inodes are not kept
+			var inode CassMetadata
+			hash, inode, err = c.readInode(meta.Inode)
+			if err == nil && inode.Attr != nil {
+				inode.Attr.Nlink = 1
+			}
+			inode.Inode = ""
+			meta = &inode
+		}
+		if err == nil {
+			err = c.insertHistory(dir, file, hash, meta, false)
+		}
+	}
+	if err != nil {
+		log.Println("Unable to record the history of", name, ":", err)
+		return
+	}
+	c.pruneHistory(dir, file)
+}
+
+//insertHistory stores a state of the entry file of dir, the state takes references of its
+//own on the data it has
+func (c *Cass) insertHistory(dir string, file string, hash []byte, meta *CassMetadata, deleted bool) error {
+	var metajson []byte
+	var refs [][]byte
+	if meta != nil {
+		var err error
+		metajson, err = json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		refs = dataRefs(hash, meta)
+	}
+	err := c.incrementRefs(refs)
+	if err != nil {
+		return err
+	}
+	err = c.session.Query("INSERT INTO history (cust_id, environment, directory, name, changed, hash, metadata, deleted, held) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, dir, file, gocql.TimeUUID(), hash, metajson, deleted, true).Consistency(c.Consistency).Exec()
+	if err != nil {
+		c.decrementRefs(refs)
+	}
+	return err
+}
+
+//historyCutoff is the time before which the states of entries are no longer read.  The
+//copy-on-write clones of the environment read it as of the time they were made, so the
+//states they read are kept however old they are.
+func (c *Cass) historyCutoff() (time.Time, error) {
+	cutoff := time.Now().Add(-c.Config.Policy.History)
+	pins, err := c.clonePins()
+	if err != nil {
+		return cutoff, err
+	}
+	for _, pin := range pins {
+		if !pin.IsZero() && pin.Before(cutoff) {
+			cutoff = pin
+		}
+	}
+	return cutoff, nil
+}
+
+//pruneHistory removes the states of an entry that are older than the retention, the last
+//of them is kept since it is the state of the entry at the start of the retention
+func (c *Cass) pruneHistory(dir string, file string) {
+	states, err := c.expiredHistory(dir, file, time.Now().Add(-c.Config.Policy.History))
+	if err == nil && len(states) > 0 {
+		//The clones are only looked up when there is something to prune, the cutoff
+		//they move is never later than the retention
+		var cutoff time.Time
+		cutoff, err = c.historyCutoff()
+		if err == nil {
+			states, err = c.expiredHistory(dir, file, cutoff)
+		}
+		if err == nil {
+			_, err = c.dropHistory(states)
+		}
+	}
+	if err != nil {
+		log.Println("Unable to prune the history of", file, ":", err)
+	}
+}
+
+//historyState is a recorded state of an entry
+type historyState struct {
+	dir      string
+	name     string
+	changed  gocql.UUID
+	held     bool
+	hash     []byte
+	metajson []byte
+}
+
+//expiredHistory lists the states of the entry file of the directory dirId, or of every
+//entry of it when file is empty, that were recorded before cutoff.  The last of them is
+//the state the entry had at cutoff and is not listed unless the entry was deleted then.
+func (c *Cass) expiredHistory(dirId string, file string, cutoff time.Time) ([]historyState, error) {
+	var states []historyState
+	var name string
+	var changed gocql.UUID
+	var hash, metajson []byte
+	var deleted, held bool
+	query := c.session.Query("SELECT name, changed, hash, metadata, deleted, held FROM history WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId)
+	if file != "" {
+		query = c.session.Query("SELECT name, changed, hash, metadata, deleted, held FROM history WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ? AND changed < maxTimeuuid(?)", c.OwnerId, c.Environment, dirId, file, cutoff)
+	}
+	//The states of each name are read newest first
+	seen := make(map[string]bool)
+	iter := query.Iter()
+	for iter.Scan(&name, &changed, &hash, &metajson, &deleted, &held) {
+		if !changed.Time().Before(cutoff) {
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			if !deleted {
+				continue
+			}
+		}
+		states = append(states, historyState{dirId, name, changed, held, hash, metajson})
+	}
+	return states, iter.Close()
+}
+
+//dropHistory removes states and releases the references of those that hold them.  Each
+//state is removed on its own and only released by the client whose delete applied, so a
+//writer pruning an entry and the reaper never release a state twice.
+func (c *Cass) dropHistory(states []historyState) (int, error) {
+	dropped := 0
+	for _, s := range states {
+		applied, err := c.session.Query("DELETE FROM history WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ? AND changed = ? IF EXISTS", c.OwnerId, c.Environment, s.dir, s.name, s.changed).Consistency(gocql.Quorum).SerialConsistency(gocql.Serial).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return dropped, err
+		}
+		if !applied {
+			continue
+		}
+		dropped++
+		if s.held {
+			err = c.releaseRefs(decodeRefs(s.hash, s.metajson))
+			if err != nil {
+				return dropped, err
+			}
+		}
+	}
+	return dropped, nil
+}
+
+//historyDirs lists the directories of the environment with recorded states.  The history
+//is partitioned by directory, so this reads every partition key of the table.
+func (c *Cass) historyDirs() ([]string, error) {
+	var dirs []string
+	var owner int64
+	var env, dir string
+	iter := c.session.Query("SELECT DISTINCT cust_id, environment, directory FROM history").Iter()
+	for iter.Scan(&owner, &env, &dir) {
+		if owner == c.OwnerId && env == c.Environment {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, iter.Close()
+}
+
+//dropDirHistory drops every state recorded in the directory dirId and returns the data
+//references they held
+func (c *Cass) dropDirHistory(dirId string) ([][]byte, error) {
+	var hash, metajson []byte
+	var held bool
+	var refs [][]byte
+	iter := c.session.Query("SELECT hash, metadata, held FROM history WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Iter()
+	for iter.Scan(&hash, &metajson, &held) {
+		if held {
+			refs = append(refs, decodeRefs(hash, metajson)...)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return refs, c.session.Query("DELETE FROM history WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Consistency(c.Consistency).Exec()
+}
+
+//historyEntry returns the state the entry file of the directory dirId had at AsOf
+func (c *Cass) historyEntry(dirId string, file string) (*CassFsMetadata, error) {
+	var hash, metajson []byte
+	var deleted bool
+	err := c.session.Query("SELECT hash, metadata, deleted FROM history WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ? AND changed <= maxTimeuuid(?) LIMIT 1", c.OwnerId, c.Environment, dirId, file, c.AsOf).Scan(&hash, &metajson, &deleted)
+	if err != nil {
+		return nil, err
+	}
+	if deleted {
+		return nil, gocql.ErrNotFound
+	}
+	meta := CassMetadata{}
+	err = json.Unmarshal(metajson, &meta)
+	if err != nil {
+		return nil, err
+	}
+	return &CassFsMetadata{
+		Metadata:  meta,
+		Hash:      hash,
+		Timestamp: time.Now().Unix(),
+	}, nil
+}
+
+//historyDirId returns the id the directory dir had at AsOf
+func (c *Cass) historyDirId(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	c.uuidLock.RLock()
+	entry, ok := c.uuidCache[dir]
+	c.uuidLock.RUnlock()
+	if ok {
+		return entry, nil
+	}
+	parent := ""
+	for _, d := range strings.Split(dir, "/") {
+		entry, err := c.historyEntry(parent, d)
+		if err != nil {
+			return "", err
+		}
+		uuid, err := gocql.UUIDFromBytes(entry.Hash)
+		if err != nil {
+			return "", ErrNotDir
+		}
+		parent = uuid.String()
+	}
+	c.uuidLock.Lock()
+	c.uuidCache[dir] = parent
+	c.uuidLock.Unlock()
+	return parent, nil
+}
+
+//historyFiledata is GetFiledata for a client reading at AsOf, the past does not change
+//so the entries do not expire, they are only dropped when the cache is full
+func (c *Cass) historyFiledata(name string) (*CassFsMetadata, error) {
+	name = strings.Trim(name, "/")
+	entry, ok := c.fileCache.get(name)
+	if ok {
+		return entry, nil
+	}
+	dirId, err := c.historyDirId(parentPath(name))
+	if err != nil {
+		return nil, err
+	}
+	entry, err = c.historyEntry(dirId, name[strings.LastIndex(name, "/")+1:])
+	if err != nil {
+		return nil, err
+	}
+	c.fileCache.put(name, entry)
+	return entry, nil
+}
+
+//historyDir is OpenDir for a client reading at AsOf
+func (c *Cass) historyDir(dir string) ([]fuse.DirEntry, error) {
+	var file_list []fuse.DirEntry
+	var file string
+	var changed gocql.UUID
+	var hash, metajson []byte
+	var deleted bool
+	dir = strings.Trim(dir, "/")
+	dirId, err := c.historyDirId(dir)
+	if err != nil {
+		return nil, err
+	}
+	//The states of each name are read newest first, the first one not after AsOf is the
+	//state of the name at that time
+	seen := make(map[string]bool)
+	iter := c.session.Query("SELECT name, changed, hash, metadata, deleted FROM history WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Iter()
+	for iter.Scan(&file, &changed, &hash, &metajson, &deleted) {
+		if seen[file] || changed.Time().After(c.AsOf) {
+			continue
+		}
+		seen[file] = true
+		if deleted {
+			continue
+		}
+		meta := CassMetadata{}
+		err := json.Unmarshal(metajson, &meta)
+		if err != nil || meta.Attr == nil {
+			log.Println("Error decoding the history of", file, ":", err)
+			continue
+		}
+		key := file
+		if dir != "" {
+			key = dir + "/" + file
+		}
+		c.fileCache.put(key, &CassFsMetadata{
+			Metadata:  meta,
+			Hash:      append([]byte(nil), hash...),
+			Timestamp: time.Now().Unix(),
+		})
+		file_list = append(file_list, fuse.DirEntry{Mode: meta.Attr.Mode, Name: file})
+	}
+	err = iter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return file_list, nil
+}
+
+//historyWalk is Walk for a client reading at AsOf.  Linked files are passed as their name
+//was, the history does not keep the state of inodes.
+func (c *Cass) historyWalk(dir string, fn WalkFunc) error {
+	list, err := c.historyDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range list {
+		full := e.Name
+		if dir != "" {
+			full = dir + "/" + e.Name
+		}
+		//historyDir caches the entries it lists
+		entry, err := c.historyFiledata(full)
+		if err != nil {
+			return err
+		}
+		err = fn(full, entry.Hash, &entry.Metadata)
+		if err != nil {
+			return err
+		}
+		if e.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			err = c.historyWalk(full, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
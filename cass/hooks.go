@@ -0,0 +1,329 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cass
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+//Programs that embed cassfs can run their own code around every operation of the mount
+//by wrapping the file system with NewHookFs, for example to enforce a policy of their own
+//or to count operations, without changing CassFs.
+
+//Op is an operation of the file system as passed to hooks.  Name is the FUSE operation in
+//upper case like in the latency map, except that SETATTR is split into TRUNCATE, CHMOD,
+//CHOWN and UTIMENS.
+type Op struct {
+	Name string
+	Path string
+	//Target is the new name of RENAME and LINK and the target of SYMLINK
+	Target string
+	//Context is the caller, it is nil for operations on open files
+	Context *fuse.Context
+	Start   time.Time
+}
+
+//A Hook runs around operations.  Before can refuse an operation by returning a status
+//other than fuse.OK, After is called with the status the operation ended with.
+type Hook interface {
+	Before(op *Op) fuse.Status
+	After(op *Op, status fuse.Status)
+}
+
+//HookFuncs turns functions into a Hook, either of them can be nil
+type HookFuncs struct {
+	BeforeFunc func(op *Op) fuse.Status
+	AfterFunc  func(op *Op, status fuse.Status)
+}
+
+func (h HookFuncs) Before(op *Op) fuse.Status {
+	if h.BeforeFunc == nil {
+		return fuse.OK
+	}
+	return h.BeforeFunc(op)
+}
+
+func (h HookFuncs) After(op *Op, status fuse.Status) {
+	if h.AfterFunc != nil {
+		h.AfterFunc(op, status)
+	}
+}
+
+//HookFs runs hooks around the operations of the file system it wraps.  The Before hooks
+//run in the order they were added and the After hooks in reverse, so every hook wraps the
+//ones added after it.
+type HookFs struct {
+	pathfs.FileSystem
+	hooks []Hook
+}
+
+//NewHookFs wraps fs, hooks can only be added before it is mounted
+func NewHookFs(fs pathfs.FileSystem, hooks ...Hook) *HookFs {
+	return &HookFs{
+		FileSystem: fs,
+		hooks:      hooks,
+	}
+}
+
+//Use adds a hook
+func (h *HookFs) Use(hook Hook) {
+	h.hooks = append(h.hooks, hook)
+}
+
+//before runs the Before hooks, when one refuses the operation only the hooks that already
+//ran see its end
+func (h *HookFs) before(op *Op) fuse.Status {
+	op.Start = time.Now()
+	for i, hook := range h.hooks {
+		if status := hook.Before(op); status != fuse.OK {
+			h.after(op, status, i)
+			return status
+		}
+	}
+	return fuse.OK
+}
+
+func (h *HookFs) after(op *Op, status fuse.Status, count int) {
+	for i := count - 1; i >= 0; i-- {
+		h.hooks[i].After(op, status)
+	}
+}
+
+//run wraps an operation that only returns a status
+func (h *HookFs) run(op *Op, fn func() fuse.Status) fuse.Status {
+	if status := h.before(op); status != fuse.OK {
+		return status
+	}
+	status := fn()
+	h.after(op, status, len(h.hooks))
+	return status
+}
+
+func (h *HookFs) op(name string, path string, context *fuse.Context) *Op {
+	return &Op{Name: name, Path: path, Context: context}
+}
+
+func (h *HookFs) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr, status fuse.Status) {
+	status = h.run(h.op("GETATTR", name, context), func() fuse.Status {
+		attr, status = h.FileSystem.GetAttr(name, context)
+		return status
+	})
+	return attr, status
+}
+
+func (h *HookFs) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return h.run(h.op("ACCESS", name, context), func() fuse.Status {
+		return h.FileSystem.Access(name, mode, context)
+	})
+}
+
+func (h *HookFs) OpenDir(name string, context *fuse.Context) (entries []fuse.DirEntry, status fuse.Status) {
+	status = h.run(h.op("OPENDIR", name, context), func() fuse.Status {
+		entries, status = h.FileSystem.OpenDir(name, context)
+		return status
+	})
+	return entries, status
+}
+
+func (h *HookFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, status fuse.Status) {
+	status = h.run(h.op("OPEN", name, context), func() fuse.Status {
+		file, status = h.FileSystem.Open(name, flags, context)
+		return status
+	})
+	return h.wrapFile(file, name), status
+}
+
+func (h *HookFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, status fuse.Status) {
+	status = h.run(h.op("CREATE", name, context), func() fuse.Status {
+		file, status = h.FileSystem.Create(name, flags, mode, context)
+		return status
+	})
+	return h.wrapFile(file, name), status
+}
+
+func (h *HookFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return h.run(h.op("MKDIR", name, context), func() fuse.Status {
+		return h.FileSystem.Mkdir(name, mode, context)
+	})
+}
+
+func (h *HookFs) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	return h.run(h.op("MKNOD", name, context), func() fuse.Status {
+		return h.FileSystem.Mknod(name, mode, dev, context)
+	})
+}
+
+func (h *HookFs) Symlink(pointedTo string, linkName string, context *fuse.Context) fuse.Status {
+	op := h.op("SYMLINK", linkName, context)
+	op.Target = pointedTo
+	return h.run(op, func() fuse.Status {
+		return h.FileSystem.Symlink(pointedTo, linkName, context)
+	})
+}
+
+func (h *HookFs) Link(orig string, newName string, context *fuse.Context) fuse.Status {
+	op := h.op("LINK", orig, context)
+	op.Target = newName
+	return h.run(op, func() fuse.Status {
+		return h.FileSystem.Link(orig, newName, context)
+	})
+}
+
+func (h *HookFs) Readlink(name string, context *fuse.Context) (target string, status fuse.Status) {
+	status = h.run(h.op("READLINK", name, context), func() fuse.Status {
+		target, status = h.FileSystem.Readlink(name, context)
+		return status
+	})
+	return target, status
+}
+
+func (h *HookFs) Unlink(name string, context *fuse.Context) fuse.Status {
+	return h.run(h.op("UNLINK", name, context), func() fuse.Status {
+		return h.FileSystem.Unlink(name, context)
+	})
+}
+
+func (h *HookFs) Rmdir(name string, context *fuse.Context) fuse.Status {
+	return h.run(h.op("RMDIR", name, context), func() fuse.Status {
+		return h.FileSystem.Rmdir(name, context)
+	})
+}
+
+func (h *HookFs) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	op := h.op("RENAME", oldName, context)
+	op.Target = newName
+	return h.run(op, func() fuse.Status {
+		return h.FileSystem.Rename(oldName, newName, context)
+	})
+}
+
+func (h *HookFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	return h.run(h.op("TRUNCATE", name, context), func() fuse.Status {
+		return h.FileSystem.Truncate(name, size, context)
+	})
+}
+
+func (h *HookFs) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return h.run(h.op("CHMOD", name, context), func() fuse.Status {
+		return h.FileSystem.Chmod(name, mode, context)
+	})
+}
+
+func (h *HookFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	return h.run(h.op("CHOWN", name, context), func() fuse.Status {
+		return h.FileSystem.Chown(name, uid, gid, context)
+	})
+}
+
+func (h *HookFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	return h.run(h.op("UTIMENS", name, context), func() fuse.Status {
+		return h.FileSystem.Utimens(name, atime, mtime, context)
+	})
+}
+
+func (h *HookFs) GetXAttr(name string, attr string, context *fuse.Context) (data []byte, status fuse.Status) {
+	status = h.run(h.op("GETXATTR", name, context), func() fuse.Status {
+		data, status = h.FileSystem.GetXAttr(name, attr, context)
+		return status
+	})
+	return data, status
+}
+
+func (h *HookFs) ListXAttr(name string, context *fuse.Context) (attrs []string, status fuse.Status) {
+	status = h.run(h.op("LISTXATTR", name, context), func() fuse.Status {
+		attrs, status = h.FileSystem.ListXAttr(name, context)
+		return status
+	})
+	return attrs, status
+}
+
+func (h *HookFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	return h.run(h.op("SETXATTR", name, context), func() fuse.Status {
+		return h.FileSystem.SetXAttr(name, attr, data, flags, context)
+	})
+}
+
+func (h *HookFs) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	return h.run(h.op("REMOVEXATTR", name, context), func() fuse.Status {
+		return h.FileSystem.RemoveXAttr(name, attr, context)
+	})
+}
+
+//hookFile runs the hooks of fs around the operations on an open file
+type hookFile struct {
+	nodefs.File
+	fs   *HookFs
+	path string
+}
+
+func (h *HookFs) wrapFile(file nodefs.File, path string) nodefs.File {
+	if file == nil || len(h.hooks) == 0 {
+		return file
+	}
+	return &hookFile{File: file, fs: h, path: path}
+}
+
+func (f *hookFile) Read(buf []byte, off int64) (result fuse.ReadResult, status fuse.Status) {
+	status = f.fs.run(f.fs.op("READ", f.path, nil), func() fuse.Status {
+		result, status = f.File.Read(buf, off)
+		return status
+	})
+	return result, status
+}
+
+func (f *hookFile) Write(data []byte, off int64) (written uint32, status fuse.Status) {
+	status = f.fs.run(f.fs.op("WRITE", f.path, nil), func() fuse.Status {
+		written, status = f.File.Write(data, off)
+		return status
+	})
+	return written, status
+}
+
+func (f *hookFile) Flush() fuse.Status {
+	return f.fs.run(f.fs.op("FLUSH", f.path, nil), f.File.Flush)
+}
+
+func (f *hookFile) Fsync(flags int) fuse.Status {
+	return f.fs.run(f.fs.op("FSYNC", f.path, nil), func() fuse.Status {
+		return f.File.Fsync(flags)
+	})
+}
+
+func (f *hookFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	return f.fs.run(f.fs.op("FALLOCATE", f.path, nil), func() fuse.Status {
+		return f.File.Allocate(off, size, mode)
+	})
+}
+
+//The attributes of an open file are changed through the handle, ftruncate and fchmod
+//get the same hooks as their path based calls
+//Release can not fail, so hooks can not refuse it either
+func (f *hookFile) Release() {
+	op := f.fs.op("RELEASE", f.path, nil)
+	status := f.fs.before(op)
+	f.File.Release()
+	if status == fuse.OK {
+		f.fs.after(op, status, len(f.fs.hooks))
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"syscall"
+)
+
+//Impact describes what removing a set of entries does to the data store.  Chunks that
+//are only referenced by the entries are freed, chunks that other entries or environments
+//reference as well survive the removal.  Sizes are the logical sizes of the chunks, the
+//stored size is smaller when the data is compressed.
+type Impact struct {
+	Files       int
+	Dirs        int
+	Chunks      int
+	Bytes       int64
+	Freed       int
+	FreedBytes  int64
+	Shared      int
+	SharedBytes int64
+}
+
+//impactRefs collects the references held by the entries being removed
+type impactRefs struct {
+	counts map[string]int64
+	sizes  map[string]int64
+}
+
+func newImpactRefs() *impactRefs {
+	return &impactRefs{
+		counts: make(map[string]int64),
+		sizes:  make(map[string]int64),
+	}
+}
+
+//add records the references of an encoded entry and returns its metadata
+func (r *impactRefs) add(hash []byte, metajson []byte) *CassMetadata {
+	meta := &CassMetadata{}
+	if err := json.Unmarshal(metajson, meta); err != nil {
+		meta = nil
+	}
+	refs := dataRefs(hash, meta)
+	for _, ref := range refs {
+		r.counts[string(ref)]++
+	}
+	if meta == nil || meta.Attr == nil {
+		return meta
+	}
+	if len(meta.Chunks) == 0 && len(refs) == 1 {
+		r.sizes[string(refs[0])] = int64(meta.Attr.Size)
+	}
+	for idx, chunk := range meta.Chunks {
+		if !isHole(chunk) {
+			r.sizes[string(chunk)] = int64(chunkLen(int64(idx), meta.Attr.Size, meta.ChunkSize()))
+		}
+	}
+	return meta
+}
+
+//resolveImpact compares the collected references with the reference counts in the store
+func (c *Cass) resolveImpact(refs *impactRefs, impact *Impact) error {
+	for hash, count := range refs.counts {
+		total, err := c.blobRefCount(c.OwnerId, []byte(hash))
+		if err != nil {
+			return err
+		}
+		size := refs.sizes[hash]
+		impact.Chunks++
+		impact.Bytes += size
+		if total <= count {
+			impact.Freed++
+			impact.FreedBytes += size
+		} else {
+			impact.Shared++
+			impact.SharedBytes += size
+		}
+	}
+	return nil
+}
+
+//EnvironmentImpact reports what deleting the environment would free.  Every entry of the
+//environment is counted, including inodes and orphans that no longer have a name and the
+//kept versions of files.
+func (c *Cass) EnvironmentImpact() (*Impact, error) {
+	var hash, metajson []byte
+	impact := &Impact{}
+	refs := newImpactRefs()
+	iter := c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Iter()
+	for iter.Scan(&hash, &metajson) {
+		meta := refs.add(hash, metajson)
+		switch {
+		case meta != nil && meta.Attr != nil && meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR:
+			impact.Dirs++
+		default:
+			impact.Files++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	for _, table := range []string{"inodes", "orphans", "file_versions", "trash"} {
+		iter = c.session.Query("SELECT hash, metadata FROM "+table+" WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Iter()
+		for iter.Scan(&hash, &metajson) {
+			refs.add(hash, metajson)
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return impact, c.resolveImpact(refs, impact)
+}
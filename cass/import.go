@@ -0,0 +1,269 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//IMPORT_CHECKPOINT is the number of uploaded chunks between saves of the import state
+const IMPORT_CHECKPOINT = 64
+
+var ErrSourceChanged = errors.New("Source file changed during the import")
+var ErrVerifyFailed = errors.New("Stored data does not match the source file")
+
+//ImportState is the resumable record of an import, Chunks has an entry for every chunk of
+//the source and the ones that are nil have not been uploaded yet
+type ImportState struct {
+	Source  string
+	Path    string
+	Hasher  string
+	Size    int64
+	ModTime time.Time
+	Chunks  [][]byte
+	//BlockSize is 0 in states saved before the block size could be changed
+	BlockSize int64 `json:",omitempty"`
+}
+
+//ImportReport holds the results of an import
+type ImportReport struct {
+	Chunks      int
+	Resumed     int
+	Uploaded    int
+	UploadBytes int64
+	Digest      string
+}
+
+//matches checks if the state was saved for the same source, target and content
+func (s *ImportState) matches(source string, path string, hasher string, blockSize int64, info os.FileInfo) bool {
+	saved := s.BlockSize
+	if saved == 0 {
+		saved = BLOBSIZE
+	}
+	return s.Source == source && s.Path == path && s.Hasher == hasher && saved == blockSize &&
+		s.Size == info.Size() && s.ModTime.Equal(info.ModTime()) &&
+		int64(len(s.Chunks)) == numChunks(uint64(info.Size()), blockSize)
+}
+
+//loadImportState reads the state left by an earlier import, a missing or unreadable
+//state means the import starts from the beginning
+func loadImportState(location string) *ImportState {
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil
+	}
+	state := &ImportState{}
+	if json.Unmarshal(data, state) != nil {
+		return nil
+	}
+	return state
+}
+
+func (s *ImportState) save(location string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(location, data)
+}
+
+//readBlock reads chunk idx of blockSize of f
+func readBlock(f *os.File, size int64, idx int, blockSize int64) ([]byte, error) {
+	start := int64(idx) * blockSize
+	buf := make([]byte, chunkLen(int64(idx), uint64(size), blockSize))
+	_, err := f.ReadAt(buf, start)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+//ImportFile uploads the local file source as name with workers chunks hashed and uploaded
+//at the same time.  Progress is saved to the state file so an interrupted import only
+//uploads the chunks that are left when it is run again.  The file is only linked once
+//every chunk is stored and, with verify, the data read back from the store matches the
+//source.  The state file is removed when the import succeeds.
+func (c *Cass) ImportFile(source string, name string, attr *fuse.Attr, state string, workers int, verify bool, progress *Progress) (*ImportReport, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	err = c.CheckName(name)
+	if err != nil {
+		return nil, err
+	}
+	err = c.CheckSize(uint64(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{}
+	bs := c.NewBlockSize()
+	st := loadImportState(state)
+	if st == nil || !st.matches(source, name, c.Hasher.Name(), bs, info) {
+		st = &ImportState{
+			Source:    source,
+			Path:      name,
+			Hasher:    c.Hasher.Name(),
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+			Chunks:    make([][]byte, numChunks(uint64(info.Size()), bs)),
+			BlockSize: bs,
+		}
+	}
+	report.Chunks = len(st.Chunks)
+	progress.SetTotal(1, info.Size())
+
+	jobs := make(chan int)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var failed error
+	done := 0
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				data, err := readBlock(f, info.Size(), idx, bs)
+				if err != nil {
+					lock.Lock()
+					failed = err
+					lock.Unlock()
+					continue
+				}
+				hash := c.hash(data)
+				exists, err := c.HasChunk(hash)
+				if err == nil && !exists {
+					var codec int
+					var stored []byte
+					codec, stored, err = c.encodeBlock(data)
+					if err == nil {
+						err = c.insertBlob(c.OwnerId, hash, codec, stored)
+					}
+				}
+				lock.Lock()
+				if err != nil {
+					failed = err
+				} else {
+					st.Chunks[idx] = hash
+					progress.Add(0, int64(len(data)))
+					if !exists {
+						report.Uploaded++
+						report.UploadBytes += int64(len(data))
+					}
+					done++
+					if done%IMPORT_CHECKPOINT == 0 {
+						st.save(state)
+					}
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for idx, hash := range st.Chunks {
+		if hash != nil {
+			report.Resumed++
+			progress.Add(0, int64(chunkLen(int64(idx), uint64(info.Size()), bs)))
+			continue
+		}
+		lock.Lock()
+		stop := failed != nil
+		lock.Unlock()
+		if stop {
+			break
+		}
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+	if err := st.save(state); err != nil && failed == nil {
+		failed = err
+	}
+	if failed != nil {
+		return report, failed
+	}
+
+	after, err := f.Stat()
+	if err != nil {
+		return report, err
+	}
+	if after.Size() != info.Size() || !after.ModTime().Equal(info.ModTime()) {
+		os.Remove(state)
+		return report, ErrSourceChanged
+	}
+	if verify {
+		report.Digest, err = c.verifyImport(f, info.Size(), st.Chunks, bs)
+		if err != nil {
+			return report, err
+		}
+	}
+	attr.Size = uint64(info.Size())
+	err = c.LinkChunks(name, st.Chunks, bs, attr)
+	if err != nil {
+		return report, err
+	}
+	os.Remove(state)
+	progress.Add(1, 0)
+	return report, nil
+}
+
+//verifyImport reads the chunks back from the store and compares the digest of the
+//assembled data with the digest of the source.  The digest is returned in the same form
+//sha512sum prints it.
+func (c *Cass) verifyImport(f *os.File, size int64, chunks [][]byte, blockSize int64) (string, error) {
+	local := sha512.New()
+	stored := sha512.New()
+	for idx, chunk := range chunks {
+		data, err := readBlock(f, size, idx, blockSize)
+		if err != nil {
+			return "", err
+		}
+		local.Write(data)
+		data, err = c.ReadChunk(chunk)
+		if err != nil {
+			return "", err
+		}
+		stored.Write(data)
+	}
+	sum := local.Sum(nil)
+	if !bytes.Equal(sum, stored.Sum(nil)) {
+		return "", ErrVerifyFailed
+	}
+	return hex.EncodeToString(sum), nil
+}
@@ -0,0 +1,223 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//The journal keeps a directory per dirty file with a file per dirty chunk and a state
+//file with the rest of the file handle.  A checkpoint only writes the chunks that changed
+//and the state, which lists the chunks it belongs with, so a write costs about the size
+//of the write whatever the size of the file.  Journals of older versions kept everything
+//in a single file per dirty file, they are still recovered.
+
+//JOURNAL_STATE is the name of the state file in the directory of a journaled file
+const JOURNAL_STATE = "state.json"
+
+//JournalEntry is the checkpointed state of a dirty file handle
+type JournalEntry struct {
+	Name   string
+	Hash   []byte
+	Chunks [][]byte
+	//Dirty is only kept in the state by older versions, the chunks of DirtyChunks are
+	//read into it from their own files
+	Dirty       map[int64][]byte `json:",omitempty"`
+	DirtyChunks []int64          `json:",omitempty"`
+	Attr        *fuse.Attr
+	XAttr       map[string]string
+	XAttrBinary map[string][]byte
+	Inode       string
+	BlockSize   int64    `json:",omitempty"`
+	Inline      []byte   `json:",omitempty"`
+	Held        [][]byte `json:",omitempty"`
+	Trimmed     bool     `json:",omitempty"`
+}
+
+//Journal keeps the state of dirty open files on local disk so they can be
+//recovered if the mount dies before the files are flushed
+type Journal struct {
+	dir string
+	//written are the chunks of each file that are in the journal
+	written map[string]map[int64]bool
+	lock    sync.Mutex
+}
+
+func NewJournal(dir string) (*Journal, error) {
+	err := os.MkdirAll(dir, os.FileMode(0700))
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{dir: dir, written: make(map[string]map[int64]bool)}, nil
+}
+
+func (j *Journal) location(name string) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%x", sha1.Sum([]byte(name))))
+}
+
+//writeFile writes data to a temporary name and renames it to location so a crash never
+//leaves a half written file behind
+func writeFile(location string, data []byte) error {
+	err := ioutil.WriteFile(location+".tmp", data, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	return os.Rename(location+".tmp", location)
+}
+
+func chunkFile(dir string, idx int64) string {
+	return filepath.Join(dir, strconv.FormatInt(idx, 10)+".chunk")
+}
+
+//Save checkpoints the current state of fd after size bytes at off were changed.  The
+//chunks of that range and the dirty chunks that are not in the journal yet are written,
+//the chunks that are no longer dirty are removed.  The state is written last, a crash
+//before it leaves the previous state, which ignores chunks it does not list.
+func (j *Journal) Save(fd *CassFileData, off int64, size int64) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	dir := j.location(*fd.Name)
+	err := os.MkdirAll(dir, os.FileMode(0700))
+	if err != nil {
+		return err
+	}
+	written, ok := j.written[*fd.Name]
+	if !ok {
+		written = make(map[int64]bool)
+		j.written[*fd.Name] = written
+	}
+	first, last := int64(0), int64(-1)
+	if off >= 0 && size > 0 {
+		bs := fd.blockSize()
+		first, last = off/bs, (off+size-1)/bs
+	}
+	chunks := make([]int64, 0, len(fd.dirty))
+	for idx, data := range fd.dirty {
+		chunks = append(chunks, idx)
+		if written[idx] && (idx < first || idx > last) {
+			continue
+		}
+		err = writeFile(chunkFile(dir, idx), data)
+		if err != nil {
+			return err
+		}
+		written[idx] = true
+	}
+	data, err := json.Marshal(JournalEntry{
+		Name:        *fd.Name,
+		Hash:        fd.Hash,
+		Chunks:      fd.Chunks,
+		DirtyChunks: chunks,
+		Attr:        fd.Attr,
+		XAttr:       fd.XAttr,
+		XAttrBinary: fd.XAttrBinary,
+		Inode:       fd.Inode,
+		BlockSize:   fd.BlockSize,
+		Inline:      fd.Inline,
+		Held:        fd.held,
+		Trimmed:     fd.trimmed,
+	})
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(dir, JOURNAL_STATE), data)
+	if err != nil {
+		return err
+	}
+	for idx := range written {
+		if _, ok := fd.dirty[idx]; !ok {
+			os.Remove(chunkFile(dir, idx))
+			delete(written, idx)
+		}
+	}
+	return nil
+}
+
+//Remove drops the checkpoint for name once it is safely in the store
+func (j *Journal) Remove(name string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	delete(j.written, name)
+	location := j.location(name)
+	//Journals of older versions are a single file
+	err := os.Remove(location + ".json")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(location)
+}
+
+//Entries returns all of the checkpoints left in the journal
+func (j *Journal) Entries() ([]*JournalEntry, error) {
+	var entries []*JournalEntry
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		location := filepath.Join(j.dir, f.Name())
+		if f.IsDir() {
+			location = filepath.Join(location, JOURNAL_STATE)
+		} else if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(location)
+		if err != nil {
+			log.Println("Unable to read journal entry", f.Name(), ":", err)
+			continue
+		}
+		entry := &JournalEntry{}
+		err = json.Unmarshal(data, entry)
+		if err == nil && f.IsDir() {
+			err = entry.readChunks(filepath.Join(j.dir, f.Name()))
+		}
+		if err != nil {
+			log.Println("Unable to decode journal entry", f.Name(), ":", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+//readChunks reads the dirty chunks the state lists from the directory dir
+func (e *JournalEntry) readChunks(dir string) error {
+	e.Dirty = make(map[int64][]byte, len(e.DirtyChunks))
+	for _, idx := range e.DirtyChunks {
+		data, err := ioutil.ReadFile(chunkFile(dir, idx))
+		if err != nil {
+			return err
+		}
+		e.Dirty[idx] = data
+	}
+	return nil
+}
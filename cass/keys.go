@@ -0,0 +1,262 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+//KEY_SIZE is the size of the keys data is encrypted with (AES-256)
+const KEY_SIZE = 32
+
+var ErrKeySize = errors.New("Encryption key must be 32 bytes")
+
+//KeyProvider supplies the key the data of an environment is encrypted with
+type KeyProvider interface {
+	Name() string
+	Key() ([]byte, error)
+}
+
+//KeyConfig selects a key provider and holds the settings of every provider, only the
+//settings of the selected one are used
+type KeyConfig struct {
+	//Provider is one of env, file, vault or kms, empty means no encryption keys
+	Provider string
+	//Env is the environment variable holding the key
+	Env string
+	//File is the file holding the key
+	File string
+	//VaultAddr, VaultToken, VaultPath and VaultField locate the key in a Vault secret
+	VaultAddr  string
+	VaultToken string
+	VaultPath  string
+	VaultField string
+	//KMSRegion and KMSCiphertext are the region and the data key encrypted by AWS KMS,
+	//the ciphertext can be kept on the mount host as only KMS can decrypt it
+	KMSRegion     string
+	KMSCiphertext string
+}
+
+//NewKeyProvider creates the provider selected by conf, the key is fetched when it is
+//first needed and kept in memory only
+func NewKeyProvider(conf *KeyConfig) (KeyProvider, error) {
+	var p KeyProvider
+	switch conf.Provider {
+	case "", "none":
+		return nil, nil
+	case "env":
+		if conf.Env == "" {
+			return nil, errors.New("The env key provider needs a variable name")
+		}
+		p = &envKeys{name: conf.Env}
+	case "file":
+		if conf.File == "" {
+			return nil, errors.New("The file key provider needs a file")
+		}
+		p = &fileKeys{path: conf.File}
+	case "vault":
+		if conf.VaultAddr == "" || conf.VaultPath == "" {
+			return nil, errors.New("The vault key provider needs an address and a secret path")
+		}
+		field := conf.VaultField
+		if field == "" {
+			field = "key"
+		}
+		p = &vaultKeys{addr: strings.TrimRight(conf.VaultAddr, "/"), token: conf.VaultToken, path: strings.Trim(conf.VaultPath, "/"), field: field}
+	case "kms":
+		if conf.KMSCiphertext == "" {
+			return nil, errors.New("The kms key provider needs the encrypted data key")
+		}
+		p = &kmsKeys{region: conf.KMSRegion, ciphertext: conf.KMSCiphertext}
+	default:
+		return nil, fmt.Errorf("Unsupported key provider: %s", conf.Provider)
+	}
+	return &cachedKeys{provider: p}, nil
+}
+
+//decodeKey accepts a key that is base64 or hex encoded, or the raw key itself
+func decodeKey(data []byte) ([]byte, error) {
+	if len(data) == KEY_SIZE {
+		return data, nil
+	}
+	s := strings.TrimSpace(string(data))
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == KEY_SIZE {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(s); err == nil && len(key) == KEY_SIZE {
+		return key, nil
+	}
+	return nil, ErrKeySize
+}
+
+//cachedKeys keeps the key after the first fetch so the remote providers are not asked for
+//every chunk
+type cachedKeys struct {
+	sync.Mutex
+	provider KeyProvider
+	key      []byte
+}
+
+func (c *cachedKeys) Name() string {
+	return c.provider.Name()
+}
+
+func (c *cachedKeys) Key() ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.key != nil {
+		return c.key, nil
+	}
+	key, err := c.provider.Key()
+	if err != nil {
+		return nil, err
+	}
+	c.key = key
+	return key, nil
+}
+
+type envKeys struct {
+	name string
+}
+
+func (e *envKeys) Name() string {
+	return "env"
+}
+
+func (e *envKeys) Key() ([]byte, error) {
+	value := os.Getenv(e.name)
+	if value == "" {
+		return nil, errors.New("Key variable is not set: " + e.name)
+	}
+	return decodeKey([]byte(value))
+}
+
+type fileKeys struct {
+	path string
+}
+
+func (f *fileKeys) Name() string {
+	return "file"
+}
+
+func (f *fileKeys) Key() ([]byte, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(data)
+}
+
+//vaultKeys reads the key from a secret in HashiCorp Vault, both versions of the key/value
+//secrets engine are supported
+type vaultKeys struct {
+	addr  string
+	token string
+	path  string
+	field string
+}
+
+func (v *vaultKeys) Name() string {
+	return "vault"
+}
+
+func (v *vaultKeys) Key() ([]byte, error) {
+	req, err := http.NewRequest("GET", v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vault returned %s reading %s", resp.Status, v.path)
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&secret)
+	if err != nil {
+		return nil, err
+	}
+	data := secret.Data
+	//Version 2 of the engine nests the secret in another data field
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		data = inner
+	}
+	value, ok := data[v.field].(string)
+	if !ok {
+		return nil, fmt.Errorf("Vault secret %s has no field %s", v.path, v.field)
+	}
+	return decodeKey([]byte(value))
+}
+
+//kmsKeys decrypts a data key with AWS KMS, the credentials come from the usual AWS
+//environment, shared configuration or instance role
+type kmsKeys struct {
+	region     string
+	ciphertext string
+}
+
+func (k *kmsKeys) Name() string {
+	return "kms"
+}
+
+func (k *kmsKeys) Key() ([]byte, error) {
+	//The encrypted key is either given directly (base64) or in a file
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(k.ciphertext))
+	if err != nil {
+		blob, err = ioutil.ReadFile(k.ciphertext)
+		if err != nil {
+			return nil, err
+		}
+	}
+	config := aws.NewConfig()
+	if k.region != "" {
+		config = config.WithRegion(k.region)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	out, err := kms.New(sess).Decrypt(&kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(out.Plaintext)
+}
@@ -0,0 +1,105 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//LifecycleRule expires files below Prefix once they have not been changed for MaxAge seconds
+type LifecycleRule struct {
+	Prefix string
+	MaxAge int64
+}
+
+//LifecycleReport holds the results of applying the lifecycle rules of an environment
+type LifecycleReport struct {
+	Checked int
+	Expired []string
+	Bytes   uint64
+	Errors  int
+}
+
+//matches checks if path is at or below the prefix of the rule
+func (r *LifecycleRule) matches(path string) bool {
+	prefix := strings.Trim(r.Prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+//entryAge returns the seconds since the entry was last changed, entries without any
+//timestamps are reported as having no known age
+func entryAge(meta *CassMetadata, now time.Time) (int64, bool) {
+	changed := meta.Attr.Mtime
+	if meta.Attr.Ctime > changed {
+		changed = meta.Attr.Ctime
+	}
+	if changed == 0 {
+		return 0, false
+	}
+	return now.Unix() - int64(changed), true
+}
+
+//ApplyLifecycle removes the files that have expired under the lifecycle rules of the
+//environment.  With dryRun set nothing is removed and the report lists what would be.
+func (c *Cass) ApplyLifecycle(dryRun bool) (*LifecycleReport, error) {
+	report := &LifecycleReport{}
+	if c.Config == nil || len(c.Config.Lifecycle) == 0 {
+		return report, nil
+	}
+	now := time.Now()
+	var expired []string
+	err := c.Walk("", func(path string, hash []byte, meta *CassMetadata) error {
+		report.Checked++
+		if meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			return nil
+		}
+		age, known := entryAge(meta, now)
+		if !known {
+			return nil
+		}
+		for _, rule := range c.Config.Lifecycle {
+			if rule.MaxAge > 0 && rule.matches(path) && age > rule.MaxAge {
+				expired = append(expired, path)
+				report.Bytes += meta.Attr.Size
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Expired = expired
+	if dryRun {
+		return report, nil
+	}
+	for _, path := range expired {
+		err := c.DeleteFile(path)
+		if err != nil {
+			log.Println("Unable to expire", path, ":", err)
+			report.Errors++
+		}
+	}
+	return report, nil
+}
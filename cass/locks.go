@@ -0,0 +1,308 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//LOCK_LEASE is how long a lock survives a client that stopped renewing it (seconds)
+const LOCK_LEASE = 30
+
+//LOCK_RETRY is how long a blocking lock waits before trying again
+const LOCK_RETRY = 100 * time.Millisecond
+
+var ErrLocked = errors.New("File is locked by another client")
+
+//LockRange is a lock on the bytes Start to End (inclusive) of a file
+type LockRange struct {
+	Start uint64
+	End   uint64
+	Write bool
+	Pid   uint32
+}
+
+func (l LockRange) overlaps(o LockRange) bool {
+	return l.Start <= o.End && o.Start <= l.End
+}
+
+//lockState is every lock held on a file by holder, and the version of the file's locks
+//the changes are made against
+type lockState struct {
+	version int64
+	mine    []LockRange
+	others  []LockRange
+}
+
+//readLocks reads the locks of a file, the locks of holder are kept apart from the others
+func (c *Cass) readLocks(name string, holder string) (*lockState, error) {
+	var version int64
+	var owner string
+	var data []byte
+	state := &lockState{}
+	iter := c.session.Query("SELECT version, holder, locks FROM locks WHERE cust_id = ? AND environment = ? AND path = ?", c.OwnerId, c.Environment, name).Consistency(gocql.Consistency(gocql.Serial)).Iter()
+	for iter.Scan(&version, &owner, &data) {
+		state.version = version
+		var ranges []LockRange
+		if err := json.Unmarshal(data, &ranges); err != nil {
+			continue
+		}
+		if owner == holder {
+			state.mine = ranges
+		} else {
+			state.others = append(state.others, ranges...)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+//conflict returns a lock of another holder that prevents lk from being taken
+func (s *lockState) conflict(lk LockRange) *LockRange {
+	for _, o := range s.others {
+		if o.overlaps(lk) && (o.Write || lk.Write) {
+			return &o
+		}
+	}
+	return nil
+}
+
+//applyLock replaces the part of locks covered by lk with lk, a nil lk unlocks the range
+func applyLock(locks []LockRange, start uint64, end uint64, lk *LockRange) []LockRange {
+	var out []LockRange
+	cover := LockRange{Start: start, End: end}
+	for _, l := range locks {
+		if !l.overlaps(cover) {
+			out = append(out, l)
+			continue
+		}
+		if l.Start < start {
+			left := l
+			left.End = start - 1
+			out = append(out, left)
+		}
+		if l.End > end {
+			right := l
+			right.Start = end + 1
+			out = append(out, right)
+		}
+	}
+	if lk != nil {
+		out = append(out, *lk)
+	}
+	return out
+}
+
+//GetLock returns a lock of another holder that conflicts with lk, nil if lk could be taken
+func (c *Cass) GetLock(name string, holder string, lk LockRange) (*LockRange, error) {
+	state, err := c.readLocks(name, holder)
+	if err != nil {
+		return nil, err
+	}
+	return state.conflict(lk), nil
+}
+
+//SetLock takes (typ F_RDLCK or F_WRLCK) or releases (F_UNLCK) a lock on a range of a file
+//for holder.  The change is a lightweight transaction on the version of the file's locks so
+//two clients can not take conflicting locks at the same time.  The locks of a holder expire
+//unless they are renewed within LOCK_LEASE.
+func (c *Cass) SetLock(name string, holder string, start uint64, end uint64, typ uint32, pid uint32) error {
+	for {
+		state, err := c.readLocks(name, holder)
+		if err != nil {
+			return err
+		}
+		var lk *LockRange
+		if typ == syscall.F_UNLCK && len(state.mine) == 0 {
+			return nil
+		}
+		if typ != syscall.F_UNLCK {
+			lk = &LockRange{Start: start, End: end, Write: typ == syscall.F_WRLCK, Pid: pid}
+			if state.conflict(*lk) != nil {
+				return ErrLocked
+			}
+		}
+		applied, err := c.writeLocks(name, holder, state.version, applyLock(state.mine, start, end, lk))
+		if err != nil {
+			return err
+		}
+		if applied {
+			return nil
+		}
+		//Another client changed the locks of the file in between, look again
+	}
+}
+
+//writeLocks replaces the locks of holder if nothing changed since version
+func (c *Cass) writeLocks(name string, holder string, version int64, locks []LockRange) (bool, error) {
+	batch := gocql.NewBatch(gocql.LoggedBatch)
+	batch.Cons = c.Consistency
+	if version == 0 {
+		batch.Query("UPDATE locks SET version = ? WHERE cust_id = ? AND environment = ? AND path = ? IF version = null", version+1, c.OwnerId, c.Environment, name)
+	} else {
+		batch.Query("UPDATE locks SET version = ? WHERE cust_id = ? AND environment = ? AND path = ? IF version = ?", version+1, c.OwnerId, c.Environment, name, version)
+	}
+	if len(locks) == 0 {
+		batch.Query("DELETE FROM locks WHERE cust_id = ? AND environment = ? AND path = ? AND holder = ?", c.OwnerId, c.Environment, name, holder)
+	} else {
+		data, err := json.Marshal(locks)
+		if err != nil {
+			return false, err
+		}
+		batch.Query("INSERT INTO locks (cust_id, environment, path, holder, locks) VALUES(?, ?, ?, ?, ?) USING TTL ?", c.OwnerId, c.Environment, name, holder, data, LOCK_LEASE)
+	}
+	applied, iter, err := c.session.MapExecuteBatchCAS(batch, make(map[string]interface{}))
+	if err != nil {
+		return false, err
+	}
+	if iter != nil {
+		iter.Close()
+	}
+	return applied, nil
+}
+
+//RenewLocks extends the lease of the locks holder has on a file, it reports whether
+//holder still has any.  The locks are written again through the same transaction on the
+//version as SetLock, so locks that expired and were taken by another client in between
+//are not brought back.
+func (c *Cass) RenewLocks(name string, holder string) (bool, error) {
+	for {
+		state, err := c.readLocks(name, holder)
+		if err != nil {
+			return false, err
+		}
+		if len(state.mine) == 0 {
+			return false, nil
+		}
+		applied, err := c.writeLocks(name, holder, state.version, state.mine)
+		if err != nil {
+			return false, err
+		}
+		if applied {
+			return true, nil
+		}
+		//Another client changed the locks of the file in between, look again
+	}
+}
+
+//ReleaseLocks drops every lock holder has on a file
+func (c *Cass) ReleaseLocks(name string, holder string) error {
+	return c.SetLock(name, holder, 0, ^uint64(0), syscall.F_UNLCK, 0)
+}
+
+//LockHolder identifies the owner of locks taken through this client
+func (c *Cass) LockHolder(owner string) string {
+	return c.origin + "/" + owner
+}
+
+//setLock takes or releases a lock for holder and keeps track of the files this mount
+//holds locks on so their lease is renewed.  A blocking lock is tried again until the
+//conflicting lock is released or expires.
+func (c *CassFs) setLock(name string, holder string, lk *fuse.FileLock, wait bool) fuse.Status {
+	retry := LOCK_RETRY
+	for {
+		c.lockLock.Lock()
+		err := c.store.SetLock(name, holder, lk.Start, lk.End, lk.Typ, lk.Pid)
+		if err == nil {
+			holders := c.held[name]
+			if holders == nil {
+				holders = make(map[string]bool)
+				c.held[name] = holders
+			}
+			holders[holder] = true
+		}
+		c.lockLock.Unlock()
+		if err != ErrLocked || !wait {
+			return errorStatus(err)
+		}
+		time.Sleep(retry)
+		if retry < time.Second {
+			retry *= 2
+		}
+	}
+}
+
+//getLock reports the lock that prevents lk from being taken in out
+func (c *CassFs) getLock(name string, holder string, lk *fuse.FileLock, out *fuse.FileLock) fuse.Status {
+	conflict, err := c.store.GetLock(name, holder, LockRange{Start: lk.Start, End: lk.End, Write: lk.Typ == syscall.F_WRLCK})
+	if err != nil {
+		log.Println("Unable to read locks of", name, ":", err)
+		return fuse.EIO
+	}
+	if lk.Typ == syscall.F_UNLCK || conflict == nil {
+		out.Typ = syscall.F_UNLCK
+		return fuse.OK
+	}
+	out.Start = conflict.Start
+	out.End = conflict.End
+	out.Pid = conflict.Pid
+	out.Typ = syscall.F_RDLCK
+	if conflict.Write {
+		out.Typ = syscall.F_WRLCK
+	}
+	return fuse.OK
+}
+
+//releaseLocks drops the locks this mount holds on a file
+func (c *CassFs) releaseLocks(name string) {
+	c.lockLock.Lock()
+	defer c.lockLock.Unlock()
+	for holder := range c.held[name] {
+		err := c.store.ReleaseLocks(name, holder)
+		if err != nil {
+			log.Println("Unable to release locks on", name, ":", err)
+		}
+	}
+	delete(c.held, name)
+}
+
+//renewLocks keeps the locks of this mount alive, locks that were released are forgotten
+func (c *CassFs) renewLocks() {
+	for {
+		time.Sleep(LOCK_LEASE * time.Second / 3)
+		c.lockLock.Lock()
+		for name, holders := range c.held {
+			for holder := range holders {
+				held, err := c.store.RenewLocks(name, holder)
+				if err != nil {
+					log.Println("Unable to renew locks on", name, ":", err)
+					continue
+				}
+				if !held {
+					delete(holders, holder)
+				}
+			}
+			if len(holders) == 0 {
+				delete(c.held, name)
+			}
+		}
+		c.lockLock.Unlock()
+	}
+}
@@ -0,0 +1,308 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sort"
+	"syscall"
+
+	"github.com/gocql/gocql"
+)
+
+//The namespace of an environment is hashed as a Merkle tree.  The hash of a directory
+//covers the names and hashes of its entries, the hash of an entry covers its manifest
+//entry and, for a directory, the hash of its contents.  Directory hashes are kept in the
+//dirtree table along with the tree generation they were computed at, every change bumps
+//the tree generation of the directory and all of its parents so only the directories on
+//the path of a change have to be hashed again.
+
+//TREE_DEPTH_MAX guards the walk up the parents against a loop in the dirtree table
+const TREE_DEPTH_MAX = 1024
+
+//entryHash hashes a single entry, subtree is the hash of the contents of a directory
+func entryHash(e *ManifestEntry, subtree []byte) []byte {
+	enc, _ := json.Marshal(e)
+	return ShaSum(append(ShaSum(enc), subtree...))
+}
+
+//treeHash combines the hashes of the entries of a directory
+func treeHash(entries map[string][]byte) []byte {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf []byte
+	for _, name := range names {
+		buf = append(buf, name...)
+		buf = append(buf, 0)
+		buf = append(buf, entries[name]...)
+	}
+	return ShaSum(buf)
+}
+
+//treeEntry is an entry of a directory as it is hashed
+type treeEntry struct {
+	Hash []byte
+	//Dir is the id of the contents of a directory
+	Dir string
+	//Leaf is the hash of the entry itself without the contents of a directory
+	Leaf []byte
+}
+
+//treeGeneration reads the tree generation of a directory
+func (c *Cass) treeGeneration(dirId string) (int64, error) {
+	var gen int64
+	err := c.session.Query("SELECT tree FROM dirgen WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Scan(&gen)
+	if err == gocql.ErrNotFound {
+		return 0, nil
+	}
+	return gen, err
+}
+
+//treeChanged bumps the tree generation of the parents of dirId, up to the root or the first
+//directory that has never been hashed
+func (c *Cass) treeChanged(dirId string) {
+	var parent string
+	for depth := 0; dirId != "" && depth < TREE_DEPTH_MAX; depth++ {
+		err := c.session.Query("SELECT parent FROM dirtree WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Scan(&parent)
+		if err != nil {
+			if err != gocql.ErrNotFound {
+				log.Println("Unable to find the parent of directory", dirId, ":", err)
+			}
+			return
+		}
+		err = c.session.Query("UPDATE dirgen SET tree = tree + 1 WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, parent).Exec()
+		if err != nil {
+			log.Println("Unable to update the tree generation of directory", parent, ":", err)
+			return
+		}
+		dirId = parent
+	}
+}
+
+//reparentDir records that the directory entry (hash, metajson) now lives in parent
+func (c *Cass) reparentDir(hash []byte, metajson []byte, parent string) {
+	meta := CassMetadata{}
+	if json.Unmarshal(metajson, &meta) != nil || meta.Attr == nil || meta.Attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return
+	}
+	uuid, err := gocql.UUIDFromBytes(hash)
+	if err != nil {
+		return
+	}
+	err = c.session.Query("UPDATE dirtree SET parent = ? WHERE cust_id = ? AND environment = ? AND directory = ?", parent, c.OwnerId, c.Environment, uuid.String()).Exec()
+	if err != nil {
+		log.Println("Unable to update the parent of directory", uuid.String(), ":", err)
+	}
+}
+
+//treeEntries hashes every entry of a directory, the contents of subdirectories are hashed
+//as needed
+func (c *Cass) treeEntries(dirId string) (map[string]treeEntry, error) {
+	var name string
+	var hash, metajson []byte
+	type subdir struct {
+		name string
+		id   string
+		leaf []byte
+	}
+	var dirs []subdir
+	entries := make(map[string]treeEntry)
+	iter := c.session.Query("SELECT name, hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Iter()
+	for iter.Scan(&name, &hash, &metajson) {
+		meta := &CassMetadata{}
+		err := json.Unmarshal(metajson, meta)
+		if err == nil && meta.Inode != "" {
+			var inode CassMetadata
+			hash, inode, err = c.readInode(meta.Inode)
+			meta = &inode
+		}
+		if err != nil || meta.Attr == nil {
+			log.Println("Error decoding metadata for", name, ":", err)
+			continue
+		}
+		e := manifestEntry(hash, meta)
+		enc, _ := json.Marshal(e)
+		leaf := ShaSum(enc)
+		if meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			uuid, err := gocql.UUIDFromBytes(hash)
+			if err != nil {
+				log.Println("Invalid directory id for", name, ":", err)
+				continue
+			}
+			dirs = append(dirs, subdir{name: name, id: uuid.String(), leaf: leaf})
+			continue
+		}
+		entries[name] = treeEntry{Hash: entryHash(e, nil), Leaf: leaf}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		//The parent is recorded before the directory is hashed so a change that follows
+		//reaches this directory
+		err := c.session.Query("UPDATE dirtree SET parent = ? WHERE cust_id = ? AND environment = ? AND directory = ?", dirId, c.OwnerId, c.Environment, d.id).Exec()
+		if err != nil {
+			return nil, err
+		}
+		sub, err := c.DirHash(d.id)
+		if err != nil {
+			return nil, err
+		}
+		entries[d.name] = treeEntry{Hash: ShaSum(append(append([]byte{}, d.leaf...), sub...)), Dir: d.id, Leaf: d.leaf}
+	}
+	return entries, nil
+}
+
+//DirHash returns the Merkle hash of the contents of the directory dirId, it is only
+//computed again when something below the directory changed since it was stored
+func (c *Cass) DirHash(dirId string) ([]byte, error) {
+	gen, err := c.treeGeneration(dirId)
+	if err != nil {
+		return nil, err
+	}
+	var stored []byte
+	var storedGen int64
+	err = c.session.Query("SELECT hash, gen FROM dirtree WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Scan(&stored, &storedGen)
+	if err != nil && err != gocql.ErrNotFound {
+		return nil, err
+	}
+	if stored != nil && storedGen == gen {
+		return stored, nil
+	}
+	entries, err := c.treeEntries(dirId)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string][]byte, len(entries))
+	for name, e := range entries {
+		hashes[name] = e.Hash
+	}
+	hash := treeHash(hashes)
+	//The generation read before hashing is stored, a change made in the meantime makes
+	//the next call hash the directory again
+	err = c.session.Query("UPDATE dirtree SET hash = ?, gen = ? WHERE cust_id = ? AND environment = ? AND directory = ?", hash, gen, c.OwnerId, c.Environment, dirId).Exec()
+	if err != nil {
+		log.Println("Unable to store the hash of directory", dirId, ":", err)
+	}
+	return hash, nil
+}
+
+//TreeHash returns the Merkle hash of everything below path
+func (c *Cass) TreeHash(path string) ([]byte, error) {
+	dirId, err := c.FindDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.DirHash(dirId)
+}
+
+//Kinds of differences between two trees
+const (
+	TREE_ADDED   = "added"
+	TREE_REMOVED = "removed"
+	TREE_CHANGED = "changed"
+)
+
+//TreeChange is a path that differs between two trees, a directory that was added or
+//removed is reported without its contents
+type TreeChange struct {
+	Path string
+	Kind string
+}
+
+//DiffTrees lists the differences from the environment of c to the environment of other
+//below path, only the directories whose hashes differ are read
+func (c *Cass) DiffTrees(other *Cass, path string) ([]TreeChange, error) {
+	from, err := c.FindDir(path)
+	if err != nil {
+		return nil, err
+	}
+	to, err := other.FindDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var changes []TreeChange
+	err = c.diffDir(other, path, from, to, &changes)
+	return changes, err
+}
+
+func (c *Cass) diffDir(other *Cass, path string, from string, to string, changes *[]TreeChange) error {
+	a, err := c.DirHash(from)
+	if err != nil {
+		return err
+	}
+	b, err := other.DirHash(to)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	fromEntries, err := c.treeEntries(from)
+	if err != nil {
+		return err
+	}
+	toEntries, err := other.treeEntries(to)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(fromEntries)+len(toEntries))
+	for name := range fromEntries {
+		names = append(names, name)
+	}
+	for name := range toEntries {
+		if _, ok := fromEntries[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		full := name
+		if path != "" {
+			full = path + "/" + name
+		}
+		f, inFrom := fromEntries[name]
+		t, inTo := toEntries[name]
+		switch {
+		case !inTo:
+			*changes = append(*changes, TreeChange{Path: full, Kind: TREE_REMOVED})
+		case !inFrom:
+			*changes = append(*changes, TreeChange{Path: full, Kind: TREE_ADDED})
+		case bytes.Equal(f.Hash, t.Hash):
+		case f.Dir != "" && t.Dir != "":
+			if !bytes.Equal(f.Leaf, t.Leaf) {
+				*changes = append(*changes, TreeChange{Path: full, Kind: TREE_CHANGED})
+			}
+			err := c.diffDir(other, full, f.Dir, t.Dir, changes)
+			if err != nil {
+				return err
+			}
+		default:
+			*changes = append(*changes, TreeChange{Path: full, Kind: TREE_CHANGED})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"io"
+)
+
+//MetaRecord is a single filesystem entry in a metadata dump.  Entries are kept in the
+//form they are stored in, keyed by the UUID of their parent directory, so a dump can be
+//loaded into any other owner or environment without translating paths.
+type MetaRecord struct {
+	Directory string
+	Name      string
+	Hash      []byte
+	Metadata  json.RawMessage
+}
+
+//DumpMeta writes every entry of the environment to w, one JSON record per line
+func (c *Cass) DumpMeta(w io.Writer) (int, error) {
+	var dir, name string
+	var hash, meta []byte
+	count := 0
+	enc := json.NewEncoder(w)
+	iter := c.session.Query("SELECT directory, name, hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Iter()
+	for iter.Scan(&dir, &name, &hash, &meta) {
+		err := enc.Encode(&MetaRecord{
+			Directory: dir,
+			Name:      name,
+			Hash:      hash,
+			Metadata:  json.RawMessage(meta),
+		})
+		if err != nil {
+			iter.Close()
+			return count, err
+		}
+		count++
+	}
+	return count, iter.Close()
+}
+
+//LoadMeta reads records written by DumpMeta from r and stores them in the environment.
+//The data the entries point to has to already be present in the cluster.
+func (c *Cass) LoadMeta(r io.Reader) (int, error) {
+	count := 0
+	dec := json.NewDecoder(r)
+	for {
+		record := &MetaRecord{}
+		err := dec.Decode(record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		err = c.session.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, record.Directory, record.Name, record.Hash, []byte(record.Metadata)).Consistency(c.Consistency).Exec()
+		if err != nil {
+			return count, err
+		}
+		err = c.incrementRefs(decodeRefs(record.Hash, record.Metadata))
+		if err != nil {
+			return count, err
+		}
+		c.dirChanged(record.Directory)
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,141 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"container/list"
+	"sync"
+)
+
+//DEFAULT_METADATA_CACHE is the number of paths whose metadata a store keeps by default
+const DEFAULT_METADATA_CACHE = 100000
+
+//MetadataCacheStats are the counters of the metadata cache of a store
+type MetadataCacheStats struct {
+	Entries   int
+	Capacity  int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+//metaCache is the LRU of the metadata of paths.  Entries still expire with the file cache
+//TTL, the size only bounds how much a long running mount keeps, so the least recently used
+//entries are dropped once it is full.  A size of 0 or less does not limit the cache.
+type metaCache struct {
+	lock      sync.Mutex
+	size      int
+	order     *list.List
+	entries   map[string]*list.Element
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type metaCacheItem struct {
+	key   string
+	entry *CassFsMetadata
+}
+
+func newMetaCache(size int) *metaCache {
+	return &metaCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, 1024),
+	}
+}
+
+func (m *metaCache) get(key string) (*CassFsMetadata, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	elem, ok := m.entries[key]
+	if !ok {
+		m.misses++
+		return nil, false
+	}
+	m.hits++
+	m.order.MoveToFront(elem)
+	return elem.Value.(*metaCacheItem).entry, true
+}
+
+func (m *metaCache) put(key string, entry *CassFsMetadata) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if elem, ok := m.entries[key]; ok {
+		elem.Value.(*metaCacheItem).entry = entry
+		m.order.MoveToFront(elem)
+		return
+	}
+	m.entries[key] = m.order.PushFront(&metaCacheItem{key: key, entry: entry})
+	for m.size > 0 && m.order.Len() > m.size {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*metaCacheItem).key)
+		m.evictions++
+	}
+}
+
+//replace sets the entry of key only when key is cached
+func (m *metaCache) replace(key string, entry *CassFsMetadata) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if elem, ok := m.entries[key]; ok {
+		elem.Value.(*metaCacheItem).entry = entry
+	}
+}
+
+func (m *metaCache) remove(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if elem, ok := m.entries[key]; ok {
+		m.order.Remove(elem)
+		delete(m.entries, key)
+	}
+}
+
+//removeIf drops every entry drop returns true for
+func (m *metaCache) removeIf(drop func(key string, entry *CassFsMetadata) bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for key, elem := range m.entries {
+		if drop(key, elem.Value.(*metaCacheItem).entry) {
+			m.order.Remove(elem)
+			delete(m.entries, key)
+		}
+	}
+}
+
+func (m *metaCache) stats() MetadataCacheStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return MetadataCacheStats{
+		Entries:   m.order.Len(),
+		Capacity:  m.size,
+		Hits:      m.hits,
+		Misses:    m.misses,
+		Evictions: m.evictions,
+	}
+}
+
+//MetadataCacheStats returns the counters of the metadata cache of the store
+func (c *Cass) MetadataCacheStats() MetadataCacheStats {
+	return c.fileCache.stats()
+}
@@ -0,0 +1,177 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//Mounts can write a row of their counters to the client_metrics table every interval, so
+//a small deployment sees its whole fleet with `cassfs fleet status` without running a
+//monitoring system.  The rows expire after a few intervals, so hosts that stopped
+//reporting drop out on their own.
+
+//METRICS_TTL_INTERVALS is the number of intervals a row outlives its mount
+const METRICS_TTL_INTERVALS = 3
+
+//METRICS_MAX_SAMPLES is the number of latencies kept per operation and interval
+const METRICS_MAX_SAMPLES = 1024
+
+//ClientMetrics is the row a mount reports for one interval
+type ClientMetrics struct {
+	Owner       int64
+	Environment string
+	Host        string
+	Reported    time.Time
+	Interval    time.Duration
+	Ops         map[string]int64
+	Errors      map[string]int64
+	P50         map[string]time.Duration
+	P99         map[string]time.Duration
+}
+
+//MetricsHook counts the operations of a mount, their errors and a sample of their
+//latencies.  A missing entry (ENOENT) is an answer, not an error, and is not counted as one.
+type MetricsHook struct {
+	lock    sync.Mutex
+	samples map[string]*sloSamples
+	errors  map[string]int64
+}
+
+func NewMetricsHook() *MetricsHook {
+	return &MetricsHook{
+		samples: make(map[string]*sloSamples),
+		errors:  make(map[string]int64),
+	}
+}
+
+func (m *MetricsHook) Before(op *Op) fuse.Status {
+	return fuse.OK
+}
+
+func (m *MetricsHook) After(op *Op, status fuse.Status) {
+	dt := time.Since(op.Start)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.samples[op.Name]
+	if !ok {
+		s = &sloSamples{}
+		m.samples[op.Name] = s
+	}
+	s.count++
+	if status != fuse.OK && status != fuse.ENOENT {
+		m.errors[op.Name]++
+	}
+	if len(s.sample) < METRICS_MAX_SAMPLES {
+		s.sample = append(s.sample, dt)
+		return
+	}
+	if idx := rand.Intn(s.count); idx < METRICS_MAX_SAMPLES {
+		s.sample[idx] = dt
+	}
+}
+
+//collect returns the counters of the interval that just ended and starts a new one
+func (m *MetricsHook) collect() *ClientMetrics {
+	m.lock.Lock()
+	samples, errors := m.samples, m.errors
+	m.samples = make(map[string]*sloSamples, len(samples))
+	m.errors = make(map[string]int64, len(errors))
+	m.lock.Unlock()
+	metrics := &ClientMetrics{
+		Ops:    make(map[string]int64, len(samples)),
+		Errors: errors,
+		P50:    make(map[string]time.Duration, len(samples)),
+		P99:    make(map[string]time.Duration, len(samples)),
+	}
+	for op, s := range samples {
+		metrics.Ops[op] = int64(s.count)
+		sort.Sort(durations(s.sample))
+		metrics.P50[op] = percentile(s.sample, 50)
+		metrics.P99[op] = percentile(s.sample, 99)
+	}
+	return metrics
+}
+
+//PushMetrics writes the counters of hook as the row of host every interval, it does not return
+func (c *Cass) PushMetrics(hook *MetricsHook, host string, interval time.Duration) {
+	ttl := int(METRICS_TTL_INTERVALS * interval / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	for range time.Tick(interval) {
+		m := hook.collect()
+		p50 := make(map[string]int64, len(m.P50))
+		p99 := make(map[string]int64, len(m.P99))
+		for op := range m.P50 {
+			p50[op] = int64(m.P50[op] / time.Microsecond)
+			p99[op] = int64(m.P99[op] / time.Microsecond)
+		}
+		err := c.session.Query("INSERT INTO client_metrics (cust_id, environment, host, reported, interval_ms, ops, errors, p50_us, p99_us) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?", c.OwnerId, c.Environment, host, time.Now(), int64(interval/time.Millisecond), m.Ops, m.Errors, p50, p99, ttl).Exec()
+		if err != nil {
+			log.Println("Unable to push metrics:", err)
+		}
+	}
+}
+
+//FleetMetrics reads the rows of every mount that reported recently, of every owner and
+//environment when allOwners is set and of the environment of the store otherwise
+func (c *Cass) FleetMetrics(allOwners bool) ([]*ClientMetrics, error) {
+	var ret []*ClientMetrics
+	var owner, intervalMs int64
+	var env, host string
+	var reported time.Time
+	var ops, errors, p50, p99 map[string]int64
+	query := c.session.Query("SELECT cust_id, environment, host, reported, interval_ms, ops, errors, p50_us, p99_us FROM client_metrics WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment)
+	if allOwners {
+		query = c.session.Query("SELECT cust_id, environment, host, reported, interval_ms, ops, errors, p50_us, p99_us FROM client_metrics")
+	}
+	iter := query.Iter()
+	for iter.Scan(&owner, &env, &host, &reported, &intervalMs, &ops, &errors, &p50, &p99) {
+		m := &ClientMetrics{
+			Owner:       owner,
+			Environment: env,
+			Host:        host,
+			Reported:    reported,
+			Interval:    time.Duration(intervalMs) * time.Millisecond,
+			Ops:         ops,
+			Errors:      errors,
+			P50:         make(map[string]time.Duration, len(p50)),
+			P99:         make(map[string]time.Duration, len(p99)),
+		}
+		for op, us := range p50 {
+			m.P50[op] = time.Duration(us) * time.Microsecond
+		}
+		for op, us := range p99 {
+			m.P99[op] = time.Duration(us) * time.Microsecond
+		}
+		ret = append(ret, m)
+		//The maps are filled by Scan, new ones keep the rows apart
+		ops, errors, p50, p99 = nil, nil, nil, nil
+	}
+	return ret, iter.Close()
+}
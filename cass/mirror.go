@@ -0,0 +1,310 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//MirrorEntry is a single file, directory or symbolic link of a mirror
+type MirrorEntry struct {
+	Path   string
+	Attr   *fuse.Attr
+	Hash   []byte   `json:",omitempty"`
+	Chunks [][]byte `json:",omitempty"`
+	Target string   `json:",omitempty"`
+	//BlockSize of the chunks, it is not set for BLOBSIZE
+	BlockSize int64 `json:",omitempty"`
+}
+
+//ChunkSize returns the size of the chunks of the entry
+func (e *MirrorEntry) ChunkSize() int64 {
+	if e.BlockSize > 0 {
+		return e.BlockSize
+	}
+	return BLOBSIZE
+}
+
+//MirrorManifest describes the content of a mirror, the data is kept next to it in a
+//chunk directory with one file per chunk named by its hash
+type MirrorManifest struct {
+	Owner       int64
+	Environment string
+	Built       time.Time
+	Entries     []MirrorEntry
+}
+
+//MirrorReport holds the results of building or refreshing a mirror
+type MirrorReport struct {
+	Entries    int
+	Changed    int
+	Fetched    int
+	FetchBytes int64
+	Pruned     int
+}
+
+//Mirror is a local read only copy of an environment
+type Mirror struct {
+	dir      string
+	Manifest *MirrorManifest
+}
+
+func mirrorManifestPath(dir string) string {
+	return filepath.Join(dir, "manifest.json")
+}
+
+//chunkPath returns the location of the chunk hash in the mirror in dir
+func chunkPath(dir string, hash []byte) string {
+	name := hex.EncodeToString(hash)
+	return filepath.Join(dir, "chunks", name[:2], name)
+}
+
+//writeFileAtomic writes data to a temporary name and renames it into place
+func writeFileAtomic(location string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(location), os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(location+".tmp", data, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	return os.Rename(location+".tmp", location)
+}
+
+//OpenMirror reads the manifest of the mirror in dir
+func OpenMirror(dir string) (*Mirror, error) {
+	data, err := ioutil.ReadFile(mirrorManifestPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &MirrorManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirror{dir: dir, Manifest: manifest}, nil
+}
+
+//ReadChunk reads a chunk of blockSize of the mirror
+func (m *Mirror) ReadChunk(hash []byte, blockSize int64) ([]byte, error) {
+	if isHole(hash) {
+		return make([]byte, blockSize), nil
+	}
+	return ioutil.ReadFile(chunkPath(m.dir, hash))
+}
+
+//HasChunk checks if the mirror has the chunk hash
+func (m *Mirror) HasChunk(hash []byte) bool {
+	_, err := os.Stat(chunkPath(m.dir, hash))
+	return err == nil
+}
+
+//fetchChunk stores the chunk hash in the mirror in dir unless it is already there and
+//returns the number of bytes fetched
+func (c *Cass) fetchChunk(dir string, hash []byte) (int, error) {
+	if isHole(hash) {
+		return 0, nil
+	}
+	location := chunkPath(dir, hash)
+	if _, err := os.Stat(location); err == nil {
+		return 0, nil
+	}
+	data, err := c.ReadChunk(hash)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), writeFileAtomic(location, data)
+}
+
+//mirrorEntry creates the entry for a file and fetches its data into the mirror in dir.
+//If the content matches the entry in the previous manifest nothing is fetched.
+func (c *Cass) mirrorEntry(dir string, path string, hash []byte, meta *CassMetadata, old *MirrorEntry, report *MirrorReport) (*MirrorEntry, error) {
+	attr := *meta.Attr
+	entry := &MirrorEntry{Path: path, Attr: &attr}
+	switch attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		return entry, nil
+	case syscall.S_IFLNK:
+		entry.Target = meta.SymlinkTarget(hash)
+		return entry, nil
+	}
+	entry.Hash = hash
+	if old != nil && old.Attr.Mode&syscall.S_IFMT == syscall.S_IFREG && bytes.Equal(old.Hash, hash) {
+		entry.Chunks = old.Chunks
+		entry.BlockSize = old.BlockSize
+		return entry, nil
+	}
+	report.Changed++
+	entry.Chunks = meta.Chunks
+	entry.BlockSize = meta.BlockSize
+	if len(meta.Chunks) == 0 && len(hash) > 0 {
+		//Older files are a single blob, they are split into chunks in the mirror
+		data, err := c.Read(hash)
+		if err != nil {
+			return nil, err
+		}
+		entry.Chunks = c.ChunkHashes(data, BLOBSIZE)
+		for idx, chunk := range entry.Chunks {
+			location := chunkPath(dir, chunk)
+			if _, err := os.Stat(location); err == nil {
+				continue
+			}
+			end := (idx + 1) * BLOBSIZE
+			if end > len(data) {
+				end = len(data)
+			}
+			err = writeFileAtomic(location, data[idx*BLOBSIZE:end])
+			if err != nil {
+				return nil, err
+			}
+			report.Fetched++
+			report.FetchBytes += int64(end - idx*BLOBSIZE)
+		}
+		return entry, nil
+	}
+	if meta.Inline != nil {
+		//The content is in the row, the mirror keeps it as a chunk like any other
+		location := chunkPath(dir, entry.Chunks[0])
+		if _, err := os.Stat(location); err != nil {
+			err = writeFileAtomic(location, meta.Inline)
+			if err != nil {
+				return nil, err
+			}
+			report.Fetched++
+			report.FetchBytes += int64(len(meta.Inline))
+		}
+		return entry, nil
+	}
+	for _, chunk := range entry.Chunks {
+		n, err := c.fetchChunk(dir, chunk)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			report.Fetched++
+			report.FetchBytes += int64(n)
+		}
+	}
+	return entry, nil
+}
+
+//BuildMirror creates a complete read only copy of the environment in dir.  Chunks that
+//are already in dir are not fetched again and the manifest is replaced last, so a mirror
+//that is being rebuilt stays usable until the new one is complete.
+func (c *Cass) BuildMirror(dir string) (*MirrorReport, error) {
+	return c.buildMirror(dir, nil)
+}
+
+//RefreshMirror brings the mirror in dir up to date.  Files whose hash did not change since
+//the last build are not looked at again and only the chunks the mirror does not have are
+//fetched.  Chunks used by neither the new nor the previous manifest are removed, keeping
+//the previous generation readable for files that are still open.
+func (c *Cass) RefreshMirror(dir string) (*MirrorReport, error) {
+	mirror, err := OpenMirror(dir)
+	if os.IsNotExist(err) {
+		return c.buildMirror(dir, nil)
+	} else if err != nil {
+		return nil, err
+	}
+	return c.buildMirror(dir, mirror.Manifest)
+}
+
+//pruneChunks removes every chunk in the mirror in dir that is not in keep
+func pruneChunks(dir string, keep map[string]bool) (int, error) {
+	pruned := 0
+	err := filepath.Walk(filepath.Join(dir, "chunks"), func(location string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		hash, err := hex.DecodeString(info.Name())
+		if err != nil {
+			//Not a chunk, e.g. a temporary file left by an earlier run
+			return os.Remove(location)
+		}
+		if !keep[string(hash)] {
+			pruned++
+			return os.Remove(location)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return pruned, err
+}
+
+func (c *Cass) buildMirror(dir string, previous *MirrorManifest) (*MirrorReport, error) {
+	report := &MirrorReport{}
+	manifest := &MirrorManifest{
+		Owner:       c.OwnerId,
+		Environment: c.Environment,
+		Built:       time.Now(),
+	}
+	oldEntries := make(map[string]*MirrorEntry)
+	if previous != nil {
+		for i := range previous.Entries {
+			oldEntries[previous.Entries[i].Path] = &previous.Entries[i]
+		}
+	}
+	err := c.Walk("", func(path string, hash []byte, meta *CassMetadata) error {
+		entry, err := c.mirrorEntry(dir, path, hash, meta, oldEntries[path], report)
+		if err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, *entry)
+		report.Entries++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(mirrorManifestPath(dir), data)
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil {
+		return report, nil
+	}
+	keep := make(map[string]bool)
+	for _, m := range []*MirrorManifest{previous, manifest} {
+		for _, entry := range m.Entries {
+			for _, chunk := range entry.Chunks {
+				keep[string(chunk)] = true
+			}
+		}
+	}
+	report.Pruned, err = pruneChunks(dir, keep)
+	return report, err
+}
@@ -0,0 +1,176 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"path"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+//MirrorFs serves a mirror as a read only filesystem without any connection to the cluster
+type MirrorFs struct {
+	pathfs.FileSystem
+	lock     sync.RWMutex
+	mirror   *Mirror
+	entries  map[string]*MirrorEntry
+	children map[string][]fuse.DirEntry
+	options  *CassFsOptions
+}
+
+func NewMirrorFs(m *Mirror, opts *CassFsOptions) *MirrorFs {
+	fs := &MirrorFs{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		options:    opts,
+	}
+	fs.Reload(m)
+	return fs
+}
+
+//Reload indexes the manifest of mirror and starts serving it, this is also used to
+//switch to a refreshed manifest
+func (m *MirrorFs) Reload(mirror *Mirror) {
+	entries := make(map[string]*MirrorEntry, len(mirror.Manifest.Entries))
+	children := make(map[string][]fuse.DirEntry)
+	for i := range mirror.Manifest.Entries {
+		entry := &mirror.Manifest.Entries[i]
+		entries[entry.Path] = entry
+		parent := path.Dir(entry.Path)
+		if parent == "." {
+			parent = ""
+		}
+		children[parent] = append(children[parent], fuse.DirEntry{Mode: entry.Attr.Mode, Name: path.Base(entry.Path)})
+	}
+	for _, list := range children {
+		sortEntries(list)
+	}
+	m.lock.Lock()
+	m.mirror = mirror
+	m.entries = entries
+	m.children = children
+	m.lock.Unlock()
+}
+
+func (m *MirrorFs) String() string {
+	return "cassfs-mirror"
+}
+
+func (m *MirrorFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if name == "" {
+		return &fuse.Attr{
+			Mode:  fuse.S_IFDIR | m.options.Mode,
+			Owner: m.options.Owner,
+		}, fuse.OK
+	}
+	m.lock.RLock()
+	entry, ok := m.entries[name]
+	m.lock.RUnlock()
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	attr := *entry.Attr
+	return &attr, fuse.OK
+}
+
+func (m *MirrorFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if name != "" {
+		if _, ok := m.entries[name]; !ok {
+			return nil, fuse.ENOENT
+		}
+	}
+	return m.children[name], fuse.OK
+}
+
+func (m *MirrorFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	m.lock.RLock()
+	entry, ok := m.entries[name]
+	m.lock.RUnlock()
+	if !ok {
+		return "", fuse.ENOENT
+	}
+	return entry.Target, fuse.OK
+}
+
+func (m *MirrorFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EROFS
+	}
+	m.lock.RLock()
+	entry, ok := m.entries[name]
+	mirror := m.mirror
+	m.lock.RUnlock()
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return nodefs.NewReadOnlyFile(&mirrorFile{File: nodefs.NewDefaultFile(), mirror: mirror, entry: entry}), fuse.OK
+}
+
+//mirrorFile reads the chunks of a mirror entry from local disk
+type mirrorFile struct {
+	nodefs.File
+	mirror *Mirror
+	entry  *MirrorEntry
+}
+
+func (f *mirrorFile) String() string {
+	return f.entry.Path
+}
+
+func (f *mirrorFile) GetAttr(out *fuse.Attr) fuse.Status {
+	*out = *f.entry.Attr
+	return fuse.OK
+}
+
+func (f *mirrorFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	var data []byte
+	size := int64(f.entry.Attr.Size)
+	if off >= size {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	length := int64(len(buf))
+	if off+length > size {
+		length = size - off
+	}
+	bs := f.entry.ChunkSize()
+	skip := off % bs
+	for idx := off / bs; idx < int64(len(f.entry.Chunks)) && int64(len(data)) < skip+length; idx++ {
+		chunk, err := f.mirror.ReadChunk(f.entry.Chunks[idx], bs)
+		if err != nil {
+			log.Println("Error reading mirror chunk for", f.entry.Path, ":", err)
+			return nil, fuse.EIO
+		}
+		data = append(data, chunk...)
+	}
+	if int64(len(data)) <= skip {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	data = data[skip:]
+	if int64(len(data)) > length {
+		data = data[:length]
+	}
+	return fuse.ReadResultData(data), fuse.OK
+}
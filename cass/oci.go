@@ -0,0 +1,267 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//An OCI image layer is a tar stream of a tree, optionally gzip compressed.  A layer
+//exported over a base only holds the entries that are new or changed since the base and
+//marks each entry the base has that is gone with an empty whiteout file named .wh.<name>
+//in its directory, which container runtimes apply when they stack the layers.  The layer
+//is identified by the sha256 of the tar stream (its diff id) and stored under the sha256
+//of the compressed stream (its digest).
+
+//OCI_WHITEOUT is the prefix of the whiteout file of a removed entry
+const OCI_WHITEOUT = ".wh."
+
+//Media types of an OCI image
+const (
+	OCI_MANIFEST_TYPE = "application/vnd.oci.image.manifest.v1+json"
+	OCI_CONFIG_TYPE   = "application/vnd.oci.image.config.v1+json"
+	OCI_LAYER_TYPE    = "application/vnd.oci.image.layer.v1.tar"
+	OCI_LAYER_GZIP    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+//OCILayer describes a written layer
+type OCILayer struct {
+	MediaType string
+	DiffId    string
+	Digest    string
+	Size      int64
+}
+
+//countWriter counts the bytes written through it
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+//LayerWriter is a TarExporter that writes an OCI image layer and computes its digests
+type LayerWriter struct {
+	*TarExporter
+	gz     *gzip.Writer
+	diff   hash.Hash
+	digest hash.Hash
+	size   *countWriter
+}
+
+//NewLayerWriter writes a layer to w, gzip compressed with compress
+func NewLayerWriter(w io.Writer, compress bool) *LayerWriter {
+	l := &LayerWriter{diff: sha256.New(), digest: sha256.New(), size: &countWriter{}}
+	out := io.MultiWriter(w, l.digest, l.size)
+	if compress {
+		l.gz = gzip.NewWriter(out)
+		out = l.gz
+	}
+	l.TarExporter = NewTarExporter(io.MultiWriter(out, l.diff))
+	return l
+}
+
+//Whiteout marks the entry name of the layers below as removed
+func (l *LayerWriter) Whiteout(name string) error {
+	dir, file := "", name
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		dir, file = name[:i+1], name[i+1:]
+	}
+	return l.w.WriteHeader(&tar.Header{
+		Name:     dir + OCI_WHITEOUT + file,
+		Mode:     0644,
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Unix(0, 0),
+	})
+}
+
+//Close finishes the tar stream and the compression
+func (l *LayerWriter) Close() error {
+	err := l.TarExporter.Close()
+	if err == nil && l.gz != nil {
+		err = l.gz.Close()
+	}
+	return err
+}
+
+//Layer describes the layer once it is closed
+func (l *LayerWriter) Layer() *OCILayer {
+	layer := &OCILayer{
+		MediaType: OCI_LAYER_TYPE,
+		DiffId:    "sha256:" + hex.EncodeToString(l.diff.Sum(nil)),
+		Digest:    "sha256:" + hex.EncodeToString(l.digest.Sum(nil)),
+		Size:      l.size.n,
+	}
+	if l.gz != nil {
+		layer.MediaType = OCI_LAYER_GZIP
+	}
+	return layer
+}
+
+//ExportLayer writes the tree below root as an OCI image layer.  Without a base, a snapshot
+//of the same tree, every entry is written.  With one only the files and symlinks that are
+//new or changed are, along with every directory so the layer carries their attributes,
+//and a whiteout for every entry of base that is gone.
+func (c *Cass) ExportLayer(root string, base map[string]*ManifestEntry, layer *LayerWriter, progress *Progress) (*ExportReport, error) {
+	if base == nil {
+		return c.Export(root, layer, progress)
+	}
+	root = strings.Trim(root, "/")
+	rel := func(name string) string {
+		if root == "" {
+			return name
+		}
+		return strings.TrimPrefix(name, root+"/")
+	}
+	report := &ExportReport{}
+	dirs := make(map[string]bool)
+	seen := make(map[string]bool)
+	err := c.Walk(root, func(name string, hash []byte, meta *CassMetadata) error {
+		seen[name] = true
+		if meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			dirs[name] = true
+		} else if e, ok := base[name]; ok && e.equal(manifestEntry(hash, meta)) {
+			report.Unchanged++
+			return nil
+		}
+		return c.exportEntry(layer, rel(name), hash, meta, report, progress)
+	})
+	if err != nil {
+		layer.Close()
+		return report, err
+	}
+	var gone []string
+	for name := range base {
+		if !seen[name] {
+			gone = append(gone, name)
+		}
+	}
+	sort.Strings(gone)
+	for _, name := range gone {
+		//Only the topmost entry that is gone needs a whiteout, the directory it is in has to
+		//be in the layer
+		parent := parentPath(name)
+		if parent != root && !dirs[parent] {
+			continue
+		}
+		if err = layer.Whiteout(rel(name)); err != nil {
+			layer.Close()
+			return report, err
+		}
+		report.Whiteouts++
+	}
+	return report, layer.Close()
+}
+
+//ociDescriptor points at a blob of an image
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+//writeBlob stores data in the blobs of an image layout and describes it
+func writeBlob(dir string, mediaType string, data []byte) (*ociDescriptor, error) {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	err := ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", digest), data, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &ociDescriptor{MediaType: mediaType, Digest: "sha256:" + digest, Size: int64(len(data))}, nil
+}
+
+//OCIBlobPath returns where a blob is stored in the image layout at dir
+func OCIBlobPath(dir string, digest string) string {
+	return filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+//WriteOCILayout writes the config, manifest and index of a single layer image tagged tag to
+//the image layout at dir, the layer has to be stored at OCIBlobPath already.  Tools like
+//skopeo copy the layout to a registry.
+func WriteOCILayout(dir string, layer *OCILayer, tag string) error {
+	err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755)
+	if err != nil {
+		return err
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"created":      time.Now().UTC(),
+		"architecture": runtime.GOARCH,
+		"os":           "linux",
+		"config":       map[string]interface{}{},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{layer.DiffId},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	configDesc, err := writeBlob(dir, OCI_CONFIG_TYPE, config)
+	if err != nil {
+		return err
+	}
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     OCI_MANIFEST_TYPE,
+		"config":        configDesc,
+		"layers":        []*ociDescriptor{{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size}},
+	})
+	if err != nil {
+		return err
+	}
+	manifestDesc, err := writeBlob(dir, OCI_MANIFEST_TYPE, manifest)
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		manifestDesc.Annotations = map[string]string{"org.opencontainers.image.ref.name": tag}
+	}
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []*ociDescriptor{manifestDesc},
+	})
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
@@ -0,0 +1,495 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+//An overlay mount serves a writable upper environment on top of read only lower
+//environments.  A name is served from the upper environment if it is there and otherwise
+//from the first lower environment that has it.  Anything that is changed is copied up
+//first, which only copies the metadata since the data is shared.  A removed name that a
+//lower environment still has is hidden by a whiteout, a character device in the upper
+//environment, and a directory that replaced a whiteout is marked opaque so the lower
+//content it used to merge with stays hidden.
+
+//OVERLAY_OPAQUE marks an upper directory that hides the lower directories of the same name
+const OVERLAY_OPAQUE = "trusted.cassfs.opaque"
+
+//OVERLAY_UPPER is the layer of names served from the upper environment
+const OVERLAY_UPPER = -1
+
+type OverlayFs struct {
+	*CassFs
+	lower []*CassFs
+}
+
+//NewOverlayFs layers upper over lower, the first lower file system is looked at first
+func NewOverlayFs(upper *CassFs, lower []*CassFs) *OverlayFs {
+	return &OverlayFs{CassFs: upper, lower: lower}
+}
+
+//isWhiteout checks if attr belongs to a whiteout, cassfs has no other character devices
+func isWhiteout(attr *fuse.Attr) bool {
+	return attr.Mode&syscall.S_IFMT == syscall.S_IFCHR
+}
+
+//layer returns the file system of a layer
+func (o *OverlayFs) layer(layer int) *CassFs {
+	if layer == OVERLAY_UPPER {
+		return o.CassFs
+	}
+	return o.lower[layer]
+}
+
+//opaque checks if the upper directory name hides the lower ones
+func (o *OverlayFs) opaque(name string) bool {
+	_, err := o.store.GetXAttr(name, OVERLAY_OPAQUE)
+	return err == nil
+}
+
+//lowerVisible checks that no upper directory above name is a whiteout or opaque
+func (o *OverlayFs) lowerVisible(name string, context *fuse.Context) bool {
+	for dir := parentPath(name); dir != ""; dir = parentPath(dir) {
+		attr, status := o.CassFs.GetAttr(dir, context)
+		if status == fuse.OK && (isWhiteout(attr) || o.opaque(dir)) {
+			return false
+		}
+	}
+	return true
+}
+
+//lookup returns the layer name is served from and its attributes
+func (o *OverlayFs) lookup(name string, context *fuse.Context) (int, *fuse.Attr, fuse.Status) {
+	attr, status := o.CassFs.GetAttr(name, context)
+	if status == fuse.OK {
+		if isWhiteout(attr) {
+			return 0, nil, fuse.ENOENT
+		}
+		return OVERLAY_UPPER, attr, fuse.OK
+	}
+	if status != fuse.ENOENT || !o.lowerVisible(name, context) {
+		return 0, nil, status
+	}
+	for i, l := range o.lower {
+		attr, status = l.GetAttr(name, context)
+		if status == fuse.OK {
+			return i, attr, fuse.OK
+		}
+		if status != fuse.ENOENT {
+			return 0, nil, status
+		}
+	}
+	return 0, nil, fuse.ENOENT
+}
+
+//inLower checks if a lower environment would serve name without the upper one
+func (o *OverlayFs) inLower(name string, context *fuse.Context) bool {
+	if !o.lowerVisible(name, context) {
+		return false
+	}
+	for _, l := range o.lower {
+		if _, status := l.GetAttr(name, context); status == fuse.OK {
+			return true
+		}
+	}
+	return false
+}
+
+//copyUp copies name and the directories above it into the upper environment unless they
+//are there already
+func (o *OverlayFs) copyUp(name string, context *fuse.Context) fuse.Status {
+	if name == "" {
+		return fuse.OK
+	}
+	layer, attr, status := o.lookup(name, context)
+	if status != fuse.OK || layer == OVERLAY_UPPER {
+		return status
+	}
+	if o.readOnly() {
+		return fuse.EROFS
+	}
+	if status = o.copyUp(parentPath(name), context); status != fuse.OK {
+		return status
+	}
+	var err error
+	if attr.IsDir() {
+		dirAttr := *attr
+		err = o.store.MakeDirectory(name, &dirAttr)
+	} else {
+		err = o.store.copyEntryFrom(o.lower[layer].store, name)
+	}
+	if err != nil {
+		log.Println("Unable to copy up", name, ":", err)
+		return errorStatus(err)
+	}
+	return fuse.OK
+}
+
+//prepare makes sure the parent of a name that is about to be created is in the upper
+//environment and removes a whiteout at the name, it returns true if there was one
+func (o *OverlayFs) prepare(name string, context *fuse.Context) (bool, fuse.Status) {
+	if status := o.copyUp(parentPath(name), context); status != fuse.OK {
+		return false, status
+	}
+	attr, status := o.CassFs.GetAttr(name, context)
+	if status != fuse.OK || !isWhiteout(attr) {
+		return false, fuse.OK
+	}
+	if err := o.store.DeleteFile(name); err != nil {
+		return false, errorStatus(err)
+	}
+	return true, fuse.OK
+}
+
+//whiteout hides name in the lower environments after it was removed from the upper one
+func (o *OverlayFs) whiteout(name string, context *fuse.Context) fuse.Status {
+	if !o.inLower(name, context) {
+		return fuse.OK
+	}
+	if status := o.copyUp(parentPath(name), context); status != fuse.OK {
+		return status
+	}
+	attr := newAttr(syscall.S_IFCHR, context)
+	attr.Nlink = 1
+	if err := o.store.CreateFile(name, attr, nil); err != nil {
+		log.Println("Unable to create whiteout for", name, ":", err)
+		return errorStatus(err)
+	}
+	return fuse.OK
+}
+
+func (o *OverlayFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	_, attr, status := o.lookup(name, context)
+	return attr, status
+}
+
+func (o *OverlayFs) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	layer, _, status := o.lookup(name, context)
+	if status != fuse.OK {
+		return status
+	}
+	if mode&ACCESS_WRITE != 0 && o.readOnly() {
+		return fuse.EROFS
+	}
+	//Lower files are copied up before they are written, so their permissions are what counts
+	return o.layer(layer).permitted(name, mode, context)
+}
+
+//OpenDir merges the listings of the layers, whiteouts hide the lower entries
+func (o *OverlayFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	layer, attr, status := o.lookup(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if !attr.IsDir() {
+		return nil, fuse.Status(syscall.ENOTDIR)
+	}
+	var res []fuse.DirEntry
+	seen := make(map[string]bool)
+	if layer == OVERLAY_UPPER {
+		entries, status := o.CassFs.OpenDir(name, context)
+		if status != fuse.OK {
+			return nil, status
+		}
+		for _, e := range entries {
+			seen[e.Name] = true
+			if e.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+				res = append(res, e)
+			}
+		}
+		if o.opaque(name) || !o.lowerVisible(name, context) {
+			return sortEntries(res), fuse.OK
+		}
+		layer = 0
+	}
+	for _, l := range o.lower[layer:] {
+		entries, status := l.OpenDir(name, context)
+		if status == fuse.ENOENT {
+			continue
+		}
+		if status != fuse.OK {
+			return nil, status
+		}
+		for _, e := range entries {
+			if !seen[e.Name] {
+				seen[e.Name] = true
+				res = append(res, e)
+			}
+		}
+	}
+	return sortEntries(res), fuse.OK
+}
+
+func (o *OverlayFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	layer, _, status := o.lookup(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if layer != OVERLAY_UPPER {
+		if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) == 0 {
+			return o.lower[layer].Open(name, flags, context)
+		}
+		if status = o.copyUp(name, context); status != fuse.OK {
+			return nil, status
+		}
+	}
+	return o.CassFs.Open(name, flags, context)
+}
+
+func (o *OverlayFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if _, _, status := o.lookup(name, context); status == fuse.OK {
+		return nil, fuse.Status(syscall.EEXIST)
+	}
+	if _, status := o.prepare(name, context); status != fuse.OK {
+		return nil, status
+	}
+	return o.CassFs.Create(name, flags, mode, context)
+}
+
+func (o *OverlayFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if _, _, status := o.lookup(name, context); status == fuse.OK {
+		return fuse.Status(syscall.EEXIST)
+	}
+	replaced, status := o.prepare(name, context)
+	if status != fuse.OK {
+		return status
+	}
+	status = o.CassFs.Mkdir(name, mode, context)
+	if status == fuse.OK && replaced {
+		if err := o.store.SetXAttr(name, OVERLAY_OPAQUE, []byte("y"), 0); err != nil {
+			log.Println("Unable to mark", name, "opaque:", err)
+			return errorStatus(err)
+		}
+	}
+	return status
+}
+
+func (o *OverlayFs) Symlink(pointedTo string, linkName string, context *fuse.Context) fuse.Status {
+	if _, _, status := o.lookup(linkName, context); status == fuse.OK {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if _, status := o.prepare(linkName, context); status != fuse.OK {
+		return status
+	}
+	return o.CassFs.Symlink(pointedTo, linkName, context)
+}
+
+func (o *OverlayFs) Link(orig string, newName string, context *fuse.Context) fuse.Status {
+	if status := o.copyUp(orig, context); status != fuse.OK {
+		return status
+	}
+	if _, _, status := o.lookup(newName, context); status == fuse.OK {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if _, status := o.prepare(newName, context); status != fuse.OK {
+		return status
+	}
+	return o.CassFs.Link(orig, newName, context)
+}
+
+func (o *OverlayFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	layer, _, status := o.lookup(name, context)
+	if status != fuse.OK {
+		return "", status
+	}
+	return o.layer(layer).Readlink(name, context)
+}
+
+func (o *OverlayFs) Unlink(name string, context *fuse.Context) fuse.Status {
+	layer, _, status := o.lookup(name, context)
+	if status != fuse.OK {
+		return status
+	}
+	if o.readOnly() {
+		return fuse.EROFS
+	}
+	if layer == OVERLAY_UPPER {
+		if status = o.CassFs.Unlink(name, context); status != fuse.OK {
+			return status
+		}
+	} else if status = o.removePermitted(name, context); status != fuse.OK {
+		return status
+	}
+	return o.whiteout(name, context)
+}
+
+func (o *OverlayFs) Rmdir(name string, context *fuse.Context) fuse.Status {
+	layer, attr, status := o.lookup(name, context)
+	if status != fuse.OK {
+		return status
+	}
+	if o.readOnly() {
+		return fuse.EROFS
+	}
+	if !attr.IsDir() {
+		return fuse.Status(syscall.ENOTDIR)
+	}
+	if status = o.removePermitted(name, context); status != fuse.OK {
+		return status
+	}
+	entries, status := o.OpenDir(name, context)
+	if status != fuse.OK {
+		return status
+	}
+	if len(entries) > 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	if layer == OVERLAY_UPPER {
+		//Only whiteouts can be left in the upper directory
+		if err := o.store.RemoveDirectory(name, true); err != nil {
+			return errorStatus(err)
+		}
+	}
+	return o.whiteout(name, context)
+}
+
+//Rename copies the source up and hides it in the lower environments.  Directories that
+//exist in a lower environment can not be renamed, like with overlayfs the caller gets
+//EXDEV and falls back to copying.
+func (o *OverlayFs) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	_, attr, status := o.lookup(oldName, context)
+	if status != fuse.OK {
+		return status
+	}
+	if attr.IsDir() && o.inLower(oldName, context) {
+		return fuse.Status(syscall.EXDEV)
+	}
+	if status = o.copyUp(oldName, context); status != fuse.OK {
+		return status
+	}
+	if _, status = o.prepare(newName, context); status != fuse.OK {
+		return status
+	}
+	if status = o.CassFs.Rename(oldName, newName, context); status != fuse.OK {
+		return status
+	}
+	return o.whiteout(oldName, context)
+}
+
+func (o *OverlayFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if status := o.copyUp(name, context); status != fuse.OK {
+		return status
+	}
+	return o.CassFs.Truncate(name, size, context)
+}
+
+func (o *OverlayFs) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if status := o.copyUp(name, context); status != fuse.OK {
+		return status
+	}
+	return o.CassFs.Chmod(name, mode, context)
+}
+
+func (o *OverlayFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if status := o.copyUp(name, context); status != fuse.OK {
+		return status
+	}
+	return o.CassFs.Chown(name, uid, gid, context)
+}
+
+func (o *OverlayFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if status := o.copyUp(name, context); status != fuse.OK {
+		return status
+	}
+	return o.CassFs.Utimens(name, atime, mtime, context)
+}
+
+func (o *OverlayFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	layer, _, status := o.lookup(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return o.layer(layer).GetXAttr(name, attr, context)
+}
+
+func (o *OverlayFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	layer, _, status := o.lookup(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return o.layer(layer).ListXAttr(name, context)
+}
+
+func (o *OverlayFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if status := o.copyUp(name, context); status != fuse.OK {
+		return status
+	}
+	return o.CassFs.SetXAttr(name, attr, data, flags, context)
+}
+
+func (o *OverlayFs) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if status := o.copyUp(name, context); status != fuse.OK {
+		return status
+	}
+	return o.CassFs.RemoveXAttr(name, attr, context)
+}
+
+//copyEntryFrom copies the entry name of src to the same path in c, like CopyFile does
+//within an environment.  Only the metadata is copied and references are added to the data.
+func (c *Cass) copyEntryFrom(src *Cass, name string) error {
+	var hash, metadata []byte
+	dir, file := src.splitPath(name)
+	err := src.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", src.OwnerId, src.Environment, dir, file).Scan(&hash, &metadata)
+	if err != nil {
+		return err
+	}
+	if id := linkedInode(metadata); id != "" {
+		//The copy does not take part in the links of the lower environment
+		var meta CassMetadata
+		hash, meta, err = src.readInode(id)
+		if err != nil {
+			return err
+		}
+		meta.Inode = ""
+		meta.Attr.Nlink = 1
+		metadata, err = json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+	}
+	refs := decodeRefs(hash, metadata)
+	err = src.copyBlobs(c, refs)
+	if err != nil {
+		return err
+	}
+	newDir, newFile := c.splitPath(name)
+	err = c.incrementRefs(refs)
+	if err != nil {
+		return err
+	}
+	err = c.session.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, newDir, newFile, hash, metadata).Consistency(c.Consistency).Exec()
+	if err != nil {
+		c.decrementRefs(refs)
+		return err
+	}
+	c.dirChanged(newDir)
+	c.invalidateMetadata(name)
+	c.publish(name)
+	return nil
+}
@@ -0,0 +1,333 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/groupcache"
+)
+
+//Mounts with the chunk cache enabled can share it.  Every mount serves the chunks it owns
+//by consistent hashing to its peers over HTTP and asks the owner of any other chunk before
+//going to the cluster, so a fleet reading the same files keeps one copy of each hot chunk
+//in memory instead of one per mount.  The peers are a static list or the addresses a DNS
+//name resolves to, which is looked up again every Refresh.
+//
+//The chunks are served decoded and decrypted, so the peers have to prove they belong to the
+//fleet: with TLS every peer presents a certificate signed by the CA of the fleet, with a
+//shared secret every request carries an HMAC of its path and the time it was sent.  One of
+//them is required, and TLS when the environment is encrypted so its chunks never cross the
+//network in the clear.
+
+//DefaultPeerRefresh is how often the DNS name of the peers is looked up again
+const DefaultPeerRefresh = 30 * time.Second
+
+//PEER_AUTH_HEADER carries the HMAC of the request time and path made with the shared secret
+const PEER_AUTH_HEADER = "X-Cassfs-Peer"
+
+//PEER_TIME_HEADER carries the unix time the request was signed at
+const PEER_TIME_HEADER = "X-Cassfs-Peer-Time"
+
+//PEER_AUTH_WINDOW is how far the time of a signed request may be from the clock of the peer,
+//a captured request can not be replayed once it is older
+const PEER_AUTH_WINDOW = 30 * time.Second
+
+var ErrNoPeerCache = errors.New("Sharing the cache with peers needs the cache to be enabled")
+var ErrNoPeerAuth = errors.New("Sharing the cache with peers needs TLS certificates or a shared secret")
+var ErrPeerTLS = errors.New("Sharing the cache of an encrypted environment with peers needs TLS certificates")
+
+//PeerConfig describes the peers a mount shares its chunk cache with
+type PeerConfig struct {
+	//Listen is the address the cache is served to the peers on, without a host the first
+	//private address of this host is used (or the loopback address if there is none)
+	Listen string
+	//Self is the URL the peers reach this mount at, <scheme>://<listen address> if not set.
+	//With DNS discovery it has to be <scheme>://<address>:<port> of an address of the name.
+	Self string
+	//Peers are the URLs of the other mounts
+	Peers []string
+	//DNS is a host:port, every address the host resolves to is a peer on port
+	DNS     string
+	Refresh time.Duration
+	//CertFile and KeyFile are the certificate of this mount, CAFile the CA the certificates
+	//of the peers are signed with.  Setting them serves and asks for the chunks over TLS.
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	//Secret is shared by every mount of the fleet and signs the requests, it is read from
+	//SecretFile when it is not given
+	Secret     string
+	SecretFile string
+}
+
+//tls reports whether the peers are reached over TLS
+func (p *PeerConfig) tls() bool {
+	return p.CertFile != "" && p.CAFile != ""
+}
+
+//scheme returns the scheme of the URLs of the peers
+func (p *PeerConfig) scheme() string {
+	if p.tls() {
+		return "https://"
+	}
+	return "http://"
+}
+
+//sign returns the HMAC of the time of a request and its path made with the shared secret
+func (p *PeerConfig) sign(at string, path string) string {
+	mac := hmac.New(sha256.New, []byte(p.Secret))
+	mac.Write([]byte(at + "\n" + path))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//verify reports whether the signature of a request is valid and the request recent
+func (p *PeerConfig) verify(r *http.Request) bool {
+	at := r.Header.Get(PEER_TIME_HEADER)
+	sent, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(sent, 0))
+	if age > PEER_AUTH_WINDOW || age < -PEER_AUTH_WINDOW {
+		return false
+	}
+	signature := r.Header.Get(PEER_AUTH_HEADER)
+	return hmac.Equal([]byte(signature), []byte(p.sign(at, r.URL.EscapedPath())))
+}
+
+//listenAddr returns Listen with the default host filled in
+func (p *PeerConfig) listenAddr() (string, error) {
+	host, port, err := net.SplitHostPort(p.Listen)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = privateAddr()
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+//privateAddr returns the first private address of this host, or the loopback address
+func privateAddr() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "127.0.0.1"
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && isPrivate(ipnet.IP) {
+			return ipnet.IP.String()
+		}
+	}
+	return "127.0.0.1"
+}
+
+//isPrivate reports whether ip is in a private (RFC 1918 or unique local) range
+func isPrivate(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 || (ip4[0] == 172 && ip4[1]&0xf0 == 16) || (ip4[0] == 192 && ip4[1] == 168)
+	}
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+//peerURL returns the URL of this mount for the peers, listen is the address it is served on
+func (p *PeerConfig) peerURL(listen string) string {
+	if p.Self != "" {
+		return strings.TrimRight(p.Self, "/")
+	}
+	return p.scheme() + listen
+}
+
+//lookupPeers returns the URLs of the addresses the DNS name of the peers resolves to
+func (p *PeerConfig) lookupPeers() ([]string, error) {
+	host, port, err := net.SplitHostPort(p.DNS)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, p.scheme()+net.JoinHostPort(addr, port))
+	}
+	return peers, nil
+}
+
+//peerSet returns the sorted peers including self, without duplicates
+func peerSet(self string, peers ...[]string) []string {
+	seen := map[string]bool{self: true}
+	set := []string{self}
+	for _, list := range peers {
+		for _, peer := range list {
+			peer = strings.TrimRight(peer, "/")
+			if !seen[peer] {
+				seen[peer] = true
+				set = append(set, peer)
+			}
+		}
+	}
+	sort.Strings(set)
+	return set
+}
+
+//ServePeers shares the chunk cache of c with the peers of config.  It has to be called
+//before the first read and only once per process, the cache is served on config.Listen
+//until the process exits.
+func (c *Cass) ServePeers(config *PeerConfig) error {
+	if !c.CacheEnabled {
+		return ErrNoPeerCache
+	}
+	if config.Secret == "" && config.SecretFile != "" {
+		data, err := ioutil.ReadFile(config.SecretFile)
+		if err != nil {
+			return err
+		}
+		config.Secret = strings.TrimSpace(string(data))
+	}
+	if !config.tls() && config.Secret == "" {
+		return ErrNoPeerAuth
+	}
+	//A shared secret only signs the requests, the chunks would go out decrypted
+	if c.Keys != nil && !config.tls() {
+		return ErrPeerTLS
+	}
+	listen, err := config.listenAddr()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	self := config.peerURL(listen)
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if config.tls() {
+		client, err := loadTLS(config.CertFile, config.KeyFile, config.CAFile)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		//The peers are both clients and servers, each checks the certificate of the other
+		transport.TLSClientConfig = client
+		listener = tls.NewListener(listener, &tls.Config{
+			Certificates: client.Certificates,
+			ClientCAs:    client.RootCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})
+	}
+	pool := groupcache.NewHTTPPoolOpts(self, nil)
+	pool.Transport = func(groupcache.Context) http.RoundTripper {
+		return &signedTransport{config: config, next: transport}
+	}
+	var found []string
+	if config.DNS != "" {
+		found, err = config.lookupPeers()
+		if err != nil {
+			log.Println("Unable to look up the peers:", err)
+		}
+	}
+	pool.Set(peerSet(self, config.Peers, found)...)
+	go func() {
+		err := http.Serve(listener, &peerHandler{config: config, pool: pool})
+		if err != nil {
+			log.Println("Peer cache stopped:", err)
+		}
+	}()
+	if config.DNS != "" {
+		go config.refreshPeers(pool, self)
+	}
+	return nil
+}
+
+//peerHandler refuses the requests that are not signed with the shared secret
+type peerHandler struct {
+	config *PeerConfig
+	pool   *groupcache.HTTPPool
+}
+
+func (h *peerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.config.Secret != "" && !h.config.verify(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	h.pool.ServeHTTP(w, r)
+}
+
+//signedTransport signs the requests to the peers with the shared secret
+type signedTransport struct {
+	config *PeerConfig
+	next   http.RoundTripper
+}
+
+func (t *signedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.config.Secret == "" {
+		return t.next.RoundTrip(r)
+	}
+	signed := new(http.Request)
+	*signed = *r
+	signed.Header = make(http.Header, len(r.Header)+2)
+	for key, values := range r.Header {
+		signed.Header[key] = values
+	}
+	at := strconv.FormatInt(time.Now().Unix(), 10)
+	signed.Header.Set(PEER_TIME_HEADER, at)
+	signed.Header.Set(PEER_AUTH_HEADER, t.config.sign(at, r.URL.EscapedPath()))
+	return t.next.RoundTrip(signed)
+}
+
+//refreshPeers looks up the DNS name of the peers every Refresh and updates the pool when
+//the peers changed, it does not return
+func (p *PeerConfig) refreshPeers(pool *groupcache.HTTPPool, self string) {
+	refresh := p.Refresh
+	if refresh <= 0 {
+		refresh = DefaultPeerRefresh
+	}
+	var current []string
+	for range time.Tick(refresh) {
+		found, err := p.lookupPeers()
+		if err != nil {
+			//The peers that are known keep being used
+			log.Println("Unable to look up the peers:", err)
+			continue
+		}
+		peers := peerSet(self, p.Peers, found)
+		if strings.Join(peers, ",") == strings.Join(current, ",") {
+			continue
+		}
+		pool.Set(peers...)
+		current = peers
+	}
+}
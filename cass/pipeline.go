@@ -0,0 +1,294 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cass
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+//Blocks go through the stages of the pipeline of the environment in order before they are
+//stored, and back through them in reverse when they are read.  The id of every stage that
+//was applied is packed into the codec column of the block, one byte per stage with the
+//first stage in the lowest byte, so a block stored by a plain snappy client (codec 1)
+//reads as having gone through the snappy stage.
+
+//MAX_STAGES is the number of stages that fit in the codec of a block
+const MAX_STAGES = 3
+
+//Ids of the transforms of cassfs, custom transforms use ids from TRANSFORM_CUSTOM on
+const (
+	TRANSFORM_SNAPPY = CODEC_SNAPPY
+	TRANSFORM_AES    = 2
+	TRANSFORM_ZSTD   = CODEC_ZSTD
+	TRANSFORM_CUSTOM = 64
+)
+
+var ErrNoKey = errors.New("Encryption needs a key provider")
+var ErrSharedBlobs = errors.New("Encrypted data has to be stored per owner (--blob_scope=owner)")
+var ErrDecrypt = errors.New("Unable to decrypt data")
+
+//Transform is a stage of the pipeline
+type Transform interface {
+	//Encode returns the encoded block, or false when the stage does not apply to it
+	Encode(data []byte) ([]byte, bool, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+//TransformFactory creates a transform for a store so the transform can use its settings,
+//like the encryption keys
+type TransformFactory func(c *Cass) (Transform, error)
+
+type transformType struct {
+	name    string
+	id      int
+	feature string
+	factory TransformFactory
+}
+
+var transformLock sync.RWMutex
+var transformNames = make(map[string]*transformType)
+var transformIds = make(map[int]*transformType)
+
+func init() {
+	registerTransform("snappy", TRANSFORM_SNAPPY, FEATURE_COMPRESSION, func(c *Cass) (Transform, error) {
+		return snappyTransform{}, nil
+	})
+	registerTransform("zstd", TRANSFORM_ZSTD, FEATURE_ZSTD, func(c *Cass) (Transform, error) {
+		return zstdTransform{}, nil
+	})
+	registerTransform("aes-gcm", TRANSFORM_AES, FEATURE_ENCRYPTION, newAESTransform)
+}
+
+func registerTransform(name string, id int, feature string, factory TransformFactory) error {
+	transformLock.Lock()
+	defer transformLock.Unlock()
+	if _, ok := transformNames[name]; ok {
+		return fmt.Errorf("Transform %s is already registered", name)
+	}
+	if _, ok := transformIds[id]; ok {
+		return fmt.Errorf("Transform id %d is already registered", id)
+	}
+	t := &transformType{name: name, id: id, feature: feature, factory: factory}
+	transformNames[name] = t
+	transformIds[id] = t
+	KnownFeatures[feature] = true
+	return nil
+}
+
+//RegisterTransform makes a custom transform available to pipelines under name.  The id is
+//stored with every block the transform encoded so it can never change, it has to be from
+//TRANSFORM_CUSTOM to 127.  Environments using the transform require it of their clients.
+func RegisterTransform(name string, id int, factory TransformFactory) error {
+	if id < TRANSFORM_CUSTOM || id > 127 {
+		return fmt.Errorf("Transform id %d is not in the custom range", id)
+	}
+	return registerTransform(name, id, "transform-"+name, factory)
+}
+
+func lookupTransform(name string) (*transformType, error) {
+	transformLock.RLock()
+	defer transformLock.RUnlock()
+	t, ok := transformNames[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown transform: %s", name)
+	}
+	return t, nil
+}
+
+//CheckPipeline verifies that the stages are known and fit in the codec of a block
+func CheckPipeline(stages []string) error {
+	if len(stages) > MAX_STAGES {
+		return fmt.Errorf("A pipeline has at most %d stages", MAX_STAGES)
+	}
+	seen := make(map[string]bool)
+	for _, name := range stages {
+		if _, err := lookupTransform(name); err != nil {
+			return err
+		}
+		if seen[name] {
+			return fmt.Errorf("Transform %s is in the pipeline twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+//Pipeline returns the stages new blocks go through, the pipeline of the environment or
+//the codec of --compression when compression was asked for
+func (c *Cass) Pipeline() []string {
+	if c.Config != nil && len(c.Config.Defaults.Pipeline) > 0 {
+		return c.Config.Defaults.Pipeline
+	}
+	switch c.Compression {
+	case CODEC_SNAPPY:
+		return []string{"snappy"}
+	case CODEC_ZSTD:
+		return []string{"zstd"}
+	}
+	return nil
+}
+
+//transform returns the transform with id created for c
+func (c *Cass) transform(id int) (Transform, error) {
+	c.transformLock.Lock()
+	defer c.transformLock.Unlock()
+	if t, ok := c.transforms[id]; ok {
+		return t, nil
+	}
+	transformLock.RLock()
+	tt, ok := transformIds[id]
+	transformLock.RUnlock()
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	t, err := tt.factory(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.transforms == nil {
+		c.transforms = make(map[int]Transform)
+	}
+	c.transforms[id] = t
+	return t, nil
+}
+
+//encodeBlock runs data through the pipeline and returns the codec of the stages that
+//were applied with the encoded data
+func (c *Cass) encodeBlock(data []byte) (int, []byte, error) {
+	codec := 0
+	applied := uint(0)
+	for _, name := range c.Pipeline() {
+		tt, err := lookupTransform(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		t, err := c.transform(tt.id)
+		if err != nil {
+			return 0, nil, err
+		}
+		encoded, ok, err := t.Encode(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !ok {
+			continue
+		}
+		codec |= tt.id << (8 * applied)
+		applied++
+		data = encoded
+	}
+	return codec, data, nil
+}
+
+//decodeBlock reverses the stages recorded in codec
+func (c *Cass) decodeBlock(codec int, data []byte) ([]byte, error) {
+	var ids []int
+	for ; codec != 0; codec >>= 8 {
+		ids = append(ids, codec&0xff)
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		t, err := c.transform(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		data, err = t.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+type snappyTransform struct{}
+
+func (s snappyTransform) Encode(data []byte) ([]byte, bool, error) {
+	codec, encoded := compress(CODEC_SNAPPY, data)
+	return encoded, codec == CODEC_SNAPPY, nil
+}
+
+func (s snappyTransform) Decode(data []byte) ([]byte, error) {
+	return decompress(CODEC_SNAPPY, data)
+}
+
+type zstdTransform struct{}
+
+func (z zstdTransform) Encode(data []byte) ([]byte, bool, error) {
+	codec, encoded := compress(CODEC_ZSTD, data)
+	return encoded, codec == CODEC_ZSTD, nil
+}
+
+func (z zstdTransform) Decode(data []byte) ([]byte, error) {
+	return decompress(CODEC_ZSTD, data)
+}
+
+//aesTransform encrypts blocks with AES-GCM and the key of the environment, every block
+//starts with its random nonce
+type aesTransform struct {
+	aead cipher.AEAD
+}
+
+func newAESTransform(c *Cass) (Transform, error) {
+	if c.Keys == nil {
+		return nil, ErrNoKey
+	}
+	//Blocks are shared by hash, in the global scope a block encrypted with one key
+	//would be read by environments with another
+	if !c.IsolatedBlobs {
+		return nil, ErrSharedBlobs
+	}
+	key, err := c.Keys.Key()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesTransform{aead: aead}, nil
+}
+
+func (a *aesTransform) Encode(data []byte) ([]byte, bool, error) {
+	nonce := make([]byte, a.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, false, err
+	}
+	return a.aead.Seal(nonce, nonce, data, nil), true, nil
+}
+
+func (a *aesTransform) Decode(data []byte) ([]byte, error) {
+	size := a.aead.NonceSize()
+	if len(data) < size {
+		return nil, ErrDecrypt
+	}
+	plain, err := a.aead.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
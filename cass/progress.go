@@ -0,0 +1,118 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//Progress counts the work done by a long running operation.  The totals are optional and
+//only used to estimate the time left.  All methods can be called on a nil Progress.
+type Progress struct {
+	lock       sync.Mutex
+	Files      int64
+	Bytes      int64
+	TotalFiles int64
+	TotalBytes int64
+	Started    time.Time
+}
+
+//NewProgress returns a progress counter for work of the given size, 0 if it is unknown
+func NewProgress(totalFiles int64, totalBytes int64) *Progress {
+	return &Progress{
+		TotalFiles: totalFiles,
+		TotalBytes: totalBytes,
+		Started:    time.Now(),
+	}
+}
+
+//Add records files and bytes as done
+func (p *Progress) Add(files int64, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	p.Files += files
+	p.Bytes += bytes
+	p.lock.Unlock()
+}
+
+//SetTotal changes the expected size of the work
+func (p *Progress) SetTotal(files int64, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	p.TotalFiles = files
+	p.TotalBytes = bytes
+	p.lock.Unlock()
+}
+
+//ETA estimates the time left from the rate so far, it returns false if there is no estimate
+func (p *Progress) ETA() (time.Duration, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.eta()
+}
+
+func (p *Progress) eta() (time.Duration, bool) {
+	elapsed := time.Since(p.Started)
+	var done, total int64
+	switch {
+	case p.TotalBytes > 0 && p.Bytes > 0:
+		done, total = p.Bytes, p.TotalBytes
+	case p.TotalFiles > 0 && p.Files > 0:
+		done, total = p.Files, p.TotalFiles
+	default:
+		return 0, false
+	}
+	if done >= total {
+		return 0, true
+	}
+	return time.Duration(float64(elapsed) * float64(total-done) / float64(done)), true
+}
+
+//String formats the progress as key=value pairs so it is easy to parse from the logs
+func (p *Progress) String() string {
+	if p == nil {
+		return ""
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s := fmt.Sprintf("files=%d", p.Files)
+	if p.TotalFiles > 0 {
+		s += fmt.Sprintf("/%d", p.TotalFiles)
+	}
+	s += fmt.Sprintf(" bytes=%d", p.Bytes)
+	if p.TotalBytes > 0 {
+		s += fmt.Sprintf("/%d", p.TotalBytes)
+	}
+	elapsed := time.Since(p.Started)
+	s += fmt.Sprintf(" elapsed=%s", elapsed/time.Second*time.Second)
+	if eta, ok := p.eta(); ok {
+		s += fmt.Sprintf(" eta=%s", eta/time.Second*time.Second)
+	} else {
+		s += " eta=unknown"
+	}
+	return s
+}
@@ -0,0 +1,164 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+var ErrMissingData = errors.New("Data for the manifest is not in the store")
+var ErrBadManifest = errors.New("Manifest does not match the file size")
+var ErrHashMismatch = errors.New("Data does not match its hash")
+
+//ChunkHashes splits data into chunks of blockSize and returns their hashes without storing anything
+func (c *Cass) ChunkHashes(data []byte, blockSize int64) [][]byte {
+	var chunks [][]byte
+	bs := int(blockSize)
+	for start := 0; start < len(data); start += bs {
+		end := start + bs
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, c.hash(data[start:end]))
+	}
+	return chunks
+}
+
+//HasChunk checks if the data for hash is already in the store
+func (c *Cass) HasChunk(hash []byte) (bool, error) {
+	return c.reuseBlob(c.OwnerId, hash)
+}
+
+//MissingChunks returns the hashes in chunks that are not in the store
+func (c *Cass) MissingChunks(chunks [][]byte) ([][]byte, error) {
+	var missing [][]byte
+	checked := make(map[string]bool)
+	for _, hash := range storedChunks(chunks) {
+		if checked[string(hash)] {
+			continue
+		}
+		checked[string(hash)] = true
+		ok, err := c.HasChunk(hash)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			missing = append(missing, hash)
+		}
+	}
+	return missing, nil
+}
+
+//PutChunk stores data under hash if it is not already there.  The hash is checked against
+//the data with the algorithm it was made with.
+func (c *Cass) PutChunk(hash []byte, data []byte) error {
+	hasher, err := ParseHasher(HashAlgorithm(hash))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hasher.Sum(data), hash) {
+		return ErrHashMismatch
+	}
+	return c.writeChunk(hash, data)
+}
+
+//LinkChunks creates or replaces the file name with the content described by chunks of
+//blockSize, all of which have to be in the store already.  Together with MissingChunks and
+//PutChunk this lets a client that knows the hashes of its content only send the data the
+//store does not have.
+func (c *Cass) LinkChunks(name string, chunks [][]byte, blockSize int64, attr *fuse.Attr) error {
+	var oldHash, oldMeta []byte
+	err := c.CheckName(name)
+	if err != nil {
+		return err
+	}
+	err = CheckBlockSize(blockSize)
+	if err != nil {
+		return err
+	}
+	err = c.CheckSize(attr.Size)
+	if err != nil {
+		return err
+	}
+	if int64(len(chunks)) != numChunks(attr.Size, blockSize) {
+		return ErrBadManifest
+	}
+	missing, err := c.MissingChunks(chunks)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return ErrMissingData
+	}
+	dir, file := c.splitPath(name)
+	cmeta := CassMetadata{Attr: attr, Chunks: chunks, BlockSize: storedBlockSize(blockSize)}
+	if blockSize != BLOBSIZE {
+		c.useFeature(FEATURE_BLOCK_SIZE)
+	}
+	var old_refs [][]byte
+	err = c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Scan(&oldHash, &oldMeta)
+	if err == nil {
+		existing := &CassMetadata{}
+		if json.Unmarshal(oldMeta, existing) == nil && existing.Attr != nil {
+			if existing.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+				return ErrIsDir
+			}
+			cmeta.XAttr = existing.XAttr
+		}
+		old_refs = decodeRefs(oldHash, oldMeta)
+	} else if err == gocql.ErrNotFound {
+		cmeta.XAttr = c.applyDefaults(attr)
+	} else {
+		return err
+	}
+	if attr.Ctime == 0 {
+		attr.Ctime = uint64(time.Now().Unix())
+	}
+	hash := c.manifestHash(chunks)
+	meta, err := json.Marshal(cmeta)
+	if err != nil {
+		return err
+	}
+	err = c.session.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, dir, file, hash, meta).Consistency(c.Consistency).Exec()
+	if err != nil {
+		return err
+	}
+	c.cacheMetadata(name, cmeta, hash)
+	c.dirChanged(dir)
+	c.publish(name)
+	c.logChange(CHANGE_UPDATE, name)
+	if oldMeta != nil && !bytes.Equal(oldHash, hash) && c.addVersion(dir, file, oldHash, oldMeta) {
+		old_refs = nil
+	}
+	err = c.updateRefs(old_refs, chunks)
+	if err == nil && linkedInode(oldMeta) != "" {
+		//The name no longer shares the content of its inode
+		err = c.releaseEntry(oldHash, oldMeta)
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"sync"
+	"time"
+)
+
+//RateLimiter spreads the load of batch commands over time so they leave room for the
+//mounts that share the cluster.  A nil limiter does not limit anything.
+type RateLimiter struct {
+	lock  sync.Mutex
+	bytes *bucket
+	ops   *bucket
+}
+
+//bucket is a token bucket that holds at most one second worth of tokens
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+//take removes n tokens from the bucket and returns how long it takes until they are paid back
+func (b *bucket) take(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+//NewRateLimiter returns a limiter for the given bytes and operations per second, a limit
+//of 0 is unlimited.  If neither is limited nil is returned.
+func NewRateLimiter(bytesPerSecond int64, opsPerSecond float64) *RateLimiter {
+	if bytesPerSecond <= 0 && opsPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		bytes: newBucket(float64(bytesPerSecond)),
+		ops:   newBucket(opsPerSecond),
+	}
+}
+
+//Wait blocks until ops operations transferring bytes fit in the budget
+func (r *RateLimiter) Wait(ops int, bytes int) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	now := time.Now()
+	wait := r.ops.take(float64(ops), now)
+	if w := r.bytes.take(float64(bytes), now); w > wait {
+		wait = w
+	}
+	r.lock.Unlock()
+	time.Sleep(wait)
+}
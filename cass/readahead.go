@@ -0,0 +1,116 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"sync"
+)
+
+//DefaultReadahead is the number of chunks read ahead of a file that is read sequentially
+const DefaultReadahead = 4
+
+//readahead follows the reads of a file handle.  Once a read starts where the previous one
+//ended the next chunks are read in the background into the cache of the handle, so a
+//stream does not wait for a round trip at every chunk boundary.  A read anywhere else
+//stops it until the reads are sequential again.
+type readahead struct {
+	lock sync.Mutex
+	//next is the offset a sequential read continues at
+	next int64
+	//ahead is the last chunk that was prefetched
+	ahead int64
+}
+
+//readaheadWindow returns the number of chunks read ahead by the handles of f
+func (f *CassFileData) readaheadWindow() int {
+	if f.Fs == nil || f.Fs.options == nil {
+		return 0
+	}
+	return f.Fs.options.Readahead
+}
+
+//handleCacheSize is the number of chunks the cache of a handle holds, enough for the
+//chunks read ahead and the ones being read
+func handleCacheSize(window int) int {
+	return HANDLE_CACHE_CHUNKS + window
+}
+
+//follow records a read of length bytes at off and prefetches the chunks after it when the
+//reads are sequential
+func (r *readahead) follow(f *CassFileData, off int64, length int, cache *chunkCache) {
+	window := f.readaheadWindow()
+	if window <= 0 || length <= 0 {
+		return
+	}
+	bs := f.blockSize()
+	r.lock.Lock()
+	sequential := off == r.next
+	r.next = off + int64(length)
+	idx := (off + int64(length) - 1) / bs
+	first := idx + 1
+	if !sequential {
+		r.ahead = idx
+		r.lock.Unlock()
+		return
+	}
+	if r.ahead >= first {
+		first = r.ahead + 1
+	}
+	last := idx + int64(window)
+	if first > last {
+		r.lock.Unlock()
+		return
+	}
+	r.ahead = last
+	r.lock.Unlock()
+	for i := first; i <= last; i++ {
+		hash := f.storedChunk(i)
+		if hash == nil {
+			continue
+		}
+		if _, ok := cache.get(hash); ok {
+			continue
+		}
+		go func(hash []byte) {
+			data, err := f.Fs.store.ReadChunk(hash)
+			if err != nil {
+				log.Println("Unable to read ahead:", err)
+				return
+			}
+			cache.put(hash, data)
+		}(hash)
+	}
+}
+
+//storedChunk returns the hash of chunk idx when its current content is a chunk in the
+//store, nil for changed chunks, holes and chunks past the end
+func (f *CassFileData) storedChunk(idx int64) []byte {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.dirty[idx]; ok {
+		return nil
+	}
+	if idx >= int64(len(f.Chunks)) || (idx == 0 && f.Inline != nil) || isHole(f.Chunks[idx]) {
+		return nil
+	}
+	return f.Chunks[idx]
+}
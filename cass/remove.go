@@ -0,0 +1,238 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"syscall"
+
+	"github.com/gocql/gocql"
+)
+
+//REMOVE_BATCH is the number of statements sent in one batch when a tree is removed
+const REMOVE_BATCH = 100
+
+//RemoveReport counts what RemoveTree removed
+type RemoveReport struct {
+	Files    int
+	Dirs     int
+	Released int
+}
+
+//RemoveTree removes name and, when it is a directory, everything below it.  Every
+//directory is listed once and its entries are removed with a single delete of the
+//directory, the data references they held are released in batches.  This is much faster
+//than removing the entries one at a time, which is what the fuse filesystem has to do.
+func (c *Cass) RemoveTree(name string, progress *Progress) (*RemoveReport, error) {
+	report := &RemoveReport{}
+	meta, err := c.GetFiledata(name)
+	if err != nil {
+		return report, err
+	}
+	if meta.Metadata.Attr == nil || meta.Metadata.Attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		err = c.DeleteFile(name)
+		if err == nil {
+			report.Files++
+			progress.Add(1, 0)
+		}
+		return report, err
+	}
+	if name == "" {
+		//The root of the environment is not an entry, environments are deleted as a whole
+		return report, ErrIsDir
+	}
+	dirId, err := c.FindDir(name)
+	if err != nil {
+		return report, err
+	}
+	err = c.removeDir(name, dirId, report, progress)
+	if err != nil {
+		return report, err
+	}
+	err = c.DeleteFile(name)
+	if err != nil {
+		return report, err
+	}
+	report.Dirs++
+	progress.Add(1, 0)
+	c.uuidLock.Lock()
+	for p := range c.uuidCache {
+		if p == name || strings.HasPrefix(p, name+"/") {
+			delete(c.uuidCache, p)
+		}
+	}
+	c.uuidLock.Unlock()
+	return report, nil
+}
+
+//removeDir removes the contents of the directory dirId at path, the subdirectories first
+//so an interrupted removal leaves a tree that can still be walked and removed again
+func (c *Cass) removeDir(path string, dirId string, report *RemoveReport, progress *Progress) error {
+	var name string
+	var hash, metajson []byte
+	type subdir struct {
+		path string
+		id   string
+	}
+	var dirs []subdir
+	var names []string
+	var refs [][]byte
+	var inodes []string
+	type trashed struct {
+		path     string
+		hash     []byte
+		metajson []byte
+		meta     *CassMetadata
+	}
+	var trash []trashed
+	iter := c.session.Query("SELECT name, hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Iter()
+	for iter.Scan(&name, &hash, &metajson) {
+		full := path + "/" + name
+		names = append(names, full)
+		meta := &CassMetadata{}
+		if err := json.Unmarshal(metajson, meta); err != nil {
+			meta = nil
+		}
+		switch {
+		case meta != nil && meta.Attr != nil && meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR:
+			uuid, err := gocql.UUIDFromBytes(hash)
+			if err != nil {
+				log.Println("Invalid directory id for", full, ":", err)
+				continue
+			}
+			dirs = append(dirs, subdir{path: full, id: uuid.String()})
+			report.Dirs++
+		case meta != nil && meta.Inode != "":
+			//The data of linked files belongs to their inode, which other names may still use
+			inodes = append(inodes, meta.Inode)
+			report.Files++
+		case c.keepsTrash() && trashable(metajson):
+			//Moved to the trash once the entries are gone
+			trash = append(trash, trashed{full, append([]byte(nil), hash...), append([]byte(nil), metajson...), meta})
+			report.Files++
+		default:
+			refs = append(refs, dataRefs(hash, meta)...)
+			report.Files++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		err := c.removeDir(d.path, d.id, report, progress)
+		if err != nil {
+			return err
+		}
+	}
+	err := c.session.Query("DELETE FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Consistency(c.Consistency).Exec()
+	if err != nil {
+		return err
+	}
+	err = c.session.Query("DELETE FROM dirtree WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Consistency(c.Consistency).Exec()
+	if err != nil {
+		return err
+	}
+	c.dirChanged(dirId)
+	for _, t := range trash {
+		if !c.moveToTrash(t.path, t.hash, t.metajson) {
+			refs = append(refs, dataRefs(t.hash, t.meta)...)
+		}
+	}
+	versionRefs, err := c.dropDirVersions(dirId)
+	if err != nil {
+		return err
+	}
+	refs = append(refs, versionRefs...)
+	for _, id := range inodes {
+		last, hash, metajson, err := c.unlinkInode(id)
+		if err != nil {
+			return err
+		}
+		if last {
+			refs = append(refs, decodeRefs(hash, metajson)...)
+		}
+	}
+	err = c.releaseRefs(refs)
+	if err != nil {
+		return err
+	}
+	report.Released += len(refs)
+	err = c.clearExpiries(names)
+	if err != nil {
+		log.Println("Unable to clear the expirations below", path, ":", err)
+	}
+	for _, p := range names {
+		c.invalidateMetadata(p)
+	}
+	c.publish(names...)
+	c.logChange(CHANGE_DELETE, names...)
+	progress.Add(int64(len(names)), 0)
+	return nil
+}
+
+//releaseRefs removes a reference from every hash in refs, the references of the same hash
+//are combined and the updates sent in batches
+func (c *Cass) releaseRefs(refs [][]byte) error {
+	counts := make(map[string]int64)
+	for _, hash := range storedChunks(refs) {
+		counts[string(hash)]++
+	}
+	batch := c.session.NewBatch(gocql.CounterBatch)
+	for hash, count := range counts {
+		if c.IsolatedBlobs {
+			batch.Query("UPDATE owner_fileref SET refs = refs - ? WHERE cust_id = ? AND hash = ?", count, c.OwnerId, []byte(hash))
+		} else {
+			batch.Query("UPDATE fileref SET refs = refs - ? WHERE hash = ?", count, []byte(hash))
+		}
+		if batch.Size() >= REMOVE_BATCH {
+			c.Limiter.Wait(batch.Size(), 0)
+			if err := c.session.ExecuteBatch(batch); err != nil {
+				return err
+			}
+			batch = c.session.NewBatch(gocql.CounterBatch)
+		}
+	}
+	if batch.Size() == 0 {
+		return nil
+	}
+	c.Limiter.Wait(batch.Size(), 0)
+	return c.session.ExecuteBatch(batch)
+}
+
+//clearExpiries removes the expirations of names in batches
+func (c *Cass) clearExpiries(names []string) error {
+	batch := c.session.NewBatch(gocql.UnloggedBatch)
+	for _, name := range names {
+		batch.Query("DELETE FROM expirations WHERE cust_id = ? AND environment = ? AND name = ?", c.OwnerId, c.Environment, name)
+		if batch.Size() >= REMOVE_BATCH {
+			if err := c.session.ExecuteBatch(batch); err != nil {
+				return err
+			}
+			batch = c.session.NewBatch(gocql.UnloggedBatch)
+		}
+	}
+	if batch.Size() == 0 {
+		return nil
+	}
+	return c.session.ExecuteBatch(batch)
+}
@@ -0,0 +1,124 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+//The same limit linux uses for the number of links followed in a lookup
+const DefaultSymlinkDepth = 40
+
+var ErrLoop = errors.New("Too many levels of symbolic links")
+
+//splitComponents breaks a path into its parts, dropping empty and "." parts
+func splitComponents(path string) []string {
+	var parts []string
+	for _, p := range strings.Split(path, "/") {
+		if p == "" || p == "." {
+			continue
+		}
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+//Resolve walks name one component at a time following any symbolic links along the way.
+//It returns the resolved path along with its metadata.  This is the lookup used by anything
+//that resolves paths on the server side instead of through the kernel.  Absolute link targets
+//are treated as relative to the root of the environment so a link can never escape it.
+func (c *Cass) Resolve(name string) (string, *CassFsMetadata, error) {
+	var meta *CassFsMetadata
+	depth := c.SymlinkDepth
+	if depth <= 0 {
+		depth = DefaultSymlinkDepth
+	}
+	links := 0
+	seen := make(map[string]bool)
+	resolved := ""
+	remaining := splitComponents(name)
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+		if part == ".." {
+			if idx := strings.LastIndex(resolved, "/"); idx >= 0 {
+				resolved = resolved[:idx]
+			} else {
+				resolved = ""
+			}
+			meta = nil
+			continue
+		}
+		next := part
+		if resolved != "" {
+			next = resolved + "/" + part
+		}
+		m, err := c.GetFiledata(next)
+		if err != nil {
+			return "", nil, err
+		}
+		if m.Metadata.Attr.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			resolved = next
+			meta = m
+			continue
+		}
+		//Following the same link with the same remainder again can only be a cycle
+		key := next + "\x00" + strings.Join(remaining, "/")
+		links++
+		if seen[key] || links > depth {
+			return "", nil, ErrLoop
+		}
+		seen[key] = true
+		target := m.Metadata.SymlinkTarget(m.Hash)
+		if strings.HasPrefix(target, "/") {
+			resolved = ""
+		}
+		remaining = append(splitComponents(target), remaining...)
+	}
+	if meta == nil && resolved != "" {
+		m, err := c.GetFiledata(resolved)
+		if err != nil {
+			return "", nil, err
+		}
+		meta = m
+	}
+	return resolved, meta, nil
+}
+
+//ResolveParent follows the symbolic links in the directories of name but not a link it ends
+//with, the way lstat does, and returns the resolved path
+func (c *Cass) ResolveParent(name string) (string, error) {
+	parts := splitComponents(name)
+	if len(parts) == 0 || parts[len(parts)-1] == ".." {
+		resolved, _, err := c.Resolve(name)
+		return resolved, err
+	}
+	dir, _, err := c.Resolve(strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return "", err
+	}
+	if dir == "" {
+		return parts[len(parts)-1], nil
+	}
+	return dir + "/" + parts[len(parts)-1], nil
+}
@@ -0,0 +1,196 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//The retention rules of an environment bound how long what it keeps besides its current
+//content stays around: Policy.VersionAge drops versions older than it whatever their
+//number, Policy.Trash empties the trash and Policy.ManifestAge drops signed manifests older
+//than it.  The latest manifest is always kept since mounts verify against it.  The states
+//recorded by history are pruned to Policy.History, including those of entries that did not
+//change since, which their writers never prune.  The reaper applies the rules on every
+//pass, the data the dropped entries held is released for gc.
+
+//RetentionReport holds the results of applying the retention rules of an environment
+type RetentionReport struct {
+	Versions  int
+	Trash     int
+	Manifests int
+	History   int
+	//Freed are the chunks only the dropped entries referenced, with their size
+	Freed      int
+	FreedBytes int64
+	Errors     int
+}
+
+//ApplyRetention drops what is older than the retention rules of the environment allow.
+//With dryRun set nothing is dropped and the report counts what would be.
+func (c *Cass) ApplyRetention(dryRun bool) (*RetentionReport, error) {
+	report := &RetentionReport{}
+	if c.Config == nil {
+		return report, nil
+	}
+	now := time.Now()
+	if age := c.Config.Policy.VersionAge; age > 0 {
+		err := c.expireVersions(now.Add(-age), dryRun, report)
+		if err != nil {
+			return report, err
+		}
+	}
+	if c.Config.Policy.History > 0 {
+		cutoff, err := c.historyCutoff()
+		if err == nil {
+			err = c.expireHistory(cutoff, dryRun, report)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	trash, err := c.EmptyTrash(false, dryRun)
+	if err != nil {
+		return report, err
+	}
+	report.Trash = trash.Files
+	report.Freed += trash.Freed
+	report.FreedBytes += trash.FreedBytes
+	if age := c.Config.Policy.ManifestAge; age > 0 {
+		err = c.expireManifests(now.Add(-age), dryRun, report)
+	}
+	return report, err
+}
+
+//expireVersions drops the versions that were replaced before cutoff
+func (c *Cass) expireVersions(cutoff time.Time, dryRun bool, report *RetentionReport) error {
+	type expired struct {
+		dir     string
+		name    string
+		version gocql.UUID
+		refs    [][]byte
+	}
+	var dir, name string
+	var version gocql.UUID
+	var hash, metajson []byte
+	var drop []expired
+	refs := newImpactRefs()
+	iter := c.session.Query("SELECT directory, name, version, hash, metadata FROM file_versions WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Iter()
+	for iter.Scan(&dir, &name, &version, &hash, &metajson) {
+		if !version.Time().Before(cutoff) {
+			continue
+		}
+		drop = append(drop, expired{dir, name, version, decodeRefs(hash, metajson)})
+		refs.add(hash, metajson)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	report.Versions = len(drop)
+	impact := &Impact{}
+	if err := c.resolveImpact(refs, impact); err != nil {
+		return err
+	}
+	report.Freed += impact.Freed
+	report.FreedBytes += impact.FreedBytes
+	if dryRun {
+		return nil
+	}
+	for _, v := range drop {
+		_, err := c.dropVersion(v.dir, v.name, v.version, v.refs)
+		if err != nil {
+			log.Println("Unable to drop the version", v.version.Time().UTC().Format(VERSION_FORMAT), "of", v.name, ":", err)
+			report.Errors++
+		}
+	}
+	return nil
+}
+
+//expireHistory drops the states of entries that can no longer be read at cutoff
+func (c *Cass) expireHistory(cutoff time.Time, dryRun bool, report *RetentionReport) error {
+	var expired []historyState
+	dirs, err := c.historyDirs()
+	if err != nil {
+		return err
+	}
+	refs := newImpactRefs()
+	for _, dirId := range dirs {
+		states, err := c.expiredHistory(dirId, "", cutoff)
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			if s.held {
+				refs.add(s.hash, s.metajson)
+			}
+		}
+		expired = append(expired, states...)
+	}
+	impact := &Impact{}
+	if err := c.resolveImpact(refs, impact); err != nil {
+		return err
+	}
+	report.Freed += impact.Freed
+	report.FreedBytes += impact.FreedBytes
+	if dryRun {
+		report.History = len(expired)
+		return nil
+	}
+	report.History, err = c.dropHistory(expired)
+	if err != nil {
+		log.Println("Unable to prune the history:", err)
+		report.Errors++
+	}
+	return nil
+}
+
+//expireManifests drops the signed manifests created before cutoff other than the latest
+func (c *Cass) expireManifests(cutoff time.Time, dryRun bool, report *RetentionReport) error {
+	var id gocql.UUID
+	var created time.Time
+	var drop []gocql.UUID
+	latest := true
+	iter := c.session.Query("SELECT id, created FROM manifests WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Iter()
+	for iter.Scan(&id, &created) {
+		if !latest && created.Before(cutoff) {
+			drop = append(drop, id)
+		}
+		latest = false
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	report.Manifests = len(drop)
+	if dryRun {
+		return nil
+	}
+	for _, id := range drop {
+		err := c.session.Query("DELETE FROM manifests WHERE cust_id = ? AND environment = ? AND id = ?", c.OwnerId, c.Environment, id).Consistency(c.Consistency).Exec()
+		if err != nil {
+			log.Println("Unable to drop the manifest", id.String(), ":", err)
+			report.Errors++
+		}
+	}
+	return nil
+}
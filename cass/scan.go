@@ -0,0 +1,307 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//QUARANTINE_SUFFIX is added to the name of an environment to get the environment rejected
+//content is moved to
+const QUARANTINE_SUFFIX = ".quarantine"
+
+//Extended attributes that record why and from where content was quarantined
+const (
+	XATTR_QUARANTINE_PATH      = "user.cassfs.quarantine.path"
+	XATTR_QUARANTINE_SIGNATURE = "user.cassfs.quarantine.signature"
+)
+
+//SCAN_TIMEOUT limits how long a scanner may take to answer
+const SCAN_TIMEOUT = 5 * time.Minute
+
+var ErrQuarantined = errors.New("Content was rejected by the scanner and quarantined")
+
+//Scanner checks content before it is published, it returns the name of what it found
+//when the content is rejected
+type Scanner interface {
+	Scan(r io.Reader) (clean bool, found string, err error)
+}
+
+//ParseScanner creates a scanner from its address:
+//clamd:///path/to/clamd.sock, clamd://host:port or icap://host:port/service
+func ParseScanner(address string) (Scanner, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "clamd":
+		if u.Host == "" {
+			return &clamdScanner{network: "unix", address: u.Path}, nil
+		}
+		return &clamdScanner{network: "tcp", address: u.Host}, nil
+	case "icap":
+		host := u.Host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host += ":1344"
+		}
+		return &icapScanner{address: host, service: u.String()}, nil
+	}
+	return nil, fmt.Errorf("Unsupported scanner: %s", address)
+}
+
+//clamdScanner streams content to clamd with the INSTREAM command
+type clamdScanner struct {
+	network string
+	address string
+}
+
+func (s *clamdScanner) Scan(r io.Reader) (bool, string, error) {
+	conn, err := net.DialTimeout(s.network, s.address, 30*time.Second)
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SCAN_TIMEOUT))
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return false, "", err
+	}
+	buf := make([]byte, 64*1024)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return false, "", err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return false, "", err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, "", err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return false, "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return false, "", err
+	}
+	//The reply is "stream: OK" or "stream: <signature> FOUND"
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return true, "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return false, strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return false, "", errors.New("clamd: " + reply)
+}
+
+//icapScanner sends content to an ICAP server as the body of a response (RESPMOD), a
+//server that wants to change the response has found something
+type icapScanner struct {
+	address string
+	service string
+}
+
+func (s *icapScanner) Scan(r io.Reader) (bool, string, error) {
+	conn, err := net.DialTimeout("tcp", s.address, 30*time.Second)
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SCAN_TIMEOUT))
+	resHeader := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nEncapsulated: res-hdr=0, res-body=%d\r\n\r\n", s.service, s.address, len(resHeader))
+	w.WriteString(resHeader)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, "", err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return false, "", err
+	}
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return false, "", err
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 2 {
+		return false, "", errors.New("icap: invalid reply " + status)
+	}
+	if fields[1] == "204" {
+		return true, "", nil
+	}
+	if fields[1] != "200" {
+		return false, "", errors.New("icap: " + strings.TrimSpace(status))
+	}
+	//The name of what was found is in one of the headers the common servers use
+	found := "unknown"
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if err != nil || line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch strings.ToLower(parts[0]) {
+		case "x-infection-found", "x-virus-id", "x-violations-found":
+			found = strings.TrimSpace(parts[1])
+		}
+	}
+	return false, found, nil
+}
+
+//chunkReader reads the current content of a file a chunk at a time, the file has to be
+//locked while it is used
+type chunkReader struct {
+	f   *CassFileData
+	idx int64
+	buf []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.idx >= numChunks(r.f.Attr.Size, r.f.blockSize()) {
+			return 0, io.EOF
+		}
+		data, err := r.f.chunk(r.idx, nil)
+		if err != nil {
+			return 0, err
+		}
+		chunk := make([]byte, chunkLen(r.idx, r.f.Attr.Size, r.f.blockSize()))
+		copy(chunk, data)
+		r.buf = chunk
+		r.idx++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+//scanned reports whether files saved at name go through the scanner
+func (c *CassFs) scanned(name string) bool {
+	if c.options.Scanner == nil {
+		return false
+	}
+	if len(c.options.ScanPaths) == 0 {
+		return true
+	}
+	for _, prefix := range c.options.ScanPaths {
+		prefix = strings.Trim(prefix, "/")
+		if prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+//scanFile runs the changed content of fd through the scanner before it is saved at name.
+//Rejected content is moved to the quarantine environment and fd goes back to what is
+//stored.  fd has to be locked.
+func (c *CassFs) scanFile(fd *CassFileData, name string) error {
+	if len(fd.dirty) == 0 || !c.scanned(name) {
+		return nil
+	}
+	clean, found, err := c.options.Scanner.Scan(&chunkReader{f: fd})
+	if err != nil {
+		//Nothing is published unscanned, the save is tried again on the next flush
+		log.Println("Unable to scan", name, ":", err)
+		return err
+	}
+	if clean {
+		return nil
+	}
+	log.Println("Quarantining", name, ":", found)
+	err = c.quarantine(fd, name, found)
+	if err != nil {
+		log.Println("Unable to quarantine", name, ":", err)
+	}
+	//The rejected changes are dropped
+	fd.dirty = nil
+	fd.Dirty = false
+	if meta, err := c.store.GetFiledata(name); err == nil && meta.Metadata.Attr != nil {
+		*fd.Attr = *meta.Metadata.Attr
+		fd.Hash = meta.Hash
+		fd.BlockSize = meta.Metadata.BlockSize
+		fd.stored(meta.Metadata.Chunks, meta.Metadata.Inline)
+	}
+	return ErrQuarantined
+}
+
+//quarantine saves the content of fd in the quarantine environment, named by the time and
+//the path it was written to
+func (c *CassFs) quarantine(fd *CassFileData, name string, found string) error {
+	q, err := c.store.ForEnvironment(c.store.Environment + QUARANTINE_SUFFIX)
+	if err != nil {
+		return err
+	}
+	chunks, err := fd.manifest(q)
+	if err != nil {
+		return err
+	}
+	qname := time.Now().UTC().Format("20060102T150405.000000000") + "-" + strings.Replace(name, "/", "_", -1)
+	attr := *fd.Attr
+	err = q.LinkChunks(qname, chunks, fd.blockSize(), &attr)
+	if err != nil {
+		return err
+	}
+	err = q.SetXAttr(qname, XATTR_QUARANTINE_PATH, []byte(name), 0)
+	if err != nil {
+		return err
+	}
+	return q.SetXAttr(qname, XATTR_QUARANTINE_SIGNATURE, []byte(found), 0)
+}
@@ -0,0 +1,349 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	ErrBadSignature = errors.New("Manifest signature does not match")
+	ErrTampered     = errors.New("Content does not match the signed manifest")
+	ErrChanged      = errors.New("Environment changed while the manifest was built")
+)
+
+//ManifestEntry is what a signed manifest records about an entry, everything that is
+//served for it has to match
+type ManifestEntry struct {
+	Mode uint32
+	Uid  uint32
+	Gid  uint32
+	Size uint64
+	//Data is the hash of files stored as a single blob, Chunks the manifest of the others
+	Data   []byte   `json:",omitempty"`
+	Chunks [][]byte `json:",omitempty"`
+	Target string   `json:",omitempty"`
+	//BlockSize of the chunks, it is not set for BLOBSIZE
+	BlockSize int64 `json:",omitempty"`
+}
+
+//EnvManifest is a signed record of the whole namespace of an environment at one point in
+//time.  The entries form a Merkle tree by directory, the signature covers its root.
+type EnvManifest struct {
+	Id          string
+	Owner       int64
+	Environment string
+	Created     time.Time
+	Root        []byte
+	Signature   []byte
+	Entries     map[string]*ManifestEntry
+}
+
+//manifestEntry builds the manifest entry of an entry as it is stored
+func manifestEntry(hash []byte, meta *CassMetadata) *ManifestEntry {
+	e := &ManifestEntry{
+		Mode: meta.Attr.Mode,
+		Uid:  meta.Attr.Uid,
+		Gid:  meta.Attr.Gid,
+		Size: meta.Attr.Size,
+	}
+	switch meta.Attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		//The hash of a directory is its id and changes when it is copied
+		e.Size = 0
+	case syscall.S_IFLNK:
+		e.Target = meta.SymlinkTarget(hash)
+	default:
+		if len(meta.Chunks) > 0 {
+			e.Chunks = meta.Chunks
+			e.BlockSize = meta.BlockSize
+		} else {
+			e.Data = hash
+		}
+	}
+	return e
+}
+
+func (e *ManifestEntry) equal(o *ManifestEntry) bool {
+	if e.Mode != o.Mode || e.Uid != o.Uid || e.Gid != o.Gid || e.Size != o.Size || e.Target != o.Target || e.BlockSize != o.BlockSize {
+		return false
+	}
+	if !bytes.Equal(e.Data, o.Data) || len(e.Chunks) != len(o.Chunks) {
+		return false
+	}
+	for i := range e.Chunks {
+		if !bytes.Equal(e.Chunks[i], o.Chunks[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//BuildManifest records every entry of the environment, it still has to be signed
+func (c *Cass) BuildManifest() (*EnvManifest, error) {
+	m := &EnvManifest{
+		Id:          gocql.TimeUUID().String(),
+		Owner:       c.OwnerId,
+		Environment: c.Environment,
+		Created:     time.Now(),
+		Entries:     make(map[string]*ManifestEntry),
+	}
+	err := c.Walk("", func(path string, hash []byte, meta *CassMetadata) error {
+		m.Entries[path] = manifestEntry(hash, meta)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	//A change made during the walk leaves the entries out of step with the tree
+	root, err := c.DirHash("")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(root, m.merkleRoot()) {
+		return nil, ErrChanged
+	}
+	return m, nil
+}
+
+//merkleRoot hashes the entries the same way the store hashes the namespace, so the root
+//matches the tree hash of the environment the manifest was built from
+func (m *EnvManifest) merkleRoot() []byte {
+	return m.dirHashes()[""]
+}
+
+//dirHashes returns the hash of the contents of every directory of the manifest by path,
+//which matches the DirHash of the directory in the environment when nothing below it
+//changed
+func (m *EnvManifest) dirHashes() map[string][]byte {
+	hashed := make(map[string][]byte)
+	children := make(map[string][]string)
+	for p := range m.Entries {
+		parent := parentPath(p)
+		children[parent] = append(children[parent], p)
+	}
+	var dir func(p string) []byte
+	dir = func(p string) []byte {
+		hashes := make(map[string][]byte, len(children[p]))
+		for _, k := range children[p] {
+			e := m.Entries[k]
+			var sub []byte
+			if e.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+				sub = dir(k)
+			}
+			hashes[k[strings.LastIndex(k, "/")+1:]] = entryHash(e, sub)
+		}
+		hashed[p] = treeHash(hashes)
+		return hashed[p]
+	}
+	dir("")
+	return hashed
+}
+
+//matchingSubtrees returns a SkipFunc for WalkTree that skips the directories whose contents
+//still match the manifest and records them in matched
+func (m *EnvManifest) matchingSubtrees(matched map[string]bool) SkipFunc {
+	hashes := m.dirHashes()
+	return func(path string, hash []byte) bool {
+		if h, ok := hashes[path]; ok && bytes.Equal(h, hash) {
+			matched[path] = true
+			return true
+		}
+		return false
+	}
+}
+
+//inSubtree checks if path is below one of the directories in dirs
+func inSubtree(path string, dirs map[string]bool) bool {
+	for len(path) > 0 {
+		path = parentPath(path)
+		if dirs[path] {
+			return true
+		}
+	}
+	return false
+}
+
+//signed returns the message the signature is made over, it binds the root to the
+//environment and the manifest so a signature can not be replayed on another one
+func (m *EnvManifest) signed() []byte {
+	msg := fmt.Sprintf("cassfs-manifest\x00%d\x00%s\x00%s\x00%d\x00", m.Owner, m.Environment, m.Id, m.Created.Unix())
+	return append([]byte(msg), m.Root...)
+}
+
+//Sign computes the root of the manifest and signs it
+func (m *EnvManifest) Sign(key ed25519.PrivateKey) {
+	m.Root = m.merkleRoot()
+	m.Signature = ed25519.Sign(key, m.signed())
+}
+
+//Verify checks that the entries match the root and the root is signed by key
+func (m *EnvManifest) Verify(key ed25519.PublicKey) error {
+	if !bytes.Equal(m.merkleRoot(), m.Root) {
+		return ErrBadSignature
+	}
+	if !ed25519.Verify(key, m.signed(), m.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+//Check compares an entry as it is stored with the manifest
+func (m *EnvManifest) Check(path string, hash []byte, meta *CassMetadata) error {
+	e, ok := m.Entries[path]
+	if !ok || meta.Attr == nil || !e.equal(manifestEntry(hash, meta)) {
+		return ErrTampered
+	}
+	return nil
+}
+
+//SaveManifest stores a signed manifest for the environment
+func (c *Cass) SaveManifest(m *EnvManifest) error {
+	id, err := gocql.ParseUUID(m.Id)
+	if err != nil {
+		return err
+	}
+	entries, err := json.Marshal(m.Entries)
+	if err != nil {
+		return err
+	}
+	return c.session.Query("INSERT INTO manifests (cust_id, environment, id, created, root, signature, entries) VALUES(?, ?, ?, ?, ?, ?, ?)", m.Owner, m.Environment, id, m.Created, m.Root, m.Signature, entries).Consistency(c.Consistency).Exec()
+}
+
+//LoadManifest reads a manifest of the environment, the latest one if id is empty
+func (c *Cass) LoadManifest(id string) (*EnvManifest, error) {
+	m := &EnvManifest{
+		Owner:       c.OwnerId,
+		Environment: c.Environment,
+	}
+	var uuid gocql.UUID
+	var entries []byte
+	var err error
+	if id == "" {
+		err = c.session.Query("SELECT id, created, root, signature, entries FROM manifests WHERE cust_id = ? AND environment = ? LIMIT 1", c.OwnerId, c.Environment).Consistency(c.Consistency).Scan(&uuid, &m.Created, &m.Root, &m.Signature, &entries)
+	} else {
+		uuid, err = gocql.ParseUUID(id)
+		if err != nil {
+			return nil, err
+		}
+		err = c.session.Query("SELECT id, created, root, signature, entries FROM manifests WHERE cust_id = ? AND environment = ? AND id = ?", c.OwnerId, c.Environment, uuid).Consistency(c.Consistency).Scan(&uuid, &m.Created, &m.Root, &m.Signature, &entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.Id = uuid.String()
+	err = json.Unmarshal(entries, &m.Entries)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//ManifestReport lists the differences between the environment and a manifest
+type ManifestReport struct {
+	Checked int
+	Changed []string
+	Added   []string
+	Missing []string
+}
+
+//CheckManifest compares every entry of the environment with a verified manifest
+func (c *Cass) CheckManifest(m *EnvManifest) (*ManifestReport, error) {
+	report := &ManifestReport{}
+	//Nothing has to be walked when the tree hash still matches the signed root
+	if root, err := c.DirHash(""); err == nil && bytes.Equal(root, m.Root) {
+		report.Checked = len(m.Entries)
+		return report, nil
+	}
+	seen := make(map[string]bool, len(m.Entries))
+	//Only the directories whose hashes differ from the manifest are read
+	matched := make(map[string]bool)
+	err := c.WalkTree("", m.matchingSubtrees(matched), func(path string, hash []byte, meta *CassMetadata) error {
+		report.Checked++
+		if _, ok := m.Entries[path]; !ok {
+			report.Added = append(report.Added, path)
+			return nil
+		}
+		seen[path] = true
+		if m.Check(path, hash, meta) != nil {
+			report.Changed = append(report.Changed, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for p := range m.Entries {
+		if seen[p] {
+			continue
+		}
+		if inSubtree(p, matched) {
+			report.Checked++
+			continue
+		}
+		report.Missing = append(report.Missing, p)
+	}
+	sort.Strings(report.Missing)
+	return report, nil
+}
+
+//GenerateSigningKey creates a key pair to sign manifests with
+func GenerateSigningKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+//readKeyFile reads a base64 encoded key of size bytes
+func readKeyFile(path string, size int) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != size {
+		return nil, errors.New("Invalid key file: " + path)
+	}
+	return key, nil
+}
+
+//LoadSigningKey reads the private key manifests are signed with
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	key, err := readKeyFile(path, ed25519.PrivateKeySize)
+	return ed25519.PrivateKey(key), err
+}
+
+//LoadVerifyKey reads the public key manifests are verified with
+func LoadVerifyKey(path string) (ed25519.PublicKey, error) {
+	key, err := readKeyFile(path, ed25519.PublicKeySize)
+	return ed25519.PublicKey(key), err
+}
@@ -0,0 +1,223 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//SLO_MAX_SAMPLES is the number of latencies kept per operation and interval, later ones
+//replace random earlier ones so the percentiles stay representative
+const SLO_MAX_SAMPLES = 4096
+
+//SLO_MIN_SAMPLES is the number of operations an interval needs before its percentile is
+//compared with the target, a handful of slow calls on an idle mount is not a violation
+const SLO_MIN_SAMPLES = 20
+
+var ErrBadSLO = errors.New("SLO must be of the form op:pNN<duration, e.g. getattr:p99<20ms")
+
+//sloWriteOps are the operations that change the file system, persistent violations of
+//their SLOs can switch the mount to read only
+var sloWriteOps = map[string]bool{
+	"CREATE": true, "MKDIR": true, "MKNOD": true, "RENAME": true, "RMDIR": true,
+	"SETATTR": true, "SETXATTR": true, "REMOVEXATTR": true, "SYMLINK": true,
+	"LINK": true, "UNLINK": true, "WRITE": true, "FLUSH": true, "FALLOCATE": true,
+}
+
+//SLO is a latency target for a FUSE operation, Percentile of the calls have to finish
+//within Target
+type SLO struct {
+	Op         string
+	Percentile float64
+	Target     time.Duration
+}
+
+//ParseSLO reads an SLO written as op:pNN<duration (or op:pNN=duration), the operation
+//is the FUSE operation name such as getattr, lookup, read or write
+func ParseSLO(s string) (*SLO, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, ErrBadSLO
+	}
+	sep := strings.IndexAny(parts[1], "<=")
+	if sep < 2 || parts[1][0] != 'p' {
+		return nil, ErrBadSLO
+	}
+	percentile, err := strconv.ParseFloat(parts[1][1:sep], 64)
+	if err != nil || percentile <= 0 || percentile > 100 {
+		return nil, ErrBadSLO
+	}
+	target, err := time.ParseDuration(parts[1][sep+1:])
+	if err != nil || target <= 0 {
+		return nil, ErrBadSLO
+	}
+	return &SLO{Op: strings.ToUpper(parts[0]), Percentile: percentile, Target: target}, nil
+}
+
+//SLOStatus is the state of an SLO after the last interval that was checked
+type SLOStatus struct {
+	SLO
+	//Current is the percentile of the last interval, Samples the operations it covers
+	Current time.Duration
+	Samples int
+	//Violations counts the intervals the target was missed in
+	Violations int
+	Failing    bool
+}
+
+//sloSamples are the latencies of one operation in the current interval
+type sloSamples struct {
+	count  int
+	sample []time.Duration
+}
+
+//SLOTracker collects the latencies of the FUSE operations of a mount, it is passed to
+//the RecordLatencies of the server.  Every interval the percentiles are compared with the
+//targets and violations are logged.  With DegradeAfter set a mount whose write operations
+//miss their targets for that many intervals in a row calls OnDegrade, once.
+type SLOTracker struct {
+	lock         sync.Mutex
+	status       []*SLOStatus
+	samples      map[string]*sloSamples
+	writeStreak  int
+	degraded     bool
+	DegradeAfter int
+	OnDegrade    func()
+}
+
+func NewSLOTracker(slos []*SLO) *SLOTracker {
+	t := &SLOTracker{samples: make(map[string]*sloSamples)}
+	for _, slo := range slos {
+		t.status = append(t.status, &SLOStatus{SLO: *slo})
+		t.samples[slo.Op] = &sloSamples{}
+	}
+	return t
+}
+
+//Add records the latency of a call of the operation name
+func (t *SLOTracker) Add(name string, dt time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s, ok := t.samples[name]
+	if !ok {
+		return
+	}
+	s.count++
+	if len(s.sample) < SLO_MAX_SAMPLES {
+		s.sample = append(s.sample, dt)
+		return
+	}
+	//Reservoir sampling keeps every call equally likely to be in the sample
+	if idx := rand.Intn(s.count); idx < SLO_MAX_SAMPLES {
+		s.sample[idx] = dt
+	}
+}
+
+//percentile returns the latency p percent of the sorted samples are within
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+//check compares the samples of the interval that just ended with the targets
+func (t *SLOTracker) check() {
+	t.lock.Lock()
+	samples := t.samples
+	t.samples = make(map[string]*sloSamples, len(samples))
+	for op := range samples {
+		t.samples[op] = &sloSamples{}
+	}
+	writesFailing := false
+	for _, status := range t.status {
+		s := samples[status.Op]
+		status.Samples = s.count
+		status.Failing = false
+		if s.count < SLO_MIN_SAMPLES {
+			continue
+		}
+		sorted := append([]time.Duration{}, s.sample...)
+		sort.Sort(durations(sorted))
+		status.Current = percentile(sorted, status.Percentile)
+		if status.Current <= status.Target {
+			continue
+		}
+		status.Failing = true
+		status.Violations++
+		writesFailing = writesFailing || sloWriteOps[status.Op]
+		log.Printf("SLO violated: %s p%g was %s over %d calls, the target is %s\n", strings.ToLower(status.Op), status.Percentile, status.Current, s.count, status.Target)
+	}
+	if writesFailing {
+		t.writeStreak++
+	} else {
+		t.writeStreak = 0
+	}
+	degrade := t.DegradeAfter > 0 && t.writeStreak >= t.DegradeAfter && !t.degraded
+	if degrade {
+		t.degraded = true
+	}
+	t.lock.Unlock()
+	if degrade && t.OnDegrade != nil {
+		log.Println("Write SLOs failed", t.writeStreak, "intervals in a row, switching to read only")
+		t.OnDegrade()
+	}
+}
+
+//Run checks the SLOs every interval, it does not return
+func (t *SLOTracker) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.check()
+	}
+}
+
+//Status returns the state of every SLO after the last interval
+func (t *SLOTracker) Status() []SLOStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := make([]SLOStatus, len(t.status))
+	for i, status := range t.status {
+		ret[i] = *status
+	}
+	return ret
+}
+
+//Degraded reports if the tracker switched the mount to read only
+func (t *SLOTracker) Degraded() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.degraded
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
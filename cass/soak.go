@@ -0,0 +1,318 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//SOAK_POOL is the number of distinct chunks the files of a soak run are made of, so
+//the same data is referenced by many files at once
+const SOAK_POOL = 16
+
+//The operations of the soak workload and how often each is picked
+var soakOps = []struct {
+	name   string
+	weight int
+}{
+	{"write", 30},
+	{"read", 40},
+	{"rename", 10},
+	{"delete", 15},
+	{"list", 5},
+}
+
+//SoakOptions controls a soak run
+type SoakOptions struct {
+	//Root is the directory the workers create their files in, it is removed at the end
+	Root     string
+	Clients  int
+	Duration time.Duration
+	//Window is the period the latency is averaged over to show drift
+	Window time.Duration
+	//MaxChunks is the largest number of chunks a file is written with
+	MaxChunks int
+	Progress  *Progress
+}
+
+//SoakStats are the results of one kind of operation
+type SoakStats struct {
+	Ops    int64
+	Errors int64
+	Total  time.Duration
+	Max    time.Duration
+}
+
+//Mean returns the average latency of the operations
+func (s *SoakStats) Mean() time.Duration {
+	if s.Ops == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Ops)
+}
+
+//SoakReport holds the results of a soak run.  Windows is the mean latency of every
+//window of the run in order, Corrupt counts reads that returned other data than was
+//written and RefErrors the chunks whose reference count did not return to where it was
+//before the run once every file was removed.
+type SoakReport struct {
+	Ops       map[string]*SoakStats
+	Windows   []time.Duration
+	Corrupt   int64
+	RefErrors int
+}
+
+//soakRun is the shared state of the workers
+type soakRun struct {
+	sync.Mutex
+	c       *Cass
+	opts    *SoakOptions
+	report  *SoakReport
+	pool    [][]byte
+	chunks  [][]byte
+	bs      int64
+	started time.Time
+	windows []SoakStats
+}
+
+//record adds the result of an operation to the report
+func (r *soakRun) record(op string, started time.Time, err error) {
+	elapsed := time.Since(started)
+	r.Lock()
+	defer r.Unlock()
+	stats := r.report.Ops[op]
+	stats.Ops++
+	stats.Total += elapsed
+	if elapsed > stats.Max {
+		stats.Max = elapsed
+	}
+	if err != nil {
+		stats.Errors++
+	}
+	idx := int(started.Sub(r.started) / r.opts.Window)
+	for len(r.windows) <= idx {
+		r.windows = append(r.windows, SoakStats{})
+	}
+	r.windows[idx].Ops++
+	r.windows[idx].Total += elapsed
+	r.opts.Progress.Add(1, 0)
+}
+
+//content returns the data a file made of the pool chunks in parts has
+func (r *soakRun) content(parts []int) []byte {
+	var data []byte
+	for _, p := range parts {
+		data = append(data, r.pool[p]...)
+	}
+	return data
+}
+
+//soakWorker runs the workload on the files of a single worker until the run ends
+type soakWorker struct {
+	run   *soakRun
+	rand  *rand.Rand
+	dir   string
+	files map[string][]int
+	next  int
+}
+
+func (w *soakWorker) pick() string {
+	total := 0
+	for _, op := range soakOps {
+		total += op.weight
+	}
+	n := w.rand.Intn(total)
+	for _, op := range soakOps {
+		if n < op.weight {
+			return op.name
+		}
+		n -= op.weight
+	}
+	return "write"
+}
+
+//anyFile returns one of the files of the worker
+func (w *soakWorker) anyFile() string {
+	n := w.rand.Intn(len(w.files))
+	for name := range w.files {
+		if n == 0 {
+			return name
+		}
+		n--
+	}
+	return ""
+}
+
+func (w *soakWorker) step() {
+	op := w.pick()
+	if len(w.files) == 0 {
+		op = "write"
+	}
+	c := w.run.c
+	started := time.Now()
+	var err error
+	switch op {
+	case "write":
+		name := w.anyFile()
+		if name == "" || w.rand.Intn(2) == 0 {
+			w.next++
+			name = fmt.Sprintf("%s/file-%d", w.dir, w.next)
+		}
+		parts := make([]int, 1+w.rand.Intn(w.run.opts.MaxChunks))
+		chunks := make([][]byte, len(parts))
+		for i := range parts {
+			parts[i] = w.rand.Intn(SOAK_POOL)
+			chunks[i] = w.run.chunks[parts[i]]
+		}
+		attr := &fuse.Attr{Mode: fuse.S_IFREG | 0644, Size: uint64(int64(len(parts)) * w.run.bs), Nlink: 1}
+		err = c.LinkChunks(name, chunks, w.run.bs, attr)
+		if err == nil {
+			w.files[name] = parts
+		}
+	case "read":
+		name := w.anyFile()
+		var meta *CassFsMetadata
+		var data []byte
+		meta, err = c.GetFiledata(name)
+		if err == nil {
+			data, err = c.ReadFile(meta)
+		}
+		if err == nil && !bytes.Equal(data, w.run.content(w.files[name])) {
+			log.Println("Soak: content of", name, "does not match what was written")
+			w.run.Lock()
+			w.run.report.Corrupt++
+			w.run.Unlock()
+		}
+	case "rename":
+		name := w.anyFile()
+		w.next++
+		target := fmt.Sprintf("%s/file-%d", w.dir, w.next)
+		err = c.Rename(name, target)
+		if err == nil {
+			w.files[target] = w.files[name]
+			delete(w.files, name)
+		}
+	case "delete":
+		name := w.anyFile()
+		err = c.DeleteFile(name)
+		if err == nil {
+			delete(w.files, name)
+		}
+	case "list":
+		_, err = c.OpenDir(w.dir)
+	}
+	if err != nil {
+		log.Println("Soak:", op, "failed:", err)
+	}
+	w.run.record(op, started, err)
+}
+
+//Soak runs a mixed workload of writes, reads, renames, deletes and listings from
+//opts.Clients workers against the store for opts.Duration.  Every file is made of chunks
+//from a small pool, so at the end, after the files are removed, the reference count of
+//every chunk of the pool has to be back where it was before the run.  Other writers in
+//the same environment or sharing the pool chunks make that check fail, so a run should
+//use an environment of its own.
+func (c *Cass) Soak(opts *SoakOptions) (*SoakReport, error) {
+	if opts.Window <= 0 {
+		opts.Window = time.Minute
+	}
+	if opts.MaxChunks <= 0 {
+		opts.MaxChunks = 4
+	}
+	run := &soakRun{
+		c:      c,
+		opts:   opts,
+		report: &SoakReport{Ops: make(map[string]*SoakStats)},
+		bs:     c.NewBlockSize(),
+	}
+	for _, op := range soakOps {
+		run.report.Ops[op.name] = &SoakStats{}
+	}
+	seed := time.Now().UnixNano()
+	source := rand.New(rand.NewSource(seed))
+	baseline := make([]int64, SOAK_POOL)
+	for i := 0; i < SOAK_POOL; i++ {
+		data := make([]byte, run.bs)
+		source.Read(data)
+		hash := c.hash(data)
+		if err := c.PutChunk(hash, data); err != nil {
+			return nil, err
+		}
+		refs, err := c.blobRefCount(c.OwnerId, hash)
+		if err != nil {
+			return nil, err
+		}
+		run.pool = append(run.pool, data)
+		run.chunks = append(run.chunks, hash)
+		baseline[i] = refs
+	}
+	dirAttr := &fuse.Attr{Mode: fuse.S_IFDIR | 0755}
+	if err := c.MakeDirectory(opts.Root, dirAttr); err != nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	run.started = time.Now()
+	deadline := run.started.Add(opts.Duration)
+	for i := 0; i < opts.Clients; i++ {
+		w := &soakWorker{
+			run:   run,
+			rand:  rand.New(rand.NewSource(seed + int64(i) + 1)),
+			dir:   fmt.Sprintf("%s/worker-%d", opts.Root, i),
+			files: make(map[string][]int),
+		}
+		if err := c.MakeDirectory(w.dir, dirAttr); err != nil {
+			return nil, err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				w.step()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, window := range run.windows {
+		run.report.Windows = append(run.report.Windows, window.Mean())
+	}
+	if err := c.RemoveDirectory(opts.Root, true); err != nil {
+		return run.report, err
+	}
+	for i, hash := range run.chunks {
+		refs, err := c.blobRefCount(c.OwnerId, hash)
+		if err != nil {
+			return run.report, err
+		}
+		if refs != baseline[i] {
+			log.Printf("Soak: chunk %x has %d references, %d before the run\n", hash, refs, baseline[i])
+			run.report.RefErrors++
+		}
+	}
+	return run.report, nil
+}
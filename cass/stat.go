@@ -0,0 +1,115 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//EntryStat is an entry as it is stored, for looking into damaged metadata.  The raw
+//metadata is kept even when it can not be decoded.
+type EntryStat struct {
+	Path      string
+	Directory string
+	Hash      []byte
+	Metadata  json.RawMessage
+	Written   time.Time
+	//Inode is set for hard linked files, the content and the references are the inode's
+	Inode         string          `json:",omitempty"`
+	InodeHash     []byte          `json:",omitempty"`
+	InodeMetadata json.RawMessage `json:",omitempty"`
+	InodeWritten  time.Time       `json:",omitempty"`
+	Chunks        int
+	//Refs are the reference counts of the data the entry holds, in the order of its chunks
+	Refs      []int64
+	DecodeErr string `json:",omitempty"`
+}
+
+//Stat reads the row of name from the filesystem table together with the write time of
+//its metadata and the reference counts of its data
+func (c *Cass) Stat(name string) (*EntryStat, error) {
+	var hash, metajson []byte
+	var written int64
+	dir, file := c.splitPath(name)
+	err := c.session.Query("SELECT hash, metadata, WRITETIME(metadata) FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Scan(&hash, &metajson, &written)
+	if err != nil {
+		return nil, err
+	}
+	st := &EntryStat{
+		Path:      name,
+		Directory: dir,
+		Hash:      hash,
+		Metadata:  rawJSON(metajson),
+		Written:   writeTime(written),
+	}
+	meta := &CassMetadata{}
+	if err := json.Unmarshal(metajson, meta); err != nil {
+		st.DecodeErr = err.Error()
+		return st, nil
+	}
+	if meta.Inode != "" {
+		st.Inode = meta.Inode
+		uuid, err := gocql.ParseUUID(meta.Inode)
+		if err != nil {
+			st.DecodeErr = err.Error()
+			return st, nil
+		}
+		err = c.session.Query("SELECT hash, metadata, WRITETIME(metadata) FROM inodes WHERE cust_id = ? AND environment = ? AND id = ?", c.OwnerId, c.Environment, uuid).Scan(&hash, &metajson, &written)
+		if err != nil {
+			return st, err
+		}
+		st.InodeHash = hash
+		st.InodeMetadata = rawJSON(metajson)
+		st.InodeWritten = writeTime(written)
+		meta = &CassMetadata{}
+		if err := json.Unmarshal(metajson, meta); err != nil {
+			st.DecodeErr = err.Error()
+			return st, nil
+		}
+	}
+	st.Chunks = len(meta.Chunks)
+	for _, ref := range dataRefs(hash, meta) {
+		refs, err := c.blobRefCount(c.OwnerId, ref)
+		if err != nil {
+			return st, err
+		}
+		st.Refs = append(st.Refs, refs)
+	}
+	return st, nil
+}
+
+//rawJSON keeps metadata that is not valid JSON printable as a JSON string
+func rawJSON(data []byte) json.RawMessage {
+	var v interface{}
+	if json.Unmarshal(data, &v) == nil {
+		return json.RawMessage(data)
+	}
+	quoted, _ := json.Marshal(string(data))
+	return json.RawMessage(quoted)
+}
+
+//writeTime converts a cassandra write time in microseconds
+func writeTime(micros int64) time.Time {
+	return time.Unix(micros/1000000, (micros%1000000)*1000)
+}
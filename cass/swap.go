@@ -0,0 +1,87 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+var ErrNotDir = errors.New("Not a directory")
+
+//invalidatePrefix drops every cached path at or below path
+func (c *Cass) invalidatePrefix(path string) {
+	c.uuidLock.Lock()
+	for key := range c.uuidCache {
+		if key == path || strings.HasPrefix(key, path+"/") {
+			delete(c.uuidCache, key)
+		}
+	}
+	c.uuidLock.Unlock()
+	c.fileCache.removeIf(func(key string, entry *CassFsMetadata) bool {
+		return key == path || strings.HasPrefix(key, path+"/")
+	})
+}
+
+//SwapDirectories exchanges the contents of the directories a and b.  A directory entry
+//only points at the UUID its children are stored under, so swapping the UUIDs (along with
+//the directory attributes) of the two entries in a single logged batch moves both subtrees
+//at once and other clients never see a partially swapped tree.
+func (c *Cass) SwapDirectories(a string, b string) error {
+	var hashA, hashB, metaA, metaB []byte
+	dirA, fileA := c.splitPath(a)
+	dirB, fileB := c.splitPath(b)
+	err := c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dirA, fileA).Scan(&hashA, &metaA)
+	if err != nil {
+		return err
+	}
+	err = c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dirB, fileB).Scan(&hashB, &metaB)
+	if err != nil {
+		return err
+	}
+	//Both entries have to be directories, their hash is the UUID of their children
+	if _, err := gocql.UUIDFromBytes(hashA); err != nil {
+		return ErrNotDir
+	}
+	if _, err := gocql.UUIDFromBytes(hashB); err != nil {
+		return ErrNotDir
+	}
+	batch := gocql.NewBatch(gocql.LoggedBatch)
+	batch.Cons = c.Consistency
+	batch.Query("UPDATE filesystem SET hash = ?, metadata = ? WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", hashB, metaB, c.OwnerId, c.Environment, dirA, fileA)
+	batch.Query("UPDATE filesystem SET hash = ?, metadata = ? WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", hashA, metaA, c.OwnerId, c.Environment, dirB, fileB)
+	err = c.session.ExecuteBatch(batch)
+	if err != nil {
+		return err
+	}
+	c.invalidatePrefix(a)
+	c.invalidatePrefix(b)
+	c.reparentDir(hashB, metaB, dirA)
+	c.reparentDir(hashA, metaA, dirB)
+	c.dirChanged(dirA)
+	c.dirChanged(dirB)
+	c.publish(a, b)
+	//Each path now holds what the other one did
+	c.logChange(CHANGE_UPDATE, a, b)
+	return nil
+}
@@ -0,0 +1,70 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+//SameContent checks if local has the content of the stored file without reading the data
+//of the store.  Every chunk of local is hashed with the algorithm its stored chunk was
+//hashed with, so the check still works while the data is migrated to another algorithm.
+func (c *Cass) SameContent(hash []byte, meta *CassMetadata, local io.Reader) (bool, error) {
+	if len(meta.Chunks) == 0 {
+		//Files stored before chunking are a single blob
+		data, err := ioutil.ReadAll(local)
+		if err != nil {
+			return false, err
+		}
+		if uint64(len(data)) != meta.Attr.Size {
+			return false, nil
+		}
+		return len(data) == 0 || matchesHash(hash, data), nil
+	}
+	buf := make([]byte, meta.ChunkSize())
+	var size uint64
+	for idx := 0; ; idx++ {
+		n, err := io.ReadFull(local, buf)
+		if n > 0 {
+			if idx >= len(meta.Chunks) {
+				return false, nil
+			}
+			data := buf[:n]
+			size += uint64(n)
+			if isHole(meta.Chunks[idx]) {
+				if bytes.Count(data, []byte{0}) != n {
+					return false, nil
+				}
+			} else if !matchesHash(meta.Chunks[idx], data) {
+				return false, nil
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return size == meta.Attr.Size, nil
+}
@@ -0,0 +1,130 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cass
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//Tenant is an environment of an owner
+type Tenant struct {
+	Owner       int64
+	Environment string
+}
+
+func (t Tenant) String() string {
+	return fmt.Sprintf("%d/%s", t.Owner, t.Environment)
+}
+
+type tenantList []Tenant
+
+func (l tenantList) Len() int      { return len(l) }
+func (l tenantList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l tenantList) Less(i, j int) bool {
+	if l[i].Owner != l[j].Owner {
+		return l[i].Owner < l[j].Owner
+	}
+	return l[i].Environment < l[j].Environment
+}
+
+//Tenants lists the environments that have entries, of every owner when allOwners is set
+//and otherwise of the owner of c.  It reads every partition key of the filesystem table.
+func (c *Cass) Tenants(allOwners bool) ([]Tenant, error) {
+	var tenants []Tenant
+	var t Tenant
+	iter := c.session.Query("SELECT DISTINCT cust_id, environment FROM filesystem").Iter()
+	for iter.Scan(&t.Owner, &t.Environment) {
+		if allOwners || t.Owner == c.OwnerId {
+			tenants = append(tenants, t)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	sort.Sort(tenantList(tenants))
+	return tenants, nil
+}
+
+//Environments lists the environments that have entries or a configuration, of every
+//owner when allOwners is set and otherwise of the owner of c
+func (c *Cass) Environments(allOwners bool) ([]Tenant, error) {
+	tenants, err := c.Tenants(allOwners)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[Tenant]bool, len(tenants))
+	for _, t := range tenants {
+		seen[t] = true
+	}
+	query := c.session.Query("SELECT cust_id, environment FROM envconfig WHERE cust_id = ?", c.OwnerId)
+	if allOwners {
+		query = c.session.Query("SELECT cust_id, environment FROM envconfig")
+	}
+	var t Tenant
+	iter := query.Iter()
+	for iter.Scan(&t.Owner, &t.Environment) {
+		if !seen[t] {
+			seen[t] = true
+			tenants = append(tenants, t)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	sort.Sort(tenantList(tenants))
+	return tenants, nil
+}
+
+//ForEachTenant calls fn with a store for every tenant, at most workers at once, and returns
+//the errors of the tenants fn failed for
+func (c *Cass) ForEachTenant(tenants []Tenant, workers int, fn func(t Tenant, store *Cass) error) map[Tenant]error {
+	failed := make(map[Tenant]error)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan Tenant)
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				store, err := c.ForOwner(t.Owner, t.Environment)
+				if err == nil {
+					err = fn(t, store)
+				}
+				if err != nil {
+					lock.Lock()
+					failed[t] = err
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, t := range tenants {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+	return failed
+}
@@ -0,0 +1,189 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//With Policy.Trash set a file that is deleted is moved to the trash table under its path
+//instead of being removed, and keeps its data referenced until it is restored or the
+//trash is emptied.  Entries older than the retention are removed by EmptyTrash, which
+//the reaper runs every pass.  Only regular files go to the trash: directories are
+//recreated on restore, links and linked files, whose content belongs to their inode, are
+//removed as before.
+
+var ErrNotInTrash = errors.New("Not in the trash")
+
+//TrashEntry is a deleted file in the trash
+type TrashEntry struct {
+	Path    string
+	Deleted time.Time
+	Hash    []byte
+	Meta    *CassMetadata
+	id      gocql.UUID
+}
+
+//keepsTrash checks if deleted files go to the trash
+func (c *Cass) keepsTrash() bool {
+	return c.Config != nil && c.Config.Policy.Trash > 0 && c.AsOf.IsZero()
+}
+
+//trashable checks if an entry goes to the trash
+func trashable(metajson []byte) bool {
+	meta := &CassMetadata{}
+	if json.Unmarshal(metajson, meta) != nil || meta.Attr == nil || meta.Inode != "" {
+		return false
+	}
+	return meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFREG
+}
+
+//moveToTrash records the entry name that was just removed in the trash.  It returns true
+//when the data references of the entry now belong to the trash, the caller must not
+//release them then.
+func (c *Cass) moveToTrash(name string, hash []byte, metajson []byte) bool {
+	if !c.keepsTrash() {
+		return false
+	}
+	if !trashable(metajson) {
+		return false
+	}
+	err := c.session.Query("INSERT INTO trash (cust_id, environment, path, deleted, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, strings.Trim(name, "/"), gocql.TimeUUID(), hash, metajson).Consistency(c.Consistency).Exec()
+	if err != nil {
+		log.Println("Unable to move", name, "to the trash:", err)
+		return false
+	}
+	return true
+}
+
+//Trash lists the files in the trash below prefix, or all of them when it is empty.  The
+//deletions of a path are listed newest first.
+func (c *Cass) Trash(prefix string) ([]*TrashEntry, error) {
+	var ret []*TrashEntry
+	var path string
+	var deleted gocql.UUID
+	var hash, metajson []byte
+	prefix = strings.Trim(prefix, "/")
+	iter := c.session.Query("SELECT path, deleted, hash, metadata FROM trash WHERE cust_id = ? AND environment = ?", c.OwnerId, c.Environment).Iter()
+	for iter.Scan(&path, &deleted, &hash, &metajson) {
+		if prefix != "" && path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+		meta := &CassMetadata{}
+		if err := json.Unmarshal(metajson, meta); err != nil || meta.Attr == nil {
+			log.Println("Error decoding the trash entry of", path, ":", err)
+			continue
+		}
+		ret = append(ret, &TrashEntry{
+			Path:    path,
+			Deleted: deleted.Time(),
+			Hash:    append([]byte(nil), hash...),
+			Meta:    meta,
+			id:      deleted,
+		})
+	}
+	return ret, iter.Close()
+}
+
+//RestoreTrash restores the last deletion of name to target, which must not exist and
+//whose directory must.
+func (c *Cass) RestoreTrash(name string, target string) error {
+	entries, err := c.Trash(name)
+	if err != nil {
+		return err
+	}
+	name = strings.Trim(name, "/")
+	var entry *TrashEntry
+	for _, e := range entries {
+		if e.Path == name {
+			entry = e
+			break
+		}
+	}
+	if entry == nil {
+		return ErrNotInTrash
+	}
+	target = strings.Trim(target, "/")
+	if _, err = c.GetFiledata(target); err == nil {
+		return ErrExists
+	} else if err != gocql.ErrNotFound {
+		return err
+	}
+	err = c.linkContent(target, entry.Hash, entry.Meta)
+	if err != nil {
+		return err
+	}
+	return c.dropTrash([]*TrashEntry{entry})
+}
+
+//dropTrash removes entries from the trash and releases their data
+func (c *Cass) dropTrash(entries []*TrashEntry) error {
+	var refs [][]byte
+	for _, e := range entries {
+		err := c.session.Query("DELETE FROM trash WHERE cust_id = ? AND environment = ? AND path = ? AND deleted = ?", c.OwnerId, c.Environment, e.Path, e.id).Consistency(c.Consistency).Exec()
+		if err != nil {
+			return err
+		}
+		refs = append(refs, dataRefs(e.Hash, e.Meta)...)
+	}
+	return c.releaseRefs(refs)
+}
+
+//EmptyTrash removes the entries that were deleted longer ago than the retention, or every
+//entry with all, and releases their data.  The returned impact is computed before
+//anything is removed, with dryRun nothing else is done.
+func (c *Cass) EmptyTrash(all bool, dryRun bool) (*Impact, error) {
+	entries, err := c.Trash("")
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now()
+	if !all {
+		if c.Config == nil || c.Config.Policy.Trash == 0 {
+			//Without a retention nothing expires
+			return &Impact{}, nil
+		}
+		cutoff = cutoff.Add(-c.Config.Policy.Trash)
+	}
+	var expired []*TrashEntry
+	impact := &Impact{}
+	refs := newImpactRefs()
+	for _, e := range entries {
+		if e.Deleted.After(cutoff) {
+			continue
+		}
+		expired = append(expired, e)
+		metajson, _ := json.Marshal(e.Meta)
+		refs.add(e.Hash, metajson)
+		impact.Files++
+	}
+	if err = c.resolveImpact(refs, impact); err != nil || dryRun {
+		return impact, err
+	}
+	return impact, c.dropTrash(expired)
+}
@@ -0,0 +1,271 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//Time a transactional save waits for the rename that usually follows a write
+const DefaultSaveWindow = time.Second
+
+var ErrIsDir = errors.New("Is a directory")
+
+//pendingSave is a flushed file whose namespace update is held back in transactional mode,
+//or whose save is held back until the next write-back (without a timer)
+type pendingSave struct {
+	fd    *CassFileData
+	timer *time.Timer
+}
+
+func (p *pendingSave) stop() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+//SaveAs writes the pending changes of f and moves it to newName.  The new entry and the
+//removal of the old one are applied in a single logged batch, so a crash either leaves the
+//old content at newName or the new content, never a mix of the two.
+func (c *Cass) SaveAs(f *CassFileData, newName string) error {
+	var replacedHash, replacedMeta []byte
+	err := c.CheckName(newName)
+	if err != nil {
+		return err
+	}
+	err = c.CheckSize(f.Attr.Size)
+	if err != nil {
+		return err
+	}
+	oldName := *f.Name
+	parent, file := c.splitPath(oldName)
+	newDir, newFile := c.splitPath(newName)
+	replaced := false
+	err = c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, newDir, newFile).Scan(&replacedHash, &replacedMeta)
+	if err == nil {
+		meta := &CassMetadata{}
+		if json.Unmarshal(replacedMeta, meta) == nil && meta.Attr != nil && meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			return ErrIsDir
+		}
+		replaced = true
+	} else if err != gocql.ErrNotFound {
+		return err
+	}
+	if f.Inode != "" {
+		//The content of a linked file belongs to its inode, only the name moves
+		err = c.UpdateFile(f)
+		if err == nil {
+			err = c.Rename(oldName, newName)
+		}
+		if err != nil {
+			return err
+		}
+		f.Name = &newName
+		if replaced && !c.addVersion(newDir, newFile, replacedHash, replacedMeta) {
+			return c.releaseEntry(replacedHash, replacedMeta)
+		}
+		return nil
+	}
+	chunks, inline, err := f.content(c)
+	if err != nil {
+		log.Println("Error writing Data:", err)
+		return err
+	}
+	hash := c.manifestHash(chunks)
+	old_refs := f.storedRefs()
+	cmeta := f.metadata(chunks, inline)
+	meta, err := json.Marshal(cmeta)
+	if err != nil {
+		log.Println("Encoding error:", err)
+		return err
+	}
+	batch := gocql.NewBatch(gocql.LoggedBatch)
+	batch.Cons = c.Consistency
+	batch.Query("INSERT INTO filesystem (cust_id, environment, directory, name, hash, metadata) VALUES(?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, newDir, newFile, hash, meta)
+	batch.Query("DELETE FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, parent, file)
+	err = c.session.ExecuteBatch(batch)
+	if err != nil {
+		return err
+	}
+	f.Name = &newName
+	f.Hash = hash
+	f.stored(chunks, inline)
+	f.saved = meta
+	c.invalidateMetadata(oldName)
+	c.cacheMetadata(newName, cmeta, hash)
+	c.dirChanged(parent)
+	c.dirChanged(newDir)
+	c.ClearExpiry(newName)
+	c.moveExpiry(oldName, newName)
+	c.publish(oldName, newName)
+	c.logChange(CHANGE_RENAME, oldName, newName)
+	err = c.updateRefs(old_refs, dataRefs(hash, &cmeta))
+	if err != nil || !replaced {
+		return err
+	}
+	//A save that replaces a file keeps what it replaced like an update in place does
+	if c.addVersion(newDir, newFile, replacedHash, replacedMeta) {
+		return nil
+	}
+	return c.releaseEntry(replacedHash, replacedMeta)
+}
+
+//deferSave holds back the namespace update of a flushed file in transactional mode, so a
+//rename that follows shortly can apply the content and the rename together.  It returns
+//false if the file has to be flushed right away.
+func (c *CassFs) deferSave(fd *CassFileData) bool {
+	if c.options.ReadOnly || fd.Orphaned {
+		return false
+	}
+	if !c.options.Transactional {
+		return c.holdBack(fd)
+	}
+	window := c.options.SaveWindow
+	if window <= 0 {
+		window = DefaultSaveWindow
+	}
+	name := *fd.Name
+	c.pendingLock.Lock()
+	if p, ok := c.pending[name]; ok {
+		p.stop()
+	}
+	p := &pendingSave{fd: fd}
+	p.timer = time.AfterFunc(window, func() { c.commitSave(name, p) })
+	c.pending[name] = p
+	c.pendingLock.Unlock()
+	return true
+}
+
+//takePending removes the pending save for name and returns its file
+func (c *CassFs) takePending(name string) *CassFileData {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	p, ok := c.pending[name]
+	if !ok {
+		return nil
+	}
+	p.stop()
+	delete(c.pending, name)
+	return p.fd
+}
+
+//pendingFile returns the file waiting on a save at name
+func (c *CassFs) pendingFile(name string) *CassFileData {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	if p, ok := c.pending[name]; ok {
+		return p.fd
+	}
+	return nil
+}
+
+//commitSave writes a pending save that was not followed by a rename
+func (c *CassFs) commitSave(name string, p *pendingSave) {
+	c.pendingLock.Lock()
+	if c.pending[name] != p {
+		c.pendingLock.Unlock()
+		return
+	}
+	delete(c.pending, name)
+	c.pendingLock.Unlock()
+	c.saveNow(p.fd)
+}
+
+//saveNow writes fd to the store and drops it from the cache if it is no longer open
+func (c *CassFs) saveNow(fd *CassFileData) error {
+	err := c.FlushFile(fd)
+	if err != nil {
+		log.Println("Error updating file:", err)
+		return err
+	}
+	fd.Dirty = false
+	c.forget(fd)
+	c.dropReleased(fd)
+	return nil
+}
+
+//dropReleased removes fd from the cache once the last handle is closed
+func (c *CassFs) dropReleased(fd *CassFileData) {
+	fd.Lock()
+	refs := fd.Refs
+	fd.Unlock()
+	if refs > 0 {
+		return
+	}
+	c.cacheLock.Lock()
+	if entry, ok := c.fileCache[*fd.Name]; ok && entry == fd {
+		delete(c.fileCache, *fd.Name)
+	}
+	c.cacheLock.Unlock()
+}
+
+//renamePending applies a rename of a file with a pending save as a single transaction.
+//It returns false if there was no pending save for oldName.
+func (c *CassFs) renamePending(oldName string, newName string) (bool, error) {
+	fd := c.takePending(oldName)
+	if fd == nil {
+		return false, nil
+	}
+	//Anything waiting to be saved at the target is replaced
+	if target := c.takePending(newName); target != nil {
+		c.forget(target)
+		c.dropReleased(target)
+	}
+	c.forget(fd)
+	fd.Lock()
+	err := c.scanFile(fd, newName)
+	if err == nil {
+		err = c.store.SaveAs(fd, newName)
+	}
+	fd.Unlock()
+	if err != nil {
+		//Fall back to saving the file where it is, the rename is reported as failed
+		c.saveNow(fd)
+		return true, err
+	}
+	fd.Dirty = false
+	c.cacheLock.Lock()
+	if entry, ok := c.fileCache[oldName]; ok && entry == fd {
+		delete(c.fileCache, oldName)
+	}
+	c.fileCache[newName] = fd
+	c.cacheLock.Unlock()
+	c.dropReleased(fd)
+	return true, nil
+}
+
+//flushPending writes every pending save, used when the filesystem is unmounted
+func (c *CassFs) flushPending() {
+	c.pendingLock.Lock()
+	pending := c.pending
+	c.pending = make(map[string]*pendingSave)
+	c.pendingLock.Unlock()
+	for _, p := range pending {
+		p.stop()
+		c.saveNow(p.fd)
+	}
+}
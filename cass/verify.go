@@ -0,0 +1,192 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+//A verification report records for every file moved into or out of the store that the
+//local copy, the chunks the store has for it and the data read back from the store all
+//agree.  The report can be signed so it can be handed on as proof of the transfer.
+
+var ErrBadReport = errors.New("Verification report signature does not match")
+
+//VerifiedFile is what the verification of one file found
+type VerifiedFile struct {
+	Path string
+	Size int64
+	//Local is the sha512 of the local copy, Stored the sha512 of the data read back
+	Local  string
+	Stored string
+	//Chunks is set when the local copy hashes to the chunks the entry links, of files
+	//stored as a single blob only the size is compared
+	Chunks bool
+	Error  string `json:",omitempty"`
+}
+
+//OK is true when all three forms of the content match
+func (f *VerifiedFile) OK() bool {
+	return f.Error == "" && f.Chunks && f.Local == f.Stored
+}
+
+//VerificationReport holds the files verified after an import or export
+type VerificationReport struct {
+	sync.Mutex  `json:"-"`
+	Operation   string
+	Owner       int64
+	Environment string
+	Root        string
+	Created     time.Time
+	Verified    int
+	Failed      int
+	Files       []*VerifiedFile
+	Signature   []byte `json:",omitempty"`
+}
+
+//NewVerificationReport starts the report of an operation on the tree below root
+func (c *Cass) NewVerificationReport(operation string, root string) *VerificationReport {
+	return &VerificationReport{
+		Operation:   operation,
+		Owner:       c.OwnerId,
+		Environment: c.Environment,
+		Root:        root,
+		Created:     time.Now(),
+	}
+}
+
+//Add records the verification of a file, it is safe to call from several workers
+func (r *VerificationReport) Add(f *VerifiedFile) {
+	r.Lock()
+	defer r.Unlock()
+	r.Files = append(r.Files, f)
+	if f.OK() {
+		r.Verified++
+	} else {
+		r.Failed++
+	}
+}
+
+//signed returns the message the signature is made over, the report without its signature
+func (r *VerificationReport) signed() ([]byte, error) {
+	sig := r.Signature
+	r.Signature = nil
+	data, err := json.Marshal(r)
+	r.Signature = sig
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("cassfs-verification\x00"), data...), nil
+}
+
+//Sign signs the report with key
+func (r *VerificationReport) Sign(key ed25519.PrivateKey) error {
+	msg, err := r.signed()
+	if err != nil {
+		return err
+	}
+	r.Signature = ed25519.Sign(key, msg)
+	return nil
+}
+
+//Verify checks that the report is signed by key and was not changed since
+func (r *VerificationReport) Verify(key ed25519.PublicKey) error {
+	msg, err := r.signed()
+	if err != nil {
+		return err
+	}
+	if len(r.Signature) == 0 || !ed25519.Verify(key, msg, r.Signature) {
+		return ErrBadReport
+	}
+	return nil
+}
+
+//VerifyFile compares the local copy of the file at name with the store.  The local copy is
+//hashed into chunks of the block size of the entry, which have to be the chunks the entry
+//links, and the content is read back from the store and compared with the local copy.
+func (c *Cass) VerifyFile(name string, local io.Reader) *VerifiedFile {
+	f := &VerifiedFile{Path: name}
+	meta, err := c.GetFiledata(name)
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	if meta.Metadata.Attr == nil {
+		f.Error = "No attributes"
+		return f
+	}
+	bs := meta.Metadata.ChunkSize()
+	localSum := sha512.New()
+	f.Chunks = true
+	buf := make([]byte, bs)
+	idx := 0
+	for {
+		n, err := io.ReadFull(local, buf)
+		if n > 0 {
+			data := buf[:n]
+			localSum.Write(data)
+			f.Size += int64(n)
+			if len(meta.Metadata.Chunks) > 0 {
+				switch {
+				case idx >= len(meta.Metadata.Chunks):
+					f.Chunks = false
+				case isHole(meta.Metadata.Chunks[idx]):
+					f.Chunks = f.Chunks && bytes.Count(data, []byte{0}) == n
+				default:
+					f.Chunks = f.Chunks && bytes.Equal(c.hash(data), meta.Metadata.Chunks[idx])
+				}
+			}
+			idx++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			f.Error = err.Error()
+			return f
+		}
+	}
+	if len(meta.Metadata.Chunks) > 0 && idx != len(meta.Metadata.Chunks) {
+		f.Chunks = false
+	}
+	if uint64(f.Size) != meta.Metadata.Attr.Size {
+		f.Chunks = false
+	}
+	f.Local = hex.EncodeToString(localSum.Sum(nil))
+
+	storedSum := sha512.New()
+	_, err = io.Copy(storedSum, c.contentReader(meta.Hash, &meta.Metadata))
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	f.Stored = hex.EncodeToString(storedSum.Sum(nil))
+	return f
+}
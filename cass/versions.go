@@ -0,0 +1,263 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//With Policy.Versions set the content a regular file had before it was changed is kept in
+//the file_versions table, the last Versions of them per path.  A version holds the data
+//references the file held, so its data stays until the version is pruned.  Versions
+//belong to the path rather than the file: they survive the file being deleted so its
+//content can still be restored, and are only dropped with their directory or environment,
+//by pruning or by PurgeVersions.
+
+var ErrNoVersion = errors.New("No such version")
+
+//VERSION_FORMAT is the time format versions are named with
+const VERSION_FORMAT = "2006-01-02T15:04:05.000000Z"
+
+//FileVersion is a previous content of a file
+type FileVersion struct {
+	Id   gocql.UUID
+	Hash []byte
+	Meta *CassMetadata
+}
+
+//Name names the version by the time it was replaced
+func (v *FileVersion) Name() string {
+	return v.Id.Time().UTC().Format(VERSION_FORMAT)
+}
+
+//keepsVersions checks if previous versions of files are kept
+func (c *Cass) keepsVersions() bool {
+	return c.Config != nil && c.Config.Policy.Versions > 0 && c.AsOf.IsZero()
+}
+
+//addVersion records hash and meta, the content the entry file of dir had until now, as a
+//version of it.  It returns true when the data references of the content now belong to
+//the version, the caller must not release them then.  Directories, links, empty files and
+//linked files, whose content belongs to their inode, get no version.
+func (c *Cass) addVersion(dir string, file string, hash []byte, metajson []byte) bool {
+	if !c.keepsVersions() {
+		return false
+	}
+	meta := &CassMetadata{}
+	if json.Unmarshal(metajson, meta) != nil || meta.Attr == nil || meta.Inode != "" {
+		return false
+	}
+	if meta.Attr.Mode&syscall.S_IFMT != syscall.S_IFREG || meta.Attr.Size == 0 {
+		return false
+	}
+	err := c.session.Query("INSERT INTO file_versions (cust_id, environment, directory, name, version, hash, metadata) VALUES(?, ?, ?, ?, ?, ?, ?)", c.OwnerId, c.Environment, dir, file, gocql.TimeUUID(), hash, metajson).Consistency(c.Consistency).Exec()
+	if err != nil {
+		log.Println("Unable to keep the previous version of", file, ":", err)
+		return false
+	}
+	c.pruneVersions(dir, file)
+	return true
+}
+
+//currentEntry reads the stored hash and metadata of the entry file of dir for addVersion,
+//nothing is read unless versions are kept
+func (c *Cass) currentEntry(dir string, file string) ([]byte, []byte) {
+	var hash, metajson []byte
+	if !c.keepsVersions() {
+		return nil, nil
+	}
+	err := c.session.Query("SELECT hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Consistency(c.Consistency).Scan(&hash, &metajson)
+	if err != nil {
+		return nil, nil
+	}
+	return hash, metajson
+}
+
+//pruneVersions drops the versions of file beyond the number the policy keeps and releases
+//their data.  Like history, failing to prune is only logged.
+func (c *Cass) pruneVersions(dir string, file string) {
+	var version gocql.UUID
+	var hash, metajson []byte
+	type expired struct {
+		version gocql.UUID
+		refs    [][]byte
+	}
+	var drop []expired
+	count := 0
+	iter := c.session.Query("SELECT version, hash, metadata FROM file_versions WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Iter()
+	for iter.Scan(&version, &hash, &metajson) {
+		count++
+		if count > c.Config.Policy.Versions {
+			drop = append(drop, expired{version, decodeRefs(hash, metajson)})
+		}
+	}
+	err := iter.Close()
+	for _, v := range drop {
+		if err != nil {
+			break
+		}
+		_, err = c.dropVersion(dir, file, v.version, v.refs)
+	}
+	if err != nil {
+		log.Println("Unable to prune the versions of", file, ":", err)
+	}
+}
+
+//dropVersion removes a version of the entry file of dir and releases refs, the data
+//references it held.  Versions are never changed, the delete is conditional so a version
+//dropped by several clients at once, pruning writers and the reaper, is only released by
+//the one whose delete applied.
+func (c *Cass) dropVersion(dir string, file string, version gocql.UUID, refs [][]byte) (bool, error) {
+	applied, err := c.session.Query("DELETE FROM file_versions WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ? AND version = ? IF EXISTS", c.OwnerId, c.Environment, dir, file, version).Consistency(gocql.Quorum).SerialConsistency(gocql.Serial).MapScanCAS(map[string]interface{}{})
+	if err != nil || !applied {
+		return false, err
+	}
+	return true, c.releaseRefs(refs)
+}
+
+//Versions lists the kept versions of name, the newest first
+func (c *Cass) Versions(name string) ([]*FileVersion, error) {
+	var ret []*FileVersion
+	var version gocql.UUID
+	var hash, metajson []byte
+	name = strings.Trim(name, "/")
+	dir, file := c.splitPath(name)
+	iter := c.session.Query("SELECT version, hash, metadata FROM file_versions WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ?", c.OwnerId, c.Environment, dir, file).Iter()
+	for iter.Scan(&version, &hash, &metajson) {
+		meta := &CassMetadata{}
+		if err := json.Unmarshal(metajson, meta); err != nil || meta.Attr == nil {
+			log.Println("Error decoding a version of", name, ":", err)
+			continue
+		}
+		ret = append(ret, &FileVersion{Id: version, Hash: append([]byte(nil), hash...), Meta: meta})
+	}
+	return ret, iter.Close()
+}
+
+//Version returns the version of name called version
+func (c *Cass) Version(name string, version string) (*FileVersion, error) {
+	versions, err := c.Versions(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.Name() == version {
+			return v, nil
+		}
+	}
+	return nil, ErrNoVersion
+}
+
+//RestoreVersion makes a version the content of name again, the content it replaces is
+//kept as a version in turn
+func (c *Cass) RestoreVersion(name string, version string) error {
+	name = strings.Trim(name, "/")
+	v, err := c.Version(name, version)
+	if err != nil {
+		return err
+	}
+	return c.linkContent(name, v.Hash, v.Meta)
+}
+
+//linkContent makes the stored content hash and meta the content of name with the
+//attributes of meta, the data is shared and gets references of its own
+func (c *Cass) linkContent(name string, hash []byte, meta *CassMetadata) error {
+	attr := *meta.Attr
+	now := time.Now()
+	attr.SetTimes(nil, nil, &now)
+	if meta.Inline != nil && len(meta.Chunks) == 1 {
+		//The new entry is linked as chunks, the content goes to the store first
+		if err := c.PutChunk(meta.Chunks[0], meta.Inline); err != nil {
+			return err
+		}
+	}
+	if len(meta.Chunks) > 0 {
+		return c.LinkChunks(name, meta.Chunks, meta.ChunkSize(), &attr)
+	}
+	if attr.Size == 0 {
+		return c.LinkChunks(name, nil, c.NewBlockSize(), &attr)
+	}
+	//Files stored before chunking are a single blob, which is stored again as chunks
+	data, err := c.ReadFile(&CassFsMetadata{Metadata: *meta, Hash: hash})
+	if err != nil {
+		return err
+	}
+	bs := c.NewBlockSize()
+	chunks := c.ChunkHashes(data, bs)
+	for idx, hash := range chunks {
+		end := (idx + 1) * int(bs)
+		if end > len(data) {
+			end = len(data)
+		}
+		if err = c.PutChunk(hash, data[idx*int(bs):end]); err != nil {
+			return err
+		}
+	}
+	return c.LinkChunks(name, chunks, bs, &attr)
+}
+
+//PurgeVersions drops every version of name and releases their data
+func (c *Cass) PurgeVersions(name string) (int, error) {
+	versions, err := c.Versions(name)
+	if err != nil || len(versions) == 0 {
+		return 0, err
+	}
+	dir, file := c.splitPath(strings.Trim(name, "/"))
+	count := 0
+	for _, v := range versions {
+		dropped, err := c.dropVersion(dir, file, v.Id, dataRefs(v.Hash, v.Meta))
+		if err != nil {
+			return count, err
+		}
+		if dropped {
+			count++
+		}
+	}
+	return count, nil
+}
+
+//dropDirVersions drops the versions of every path in the directory dirId and returns the
+//data references of those this client dropped
+func (c *Cass) dropDirVersions(dirId string) ([][]byte, error) {
+	var file string
+	var version gocql.UUID
+	var hash, metajson []byte
+	var refs [][]byte
+	iter := c.session.Query("SELECT name, version, hash, metadata FROM file_versions WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Iter()
+	for iter.Scan(&file, &version, &hash, &metajson) {
+		applied, err := c.session.Query("DELETE FROM file_versions WHERE cust_id = ? AND environment = ? AND directory = ? AND name = ? AND version = ? IF EXISTS", c.OwnerId, c.Environment, dirId, file, version).Consistency(gocql.Quorum).SerialConsistency(gocql.Serial).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			iter.Close()
+			return refs, err
+		}
+		if applied {
+			refs = append(refs, decodeRefs(hash, metajson)...)
+		}
+	}
+	return refs, iter.Close()
+}
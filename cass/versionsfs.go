@@ -0,0 +1,173 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"log"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+//VERSIONS_SUFFIX turns the name of a file into the name of the directory of its versions
+const VERSIONS_SUFFIX = ".versions"
+
+//VersionsFs serves the kept versions of every file as read only files in a directory
+//named after the file with VERSIONS_SUFFIX, e.g. index.php.versions/2016-05-01T10:00:00.000000Z.
+//The directories are not listed and only exist while the file does, a stored entry of the
+//same name always wins.
+type VersionsFs struct {
+	pathfs.FileSystem
+	fs *CassFs
+}
+
+//NewVersionsFs wraps fs, the versions are read from the environment of store
+func NewVersionsFs(fs pathfs.FileSystem, store *CassFs) *VersionsFs {
+	return &VersionsFs{FileSystem: fs, fs: store}
+}
+
+//versionPath splits a name below a versions directory into the file and the version, the
+//version is empty for the directory itself
+func versionPath(name string) (string, string, bool) {
+	if strings.HasSuffix(name, VERSIONS_SUFFIX) && len(name) > len(VERSIONS_SUFFIX) {
+		return strings.TrimSuffix(name, VERSIONS_SUFFIX), "", true
+	}
+	dir := parentPath(name)
+	if !strings.HasSuffix(dir, VERSIONS_SUFFIX) || len(dir) == len(VERSIONS_SUFFIX) {
+		return "", "", false
+	}
+	return strings.TrimSuffix(dir, VERSIONS_SUFFIX), name[len(dir)+1:], true
+}
+
+//versionedFile returns the attributes of file if it is a regular file that can have versions
+func (v *VersionsFs) versionedFile(file string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	attr, status := v.FileSystem.GetAttr(file, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if attr.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil, fuse.ENOENT
+	}
+	return attr, fuse.OK
+}
+
+//version looks up a version of file
+func (v *VersionsFs) version(file string, version string) (*FileVersion, fuse.Status) {
+	ver, err := v.fs.store.Version(file, version)
+	if err == ErrNoVersion {
+		return nil, fuse.ENOENT
+	}
+	if err != nil {
+		log.Println("Unable to read the versions of", file, ":", err)
+		return nil, fuse.EIO
+	}
+	return ver, fuse.OK
+}
+
+func (v *VersionsFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	attr, status := v.FileSystem.GetAttr(name, context)
+	file, version, ok := versionPath(name)
+	if status != fuse.ENOENT || !ok {
+		return attr, status
+	}
+	fattr, status := v.versionedFile(file, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if version == "" {
+		dir := *fattr
+		dir.Mode = fuse.S_IFDIR | 0555
+		dir.Size = 0
+		dir.Nlink = 2
+		return &dir, fuse.OK
+	}
+	ver, status := v.version(file, version)
+	if status != fuse.OK {
+		return nil, status
+	}
+	vattr := *ver.Meta.Attr
+	vattr.Mode &^= 0222
+	vattr.Nlink = 1
+	return &vattr, fuse.OK
+}
+
+func (v *VersionsFs) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	status := v.FileSystem.Access(name, mode, context)
+	file, _, ok := versionPath(name)
+	if status != fuse.ENOENT || !ok {
+		return status
+	}
+	if mode&ACCESS_WRITE != 0 {
+		return fuse.EROFS
+	}
+	//The versions can be read by whoever can read the file
+	return v.FileSystem.Access(file, ACCESS_READ, context)
+}
+
+func (v *VersionsFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	entries, status := v.FileSystem.OpenDir(name, context)
+	file, version, ok := versionPath(name)
+	if status != fuse.ENOENT || !ok || version != "" {
+		return entries, status
+	}
+	if _, status = v.versionedFile(file, context); status != fuse.OK {
+		return nil, status
+	}
+	if status = v.FileSystem.Access(file, ACCESS_READ, context); status != fuse.OK {
+		return nil, status
+	}
+	versions, err := v.fs.store.Versions(file)
+	if err != nil {
+		log.Println("Unable to read the versions of", file, ":", err)
+		return nil, fuse.EIO
+	}
+	for _, ver := range versions {
+		entries = append(entries, fuse.DirEntry{Name: ver.Name(), Mode: fuse.S_IFREG})
+	}
+	return sortEntries(entries), fuse.OK
+}
+
+func (v *VersionsFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, status := v.FileSystem.Open(name, flags, context)
+	file, version, ok := versionPath(name)
+	if status != fuse.ENOENT || !ok || version == "" {
+		return f, status
+	}
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EROFS
+	}
+	if status = v.FileSystem.Access(file, ACCESS_READ, context); status != fuse.OK {
+		return nil, status
+	}
+	ver, status := v.version(file, version)
+	if status != fuse.OK {
+		return nil, status
+	}
+	fd, err := v.fs.fileData(name, &CassFsMetadata{Metadata: *ver.Meta, Hash: ver.Hash})
+	if err != nil {
+		log.Println("Unable to read version", version, "of", file, ":", err)
+		return nil, fuse.EIO
+	}
+	return nodefs.NewReadOnlyFile(NewFileHandle(fd)), fuse.OK
+}
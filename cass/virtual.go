@@ -0,0 +1,76 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+//Virtual directories are always present and empty, their attributes are made up like
+//those of the root so stats of them by health checks and probes never reach the store.
+//Nothing can be created in them and they can not be removed or renamed.
+
+//virtualDirs returns the set of virtual directories along with every directory above them
+func virtualDirs(dirs []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, dir := range dirs {
+		for dir = strings.Trim(dir, "/"); dir != ""; dir = parentPath(dir) {
+			set[dir] = true
+		}
+	}
+	return set
+}
+
+//isVirtual checks if name is the root or a virtual directory
+func (c *CassFs) isVirtual(name string) bool {
+	return name == "" || c.virtual[name]
+}
+
+//virtualAttr returns the attributes of the root and the virtual directories
+func (c *CassFs) virtualAttr() *fuse.Attr {
+	return &fuse.Attr{
+		Mode: fuse.S_IFDIR | c.options.Mode,
+		Owner: fuse.Owner{
+			Uid: c.options.Owner.Uid,
+			Gid: c.options.Owner.Gid,
+		},
+	}
+}
+
+//virtualEntries adds the virtual directories in dir to the listing res unless it has them
+func (c *CassFs) virtualEntries(dir string, res []fuse.DirEntry) []fuse.DirEntry {
+	for name := range c.virtual {
+		if parentPath(name) != dir {
+			continue
+		}
+		base := name[strings.LastIndex(name, "/")+1:]
+		found := false
+		for _, e := range res {
+			found = found || e.Name == base
+		}
+		if !found {
+			res = append(res, fuse.DirEntry{Name: base, Mode: fuse.S_IFDIR | c.options.Mode})
+		}
+	}
+	return res
+}
@@ -0,0 +1,122 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"syscall"
+
+	"github.com/gocql/gocql"
+)
+
+//WalkFunc is called for every entry found by Walk with the full path of the entry
+type WalkFunc func(path string, hash []byte, meta *CassMetadata) error
+
+//Walk calls fn for every entry below root, directories are passed to fn before their contents.
+//A client reading at AsOf walks the tree as it was then.
+func (c *Cass) Walk(root string, fn WalkFunc) error {
+	if !c.AsOf.IsZero() {
+		return c.historyWalk(strings.Trim(root, "/"), fn)
+	}
+	dirId, err := c.FindDir(root)
+	if err != nil {
+		return err
+	}
+	return c.walkDir(root, dirId, nil, fn)
+}
+
+//SkipFunc is called by WalkTree with the Merkle hash of a directory before its contents
+//are read, they are skipped when it returns true
+type SkipFunc func(path string, hash []byte) bool
+
+//WalkTree is Walk that passes the Merkle hash of every directory, root included, to skip
+//first.  The hash of a directory that did not change since it was last hashed is read
+//from the dirtree table, so skipping an unchanged subtree costs a couple of reads.
+func (c *Cass) WalkTree(root string, skip SkipFunc, fn WalkFunc) error {
+	dirId, err := c.FindDir(root)
+	if err != nil {
+		return err
+	}
+	return c.walkDir(root, dirId, skip, fn)
+}
+
+func (c *Cass) walkDir(path string, dirId string, skip SkipFunc, fn WalkFunc) error {
+	if skip != nil {
+		hash, err := c.DirHash(dirId)
+		if err != nil {
+			return err
+		}
+		if skip(path, hash) {
+			return nil
+		}
+	}
+	var name string
+	var hash, metajson []byte
+	type subdir struct {
+		path string
+		id   string
+	}
+	var dirs []subdir
+	iter := c.session.Query("SELECT name, hash, metadata FROM filesystem WHERE cust_id = ? AND environment = ? AND directory = ?", c.OwnerId, c.Environment, dirId).Iter()
+	for iter.Scan(&name, &hash, &metajson) {
+		meta := &CassMetadata{}
+		err := json.Unmarshal(metajson, meta)
+		if err == nil && meta.Inode != "" {
+			var inode CassMetadata
+			hash, inode, err = c.readInode(meta.Inode)
+			meta = &inode
+		}
+		if err != nil || meta.Attr == nil {
+			log.Println("Error decoding metadata for", name, ":", err)
+			continue
+		}
+		full := name
+		if path != "" {
+			full = path + "/" + name
+		}
+		err = fn(full, hash, meta)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		if meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			uuid, err := gocql.UUIDFromBytes(hash)
+			if err != nil {
+				log.Println("Invalid directory id for", full, ":", err)
+				continue
+			}
+			dirs = append(dirs, subdir{path: full, id: uuid.String()})
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	//The subdirectories are walked after the listing is closed to keep only one query open at a time
+	for _, d := range dirs {
+		err := c.walkDir(d.path, d.id, skip, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
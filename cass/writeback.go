@@ -0,0 +1,120 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"time"
+)
+
+//In write-back mode a flushed file is not saved right away.  It stays with the pending
+//saves until the flusher writes every held back file each FlushInterval, so a burst of
+//small writes and closes of the same file reaches the store as a single save.  When the
+//held back files hold more than MaxDirtyBytes of changes the flusher runs right away.
+//Fsync, a rename and unmounting still write a held back file before they return.
+
+//DefaultMaxDirtyBytes is the amount of changes held back before they are written early
+const DefaultMaxDirtyBytes = 64 * 1024 * 1024
+
+//holdBack adds fd to the pending saves for the flusher, it returns false if write-back
+//is off and the file has to be saved right away
+func (c *CassFs) holdBack(fd *CassFileData) bool {
+	if c.options.FlushInterval <= 0 {
+		return false
+	}
+	name := *fd.Name
+	c.pendingLock.Lock()
+	previous, ok := c.pending[name]
+	if !ok || previous.fd != fd {
+		c.pending[name] = &pendingSave{fd: fd}
+	}
+	dirty := c.heldBytes()
+	c.pendingLock.Unlock()
+	if ok && previous.fd != fd {
+		//Another file was held back under the name, it is written first
+		previous.stop()
+		c.saveNow(previous.fd)
+	}
+	if dirty > c.maxDirtyBytes() {
+		select {
+		case c.flushNow <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+//heldBytes returns the size of the changes of the held back files, pendingLock is held
+func (c *CassFs) heldBytes() int64 {
+	var total int64
+	for _, p := range c.pending {
+		if p.timer == nil {
+			total += p.fd.dirtyBytes()
+		}
+	}
+	return total
+}
+
+func (c *CassFs) maxDirtyBytes() int64 {
+	if c.options.MaxDirtyBytes > 0 {
+		return c.options.MaxDirtyBytes
+	}
+	return DefaultMaxDirtyBytes
+}
+
+//writeBack is the flusher of a write-back mount, it does not return
+func (c *CassFs) writeBack() {
+	ticker := time.NewTicker(c.options.FlushInterval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.flushNow:
+		}
+		c.flushHeld()
+	}
+}
+
+//flushHeld writes every file that is held back by write-back, the saves held back for a
+//rename in transactional mode keep waiting for it
+func (c *CassFs) flushHeld() {
+	var held []*CassFileData
+	c.pendingLock.Lock()
+	for name, p := range c.pending {
+		if p.timer == nil {
+			held = append(held, p.fd)
+			delete(c.pending, name)
+		}
+	}
+	c.pendingLock.Unlock()
+	for _, fd := range held {
+		c.saveNow(fd)
+	}
+}
+
+//dirtyBytes returns the size of the changed chunks of f
+func (f *CassFileData) dirtyBytes() int64 {
+	f.Lock()
+	defer f.Unlock()
+	var total int64
+	for _, data := range f.dirty {
+		total += int64(len(data))
+	}
+	return total
+}
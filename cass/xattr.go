@@ -0,0 +1,157 @@
+/*
+ *CassFs is a filesystem that uses Cassandra as the data store.  It is
+ *meant for docker like systems that require a lightweight filesystem
+ *that can be distributed across many systems.
+ *Copyright (C) 2016  Chris Tsonis (cgt212@whatbroke.com)
+ *
+ *This program is free software: you can redistribute it and/or modify
+ *it under the terms of the GNU General Public License as published by
+ *the Free Software Foundation, either version 3 of the License, or
+ *(at your option) any later version.
+ *
+ *This program is distributed in the hope that it will be useful,
+ *but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *GNU General Public License for more details.
+ *
+ *You should have received a copy of the GNU General Public License
+ *along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cass
+
+import (
+	"errors"
+	"sort"
+	"unicode/utf8"
+)
+
+//Flags of setxattr(2)
+const (
+	XATTR_CREATE  = 1
+	XATTR_REPLACE = 2
+)
+
+var ErrNoAttr = errors.New("No such attribute")
+var ErrAttrExists = errors.New("Attribute exists")
+
+//Attribute values that are valid UTF-8 are kept in XAttr, anything else (e.g. file
+//capabilities) is kept in XAttrBinary since JSON strings can not hold arbitrary bytes.
+
+//getXAttr returns the value of the attribute name
+func (m *CassMetadata) getXAttr(name string) ([]byte, bool) {
+	if value, ok := m.XAttr[name]; ok {
+		return []byte(value), true
+	}
+	value, ok := m.XAttrBinary[name]
+	return value, ok
+}
+
+//listXAttr returns the names of every attribute in order
+func (m *CassMetadata) listXAttr() []string {
+	names := make([]string, 0, len(m.XAttr)+len(m.XAttrBinary))
+	for name := range m.XAttr {
+		names = append(names, name)
+	}
+	for name := range m.XAttrBinary {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//copyXAttr gives m its own copy of the attribute maps, so metadata that is shared with
+//the caches is never changed in place
+func (m *CassMetadata) copyXAttr() {
+	text := make(map[string]string, len(m.XAttr))
+	for k, v := range m.XAttr {
+		text[k] = v
+	}
+	binary := make(map[string][]byte, len(m.XAttrBinary))
+	for k, v := range m.XAttrBinary {
+		binary[k] = v
+	}
+	m.XAttr = text
+	m.XAttrBinary = binary
+}
+
+//setXAttr sets the attribute name honoring the XATTR_CREATE and XATTR_REPLACE flags
+func (m *CassMetadata) setXAttr(name string, value []byte, flags int) error {
+	_, exists := m.getXAttr(name)
+	if flags&XATTR_CREATE != 0 && exists {
+		return ErrAttrExists
+	}
+	if flags&XATTR_REPLACE != 0 && !exists {
+		return ErrNoAttr
+	}
+	m.copyXAttr()
+	delete(m.XAttr, name)
+	delete(m.XAttrBinary, name)
+	if utf8.Valid(value) {
+		m.XAttr[name] = string(value)
+	} else {
+		m.XAttrBinary[name] = append([]byte{}, value...)
+	}
+	return nil
+}
+
+//removeXAttr removes the attribute name
+func (m *CassMetadata) removeXAttr(name string) error {
+	if _, exists := m.getXAttr(name); !exists {
+		return ErrNoAttr
+	}
+	m.copyXAttr()
+	delete(m.XAttr, name)
+	delete(m.XAttrBinary, name)
+	return nil
+}
+
+//GetXAttr returns the value of the extended attribute attr of name
+func (c *Cass) GetXAttr(name string, attr string) ([]byte, error) {
+	meta, err := c.GetFiledata(name)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := meta.Metadata.getXAttr(attr)
+	if !ok {
+		return nil, ErrNoAttr
+	}
+	return value, nil
+}
+
+//ListXAttr returns the names of the extended attributes of name
+func (c *Cass) ListXAttr(name string) ([]string, error) {
+	meta, err := c.GetFiledata(name)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Metadata.listXAttr(), nil
+}
+
+//SetXAttr sets the extended attribute attr of name
+func (c *Cass) SetXAttr(name string, attr string, value []byte, flags int) error {
+	meta, err := c.GetFiledata(name)
+	if err != nil {
+		return err
+	}
+	m := meta.Metadata
+	err = m.setXAttr(attr, value, flags)
+	if err != nil {
+		return err
+	}
+	return c.WriteMetadata(name, m)
+}
+
+//RemoveXAttr removes the extended attribute attr of name
+func (c *Cass) RemoveXAttr(name string, attr string) error {
+	meta, err := c.GetFiledata(name)
+	if err != nil {
+		return err
+	}
+	m := meta.Metadata
+	err = m.removeXAttr(attr)
+	if err != nil {
+		return err
+	}
+	return c.WriteMetadata(name, m)
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var AnalyzeCommand = &cobra.Command{
+	Use:   "analyze",
+	Short: "Report the hot spots of an environment with recommendations",
+	Long: `Scan an environment for its largest directories, the files with the most
+		chunks and the most referenced blobs, and suggest changes based on how the
+		data is actually distributed.`,
+	Run: analyze,
+}
+
+var (
+	analyze_top         int
+	analyze_dir_entries int
+	analyze_file_chunks int
+)
+
+func init() {
+	AnalyzeCommand.Flags().IntVar(&analyze_top, "top", cass.ANALYZE_TOP, "Number of directories, files and blobs listed")
+	AnalyzeCommand.Flags().IntVar(&analyze_dir_entries, "dir-entries", cass.ANALYZE_DIR_ENTRIES, "Entries above which a directory is too large")
+	AnalyzeCommand.Flags().IntVar(&analyze_file_chunks, "file-chunks", cass.ANALYZE_FILE_CHUNKS, "Chunks above which a file is too large")
+	addTenantFlags(AnalyzeCommand)
+	RootCommand.AddCommand(AnalyzeCommand)
+}
+
+func analyze(cmd *cobra.Command, args []string) {
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	opts := cass.AnalyzeOptions{
+		Top:        analyze_top,
+		DirEntries: analyze_dir_entries,
+		FileChunks: analyze_file_chunks,
+	}
+	var lock sync.Mutex
+	total := &cass.AnalyzeReport{}
+	failed := forTenants(c, "Unable to analyze environment", func(t cass.Tenant, store *cass.Cass) error {
+		report, err := store.Analyze(opts)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if !manyTenants() {
+			printAnalysis(report)
+			return nil
+		}
+		//Many environments only get a summary each
+		fmt.Printf("%s: %d entries, %d directories, %d files (%d bytes)\n", t, report.Entries, report.Dirs, report.Files, report.Bytes)
+		for _, rec := range report.Recommendations {
+			fmt.Printf("%s: - %s\n", t, rec)
+		}
+		total.Entries += report.Entries
+		total.Dirs += report.Dirs
+		total.Files += report.Files
+		total.Bytes += report.Bytes
+		total.Recommendations = append(total.Recommendations, report.Recommendations...)
+		return nil
+	})
+	if manyTenants() {
+		fmt.Printf("Total: %d entries, %d directories, %d files (%d bytes), %d recommendations\n", total.Entries, total.Dirs, total.Files, total.Bytes, len(total.Recommendations))
+	}
+	if failed > 0 {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
+
+func printAnalysis(report *cass.AnalyzeReport) {
+	fmt.Printf("Entries:     %d\n", report.Entries)
+	fmt.Printf("Directories: %d\n", report.Dirs)
+	fmt.Printf("Files:       %d (%d bytes)\n", report.Files, report.Bytes)
+	fmt.Println("\nLargest directories:")
+	for _, dir := range report.LargeDirs {
+		fmt.Printf("  %10d  %s\n", dir.Entries, dir.Path)
+	}
+	fmt.Println("\nFiles with the most chunks:")
+	for _, file := range report.LargeFiles {
+		fmt.Printf("  %10d  %s (%d bytes in %d byte blocks)\n", file.Chunks, file.Path, file.Size, file.BlockSize)
+	}
+	fmt.Println("\nMost referenced blobs:")
+	for _, blob := range report.Blobs {
+		fmt.Printf("  %10d  %x (%d references in the store)\n", blob.Refs, blob.Hash, blob.StoreRefs)
+	}
+	if len(report.Recommendations) > 0 {
+		fmt.Println("\nRecommendations:")
+		for _, rec := range report.Recommendations {
+			fmt.Println("  -", rec)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var AuditCommand = &cobra.Command{
+	Use:   "audit [path]",
+	Short: "List the destructive operations made to the environment",
+	Long: `List the deletes, rmdirs, renames, chmods and chowns recorded while the
+		policy of the environment sets --audit, the newest first, with the uid that
+		made them, the host and the id of the mount or command.  A path limits the
+		list to operations on it and below it.`,
+	Run: audit,
+}
+
+var (
+	audit_since string
+	audit_op    string
+	audit_uid   int64
+	audit_limit int
+	audit_json  bool
+)
+
+func init() {
+	AuditCommand.Flags().StringVar(&audit_since, "since", "24h", "List the operations since this duration ago or RFC3339 time")
+	AuditCommand.Flags().StringVar(&audit_op, "op", "", "Only list this operation (delete, rmdir, rename, chmod or chown)")
+	AuditCommand.Flags().Int64Var(&audit_uid, "uid", -1, "Only list the operations of this uid")
+	AuditCommand.Flags().IntVar(&audit_limit, "limit", 0, "List at most this many operations, 0 for all")
+	AuditCommand.Flags().BoolVar(&audit_json, "json", false, "Print each operation as a JSON object")
+	RootCommand.AddCommand(AuditCommand)
+}
+
+func audit(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	filter := &cass.AuditFilter{Op: audit_op, Uid: audit_uid, Limit: audit_limit}
+	if len(args) == 1 {
+		filter.Path = storePath(args[0])
+	}
+	var err error
+	filter.Since, err = parseSince(audit_since)
+	if err != nil {
+		fail(EXIT_USAGE, "Invalid --since:", err)
+	}
+	switch audit_op {
+	case "", cass.AUDIT_DELETE, cass.AUDIT_RMDIR, cass.AUDIT_RENAME, cass.AUDIT_CHMOD, cass.AUDIT_CHOWN:
+	default:
+		fail(EXIT_USAGE, "Unknown operation:", audit_op)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	records, err := c.AuditLog(filter)
+	if err != nil {
+		fail(exitCode(err), "Unable to read the audit log:", err)
+	}
+	for _, r := range records {
+		if audit_json {
+			enc, err := json.Marshal(struct {
+				Time time.Time
+				*cass.AuditRecord
+			}{r.Time(), r})
+			if err != nil {
+				fail(EXIT_FAILURE, "Unable to encode the audit log:", err)
+			}
+			fmt.Println(string(enc))
+			continue
+		}
+		fmt.Printf("%s %-6s uid=%d host=%s mount=%s /%s %s\n", r.Time().Format(time.RFC3339), r.Op, r.Uid, r.Host, r.Mount, r.Path, r.Detail)
+	}
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var CatCommand = &cobra.Command{
+	Use:   "cat <path>...",
+	Short: "Write the content of files of an environment to stdout without mounting it",
+	Long: `Read the files from the store one chunk at a time and write them to
+		stdout.  --offset and --length select a part of every file.`,
+	Run: cat,
+}
+
+var (
+	cat_offset int64
+	cat_length int64
+)
+
+func init() {
+	CatCommand.Flags().Int64Var(&cat_offset, "offset", 0, "Byte of the file to start at")
+	CatCommand.Flags().Int64Var(&cat_length, "length", -1, "Number of bytes to write, the rest of the file if negative")
+	RootCommand.AddCommand(CatCommand)
+}
+
+//writeContent writes length bytes of the file starting at offset to out, only the chunks
+//covering that range are read and only one of them is held at a time
+func writeContent(c *cass.Cass, meta *cass.CassFsMetadata, offset int64, length int64, out io.Writer) error {
+	size := int64(meta.Metadata.Attr.Size)
+	end := size
+	if length >= 0 && offset+length < size {
+		end = offset + length
+	}
+	if offset >= end {
+		return nil
+	}
+	if len(meta.Metadata.Chunks) == 0 || meta.Metadata.Inline != nil {
+		//Files stored before chunking are a single blob, small files can be in their row
+		data, err := c.ReadFile(meta)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) < end {
+			return errors.New("Content is shorter than the file")
+		}
+		_, err = out.Write(data[offset:end])
+		return err
+	}
+	blockSize := meta.Metadata.ChunkSize()
+	for offset < end {
+		n := blockSize - offset%blockSize
+		if offset+n > end {
+			n = end - offset
+		}
+		data, err := c.ReadRange(meta.Metadata.Chunks, blockSize, offset, int(n))
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			//The file was extended past its last chunk, which reads as zeros
+			data = make([]byte, n)
+		}
+		_, err = out.Write(data)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(data))
+	}
+	return nil
+}
+
+func cat(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	if cat_offset < 0 {
+		fail(EXIT_USAGE, "The offset can not be negative")
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	code := EXIT_OK
+	for _, arg := range args {
+		_, meta, err := c.Resolve(storePath(arg))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to read", arg, ":", err)
+			code = exitCode(err)
+			continue
+		}
+		if meta != nil && meta.Metadata.Attr == nil {
+			fmt.Fprintln(os.Stderr, "Unable to read", arg, ": no attributes")
+			code = EXIT_FAILURE
+			continue
+		}
+		//The root of the environment has no row
+		if meta == nil || meta.Metadata.Attr.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			fmt.Fprintln(os.Stderr, "Unable to read", arg, ": not a regular file")
+			code = EXIT_FAILURE
+			continue
+		}
+		err = writeContent(c, meta, cat_offset, cat_length, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to read", arg, ":", err)
+			code = exitCode(err)
+		}
+	}
+	if code != EXIT_OK {
+		os.Exit(code)
+	}
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+//Long running commands keep a checkpoint in the statedir so an interrupted run can be
+//continued with --resume instead of starting over
+
+var (
+	resume            bool
+	progress_interval time.Duration
+)
+
+//addProgressFlags adds the flags for progress reporting and resuming to cmd
+func addProgressFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&resume, "resume", false, "Continue from the checkpoint of an interrupted run instead of starting over")
+	cmd.Flags().DurationVar(&progress_interval, "progress", 10*time.Second, "How often progress is reported, 0 disables it")
+}
+
+//checkpointPath returns the checkpoint of op for key in the current owner and environment
+func checkpointPath(op string, key string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d/%s/%s", viper.GetInt64("owner"), viper.GetString("environment"), key)))
+	return filepath.Join(viper.GetString("statedir"), "checkpoints", fmt.Sprintf("%s-%x.json", op, sum))
+}
+
+//loadCheckpoint reads the checkpoint at location into v, it returns false if there is none
+func loadCheckpoint(location string, v interface{}) bool {
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return false
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		log.Println("Ignoring unreadable checkpoint", location, ":", err)
+		return false
+	}
+	return true
+}
+
+//saveCheckpoint replaces the checkpoint at location with v
+func saveCheckpoint(location string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(location), os.FileMode(0755))
+	}
+	if err == nil {
+		err = ioutil.WriteFile(location+".tmp", data, os.FileMode(0644))
+	}
+	if err == nil {
+		err = os.Rename(location+".tmp", location)
+	}
+	if err != nil {
+		log.Println("Unable to save checkpoint:", err)
+	}
+}
+
+//reportProgress logs the progress of op every progress interval until the returned
+//function is called, which logs the final state
+func reportProgress(op string, p *cass.Progress) func() {
+	if progress_interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progress_interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Println("progress op="+op, p)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		log.Println("progress op="+op, p)
+	}
+}
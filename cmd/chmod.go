@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var ChmodCommand = &cobra.Command{
+	Use:   "chmod <mode> <path>",
+	Short: "Change the mode of entries directly in the store",
+	Long: `Change the mode of a path, and with -R of everything below it, without
+		going through a mount.  The mode is octal (0644) or symbolic (u+rwX,go-w),
+		--name, --uid, --gid and --type only change the entries that match.`,
+	Run: chmod,
+}
+
+var (
+	attr_recursive bool
+	attr_names     []string
+	attr_uid       int64
+	attr_gid       int64
+	attr_type      string
+	attr_page_size int
+	attr_dry_run   bool
+)
+
+func init() {
+	addAttrFlags(ChmodCommand)
+	RootCommand.AddCommand(ChmodCommand)
+}
+
+//addAttrFlags adds the filter and paging flags shared by chmod and chown to cmd
+func addAttrFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&attr_recursive, "recursive", "R", false, "Change everything below the path as well")
+	cmd.Flags().StringSliceVar(&attr_names, "name", nil, "Only change entries whose name (or path, if the pattern holds a /) matches one of these globs")
+	cmd.Flags().Int64Var(&attr_uid, "uid", -1, "Only change entries owned by this uid")
+	cmd.Flags().Int64Var(&attr_gid, "gid", -1, "Only change entries in this gid")
+	cmd.Flags().StringVar(&attr_type, "type", "", "Only change entries of this type (f, d or l)")
+	cmd.Flags().IntVar(&attr_page_size, "page-size", cass.ATTR_PAGE_SIZE, "Number of entries read at a time")
+	cmd.Flags().BoolVar(&attr_dry_run, "dry-run", false, "Report what would change without changing anything")
+	cmd.Flags().DurationVar(&progress_interval, "progress", 10*time.Second, "How often progress is reported, 0 disables it")
+	addBudgetFlags(cmd)
+}
+
+//attrOptions returns the options of a chmod or chown of p from the flags
+func attrOptions(p string) *cass.AttrOptions {
+	opts := &cass.AttrOptions{
+		Root:      storePath(p),
+		Recursive: attr_recursive,
+		Patterns:  attr_names,
+		Uid:       attr_uid,
+		Gid:       attr_gid,
+		NewUid:    -1,
+		NewGid:    -1,
+		PageSize:  attr_page_size,
+		DryRun:    attr_dry_run,
+		Progress:  cass.NewProgress(0, 0),
+	}
+	switch attr_type {
+	case "":
+	case "f":
+		opts.Type = syscall.S_IFREG
+	case "d":
+		opts.Type = syscall.S_IFDIR
+	case "l":
+		opts.Type = syscall.S_IFLNK
+	default:
+		fail(EXIT_USAGE, "Unknown type:", attr_type)
+	}
+	return opts
+}
+
+//changeAttrs runs a chmod or chown and reports the result, spec is what it was asked to
+//change to and is recorded in the audit log
+func changeAttrs(op string, spec string, opts *cass.AttrOptions) {
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	finished := reportProgress(op, opts.Progress)
+	report, err := c.ChangeAttrs(opts)
+	finished()
+	if err != nil {
+		fail(exitCode(err), "Unable to", op, opts.Root, ":", err)
+	}
+	action := "changed"
+	if opts.DryRun {
+		action = "would change"
+	}
+	log.Printf("Checked %d entries, %d matched, %s %d, %d errors\n", report.Checked, report.Matched, action, report.Changed, report.Errors)
+	if !opts.DryRun && report.Changed > 0 {
+		if opts.Recursive {
+			spec += fmt.Sprintf(" -R (%d entries)", report.Changed)
+		}
+		c.Audit(op, uint32(os.Getuid()), opts.Root, spec)
+	}
+	if report.Errors > 0 {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
+
+//parseMode parses an octal or symbolic (chmod(1) style) mode into a function that
+//returns the new permission bits of an entry
+func parseMode(spec string) (func(mode uint32) uint32, error) {
+	if n, err := strconv.ParseUint(spec, 8, 32); err == nil {
+		if n > 07777 {
+			return nil, errors.New("Invalid mode: " + spec)
+		}
+		return func(mode uint32) uint32 { return uint32(n) }, nil
+	}
+	type clause struct {
+		who   uint32
+		op    byte
+		perms string
+	}
+	var clauses []clause
+	for _, part := range strings.Split(spec, ",") {
+		who := uint32(0)
+		i := 0
+		for ; i < len(part) && strings.IndexByte("ugoa", part[i]) >= 0; i++ {
+			switch part[i] {
+			case 'u':
+				who |= 04700
+			case 'g':
+				who |= 02070
+			case 'o':
+				who |= 01007
+			case 'a':
+				who |= 07777
+			}
+		}
+		if who == 0 {
+			who = 07777
+		}
+		if i == len(part) {
+			return nil, errors.New("Invalid mode: " + spec)
+		}
+		//Each operator applies to the permissions that follow it
+		for i < len(part) {
+			op := part[i]
+			if op != '+' && op != '-' && op != '=' {
+				return nil, errors.New("Invalid mode: " + spec)
+			}
+			i++
+			start := i
+			for ; i < len(part) && strings.IndexByte("rwxXst", part[i]) >= 0; i++ {
+			}
+			clauses = append(clauses, clause{who: who, op: op, perms: part[start:i]})
+		}
+	}
+	return func(mode uint32) uint32 {
+		perm := mode & 07777
+		for _, cl := range clauses {
+			bits := uint32(0)
+			for _, p := range cl.perms {
+				switch p {
+				case 'r':
+					bits |= 0444
+				case 'w':
+					bits |= 0222
+				case 'x':
+					bits |= 0111
+				case 'X':
+					//Execute only for directories and files that are executable by someone
+					if mode&syscall.S_IFMT == syscall.S_IFDIR || perm&0111 != 0 {
+						bits |= 0111
+					}
+				case 's':
+					bits |= 06000
+				case 't':
+					bits |= 01000
+				}
+			}
+			bits &= cl.who
+			switch cl.op {
+			case '+':
+				perm |= bits
+			case '-':
+				perm &^= bits
+			case '=':
+				perm = (perm &^ cl.who) | bits
+			}
+		}
+		return perm
+	}, nil
+}
+
+func chmod(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	mode, err := parseMode(args[0])
+	if err != nil {
+		fail(EXIT_USAGE, err)
+	}
+	opts := attrOptions(args[1])
+	opts.Mode = mode
+	changeAttrs(cass.AUDIT_CHMOD, args[0], opts)
+}
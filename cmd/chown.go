@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var ChownCommand = &cobra.Command{
+	Use:   "chown <uid>[:<gid>] <path>",
+	Short: "Change the owner and group of entries directly in the store",
+	Long: `Change the owner and group of a path, and with -R of everything below it,
+		without going through a mount.  Either id can be left out (1000, 1000:1000
+		or :1000), with --uid and --gid it remaps the ids of a migration.`,
+	Run: chown,
+}
+
+func init() {
+	addAttrFlags(ChownCommand)
+	RootCommand.AddCommand(ChownCommand)
+}
+
+//parseOwner parses uid[:gid], a missing id is returned as -1
+func parseOwner(spec string) (int64, int64, bool) {
+	uid, gid := int64(-1), int64(-1)
+	parts := strings.SplitN(spec, ":", 2)
+	if parts[0] != "" {
+		n, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return 0, 0, false
+		}
+		uid = int64(n)
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		n, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return 0, 0, false
+		}
+		gid = int64(n)
+	}
+	return uid, gid, uid >= 0 || gid >= 0
+}
+
+func chown(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	uid, gid, ok := parseOwner(args[0])
+	if !ok {
+		fail(EXIT_USAGE, "Invalid owner:", args[0])
+	}
+	opts := attrOptions(args[1])
+	opts.NewUid = uid
+	opts.NewGid = gid
+	changeAttrs(cass.AUDIT_CHOWN, args[0], opts)
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/spf13/viper"
+)
+
+//DAEMON_ENV marks the process started by --daemon, it holds the descriptor the mount
+//reports it is ready on
+const DAEMON_ENV = "CASSFS_DAEMON_READY"
+
+//UNMOUNT_RETRIES is how often an unmount of a busy mount is tried before giving up until
+//the next signal
+const UNMOUNT_RETRIES = 10
+
+//daemonize starts the mount again in the background and waits until it is mounted, the
+//exit code of a mount that fails is passed on.  In the background process it only
+//detaches the log from the terminal.
+func daemonize() {
+	if os.Getenv(DAEMON_ENV) != "" {
+		if w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "cassfs"); err == nil {
+			log.SetOutput(w)
+			errLog.SetOutput(w)
+		} else {
+			log.SetOutput(ioutil.Discard)
+			errLog.SetOutput(ioutil.Discard)
+		}
+		return
+	}
+	ready, done, err := os.Pipe()
+	if err != nil {
+		fail(EXIT_FAILURE, "Unable to start the daemon:", err)
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		fail(EXIT_FAILURE, "Unable to start the daemon:", err)
+	}
+	child := exec.Command(os.Args[0], os.Args[1:]...)
+	//The pipe is the first extra file, so descriptor 3 in the child
+	child.Env = append(os.Environ(), DAEMON_ENV+"=3")
+	child.Stdin = null
+	child.Stdout = null
+	child.Stderr = null
+	child.ExtraFiles = []*os.File{done}
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = child.Start()
+	if err != nil {
+		fail(EXIT_FAILURE, "Unable to start the daemon:", err)
+	}
+	done.Close()
+	buf := make([]byte, 1)
+	if n, _ := ready.Read(buf); n == 1 {
+		log.Println("Mounted in the background as process", child.Process.Pid)
+		os.Exit(EXIT_OK)
+	}
+	//The daemon exited before it was mounted, its log explains why
+	err = child.Wait()
+	if exit, ok := err.(*exec.ExitError); ok {
+		if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.ExitStatus() > 0 {
+			fail(status.ExitStatus(), "The daemon failed to mount, see the system log")
+		}
+	}
+	fail(EXIT_FAILURE, "The daemon failed to mount, see the system log")
+}
+
+//daemonReady tells the process that started the daemon that the file system is mounted
+func daemonReady() {
+	fd, err := strconv.Atoi(os.Getenv(DAEMON_ENV))
+	if err != nil {
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+	os.Unsetenv(DAEMON_ENV)
+}
+
+//writePidfile records the pid of the mount in location, a pidfile of a mount that is still
+//running is not replaced
+func writePidfile(location string) {
+	if data, err := ioutil.ReadFile(location); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && syscall.Kill(pid, 0) == nil {
+			fail(EXIT_CONFLICT, "Already running as process", pid, "according to", location)
+		}
+	}
+	err := os.MkdirAll(filepath.Dir(location), os.FileMode(0755))
+	if err == nil {
+		err = ioutil.WriteFile(location+".tmp", []byte(strconv.Itoa(os.Getpid())+"\n"), os.FileMode(0644))
+	}
+	if err == nil {
+		err = os.Rename(location+".tmp", location)
+	}
+	if err != nil {
+		fail(exitCode(err), "Unable to write the pidfile:", err)
+	}
+}
+
+//unmountOnSignal unmounts server on SIGINT or SIGTERM so the mount point is not left
+//behind, a busy mount is retried for a while and again on the next signal
+func unmountOnSignal(server *fuse.Server, mount string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			log.Println("Received", sig, "- unmounting", mount)
+			for attempt := 1; ; attempt++ {
+				err := server.Unmount()
+				if err == nil {
+					break
+				}
+				if attempt == UNMOUNT_RETRIES {
+					log.Println("Unable to unmount", mount, ":", err, "- stop the processes using it and signal again")
+					break
+				}
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+}
+
+//serve answers requests for the mounted server until it is unmounted
+func serve(server *fuse.Server, mount string) {
+	server.SetDebug(viper.GetBool("debug"))
+	unmountOnSignal(server, mount)
+	pidfile := viper.GetString("pidfile")
+	if pidfile != "" {
+		writePidfile(pidfile)
+	}
+	daemonReady()
+	server.Serve()
+	if pidfile != "" {
+		os.Remove(pidfile)
+	}
+	log.Println("Unmounted", mount)
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var DefaultsCommand = &cobra.Command{
+	Use:   "defaults",
+	Short: "Show or set the defaults for new files in an environment",
+	Long: `Show or set the mode masks, owner and extended attributes
+		applied to every file and directory created in an environment.`,
+	Run: defaults,
+}
+
+var (
+	defaults_file_mask string
+	defaults_dir_mask  string
+	defaults_uid       uint32
+	defaults_gid       uint32
+	defaults_xattr     []string
+	defaults_clear     bool
+	defaults_block     string
+	defaults_pipeline  []string
+	defaults_inline    string
+)
+
+func init() {
+	DefaultsCommand.Flags().StringVar(&defaults_file_mask, "file-mask", "", "Octal permission bits removed from new files")
+	DefaultsCommand.Flags().StringVar(&defaults_dir_mask, "dir-mask", "", "Octal permission bits removed from new directories")
+	DefaultsCommand.Flags().Uint32Var(&defaults_uid, "uid", 0, "Owner of new files and directories")
+	DefaultsCommand.Flags().Uint32Var(&defaults_gid, "gid", 0, "Group of new files and directories")
+	DefaultsCommand.Flags().StringSliceVar(&defaults_xattr, "xattr", nil, "Extended attribute (name=value) set on new files and directories")
+	DefaultsCommand.Flags().StringVar(&defaults_block, "block-size", "", "Size of the chunks new files are split into, with an optional K or M suffix")
+	DefaultsCommand.Flags().StringVar(&defaults_inline, "inline-size", "", "Size up to which files are kept in their metadata row, with an optional K suffix, 0 does not inline")
+	DefaultsCommand.Flags().StringSliceVar(&defaults_pipeline, "pipeline", nil, "Transforms new data goes through in order (snappy,zstd,aes-gcm or registered ones), none for no transforms")
+	DefaultsCommand.Flags().BoolVar(&defaults_clear, "clear", false, "Remove all of the defaults")
+	RootCommand.AddCommand(DefaultsCommand)
+}
+
+func defaults(cmd *cobra.Command, args []string) {
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	config := c.Config
+	changed := false
+	if defaults_clear {
+		config.Defaults = cass.EnvDefaults{}
+		changed = true
+	}
+	if cmd.Flags().Changed("file-mask") {
+		mask, err := strconv.ParseUint(defaults_file_mask, 8, 32)
+		if err != nil {
+			fail(EXIT_USAGE, "Invalid file mask:", err)
+		}
+		config.Defaults.FileMask = uint32(mask)
+		changed = true
+	}
+	if cmd.Flags().Changed("dir-mask") {
+		mask, err := strconv.ParseUint(defaults_dir_mask, 8, 32)
+		if err != nil {
+			fail(EXIT_USAGE, "Invalid directory mask:", err)
+		}
+		config.Defaults.DirMask = uint32(mask)
+		changed = true
+	}
+	if cmd.Flags().Changed("uid") || cmd.Flags().Changed("gid") {
+		if config.Defaults.Owner == nil {
+			config.Defaults.Owner = &fuse.Owner{}
+		}
+		if cmd.Flags().Changed("uid") {
+			config.Defaults.Owner.Uid = defaults_uid
+		}
+		if cmd.Flags().Changed("gid") {
+			config.Defaults.Owner.Gid = defaults_gid
+		}
+		changed = true
+	}
+	if cmd.Flags().Changed("block-size") {
+		size, err := parseSize(defaults_block)
+		if err == nil {
+			err = cass.CheckBlockSize(size)
+		}
+		if err != nil {
+			fail(EXIT_USAGE, err)
+		}
+		config.Defaults.BlockSize = size
+		changed = true
+	}
+	if cmd.Flags().Changed("inline-size") {
+		size, err := parseSize(defaults_inline)
+		if err == nil {
+			err = cass.CheckInlineSize(size)
+		}
+		if err != nil {
+			fail(EXIT_USAGE, err)
+		}
+		config.Defaults.InlineSize = size
+		changed = true
+	}
+	if cmd.Flags().Changed("pipeline") {
+		if len(defaults_pipeline) == 1 && defaults_pipeline[0] == "none" {
+			defaults_pipeline = nil
+		}
+		err = cass.CheckPipeline(defaults_pipeline)
+		if err != nil {
+			fail(EXIT_USAGE, err)
+		}
+		config.Defaults.Pipeline = defaults_pipeline
+		changed = true
+	}
+	for _, x := range defaults_xattr {
+		kv := strings.SplitN(x, "=", 2)
+		if len(kv) != 2 {
+			fail(EXIT_USAGE, "Extended attributes must be in the form name=value:", x)
+		}
+		if config.Defaults.XAttr == nil {
+			config.Defaults.XAttr = make(map[string]string)
+		}
+		config.Defaults.XAttr[kv[0]] = kv[1]
+		changed = true
+	}
+	if changed {
+		err = c.SaveEnvConfig(config)
+		if err != nil {
+			fail(exitCode(err), "Unable to save the environment configuration:", err)
+		}
+		//Records the features the pipeline needs
+		err = c.CheckFeatures(false)
+		if err != nil {
+			fail(exitCode(err), "Unable to record the features of the environment:", err)
+		}
+	}
+	fmt.Printf("File mask: %04o\n", config.Defaults.FileMask)
+	fmt.Printf("Dir mask:  %04o\n", config.Defaults.DirMask)
+	if config.Defaults.Owner != nil {
+		fmt.Printf("Owner:     %d:%d\n", config.Defaults.Owner.Uid, config.Defaults.Owner.Gid)
+	}
+	block := config.Defaults.BlockSize
+	if block == 0 {
+		block = cass.BLOBSIZE
+	}
+	fmt.Printf("Blocks:    %d\n", block)
+	if config.Defaults.InlineSize > 0 {
+		fmt.Printf("Inline:    %d\n", config.Defaults.InlineSize)
+	}
+	if len(config.Defaults.Pipeline) > 0 {
+		fmt.Printf("Pipeline:  %s\n", strings.Join(config.Defaults.Pipeline, ","))
+	}
+	for k, v := range config.Defaults.XAttr {
+		fmt.Printf("XAttr:     %s=%s\n", k, v)
+	}
+}
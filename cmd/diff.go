@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var DiffCommand = &cobra.Command{
+	Use:   "diff <from> <to> [path]",
+	Short: "List the paths that differ between two environments or snapshots",
+	Long: `Compare two environments below path and list what was added, removed or
+		changed from the first to the second.  Either side can be a snapshot:
+		environment@<RFC3339 time> is the environment as it was at that time, which
+		needs the history policy, and environment@<manifest id> or
+		environment@manifest is a signed manifest of it, the latest one for the
+		latter.  Environments and manifests are compared by their Merkle hashes,
+		only the directories that differ are read.  Exits with 5 when there are
+		differences.`,
+	Run: diff,
+}
+
+var diff_summary bool
+
+func init() {
+	DiffCommand.Flags().BoolVar(&diff_summary, "summary", false, "Only print the number of paths of each kind")
+	RootCommand.AddCommand(DiffCommand)
+}
+
+//diffSide is one side of a diff: an environment as it is now, the state it had at a time,
+//whose entries are read right away, or a signed manifest of it
+type diffSide struct {
+	store    *cass.Cass
+	entries  map[string]*cass.ManifestEntry
+	manifest *cass.EnvManifest
+}
+
+//openSide opens the side of a diff written as environment[@snapshot]
+func openSide(c *cass.Cass, spec string, p string) (*diffSide, error) {
+	env, snapshot := spec, ""
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		env, snapshot = spec[:i], spec[i+1:]
+	}
+	store, err := c.ForEnvironment(env)
+	if err != nil {
+		return nil, err
+	}
+	side := &diffSide{store: store}
+	if snapshot == "" {
+		return side, nil
+	}
+	if asOf, err := time.Parse(time.RFC3339, snapshot); err == nil {
+		start, err := store.HistoryStart()
+		if err != nil {
+			return nil, err
+		}
+		if asOf.Before(start) || asOf.After(time.Now()) {
+			return nil, cass.ErrNoHistory
+		}
+		store.AsOf = asOf
+		side.entries, err = store.Snapshot(p)
+		return side, err
+	}
+	if snapshot == "manifest" {
+		snapshot = ""
+	}
+	side.manifest, err = store.LoadManifest(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	side.entries = side.manifest.Below(p)
+	return side, nil
+}
+
+//current checks if the side is an environment as it is now
+func (s *diffSide) current() bool {
+	return s.entries == nil
+}
+
+//reverseChanges turns the changes from a to b into the changes from b to a
+func reverseChanges(changes []cass.TreeChange) {
+	for i := range changes {
+		switch changes[i].Kind {
+		case cass.TREE_ADDED:
+			changes[i].Kind = cass.TREE_REMOVED
+		case cass.TREE_REMOVED:
+			changes[i].Kind = cass.TREE_ADDED
+		}
+	}
+}
+
+func diff(cmd *cobra.Command, args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	p := ""
+	if len(args) == 3 {
+		p = storePath(args[2])
+	}
+	viper.Set("environment", strings.Split(args[0], "@")[0])
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	from, err := openSide(c, args[0], p)
+	if err != nil {
+		fail(exitCode(err), "Unable to open", args[0], ":", err)
+	}
+	to, err := openSide(c, args[1], p)
+	if err != nil {
+		fail(exitCode(err), "Unable to open", args[1], ":", err)
+	}
+	//Environments and manifests are compared by their Merkle hashes, only the state at a
+	//time has to be compared entry by entry
+	var changes []cass.TreeChange
+	switch {
+	case from.current() && to.current():
+		changes, err = from.store.DiffTrees(to.store, p)
+	case from.manifest != nil && to.current():
+		changes, err = to.store.DiffManifest(from.manifest, p)
+	case from.current() && to.manifest != nil:
+		changes, err = from.store.DiffManifest(to.manifest, p)
+		reverseChanges(changes)
+	default:
+		if from.current() {
+			from.entries, err = from.store.Snapshot(p)
+		} else if to.current() {
+			to.entries, err = to.store.Snapshot(p)
+		}
+		if err == nil {
+			changes = cass.DiffSnapshots(from.entries, to.entries)
+		}
+	}
+	if err != nil {
+		fail(exitCode(err), "Unable to compare", args[0], "and", args[1], ":", err)
+	}
+	if diff_summary {
+		counts := make(map[string]int)
+		for _, change := range changes {
+			counts[change.Kind]++
+		}
+		fmt.Printf("%d added, %d removed, %d changed\n", counts[cass.TREE_ADDED], counts[cass.TREE_REMOVED], counts[cass.TREE_CHANGED])
+	} else {
+		for _, change := range changes {
+			fmt.Println(change.Kind, change.Path)
+		}
+	}
+	if len(changes) > 0 {
+		os.Exit(EXIT_CONFLICT)
+	}
+}
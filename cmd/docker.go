@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/cgt212/cassfs/cass"
 	"github.com/cgt212/cassfs/driver"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/spf13/cobra"
@@ -37,6 +38,24 @@ func docker(cmd *cobra.Command, args []string) {
 		StateDir:    viper.GetString("statedir"),
 		VolumeDir:   viper.GetString("voldir"),
 	}
+	//The cluster is only connected to when an overlay volume is removed
+	var store *cass.Cass
+	config.DeleteEnvironment = func(owner int, env string) error {
+		if store == nil {
+			c := newStore()
+			err := c.Init()
+			if err != nil {
+				return err
+			}
+			store = c
+		}
+		overlay, err := store.ForOwner(int64(owner), env)
+		if err != nil {
+			return err
+		}
+		_, err = overlay.DeleteEnvironment(false)
+		return err
+	}
 	driver := driver.NewCassFsDriver(&config)
 	if driver == nil {
 		panic("Got nil back for driver")
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var DuCommand = &cobra.Command{
+	Use:   "du [path]",
+	Short: "Report the logical and physical usage of the directories of an environment",
+	Long: `List the directories below path with the number of files, the sum of
+		their sizes (logical) and the data they keep in the store (physical),
+		which counts content shared by several files once.`,
+	Run: du,
+}
+
+var (
+	du_depth int
+	du_human bool
+)
+
+func init() {
+	DuCommand.Flags().IntVarP(&du_depth, "max-depth", "d", 1, "Levels of directories listed below path, -1 lists all")
+	DuCommand.Flags().BoolVarP(&du_human, "human-readable", "H", false, "Print sizes with a K, M or G suffix")
+	RootCommand.AddCommand(DuCommand)
+}
+
+//formatSize prints a size in bytes, or rounded with the suffix parseSize accepts
+func formatSize(size int64) string {
+	if !du_human {
+		return fmt.Sprintf("%d", size)
+	}
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if size >= unit.size {
+			return fmt.Sprintf("%.1f%s", float64(size)/float64(unit.size), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%d", size)
+}
+
+func du(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	root := ""
+	if len(args) == 1 {
+		root = storePath(args[0])
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	usage, err := c.Usage(root, du_depth)
+	if err != nil {
+		fail(exitCode(err), "Unable to compute the usage:", err)
+	}
+	fmt.Printf("%10s %10s %8s %s\n", "LOGICAL", "PHYSICAL", "FILES", "PATH")
+	for _, u := range usage {
+		name := "/" + u.Path
+		fmt.Printf("%10s %10s %8d %s\n", formatSize(u.Logical), formatSize(u.Physical), u.Files, name)
+	}
+}
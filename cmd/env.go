@@ -0,0 +1,381 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/cgt212/cassfs/cass"
+	"github.com/gocql/gocql"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var EnvCommand = &cobra.Command{
+	Use:   "env",
+	Short: "Manage the environments of an owner",
+}
+
+var EnvListCommand = &cobra.Command{
+	Use:   "list",
+	Short: "List the environments of the owner",
+	Long: `List the environments that have entries or a configuration, an environment
+		made with create is listed before anything is stored in it.`,
+	Run: envList,
+}
+
+var EnvCreateCommand = &cobra.Command{
+	Use:   "create <environment>",
+	Short: "Create an empty environment",
+	Long: `Create an environment with only its root directory, which gets --mode and
+		the owner of --uid and --gid.  Mounts of the environment use them instead
+		of the mode and owner of the mount point.`,
+	Run: envCreate,
+}
+
+var EnvCloneCommand = &cobra.Command{
+	Use:   "clone <from environment> <to environment>",
+	Short: "Copy an environment into a new one",
+	Long: `Copy the entries and the configuration of an environment into one that does
+		not exist yet.  The data is shared, only the metadata is copied.  With --cow
+		nothing is copied, the clone is mounted over the environment it came from as
+		it was at the time of the clone and only stores the entries that are changed
+		through it.`,
+	Run: envClone,
+}
+
+var EnvStampCommand = &cobra.Command{
+	Use:   "stamp",
+	Short: "Create many copies of a template environment",
+	Long: `Create --count copy-on-write clones of the --from environment named with
+		--prefix and a sequence number, optionally changing the default owner and
+		the largest file size of each clone.  Nothing but the configuration of the
+		clones is written, see env clone --cow.`,
+	Run: envStamp,
+}
+
+var EnvHashCommand = &cobra.Command{
+	Use:   "hash [path]",
+	Short: "Print the Merkle hash of the environment or a directory in it",
+	Run:   envHash,
+}
+
+var EnvDiffCommand = &cobra.Command{
+	Use:   "diff <from environment> <to environment> [path]",
+	Short: "List the paths that differ between two environments",
+	Long: `Compare the Merkle hashes of two environments, only the directories
+		whose hashes differ are read.  Exits with 5 when there are differences.
+		The same as cassfs diff, which also compares snapshots.`,
+	Run: diff,
+}
+
+var EnvFeaturesCommand = &cobra.Command{
+	Use:   "features",
+	Short: "List or change the features used by the environment",
+	Long: `Without flags the features of the environment are listed, features marked
+		required keep clients that do not support them from mounting read-write.`,
+	Run: envFeatures,
+}
+
+var EnvDeleteCommand = &cobra.Command{
+	Use:   "delete",
+	Short: "Delete the environment and release its data",
+	Long: `Remove every entry and the configuration of the environment.  The report
+		lists the entries removed, the chunks only the environment referenced that
+		gc can reclaim and the chunks that survive since other entries share them.
+		With --dry-run only the report is printed.`,
+	Run: envDelete,
+}
+
+var (
+	delete_dry_run bool
+
+	env_all_owners bool
+	clone_cow      bool
+	create_mode    string
+	create_uid     uint32
+	create_gid     uint32
+
+	stamp_from   string
+	stamp_count  int
+	stamp_start  int
+	stamp_prefix string
+	stamp_uid    uint32
+	stamp_gid    uint32
+	stamp_max    uint64
+
+	feature_enable   []string
+	feature_disable  []string
+	feature_required bool
+)
+
+func init() {
+	EnvStampCommand.Flags().StringVar(&stamp_from, "from", "", "Template environment, defaults to --environment")
+	EnvStampCommand.Flags().IntVar(&stamp_count, "count", 1, "Number of environments to create")
+	EnvStampCommand.Flags().IntVar(&stamp_start, "start", 1, "First sequence number")
+	EnvStampCommand.Flags().StringVar(&stamp_prefix, "prefix", "", "Prefix of the new environment names")
+	EnvStampCommand.Flags().Uint32Var(&stamp_uid, "uid", 0, "Default owner of new files in the copies")
+	EnvStampCommand.Flags().Uint32Var(&stamp_gid, "gid", 0, "Default group of new files in the copies")
+	EnvStampCommand.Flags().Uint64Var(&stamp_max, "max-size", 0, "Largest file in bytes the copies can store, 0 for no limit")
+	EnvCommand.AddCommand(EnvStampCommand)
+	EnvCommand.AddCommand(EnvHashCommand)
+	EnvFeaturesCommand.Flags().StringSliceVar(&feature_enable, "enable", nil, "Features to enable")
+	EnvFeaturesCommand.Flags().StringSliceVar(&feature_disable, "disable", nil, "Features to disable")
+	EnvFeaturesCommand.Flags().BoolVar(&feature_required, "required", false, "Clients must support the enabled features to mount read-write")
+	EnvCommand.AddCommand(EnvDiffCommand)
+	EnvCommand.AddCommand(EnvFeaturesCommand)
+	EnvDeleteCommand.Flags().BoolVar(&delete_dry_run, "dry-run", false, "Report the impact of the deletion without changing anything")
+	EnvCommand.AddCommand(EnvDeleteCommand)
+	EnvListCommand.Flags().BoolVar(&env_all_owners, "all-owners", false, "List the environments of every owner")
+	EnvCommand.AddCommand(EnvListCommand)
+	EnvCreateCommand.Flags().StringVar(&create_mode, "mode", "0755", "Permissions of the root directory in octal")
+	EnvCreateCommand.Flags().Uint32Var(&create_uid, "uid", uint32(os.Getuid()), "Owner of the root directory")
+	EnvCreateCommand.Flags().Uint32Var(&create_gid, "gid", uint32(os.Getgid()), "Group of the root directory")
+	EnvCommand.AddCommand(EnvCreateCommand)
+	EnvCloneCommand.Flags().BoolVar(&clone_cow, "cow", false, "Make a copy-on-write clone that shares the entries of the environment")
+	EnvCommand.AddCommand(EnvCloneCommand)
+	RootCommand.AddCommand(EnvCommand)
+}
+
+func envList(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	envs, err := c.Environments(env_all_owners)
+	if err != nil {
+		fail(exitCode(err), "Unable to list the environments:", err)
+	}
+	for _, env := range envs {
+		if env_all_owners {
+			fmt.Println(env)
+		} else {
+			fmt.Println(env.Environment)
+		}
+	}
+}
+
+func envCreate(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	mode, err := strconv.ParseUint(create_mode, 8, 32)
+	if err != nil || mode&^07777 != 0 {
+		fail(EXIT_USAGE, "Invalid mode:", create_mode)
+	}
+	viper.Set("environment", args[0])
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	err = c.CreateEnvironment(uint32(mode), fuse.Owner{Uid: create_uid, Gid: create_gid})
+	if err != nil {
+		fail(exitCode(err), "Unable to create", args[0], ":", err)
+	}
+}
+
+func envClone(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	viper.Set("environment", args[0])
+	from, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	exists, err := from.EnvironmentExists()
+	if err == nil && !exists {
+		err = gocql.ErrNotFound
+	}
+	if err != nil {
+		fail(exitCode(err), "Unable to clone", args[0], ":", err)
+	}
+	to, err := from.ForEnvironment(args[1])
+	if err != nil {
+		fail(exitCode(err), "Unable to open environment", args[1], ":", err)
+	}
+	exists, err = to.EnvironmentExists()
+	if err == nil && exists {
+		err = cass.ErrEnvExists
+	}
+	if err != nil {
+		fail(exitCode(err), "Unable to clone into", args[1], ":", err)
+	}
+	if clone_cow {
+		err = from.CloneShared(to)
+		if err != nil {
+			fail(exitCode(err), "Unable to clone", args[0], ":", err)
+		}
+		return
+	}
+	count, err := from.CloneEnvironment(to)
+	if err != nil {
+		fail(exitCode(err), "Unable to clone", args[0], ":", err)
+	}
+	fmt.Printf("%s: %d entries\n", args[1], count)
+}
+
+func envStamp(cmd *cobra.Command, args []string) {
+	if stamp_prefix == "" {
+		fail(EXIT_USAGE, "A --prefix is required")
+	}
+	if stamp_from != "" {
+		viper.Set("environment", stamp_from)
+	}
+	template, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	failed := 0
+	for i := stamp_start; i < stamp_start+stamp_count; i++ {
+		name := fmt.Sprintf("%s%d", stamp_prefix, i)
+		target, err := template.ForEnvironment(name)
+		if err != nil {
+			log.Println("Unable to open environment", name, ":", err)
+			failed++
+			continue
+		}
+		exists, err := target.EnvironmentExists()
+		if err != nil || exists {
+			log.Println("Skipping", name, "since it already exists")
+			failed++
+			continue
+		}
+		err = template.CloneShared(target)
+		if err != nil {
+			log.Println("Unable to create", name, ":", err)
+			failed++
+			continue
+		}
+		if cmd.Flags().Changed("max-size") {
+			target.Config.Policy.MaxFileSize = stamp_max
+		}
+		if cmd.Flags().Changed("uid") || cmd.Flags().Changed("gid") {
+			owner := &fuse.Owner{Uid: stamp_uid, Gid: stamp_gid}
+			if target.Config.Defaults.Owner != nil {
+				*owner = *target.Config.Defaults.Owner
+			}
+			if cmd.Flags().Changed("uid") {
+				owner.Uid = stamp_uid
+			}
+			if cmd.Flags().Changed("gid") {
+				owner.Gid = stamp_gid
+			}
+			target.Config.Defaults.Owner = owner
+		}
+		if cmd.Flags().Changed("max-size") || cmd.Flags().Changed("uid") || cmd.Flags().Changed("gid") {
+			err = target.SaveEnvConfig(target.Config)
+			if err != nil {
+				log.Println("Unable to configure", name, ":", err)
+				failed++
+				continue
+			}
+		}
+		fmt.Printf("%s: cloned from %s\n", name, template.Environment)
+	}
+	if failed > 0 {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
+
+func envHash(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	p := ""
+	if len(args) == 1 {
+		p = storePath(args[0])
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	hash, err := c.TreeHash(p)
+	if err != nil {
+		fail(exitCode(err), "Unable to hash", p, ":", err)
+	}
+	fmt.Printf("%x\n", hash)
+}
+
+func envDelete(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	impact, err := c.DeleteEnvironment(delete_dry_run)
+	if err != nil {
+		fail(exitCode(err), "Unable to delete the environment:", err)
+	}
+	if !delete_dry_run {
+		c.Audit(cass.AUDIT_DELETE, uint32(os.Getuid()), "", "environment")
+	}
+	printImpact(impact, delete_dry_run)
+}
+
+//printImpact prints the report of a removal, which is in the future tense for a dry run
+func printImpact(impact *cass.Impact, dryRun bool) {
+	removed, freed := "Removed", "can be reclaimed by gc"
+	if dryRun {
+		removed, freed = "Would remove", "would become reclaimable by gc"
+	}
+	fmt.Printf("%s %d files and %d directories\n", removed, impact.Files, impact.Dirs)
+	fmt.Printf("%d of %d chunks (%d of %d bytes) %s\n", impact.Freed, impact.Chunks, impact.FreedBytes, impact.Bytes, freed)
+	fmt.Printf("%d chunks (%d bytes) survive since other entries reference them\n", impact.Shared, impact.SharedBytes)
+}
+
+func envFeatures(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	for _, name := range feature_enable {
+		if !cass.KnownFeatures[name] {
+			log.Println("Warning: this client does not support", name)
+		}
+		err = c.EnableFeature(name, feature_required)
+		if err != nil {
+			fail(exitCode(err), "Unable to enable", name, ":", err)
+		}
+	}
+	for _, name := range feature_disable {
+		err = c.DisableFeature(name)
+		if err != nil {
+			fail(exitCode(err), "Unable to disable", name, ":", err)
+		}
+	}
+	features, err := c.LoadFeatures()
+	if err != nil {
+		fail(exitCode(err), "Unable to read the features:", err)
+	}
+	for _, name := range features.Enabled {
+		required := false
+		for _, r := range features.Required {
+			required = required || r == name
+		}
+		state := "optional"
+		if required {
+			state = "required"
+		}
+		if !cass.KnownFeatures[name] {
+			state += ", unsupported"
+		}
+		fmt.Printf("%s\t%s\n", name, state)
+	}
+}
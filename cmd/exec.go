@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var ExecCommand = &cobra.Command{
+	Use:   "exec [flags] -- <command> [args]...",
+	Short: "Run a command in a temporary mount of an environment",
+	Long: `Mount the environment at a temporary directory, run the command with
+		that directory as its working directory, then write back everything
+		the mount holds, unmount it and remove the directory.  The exit code
+		is the one of the command.  Mount options set in the config file, like
+		subpath or consistency, apply to the temporary mount as well.`,
+	Run: execCommand,
+}
+
+var (
+	exec_ro bool
+)
+
+func init() {
+	ExecCommand.Flags().BoolVar(&exec_ro, "ro", false, "Mount the environment read only")
+	RootCommand.AddCommand(ExecCommand)
+}
+
+func execCommand(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	if exec_ro {
+		viper.Set("ro", true)
+	}
+	dir, err := ioutil.TempDir("", "cassfs-exec-")
+	if err != nil {
+		fail(exitCode(err), "Unable to create the mount point:", err)
+	}
+	server, fs := newMount(dir, entry_ttl)
+	server.SetDebug(viper.GetBool("debug"))
+	go server.Serve()
+	err = server.WaitMount()
+	if err != nil {
+		os.Remove(dir)
+		fail(EXIT_FAILURE, "Unable to mount:", err)
+	}
+
+	child := exec.Command(args[0], args[1:]...)
+	child.Dir = dir
+	child.Env = append(os.Environ(), "CASSFS_MOUNT="+dir)
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	code := EXIT_OK
+	//The command gets the signals, the mount has to outlive it to be cleaned up
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	err = child.Start()
+	if err != nil {
+		log.Println("Unable to run", args[0], ":", err)
+		code = EXIT_FAILURE
+	} else {
+		go func() {
+			for sig := range signals {
+				child.Process.Signal(sig)
+			}
+		}()
+		err = child.Wait()
+		if exit, ok := err.(*exec.ExitError); ok {
+			code = EXIT_FAILURE
+			if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.ExitStatus() > 0 {
+				code = status.ExitStatus()
+			}
+		} else if err != nil {
+			log.Println("Unable to run", args[0], ":", err)
+			code = EXIT_FAILURE
+		}
+	}
+	signal.Stop(signals)
+
+	fs.Flush()
+	for attempt := 1; ; attempt++ {
+		err = server.Unmount()
+		if err == nil {
+			break
+		}
+		if attempt == UNMOUNT_RETRIES {
+			//Something the command started in the background still uses the mount
+			fail(EXIT_CONFLICT, "Unable to unmount", dir, ":", err)
+		}
+		time.Sleep(time.Second)
+	}
+	os.Remove(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"log"
+	"net"
+	"os"
+
+	"github.com/gocql/gocql"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+//Exit codes of the commands, tooling can rely on these instead of parsing the log
+const (
+	EXIT_OK         = 0
+	EXIT_FAILURE    = 1 //Any failure that does not fit one of the classes below
+	EXIT_USAGE      = 2 //Invalid arguments or flags
+	EXIT_CONNECTION = 3 //The cluster or a mount could not be reached
+	EXIT_NOT_FOUND  = 4 //A file, directory or environment does not exist
+	EXIT_CONFLICT   = 5 //The target already exists or is in a state that does not allow the operation
+	EXIT_QUOTA      = 6 //An environment policy or quota was exceeded
+	EXIT_PARTIAL    = 7 //The command finished but some of its work failed
+	EXIT_FORMAT     = 8 //The stored data format is not supported by this binary
+)
+
+//errLog reports the error a command stops on, it is not silenced by --quiet
+var errLog = log.New(os.Stderr, "", log.LstdFlags)
+
+//exitCode returns the exit code for err
+func exitCode(err error) int {
+	switch err {
+	case nil:
+		return EXIT_OK
+	case gocql.ErrNotFound, cass.ErrNoVersion, cass.ErrNotInTrash, cass.ErrNoHistory:
+		return EXIT_NOT_FOUND
+	case gocql.ErrNoConnections, gocql.ErrNoHosts, gocql.ErrTimeoutNoResponse, gocql.ErrConnectionClosed:
+		return EXIT_CONNECTION
+	case cass.ErrExists, cass.ErrEnvExists, cass.ErrHasClones, cass.ErrAttrExists, cass.ErrNotEmpty, cass.ErrIsDir, cass.ErrNotDir, cass.ErrLinkDir, cass.ErrSourceChanged, cass.ErrBadSignature, cass.ErrBadReport, cass.ErrTampered, cass.ErrChanged, cass.ErrUnknownFeature, cass.ErrFormatChanged:
+		return EXIT_CONFLICT
+	case cass.ErrTooLarge, cass.ErrDenied:
+		return EXIT_QUOTA
+	case cass.ErrFormatTooNew, cass.ErrFormatTooOld, cass.ErrFormatDowngrade:
+		return EXIT_FORMAT
+	}
+	if os.IsNotExist(err) {
+		return EXIT_NOT_FOUND
+	}
+	if os.IsExist(err) {
+		return EXIT_CONFLICT
+	}
+	if _, ok := err.(net.Error); ok {
+		return EXIT_CONNECTION
+	}
+	return EXIT_FAILURE
+}
+
+//fail logs v and exits with code
+func fail(code int, v ...interface{}) {
+	errLog.Println(v...)
+	os.Exit(code)
+}
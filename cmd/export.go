@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"archive/tar"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var ExportCommand = &cobra.Command{
+	Use:   "export <path> <local directory, .tar file or ->",
+	Short: "Export an environment or a subtree to a local directory or a tar stream",
+	Long: `Read the tree below path out of the store without mounting it and write
+		it to a local directory, a tar file, or as a tar stream to stdout with -.
+		Modes, owners, times and extended attributes are kept, owners of local
+		files are only set when running as root.`,
+	Run: export,
+}
+
+func init() {
+	addBudgetFlags(ExportCommand)
+	addProgressFlags(ExportCommand)
+	addVerifyFlags(ExportCommand)
+	RootCommand.AddCommand(ExportCommand)
+}
+
+func export(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	root, _, err := c.Resolve(storePath(args[0]))
+	if err != nil {
+		fail(exitCode(err), "Unable to resolve", args[0], ":", err)
+	}
+	verification := newVerification(c, "export", root)
+	dest := args[1]
+	var exp cass.Exporter
+	switch {
+	case dest == "-":
+		if verification != nil {
+			fail(EXIT_USAGE, "A tar stream on stdout can not be verified")
+		}
+		exp = cass.NewTarExporter(os.Stdout)
+	case strings.HasSuffix(dest, ".tar"):
+		f, err := os.Create(dest)
+		if err != nil {
+			fail(exitCode(err), "Unable to create", dest, ":", err)
+		}
+		defer f.Close()
+		exp = cass.NewTarExporter(f)
+	default:
+		exp, err = cass.NewDirExporter(dest)
+		if err != nil {
+			fail(exitCode(err), "Unable to create", dest, ":", err)
+		}
+	}
+	progress := cass.NewProgress(0, 0)
+	finished := reportProgress("export", progress)
+	report, err := c.Export(root, exp, progress)
+	finished()
+	if err != nil {
+		fail(exitCode(err), "Export failed:", err)
+	}
+	log.Printf("Exported %d directories, %d files (%d bytes) and %d symlinks\n", report.Dirs, report.Files, report.Bytes, report.Symlinks)
+	if report.Skipped > 0 {
+		log.Println("Skipped", report.Skipped, "entries that are not files, directories or symlinks")
+	}
+	if verification != nil {
+		err = verifyExport(c, verification, root, dest)
+		if err != nil {
+			fail(exitCode(err), "Unable to verify the export:", err)
+		}
+		saveVerification(verification)
+	}
+}
+
+//verifyExport compares the exported files with the store.  Every file of the tree has to
+//be in an exported directory, a tar file is read back entry by entry.
+func verifyExport(c *cass.Cass, report *cass.VerificationReport, root string, dest string) error {
+	if !strings.HasSuffix(dest, ".tar") {
+		return c.Walk(root, func(name string, hash []byte, meta *cass.CassMetadata) error {
+			if meta.Attr.Mode&syscall.S_IFMT == syscall.S_IFREG {
+				rel := strings.TrimPrefix(name, root+"/")
+				if root == "" {
+					rel = name
+				}
+				verifyLocal(c, report, filepath.Join(dest, filepath.FromSlash(rel)), name)
+			}
+			return nil
+		})
+	}
+	f, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := tar.NewReader(f)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			report.Add(c.VerifyFile(storePath(path.Join(root, hdr.Name)), r))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var FleetCommand = &cobra.Command{
+	Use:   "fleet",
+	Short: "Look at the mounts that report metrics",
+}
+
+var FleetStatusCommand = &cobra.Command{
+	Use:   "status",
+	Short: "Print the operations, errors and latencies the mounts reported",
+	Long: `Print a line per mount started with --metrics_interval that reported
+		recently, followed by the totals per operation over all of them.  Mounts
+		that stop reporting drop out after a few of their intervals.`,
+	Run: fleetStatus,
+}
+
+var fleet_all_owners bool
+
+func init() {
+	FleetStatusCommand.Flags().BoolVar(&fleet_all_owners, "all-owners", false, "Include the mounts of every environment of every owner")
+	FleetCommand.AddCommand(FleetStatusCommand)
+	RootCommand.AddCommand(FleetCommand)
+}
+
+func fleetStatus(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	fleet, err := c.FleetMetrics(fleet_all_owners)
+	if err != nil {
+		fail(exitCode(err), "Unable to read the fleet metrics:", err)
+	}
+	if len(fleet) == 0 {
+		fmt.Println("No mounts reported metrics")
+		return
+	}
+	ops := make(map[string]int64)
+	errors := make(map[string]int64)
+	fmt.Printf("%-30s %-20s %8s %10s %8s  %s\n", "ENVIRONMENT", "HOST", "AGE", "OPS", "ERRORS", "SLOWEST P99")
+	for _, m := range fleet {
+		var total, failed int64
+		for op, n := range m.Ops {
+			total += n
+			ops[op] += n
+		}
+		for op, n := range m.Errors {
+			failed += n
+			errors[op] += n
+		}
+		slowest := "-"
+		var worst time.Duration
+		for op, p99 := range m.P99 {
+			if p99 > worst {
+				worst = p99
+				slowest = fmt.Sprintf("%s %s", strings.ToLower(op), p99)
+			}
+		}
+		age := time.Since(m.Reported) / time.Second * time.Second
+		fmt.Printf("%-30s %-20s %8s %10d %8d  %s\n", fmt.Sprintf("%d/%s", m.Owner, m.Environment), m.Host, age, total, failed, slowest)
+	}
+	names := make([]string, 0, len(ops))
+	for op := range ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+	fmt.Printf("\n%-12s %10s %8s\n", "OPERATION", "OPS", "ERRORS")
+	for _, op := range names {
+		fmt.Printf("%-12s %10d %8d\n", strings.ToLower(op), ops[op], errors[op])
+	}
+}
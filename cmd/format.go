@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/cgt212/cassfs/cass"
+	"github.com/spf13/cobra"
+)
+
+var FormatCommand = &cobra.Command{
+	Use:   "format",
+	Short: "Show the data format of the keyspace",
+	Run:   formatShow,
+}
+
+var FormatUpgradeCommand = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Record the data format written by this binary",
+	Long: `Record the data format written by this binary, run it once every client
+		is updated.  Binaries that only support older formats refuse to mount afterwards.`,
+	Run: formatUpgrade,
+}
+
+var FormatDowngradeCommand = &cobra.Command{
+	Use:   "downgrade <version>",
+	Short: "Record an older data format so older binaries can be used again",
+	Long: `Record an older data format, it is refused when the stored data already
+		needs a newer format than the one requested.`,
+	Run: formatDowngrade,
+}
+
+func init() {
+	FormatCommand.AddCommand(FormatUpgradeCommand)
+	FormatCommand.AddCommand(FormatDowngradeCommand)
+	RootCommand.AddCommand(FormatCommand)
+}
+
+//formatStore connects to the cluster without checking the data format
+func formatStore() *cass.Cass {
+	c := newStore()
+	err := c.Init()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	return c
+}
+
+func formatShow(cmd *cobra.Command, args []string) {
+	c := formatStore()
+	f, err := c.LoadFormat()
+	if err != nil {
+		fail(exitCode(err), "Unable to read the data format:", err)
+	}
+	fmt.Println("Stored: ", f)
+	fmt.Printf("Binary:  version %d, reads %d or newer\n", cass.FORMAT_VERSION, cass.FORMAT_MIN_VERSION)
+}
+
+func formatUpgrade(cmd *cobra.Command, args []string) {
+	c := formatStore()
+	f, err := c.UpgradeFormat()
+	if err != nil {
+		fail(exitCode(err), "Unable to upgrade the data format:", err)
+	}
+	fmt.Println("Stored: ", f)
+}
+
+func formatDowngrade(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	version, err := strconv.Atoi(args[0])
+	if err != nil {
+		fail(EXIT_USAGE, "Invalid version:", args[0])
+	}
+	c := formatStore()
+	f, err := c.DowngradeFormat(version)
+	if err != nil {
+		fail(exitCode(err), "Unable to downgrade the data format:", err)
+	}
+	fmt.Println("Stored: ", f)
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var FsckCommand = &cobra.Command{
+	Use:   "fsck",
+	Short: "Check an environment for problems",
+	Long: `Check the entries of an environment for inconsistencies,
+		use --repair to fix the problems that are found.`,
+	Run: fsck,
+}
+
+var (
+	fsck_repair bool
+)
+
+func init() {
+	FsckCommand.Flags().BoolVar(&fsck_repair, "repair", false, "Fix the problems that are found")
+	addTenantFlags(FsckCommand)
+	RootCommand.AddCommand(FsckCommand)
+}
+
+func fsck(cmd *cobra.Command, args []string) {
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	var lock sync.Mutex
+	total := &cass.FsckReport{}
+	failed := forTenants(c, "Unable to check environment", func(t cass.Tenant, store *cass.Cass) error {
+		report, err := store.Fsck(fsck_repair)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if manyTenants() {
+			fmt.Printf("%s: checked %d, empty hashes %d, old symlinks %d, repaired %d, errors %d\n", t, report.Checked, report.EmptyHashes, report.OldSymlinks, report.Repaired, report.Errors)
+		}
+		total.Checked += report.Checked
+		total.EmptyHashes += report.EmptyHashes
+		total.OldSymlinks += report.OldSymlinks
+		total.Repaired += report.Repaired
+		total.Errors += report.Errors
+		return nil
+	})
+	fmt.Printf("Checked:      %d\n", total.Checked)
+	fmt.Printf("Empty hashes: %d\n", total.EmptyHashes)
+	fmt.Printf("Old symlinks: %d\n", total.OldSymlinks)
+	fmt.Printf("Repaired:     %d\n", total.Repaired)
+	fmt.Printf("Errors:       %d\n", total.Errors)
+	if total.Errors > 0 || failed > 0 {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var GCCommand = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove data that is no longer referenced by any file",
+	Long: `Mark the data that has no references and delete the data that was
+		marked by an earlier run more than the grace period ago and is
+		still unreferenced.  Data is shared by every environment so this
+		covers the whole keyspace, for every owner when --blob_scope=owner.`,
+	Run: gc,
+}
+
+var (
+	gc_grace   time.Duration
+	gc_dry_run bool
+)
+
+func init() {
+	GCCommand.Flags().DurationVar(&gc_grace, "grace", 24*time.Hour, "Time data has to stay unreferenced before it is deleted")
+	GCCommand.Flags().BoolVar(&gc_dry_run, "dry-run", false, "Report what would be marked and deleted without changing anything")
+	addBudgetFlags(GCCommand)
+	addProgressFlags(GCCommand)
+	RootCommand.AddCommand(GCCommand)
+}
+
+func gc(cmd *cobra.Command, args []string) {
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	location := checkpointPath("gc", viper.GetString("blob_scope"))
+	opts := &cass.GCOptions{
+		Grace:    gc_grace,
+		DryRun:   gc_dry_run,
+		Progress: cass.NewProgress(0, 0),
+	}
+	if !gc_dry_run {
+		opts.Checkpoint = func(cp *cass.GCCheckpoint) {
+			saveCheckpoint(location, cp)
+		}
+		cp := &cass.GCCheckpoint{}
+		if resume && loadCheckpoint(location, cp) {
+			log.Println("Resuming the run started at", cp.Started)
+			opts.Resume = cp
+		}
+	}
+	finished := reportProgress("gc", opts.Progress)
+	report, err := c.RunGC(opts)
+	finished()
+	if err != nil {
+		if opts.Checkpoint != nil {
+			log.Println("Run it again with --resume to continue")
+		}
+		fail(exitCode(err), "Garbage collection failed:", err)
+	}
+	os.Remove(location)
+	if gc_dry_run {
+		log.Printf("Scanned %d chunks, would mark %d, would delete %d (%d bytes), %d referenced again, %d errors\n", report.Scanned, report.Marked, report.Deleted, report.Bytes, report.Survived, report.Errors)
+	} else {
+		log.Printf("Scanned %d chunks, marked %d, deleted %d, %d referenced again, %d errors\n", report.Scanned, report.Marked, report.Deleted, report.Survived, report.Errors)
+	}
+	if report.Errors > 0 {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
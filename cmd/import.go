@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/gocql/gocql"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var ImportCommand = &cobra.Command{
+	Use:   "import <local file or directory> <path>",
+	Short: "Import a large local file or a directory tree without mounting",
+	Long: `Split the file into chunks that are hashed and uploaded by several
+		workers at once.  Progress is kept in a state file so an interrupted
+		import picks up where it stopped when it is run again.  The stored
+		data is read back and checked against the file before it is linked.
+
+		A directory is imported with its subdirectories, symlinks, permissions
+		and owners, --parallel files are uploaded at once and only the chunks the
+		store does not have are sent.`,
+	Run: importFile,
+}
+
+var (
+	import_parallel int
+	import_state    string
+	import_verify   bool
+)
+
+func init() {
+	ImportCommand.Flags().IntVar(&import_parallel, "parallel", 4, "Number of chunks (files for a directory) uploaded at the same time")
+	ImportCommand.Flags().StringVar(&import_state, "state", "", "File the progress is kept in (default a checkpoint in the statedir)")
+	ImportCommand.Flags().BoolVar(&import_verify, "verify", true, "Read the data back and compare it with the file before linking it")
+	addBudgetFlags(ImportCommand)
+	addProgressFlags(ImportCommand)
+	addVerifyFlags(ImportCommand)
+	RootCommand.AddCommand(ImportCommand)
+}
+
+func importFile(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	info, err := os.Stat(args[0])
+	if err != nil {
+		fail(exitCode(err), "Unable to read", args[0], ":", err)
+	}
+	if info.IsDir() {
+		importTree(filepath.Clean(args[0]), storePath(args[1]))
+		return
+	}
+	if !info.Mode().IsRegular() {
+		fail(EXIT_USAGE, args[0], "is not a regular file or directory")
+	}
+	name := storePath(args[1])
+	state := import_state
+	if state == "" {
+		source, err := filepath.Abs(args[0])
+		if err != nil {
+			source = args[0]
+		}
+		state = checkpointPath("import", source+"\x00"+name)
+	}
+	if !resume {
+		os.Remove(state)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	verification := newVerification(c, "import", name)
+	progress := cass.NewProgress(1, info.Size())
+	finished := reportProgress("import", progress)
+	report, err := c.ImportFile(args[0], name, localAttr(info), state, import_parallel, import_verify, progress)
+	finished()
+	if err != nil {
+		if report != nil && err != cass.ErrSourceChanged {
+			log.Println("Progress was saved, run the import again with --resume to continue")
+		}
+		fail(exitCode(err), "Import failed:", err)
+	}
+	log.Printf("Imported %d chunks (%d resumed), uploaded %d chunks (%d bytes)\n", report.Chunks, report.Resumed, report.Uploaded, report.UploadBytes)
+	if report.Digest != "" {
+		log.Println("Verified sha512", report.Digest)
+	}
+	if verification != nil {
+		verifyLocal(c, verification, args[0], name)
+		saveVerification(verification)
+	}
+}
+
+//treeImport counts what importTree stored
+type treeImport struct {
+	sync.Mutex
+	Dirs     int
+	Files    int
+	Symlinks int
+	Bytes    int64
+	Uploaded int
+	Failed   int
+}
+
+//importTree imports the local directory root at target.  Directories and symlinks are
+//created while the tree is walked, so they exist before the files in them are uploaded by
+//the workers.  Entries that fail are logged and the rest of the tree is still imported.
+func importTree(root string, target string) {
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	report := &treeImport{}
+	verification := newVerification(c, "import", target)
+	progress := cass.NewProgress(treeSize(root))
+	finished := reportProgress("import", progress)
+	type job struct {
+		local string
+		name  string
+		info  os.FileInfo
+	}
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	workers := import_parallel
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				sent, err := publishFile(c, j.local, j.name, j.info)
+				progress.Add(1, j.info.Size())
+				report.Lock()
+				if err != nil {
+					log.Println("Unable to import", j.local, ":", err)
+					report.Failed++
+				} else {
+					report.Files++
+					report.Bytes += j.info.Size()
+					report.Uploaded += sent
+				}
+				report.Unlock()
+				if err == nil && verification != nil {
+					verifyLocal(c, verification, j.local, j.name)
+				}
+			}
+		}()
+	}
+	err = filepath.Walk(root, func(local string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, local)
+		if err != nil {
+			return err
+		}
+		name := storePath(path.Join(target, filepath.ToSlash(rel)))
+		switch {
+		case info.IsDir():
+			if name == "" {
+				return nil
+			}
+			err = importDir(c, name, info)
+			if err != nil {
+				//Nothing below the directory can be stored
+				log.Println("Unable to import", local, ":", err)
+				report.Lock()
+				report.Failed++
+				report.Unlock()
+				return filepath.SkipDir
+			}
+			report.Lock()
+			report.Dirs++
+			report.Unlock()
+		case info.Mode()&os.ModeSymlink != 0:
+			err = importSymlink(c, local, name, info)
+			report.Lock()
+			if err != nil {
+				log.Println("Unable to import", local, ":", err)
+				report.Failed++
+			} else {
+				report.Symlinks++
+			}
+			report.Unlock()
+		case info.Mode().IsRegular():
+			jobs <- job{local: local, name: name, info: info}
+		default:
+			log.Println("Skipping", local, "which is not a regular file, directory or symlink")
+		}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	finished()
+	if err != nil {
+		fail(exitCode(err), "Import failed:", err)
+	}
+	log.Printf("Imported %d directories, %d files (%d bytes) and %d symlinks, uploaded %d bytes\n", report.Dirs, report.Files, report.Bytes, report.Symlinks, report.Uploaded)
+	if verification != nil {
+		saveVerification(verification)
+	}
+	if report.Failed > 0 {
+		fail(EXIT_PARTIAL, report.Failed, "entries could not be imported")
+	}
+}
+
+//importDir creates the directory name with the mode and owner of the local one, an
+//existing directory is kept as it is
+func importDir(c *cass.Cass, name string, info os.FileInfo) error {
+	meta, err := c.GetFiledata(name)
+	if err == nil {
+		if meta.Metadata.Attr == nil || meta.Metadata.Attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return cass.ErrNotDir
+		}
+		return nil
+	}
+	if err != gocql.ErrNotFound {
+		return err
+	}
+	attr := localAttr(info)
+	attr.Mode = fuse.S_IFDIR | uint32(info.Mode().Perm())
+	return c.MakeDirectory(name, attr)
+}
+
+//importSymlink stores the local symlink at name, only a symlink can be replaced by it
+func importSymlink(c *cass.Cass, local string, name string, info os.FileInfo) error {
+	target, err := os.Readlink(local)
+	if err != nil {
+		return err
+	}
+	meta, err := c.GetFiledata(name)
+	if err == nil && (meta.Metadata.Attr == nil || meta.Metadata.Attr.Mode&syscall.S_IFMT != syscall.S_IFLNK) {
+		return cass.ErrExists
+	}
+	if err != nil && err != gocql.ErrNotFound {
+		return err
+	}
+	attr := localAttr(info)
+	attr.Mode = fuse.S_IFLNK | 0777
+	return c.CreateSymlink(name, attr, target)
+}
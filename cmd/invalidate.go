@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var InvalidateCommand = &cobra.Command{
+	Use:   "invalidate <path>...",
+	Short: "Drop the cached state of paths on a running mount",
+	Long: `Ask a mount to forget what it has cached about the given paths,
+		both in cassfs and in the kernel.  This is how changes are made
+		visible on mounts using the read-mostly profile.`,
+	Run: invalidate,
+}
+
+var invalidate_control string
+
+func init() {
+	InvalidateCommand.Flags().StringVar(&invalidate_control, "control", "", "Control socket of the mount")
+	RootCommand.AddCommand(InvalidateCommand)
+}
+
+//controlClient returns a client that sends its requests to the control socket of a mount
+func controlClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+}
+
+func invalidate(cmd *cobra.Command, args []string) {
+	if len(args) == 0 || invalidate_control == "" {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	query := url.Values{}
+	for _, p := range args {
+		query.Add("path", storePath(p))
+	}
+	resp, err := controlClient(invalidate_control).Post("http://cassfs/invalidate?"+query.Encode(), "text/plain", nil)
+	if err != nil {
+		fail(EXIT_CONNECTION, "Unable to reach the mount:", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		fail(EXIT_FAILURE, "Invalidation failed:", string(msg))
+	}
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var LayerCommand = &cobra.Command{
+	Use:   "layer <path> <.tar or .tar.gz file, - or image layout directory>",
+	Short: "Export an environment or a snapshot as an OCI image layer",
+	Long: `Write the tree below path as an OCI image layer that container tooling can
+		stack and push to a registry.  --as-of exports the environment as it was at
+		that time.  With --base only what changed since the base is written, with
+		whiteouts for the entries that are gone; the base is an environment, or a
+		snapshot written as environment@<RFC3339 time> or environment@manifest as
+		for diff.  --layout writes an OCI image layout directory holding a single
+		layer image tagged --tag, which e.g. skopeo copies to a registry.`,
+	Run: layer,
+}
+
+var (
+	layer_as_of  string
+	layer_base   string
+	layer_layout bool
+	layer_tag    string
+	layer_gzip   bool
+)
+
+func init() {
+	LayerCommand.Flags().StringVar(&layer_as_of, "as-of", "", "Export the environment as it was at this time (RFC3339), needs the history policy")
+	LayerCommand.Flags().StringVar(&layer_base, "base", "", "Only write what changed since this environment or snapshot")
+	LayerCommand.Flags().BoolVar(&layer_layout, "layout", false, "Write an OCI image layout directory instead of the layer alone")
+	LayerCommand.Flags().StringVar(&layer_tag, "tag", "latest", "Tag of the image in the layout")
+	LayerCommand.Flags().BoolVar(&layer_gzip, "gzip", false, "Compress the layer, always done for a layout and a .gz file")
+	addProgressFlags(LayerCommand)
+	RootCommand.AddCommand(LayerCommand)
+}
+
+func layer(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	root := storePath(args[0])
+	dest := args[1]
+	if layer_as_of != "" {
+		c.AsOf, err = time.Parse(time.RFC3339, layer_as_of)
+		if err != nil {
+			fail(EXIT_USAGE, "Invalid --as-of time:", err)
+		}
+		start, err := c.HistoryStart()
+		if err != nil {
+			fail(exitCode(err), "Unable to export", c.Environment, "as of", layer_as_of, ":", err)
+		}
+		if c.AsOf.Before(start) || c.AsOf.After(time.Now()) {
+			fail(EXIT_NOT_FOUND, "Unable to export", c.Environment, "as of", layer_as_of, ": history starts at", start.Format(time.RFC3339))
+		}
+	}
+	var base map[string]*cass.ManifestEntry
+	if layer_base != "" {
+		side, err := openSide(c, layer_base, root)
+		if err != nil {
+			fail(exitCode(err), "Unable to open", layer_base, ":", err)
+		}
+		base = side.entries
+		if side.current() {
+			base, err = side.store.Snapshot(root)
+			if err != nil {
+				fail(exitCode(err), "Unable to read", layer_base, ":", err)
+			}
+		}
+	}
+
+	var out *os.File
+	switch {
+	case layer_layout:
+		layer_gzip = true
+		err = os.MkdirAll(filepath.Join(dest, "blobs", "sha256"), 0755)
+		if err == nil {
+			out, err = os.Create(filepath.Join(dest, "blobs", "sha256", "layer.tmp"))
+		}
+	case dest == "-":
+		out = os.Stdout
+	default:
+		layer_gzip = layer_gzip || strings.HasSuffix(dest, ".gz")
+		out, err = os.Create(dest)
+	}
+	if err != nil {
+		fail(exitCode(err), "Unable to create", dest, ":", err)
+	}
+	w := cass.NewLayerWriter(out, layer_gzip)
+	progress := cass.NewProgress(0, 0)
+	finished := reportProgress("layer", progress)
+	report, err := c.ExportLayer(root, base, w, progress)
+	finished()
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		fail(exitCode(err), "Export failed:", err)
+	}
+	l := w.Layer()
+	if layer_layout {
+		err = os.Rename(out.Name(), cass.OCIBlobPath(dest, l.Digest))
+		if err == nil {
+			err = cass.WriteOCILayout(dest, l, layer_tag)
+		}
+		if err != nil {
+			fail(exitCode(err), "Unable to write the image layout:", err)
+		}
+	}
+	log.Printf("Exported %d directories, %d files (%d bytes) and %d symlinks\n", report.Dirs, report.Files, report.Bytes, report.Symlinks)
+	if base != nil {
+		log.Printf("Left out %d unchanged entries, wrote %d whiteouts\n", report.Unchanged, report.Whiteouts)
+	}
+	log.Printf("Layer %s, diff id %s, %d bytes\n", l.Digest, l.DiffId, l.Size)
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var LifecycleCommand = &cobra.Command{
+	Use:   "lifecycle",
+	Short: "Show or change the lifecycle rules of an environment",
+	Long: `Lifecycle rules expire files below a path once they have not been
+		changed for a given age, for example --add tmp=7d.  The rules are
+		enforced by the reaper.`,
+	Run: lifecycle,
+}
+
+var (
+	lifecycle_add    []string
+	lifecycle_remove []string
+	lifecycle_clear  bool
+)
+
+func init() {
+	LifecycleCommand.Flags().StringSliceVar(&lifecycle_add, "add", nil, "Rule to add in the form path=age (e.g. tmp=7d or cache=12h)")
+	LifecycleCommand.Flags().StringSliceVar(&lifecycle_remove, "remove", nil, "Path of a rule to remove")
+	LifecycleCommand.Flags().BoolVar(&lifecycle_clear, "clear", false, "Remove all of the rules")
+	RootCommand.AddCommand(LifecycleCommand)
+}
+
+//parseAge parses a duration that can also be given in days (e.g. 7d)
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func lifecycle(cmd *cobra.Command, args []string) {
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	config := c.Config
+	changed := false
+	if lifecycle_clear {
+		config.Lifecycle = nil
+		changed = true
+	}
+	for _, path := range lifecycle_remove {
+		var rules []cass.LifecycleRule
+		for _, rule := range config.Lifecycle {
+			if rule.Prefix != storePath(path) {
+				rules = append(rules, rule)
+			}
+		}
+		config.Lifecycle = rules
+		changed = true
+	}
+	for _, rule := range lifecycle_add {
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) != 2 {
+			fail(EXIT_USAGE, "Rules must be in the form path=age:", rule)
+		}
+		age, err := parseAge(kv[1])
+		if err != nil {
+			fail(EXIT_USAGE, "Invalid age:", err)
+		}
+		config.Lifecycle = append(config.Lifecycle, cass.LifecycleRule{
+			Prefix: storePath(kv[0]),
+			MaxAge: int64(age / time.Second),
+		})
+		changed = true
+	}
+	if changed {
+		err = c.SaveEnvConfig(config)
+		if err != nil {
+			fail(exitCode(err), "Unable to save the environment configuration:", err)
+		}
+	}
+	for _, rule := range config.Lifecycle {
+		fmt.Printf("/%s expires after %s\n", rule.Prefix, time.Duration(rule.MaxAge)*time.Second)
+	}
+}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var LsCommand = &cobra.Command{
+	Use:   "ls [path]...",
+	Short: "List a directory of an environment without mounting it",
+	Long: `List the entries of directories, or the files given, directly from
+		the store.  With --long the mode, links, owner, size and modification
+		time of every entry are shown like ls -l.`,
+	Run: ls,
+}
+
+var (
+	ls_long  bool
+	ls_after string
+	ls_limit int
+)
+
+func init() {
+	LsCommand.Flags().BoolVarP(&ls_long, "long", "l", false, "Show the mode, links, owner, size and modification time")
+	LsCommand.Flags().StringVar(&ls_after, "after", "", "Only list the entries whose names sort after this one")
+	LsCommand.Flags().IntVar(&ls_limit, "limit", 0, "List at most this many entries, the last name is the --after of the next page")
+	RootCommand.AddCommand(LsCommand)
+}
+
+//fileMode converts the mode of an entry into the form os.FileMode prints like ls
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		m |= os.ModeDir
+	case syscall.S_IFLNK:
+		m |= os.ModeSymlink
+	case syscall.S_IFCHR:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		m |= os.ModeDevice
+	case syscall.S_IFIFO:
+		m |= os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		m |= os.ModeSocket
+	}
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func printEntry(name string, meta *cass.CassFsMetadata) {
+	if !ls_long {
+		fmt.Println(name)
+		return
+	}
+	attr := meta.Metadata.Attr
+	mtime := time.Unix(int64(attr.Mtime), int64(attr.Mtimensec))
+	line := fmt.Sprintf("%s %3d %5d %5d %10d %s %s", fileMode(attr.Mode), attr.Nlink, attr.Uid, attr.Gid, attr.Size, mtime.Format("2006-01-02 15:04"), name)
+	if attr.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		line += " -> " + meta.Metadata.SymlinkTarget(meta.Hash)
+	}
+	fmt.Println(line)
+}
+
+func ls(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	code := EXIT_OK
+	for i, arg := range args {
+		name, meta, err := c.Resolve(storePath(arg))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to list", arg, ":", err)
+			code = exitCode(err)
+			continue
+		}
+		if name != "" {
+			if meta.Metadata.Attr == nil {
+				fmt.Fprintln(os.Stderr, "Unable to list", arg, ": no attributes")
+				code = EXIT_FAILURE
+				continue
+			}
+			if meta.Metadata.Attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+				printEntry(arg, meta)
+				continue
+			}
+		}
+		var entries []fuse.DirEntry
+		if ls_after != "" || ls_limit > 0 {
+			limit := ls_limit
+			if limit <= 0 {
+				limit = math.MaxInt32
+			}
+			entries, err = c.ReadDirAfter(name, ls_after, limit)
+		} else {
+			entries, err = c.OpenDir(name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to list", arg, ":", err)
+			code = exitCode(err)
+			continue
+		}
+		if len(args) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s:\n", arg)
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		sort.Strings(names)
+		for _, entry := range names {
+			if !ls_long {
+				fmt.Println(entry)
+				continue
+			}
+			meta, err := c.GetFiledata(path.Join(name, entry))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Unable to read", entry, ":", err)
+				code = exitCode(err)
+				continue
+			}
+			if meta.Metadata.Attr == nil {
+				fmt.Fprintln(os.Stderr, "Unable to read", entry, ": no attributes")
+				code = EXIT_FAILURE
+				continue
+			}
+			printEntry(entry, meta)
+		}
+	}
+	if code != EXIT_OK {
+		os.Exit(code)
+	}
+}
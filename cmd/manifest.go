@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var ManifestCommand = &cobra.Command{
+	Use:   "manifest",
+	Short: "Sign and verify manifests of an environment",
+	Long: `A manifest records every entry of an environment, signed by a key
+		that is kept off the cluster.  A mount started with --verify-manifest
+		only serves what the manifest records.`,
+}
+
+var ManifestKeygenCommand = &cobra.Command{
+	Use:   "keygen <private key file> <public key file>",
+	Short: "Create a key pair to sign manifests with",
+	Run:   manifestKeygen,
+}
+
+var ManifestSignCommand = &cobra.Command{
+	Use:   "sign <private key file>",
+	Short: "Record and sign the current state of the environment",
+	Run:   manifestSign,
+}
+
+var ManifestVerifyCommand = &cobra.Command{
+	Use:   "verify <public key file>",
+	Short: "Check the environment against its signed manifest",
+	Run:   manifestVerify,
+}
+
+var manifest_id string
+
+func init() {
+	ManifestVerifyCommand.Flags().StringVar(&manifest_id, "id", "", "Manifest to verify against, the latest one if not set")
+	MountCommand.Flags().String("verify-manifest", "", "Public key file, only serve content that matches the signed manifest of the environment (read only)")
+	MountCommand.Flags().StringVar(&manifest_id, "manifest", "", "Manifest to serve with --verify-manifest, the latest one if not set")
+	ManifestCommand.AddCommand(ManifestKeygenCommand)
+	ManifestCommand.AddCommand(ManifestSignCommand)
+	ManifestCommand.AddCommand(ManifestVerifyCommand)
+	RootCommand.AddCommand(ManifestCommand)
+}
+
+func manifestKeygen(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	public, private, err := cass.GenerateSigningKey()
+	if err != nil {
+		fail(EXIT_FAILURE, "Unable to generate key:", err)
+	}
+	err = ioutil.WriteFile(args[0], []byte(base64.StdEncoding.EncodeToString(private)+"\n"), 0600)
+	if err != nil {
+		fail(exitCode(err), "Unable to write private key:", err)
+	}
+	err = ioutil.WriteFile(args[1], []byte(base64.StdEncoding.EncodeToString(public)+"\n"), 0644)
+	if err != nil {
+		fail(exitCode(err), "Unable to write public key:", err)
+	}
+}
+
+func manifestSign(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	key, err := cass.LoadSigningKey(args[0])
+	if err != nil {
+		fail(exitCode(err), err)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	m, err := c.BuildManifest()
+	if err != nil {
+		fail(exitCode(err), "Unable to record the environment:", err)
+	}
+	m.Sign(key)
+	err = c.SaveManifest(m)
+	if err != nil {
+		fail(exitCode(err), "Unable to save manifest:", err)
+	}
+	log.Printf("Signed %d entries with root %x\n", len(m.Entries), m.Root)
+	fmt.Println(m.Id)
+}
+
+func manifestVerify(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	m := loadVerifiedManifest(c, args[0], manifest_id)
+	report, err := c.CheckManifest(m)
+	if err != nil {
+		fail(exitCode(err), "Unable to check the environment:", err)
+	}
+	for _, p := range report.Changed {
+		fmt.Println("changed", p)
+	}
+	for _, p := range report.Added {
+		fmt.Println("added", p)
+	}
+	for _, p := range report.Missing {
+		fmt.Println("missing", p)
+	}
+	log.Printf("Checked %d entries against manifest %s: %d changed, %d added, %d missing\n", report.Checked, m.Id, len(report.Changed), len(report.Added), len(report.Missing))
+	if len(report.Changed)+len(report.Added)+len(report.Missing) > 0 {
+		os.Exit(EXIT_CONFLICT)
+	}
+}
+
+//loadVerifiedManifest reads a manifest of the environment and checks its signature
+func loadVerifiedManifest(c *cass.Cass, keyFile string, id string) *cass.EnvManifest {
+	key, err := cass.LoadVerifyKey(keyFile)
+	if err != nil {
+		fail(exitCode(err), err)
+	}
+	m, err := c.LoadManifest(id)
+	if err != nil {
+		fail(exitCode(err), "Unable to load manifest:", err)
+	}
+	err = m.Verify(key)
+	if err != nil {
+		fail(exitCode(err), "Manifest", m.Id, ":", err)
+	}
+	return m
+}
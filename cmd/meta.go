@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var MetaCommand = &cobra.Command{
+	Use:   "meta",
+	Short: "Dump or load the metadata of an environment",
+	Long: `Export the namespace of an environment (entries, hashes and metadata)
+		and load it into another owner, environment or cluster.  The file data
+		is not included and has to be present in the target cluster.`,
+}
+
+var MetaDumpCommand = &cobra.Command{
+	Use:   "dump",
+	Short: "Write the metadata of an environment to a file or stdout",
+	Run:   metaDump,
+}
+
+var MetaLoadCommand = &cobra.Command{
+	Use:   "load",
+	Short: "Load metadata written by dump into an environment",
+	Run:   metaLoad,
+}
+
+var (
+	meta_file  string
+	meta_force bool
+)
+
+func init() {
+	MetaCommand.PersistentFlags().StringVar(&meta_file, "file", "-", "File to write to or read from, - for stdout/stdin")
+	MetaLoadCommand.Flags().BoolVar(&meta_force, "force", false, "Load into an environment that already has entries")
+	MetaCommand.AddCommand(MetaDumpCommand)
+	MetaCommand.AddCommand(MetaLoadCommand)
+	RootCommand.AddCommand(MetaCommand)
+}
+
+func metaDump(cmd *cobra.Command, args []string) {
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	var out io.Writer = os.Stdout
+	if meta_file != "-" {
+		f, err := os.Create(meta_file)
+		if err != nil {
+			fail(exitCode(err), "Unable to create file:", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	count, err := c.DumpMeta(out)
+	if err != nil {
+		fail(exitCode(err), "Error dumping metadata:", err)
+	}
+	log.Println("Dumped", count, "entries")
+}
+
+func metaLoad(cmd *cobra.Command, args []string) {
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	if !meta_force {
+		children, err := c.HasChildren("")
+		if err != nil {
+			fail(exitCode(err), "Unable to check the target environment:", err)
+		}
+		if children {
+			fail(EXIT_CONFLICT, "The target environment is not empty, use --force to load anyway")
+		}
+	}
+	var in io.Reader = os.Stdin
+	if meta_file != "-" {
+		f, err := os.Open(meta_file)
+		if err != nil {
+			fail(exitCode(err), "Unable to open file:", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	count, err := c.LoadMeta(in)
+	if err != nil {
+		fail(exitCode(err), "Error loading metadata after", count, "entries:", err)
+	}
+	log.Println("Loaded", count, "entries")
+}
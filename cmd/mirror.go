@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var MirrorCommand = &cobra.Command{
+	Use:   "mirror",
+	Short: "Manage local read only mirrors of an environment",
+	Long: `A mirror is a complete local copy of an environment that can be
+		mounted with "cassfs mount --mirror" without a connection to the cluster.`,
+}
+
+var MirrorBuildCommand = &cobra.Command{
+	Use:   "build <environment> <dir>",
+	Short: "Build a local read only mirror of an environment",
+	Run:   mirrorBuild,
+}
+
+var MirrorRefreshCommand = &cobra.Command{
+	Use:   "refresh <environment> <dir>",
+	Short: "Update a mirror, only fetching the data that changed",
+	Run:   mirrorRefresh,
+}
+
+var mirror_refresh time.Duration
+
+func init() {
+	MountCommand.Flags().DurationVar(&mirror_refresh, "mirror_refresh", 0, "How often a mounted mirror is refreshed from the cluster when it can be reached, 0 disables it")
+	addBudgetFlags(MirrorBuildCommand)
+	addBudgetFlags(MirrorRefreshCommand)
+	MirrorCommand.AddCommand(MirrorBuildCommand)
+	MirrorCommand.AddCommand(MirrorRefreshCommand)
+	RootCommand.AddCommand(MirrorCommand)
+}
+
+func mirrorBuild(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	viper.Set("environment", args[0])
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	report, err := c.BuildMirror(args[1])
+	if err != nil {
+		fail(exitCode(err), "Unable to build mirror:", err)
+	}
+	log.Printf("Mirrored %d entries, fetched %d chunks (%d bytes)\n", report.Entries, report.Fetched, report.FetchBytes)
+}
+
+func mirrorRefresh(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	viper.Set("environment", args[0])
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	report, err := c.RefreshMirror(args[1])
+	if err != nil {
+		fail(exitCode(err), "Unable to refresh mirror:", err)
+	}
+	log.Printf("Mirrored %d entries, %d changed, fetched %d chunks (%d bytes), pruned %d chunks\n", report.Entries, report.Changed, report.Fetched, report.FetchBytes, report.Pruned)
+}
+
+//refreshMounted keeps a mounted mirror up to date while the cluster can be reached
+func refreshMounted(fs *cass.MirrorFs, dir string, owner int64, env string) {
+	var c *cass.Cass
+	for {
+		time.Sleep(mirror_refresh)
+		if c == nil {
+			c = newStore()
+			c.OwnerId = owner
+			c.Environment = env
+			if err := c.Init(); err != nil {
+				log.Println("Cluster not reachable, serving the existing mirror:", err)
+				c = nil
+				continue
+			}
+		}
+		report, err := c.RefreshMirror(dir)
+		if err != nil {
+			log.Println("Unable to refresh mirror:", err)
+			continue
+		}
+		mirror, err := cass.OpenMirror(dir)
+		if err != nil {
+			log.Println("Unable to open refreshed mirror:", err)
+			continue
+		}
+		fs.Reload(mirror)
+		log.Printf("Refreshed mirror, %d changed, fetched %d chunks\n", report.Changed, report.Fetched)
+	}
+}
+
+//mountMirror serves the mirror in dir at mount until it is unmounted
+func mountMirror(mount string, dir string, attr_ttl float64) {
+	mirror, err := cass.OpenMirror(dir)
+	if err != nil {
+		fail(exitCode(err), "Unable to open mirror:", err)
+	}
+	dinfo, err := os.Stat(mount)
+	if err != nil {
+		fail(exitCode(err), "Error opening:", err)
+	}
+	opts := &cass.CassFsOptions{
+		Owner: fuse.Owner{
+			Uid: dinfo.Sys().(*syscall.Stat_t).Uid,
+			Gid: dinfo.Sys().(*syscall.Stat_t).Gid,
+		},
+		Mode:     uint32(dinfo.Mode()),
+		ReadOnly: true,
+	}
+	fs := cass.NewMirrorFs(mirror, opts)
+	if mirror_refresh > 0 {
+		go refreshMounted(fs, dir, mirror.Manifest.Owner, mirror.Manifest.Environment)
+	}
+	nodeFs := pathfs.NewPathNodeFs(fs, &pathfs.PathNodeFsOptions{ClientInodes: true})
+	mOpts := nodefs.Options{
+		EntryTimeout:    time.Duration(entry_ttl * float64(time.Second)),
+		AttrTimeout:     time.Duration(attr_ttl * float64(time.Second)),
+		NegativeTimeout: time.Duration(negative_ttl * float64(time.Second)),
+		PortableInodes:  false,
+	}
+	fuseOpts, err := fuseOptions(viper.GetStringSlice("options"), "cassfs-mirror:"+dir)
+	if err != nil {
+		fail(EXIT_USAGE, err)
+	}
+	conn := nodefs.NewFileSystemConnector(nodeFs.Root(), &mOpts)
+	mountState, err := fuse.NewServer(conn.RawFS(), mount, fuseOpts)
+	if err != nil {
+		log.Fatal("Mount fail:", err)
+	}
+	log.Printf("Serving mirror of %d/%s built %s\n", mirror.Manifest.Owner, mirror.Manifest.Environment, mirror.Manifest.Built)
+	serve(mountState, mount)
+}
@@ -21,14 +21,15 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/gocql/gocql"
-
 	"github.com/spf13/cobra"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
@@ -45,6 +46,9 @@ var MountCommand = &cobra.Command{
 	Run:   mount,
 }
 
+//Cache timeout in seconds used by the read-mostly profile
+const READ_MOSTLY_TTL = 24 * 60 * 60
+
 var (
 	entry_ttl    float64
 	negative_ttl float64
@@ -57,12 +61,92 @@ func init() {
 	MountCommand.Flags().Float64VarP(&negative_ttl, "negative_ttl", "n", 1.0, "fuse negative cache TTL.")
 	MountCommand.Flags().Int64VarP(&fcache_ttl, "fcache_ttl", "f", 1, "File cache TTL.")
 	MountCommand.Flags().StringVarP(&consistency, "consistency", "c", "ONE", "Consistency level to use (ANY,ONE,TWO,THREE,QUORUM,ALL,...)")
+	MountCommand.Flags().Bool("adaptive_ttl", false, "Cache the metadata of directories that rarely change longer than that of busy ones")
+	MountCommand.Flags().Int64("fcache_ttl_min", 1, "Shortest file cache TTL with --adaptive_ttl")
+	MountCommand.Flags().Int64("fcache_ttl_max", 600, "Longest file cache TTL with --adaptive_ttl")
 	MountCommand.Flags().Bool("ro", false, "Mount file system as read only")
+	MountCommand.Flags().String("journal", "", "Directory to checkpoint dirty open files in so they survive a crash")
+	MountCommand.Flags().String("profile", "default", "Mount profile (default,read-mostly or one of the profiles of the config file)")
+	MountCommand.Flags().String("control", "", "Unix socket to accept control requests (e.g. invalidations) on")
+	MountCommand.Flags().Bool("transactional", false, "Apply a write followed by a rename of the file as a single transaction")
+	MountCommand.Flags().Duration("save_window", cass.DefaultSaveWindow, "How long a transactional save waits for a rename")
+	MountCommand.Flags().String("mirror", "", "Serve a local mirror built with \"cassfs mirror build\" read only instead of the cluster")
+	MountCommand.Flags().Duration("watch_interval", time.Second, "How often to poll the invalidation feed for changes made by other clients, 0 disables it")
+	MountCommand.Flags().String("scan", "", "Scanner new content is checked by before it is saved (clamd:///path/to/socket, clamd://host:port or icap://host:port/service)")
+	MountCommand.Flags().StringSlice("scan_paths", nil, "Only scan content saved below these directories")
+	MountCommand.Flags().Bool("no-permission-check", false, "Do not check the owner and mode of files against the caller, everyone may access everything")
+	MountCommand.Flags().Bool("daemon", false, "Mount in the background, the command returns once the file system is mounted")
+	MountCommand.Flags().String("pidfile", "", "File the pid of the mount is written to")
+	MountCommand.Flags().StringSlice("virtual_dirs", nil, "Empty directories that are always present and never looked up in the store (e.g. tmp,.cassfs)")
+	MountCommand.Flags().StringSlice("lower", nil, "Read only environments the mounted one is layered over, the first is looked at first")
+	MountCommand.Flags().String("subpath", "", "Directory of the environment to mount as the root")
+	MountCommand.Flags().String("as-of", "", "Mount the environment read only as it was at this time (RFC3339), needs the history policy")
+	MountCommand.Flags().StringSlice("slo", nil, "Latency targets of FUSE operations, e.g. getattr:p99<20ms")
+	MountCommand.Flags().Duration("slo_interval", 30*time.Second, "Period the SLO percentiles are computed over")
+	MountCommand.Flags().Int("slo_degrade", 0, "Switch to read only after the write SLOs failed this many intervals in a row, 0 never does")
+	MountCommand.Flags().Duration("hedge_delay", 0, "Send a read again when it has not returned after this long, 0 never does")
+	MountCommand.Flags().Duration("flush_interval", 0, "Hold back the save of closed files and write them this often, 0 saves them when they are closed")
+	MountCommand.Flags().String("max_dirty", "64M", "Write the held back files early once their changes are larger than this, with an optional K, M or G suffix")
+	MountCommand.Flags().Int("readahead", cass.DefaultReadahead, "Number of chunks read ahead of a file that is read sequentially, 0 does not read ahead")
+	MountCommand.Flags().String("cache_size", "", "Size of the chunk cache in memory, with an optional K, M or G suffix (no cache if not set)")
+	MountCommand.Flags().String("peer_listen", "", "Address the chunk cache is shared with the peers on, e.g. :8090 (default host the first private address), needs the peer_tls flags or peer_secret in the config file")
+	MountCommand.Flags().String("peer_url", "", "URL the peers reach this mount at (default http(s)://<peer_listen address>)")
+	MountCommand.Flags().StringSlice("peers", nil, "URLs of the mounts the chunk cache is shared with")
+	MountCommand.Flags().String("peer_dns", "", "host:port, every address the host resolves to is a peer")
+	MountCommand.Flags().Duration("peer_refresh", cass.DefaultPeerRefresh, "How often --peer_dns is looked up again")
+	MountCommand.Flags().String("peer_tls_cert", "", "Certificate the peers are served and asked with over TLS")
+	MountCommand.Flags().String("peer_tls_key", "", "Key of the peer certificate")
+	MountCommand.Flags().String("peer_tls_ca", "", "CA the certificates of the peers are signed with")
+	MountCommand.Flags().Int("metadata-cache-size", cass.DEFAULT_METADATA_CACHE, "Number of paths whose metadata is cached, the least recently used are dropped first, 0 is unlimited")
+	MountCommand.Flags().String("read_dc", "", "Data center whose nodes are preferred")
+	MountCommand.Flags().Duration("metrics_interval", 0, "Push operation counts and latencies to the cluster this often for \"cassfs fleet status\", 0 does not")
+	MountCommand.Flags().StringSlice("options", nil, "FUSE mount options (allow_other,allow_root,default_permissions,max_read=N,fsname=NAME,subtype=TYPE)")
 	viper.BindPFlag("entry_ttl", MountCommand.Flags().Lookup("entry_ttl"))
 	viper.BindPFlag("negative_ttl", MountCommand.Flags().Lookup("negative_ttl"))
 	viper.BindPFlag("fcache_ttl", MountCommand.Flags().Lookup("fcache_ttl"))
+	viper.BindPFlag("adaptive_ttl", MountCommand.Flags().Lookup("adaptive_ttl"))
+	viper.BindPFlag("fcache_ttl_min", MountCommand.Flags().Lookup("fcache_ttl_min"))
+	viper.BindPFlag("fcache_ttl_max", MountCommand.Flags().Lookup("fcache_ttl_max"))
 	viper.BindPFlag("consistency", MountCommand.Flags().Lookup("consistency"))
 	viper.BindPFlag("ro", MountCommand.Flags().Lookup("ro"))
+	viper.BindPFlag("journal", MountCommand.Flags().Lookup("journal"))
+	viper.BindPFlag("profile", MountCommand.Flags().Lookup("profile"))
+	viper.BindPFlag("control", MountCommand.Flags().Lookup("control"))
+	viper.BindPFlag("watch_interval", MountCommand.Flags().Lookup("watch_interval"))
+	viper.BindPFlag("mirror", MountCommand.Flags().Lookup("mirror"))
+	viper.BindPFlag("transactional", MountCommand.Flags().Lookup("transactional"))
+	viper.BindPFlag("save_window", MountCommand.Flags().Lookup("save_window"))
+	viper.BindPFlag("no_permission_check", MountCommand.Flags().Lookup("no-permission-check"))
+	viper.BindPFlag("scan", MountCommand.Flags().Lookup("scan"))
+	viper.BindPFlag("scan_paths", MountCommand.Flags().Lookup("scan_paths"))
+	viper.BindPFlag("verify_manifest", MountCommand.Flags().Lookup("verify-manifest"))
+	viper.BindPFlag("options", MountCommand.Flags().Lookup("options"))
+	viper.BindPFlag("virtual_dirs", MountCommand.Flags().Lookup("virtual_dirs"))
+	viper.BindPFlag("lower", MountCommand.Flags().Lookup("lower"))
+	viper.BindPFlag("subpath", MountCommand.Flags().Lookup("subpath"))
+	viper.BindPFlag("as_of", MountCommand.Flags().Lookup("as-of"))
+	viper.BindPFlag("slo", MountCommand.Flags().Lookup("slo"))
+	viper.BindPFlag("slo_interval", MountCommand.Flags().Lookup("slo_interval"))
+	viper.BindPFlag("slo_degrade", MountCommand.Flags().Lookup("slo_degrade"))
+	viper.BindPFlag("hedge_delay", MountCommand.Flags().Lookup("hedge_delay"))
+	viper.BindPFlag("read_dc", MountCommand.Flags().Lookup("read_dc"))
+	viper.BindPFlag("flush_interval", MountCommand.Flags().Lookup("flush_interval"))
+	viper.BindPFlag("max_dirty", MountCommand.Flags().Lookup("max_dirty"))
+	viper.BindPFlag("readahead", MountCommand.Flags().Lookup("readahead"))
+	viper.BindPFlag("cache_size", MountCommand.Flags().Lookup("cache_size"))
+	viper.BindPFlag("peer_listen", MountCommand.Flags().Lookup("peer_listen"))
+	viper.BindPFlag("peer_url", MountCommand.Flags().Lookup("peer_url"))
+	viper.BindPFlag("peers", MountCommand.Flags().Lookup("peers"))
+	viper.BindPFlag("peer_dns", MountCommand.Flags().Lookup("peer_dns"))
+	viper.BindPFlag("peer_refresh", MountCommand.Flags().Lookup("peer_refresh"))
+	viper.BindPFlag("peer_tls_cert", MountCommand.Flags().Lookup("peer_tls_cert"))
+	viper.BindPFlag("peer_tls_key", MountCommand.Flags().Lookup("peer_tls_key"))
+	viper.BindPFlag("peer_tls_ca", MountCommand.Flags().Lookup("peer_tls_ca"))
+	viper.BindPFlag("metadata_cache_size", MountCommand.Flags().Lookup("metadata-cache-size"))
+	viper.BindPFlag("metrics_interval", MountCommand.Flags().Lookup("metrics_interval"))
+	viper.BindPFlag("daemon", MountCommand.Flags().Lookup("daemon"))
+	viper.BindPFlag("pidfile", MountCommand.Flags().Lookup("pidfile"))
+	addBudgetFlags(MountCommand)
 
 	RootCommand.AddCommand(MountCommand)
 }
@@ -74,53 +158,330 @@ func mount(cmd *cobra.Command, args []string) {
 		panic("Mount point required")
 	}
 	mount := args[0]
+	if viper.GetBool("daemon") {
+		daemonize()
+	}
+
+	//A profile of the config file sets the defaults of the options it lists
+	profile := viper.GetString("profile")
+	if options := configProfile(profile); options != nil {
+		err := applyProfile(cmd, options)
+		if err != nil {
+			fail(EXIT_USAGE, err)
+		}
+		profile = "default"
+	}
+
+	//The read-mostly profile keeps everything cached and relies on explicit invalidation
+	attr_ttl := entry_ttl
+	switch profile {
+	case "default":
+	case "read-mostly":
+		entry_ttl = READ_MOSTLY_TTL
+		attr_ttl = READ_MOSTLY_TTL
+		negative_ttl = READ_MOSTLY_TTL
+		fcache_ttl = int64(READ_MOSTLY_TTL)
+		if viper.GetString("control") == "" && viper.GetDuration("watch_interval") == 0 {
+			log.Println("Warning: read-mostly mount without a control socket or the invalidation feed, changes will not be seen until the caches expire")
+		}
+	default:
+		fail(EXIT_USAGE, "Unknown mount profile:", viper.GetString("profile"))
+	}
+
+	if dir := viper.GetString("mirror"); dir != "" {
+		if viper.GetString("subpath") != "" {
+			fail(EXIT_USAGE, "A mirror can not be mounted with --subpath")
+		}
+		if viper.GetString("as_of") != "" {
+			fail(EXIT_USAGE, "A mirror can not be mounted with --as-of")
+		}
+		mountMirror(mount, dir, attr_ttl)
+		return
+	}
+	server, _ := newMount(mount, attr_ttl)
+	serve(server, mount)
+}
 
+//newMount connects to the cluster and creates the FUSE server that mounts the environment
+//at mount with the mount options
+func newMount(mount string, attr_ttl float64) (*fuse.Server, *cass.CassFs) {
 	//Set cstore options relating to the Database
-	c := cass.NewDefaultCass()
-	c.Host = strings.Split(viper.GetString("server"), ",")
-	c.Keyspace = viper.GetString("keyspace")
-	c.OwnerId = viper.GetInt64("owner")
-	c.Consistency = gocql.ParseConsistency(viper.GetString("consistency"))
-	c.Environment = viper.GetString("environment")
+	c := newStore()
 	c.FcacheDuration = fcache_ttl
-	err := c.Init()
+	c.HedgeDelay = viper.GetDuration("hedge_delay")
+	c.LocalDC = viper.GetString("read_dc")
+	c.MetaCacheSize = viper.GetInt("metadata_cache_size")
+	bandwidth, err := parseSize(max_bandwidth)
+	if err != nil {
+		fail(EXIT_USAGE, err)
+	}
+	c.Limiter = cass.NewRateLimiter(bandwidth, max_ops_per_second)
+	c.CacheSize, err = parseSize(viper.GetString("cache_size"))
 	if err != nil {
-		log.Println("Could not initialize cluster connection:", err)
-		os.Exit(1)
+		fail(EXIT_USAGE, err)
+	}
+	c.CacheEnabled = c.CacheSize > 0
+	if viper.GetBool("adaptive_ttl") {
+		if viper.GetDuration("watch_interval") == 0 {
+			log.Println("Warning: adaptive TTLs without the invalidation feed only see the changes of this mount")
+		}
+		c.AdaptiveTTL = cass.NewAdaptiveTTL(viper.GetInt64("fcache_ttl_min"), viper.GetInt64("fcache_ttl_max"))
+	}
+	err = c.Init()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	if listen := viper.GetString("peer_listen"); listen != "" {
+		err = c.ServePeers(&cass.PeerConfig{
+			Listen:     listen,
+			Self:       viper.GetString("peer_url"),
+			Peers:      viper.GetStringSlice("peers"),
+			DNS:        viper.GetString("peer_dns"),
+			Refresh:    viper.GetDuration("peer_refresh"),
+			CertFile:   viper.GetString("peer_tls_cert"),
+			KeyFile:    viper.GetString("peer_tls_key"),
+			CAFile:     viper.GetString("peer_tls_ca"),
+			Secret:     viper.GetString("peer_secret"),
+			SecretFile: viper.GetString("peer_secret_file"),
+		})
+		if err != nil {
+			fail(EXIT_USAGE, "Unable to share the cache with the peers:", err)
+		}
 	}
 
         //The stat of the directory on the file system is being used to create the Owner and Permissions of the directory
         dinfo, err := os.Stat(mount)
         if err != nil {
-                log.Println("Error opening:", err)
-                os.Exit(1)
+                fail(exitCode(err), "Error opening:", err)
         }
 	owner := fuse.Owner{
 		Uid:      dinfo.Sys().(*syscall.Stat_t).Uid,
 		Gid:      dinfo.Sys().(*syscall.Stat_t).Gid,
 	}
 	mode := uint32(dinfo.Mode())
+	if root := c.Config.Root; root != nil {
+		//Environments made with "cassfs env create" carry their own root
+		owner = fuse.Owner{Uid: root.Uid, Gid: root.Gid}
+		mode = root.Mode & 07777
+	}
 
 	opts := &cass.CassFsOptions{
 		Owner: owner,
 		Mode:  mode,
 	}
 	opts.ReadOnly = viper.GetBool("ro")
+	if asOf := viper.GetString("as_of"); asOf != "" {
+		if len(viper.GetStringSlice("lower")) > 0 || c.Config.Parent != "" {
+			fail(EXIT_USAGE, "Layered environments can not be mounted with --as-of")
+		}
+		c.AsOf, err = time.Parse(time.RFC3339, asOf)
+		if err != nil {
+			fail(EXIT_USAGE, "Invalid --as-of time:", err)
+		}
+		start, err := c.HistoryStart()
+		if err != nil {
+			fail(EXIT_NOT_FOUND, "Unable to mount", c.Environment, "as of", asOf, ":", err)
+		}
+		if c.AsOf.Before(start) || c.AsOf.After(time.Now()) {
+			fail(EXIT_NOT_FOUND, "Unable to mount", c.Environment, "as of", asOf, ": history starts at", start.Format(time.RFC3339))
+		}
+		//The past can not be changed
+		opts.ReadOnly = true
+	}
+	opts.Transactional = viper.GetBool("transactional")
+	opts.SaveWindow = viper.GetDuration("save_window")
+	opts.Readahead = viper.GetInt("readahead")
+	opts.FlushInterval = viper.GetDuration("flush_interval")
+	opts.MaxDirtyBytes, err = parseSize(viper.GetString("max_dirty"))
+	if err != nil {
+		fail(EXIT_USAGE, err)
+	}
+	opts.CheckPermissions = !viper.GetBool("no_permission_check")
+	opts.VirtualDirs = viper.GetStringSlice("virtual_dirs")
+	if address := viper.GetString("scan"); address != "" {
+		opts.Scanner, err = cass.ParseScanner(address)
+		if err != nil {
+			fail(EXIT_USAGE, err)
+		}
+		opts.ScanPaths = viper.GetStringSlice("scan_paths")
+	}
+	var lowers []*cass.Cass
+	for _, env := range viper.GetStringSlice("lower") {
+		lower, err := c.ForEnvironment(env)
+		if err != nil {
+			fail(exitCode(err), "Unable to open environment", env, ":", err)
+		}
+		lowers = append(lowers, lower)
+	}
+	if len(lowers) == 0 && c.Config.Parent != "" {
+		//A copy-on-write clone is served over the environments it was cloned from
+		lowers, err = c.Layers()
+		if err != nil {
+			fail(exitCode(err), "Unable to open the parents of", c.Environment, ":", err)
+		}
+	}
+	if sub := storePath(viper.GetString("subpath")); sub != "" {
+		//With layers the directory only has to be in one of them
+		var entry *cass.CassFsMetadata
+		for _, store := range append([]*cass.Cass{c}, lowers...) {
+			entry, err = store.GetFiledata(sub)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			fail(exitCode(err), "Unable to mount", sub, ":", err)
+		}
+		if entry.Metadata.Attr == nil || entry.Metadata.Attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			fail(exitCode(cass.ErrNotDir), "Unable to mount", sub, ":", cass.ErrNotDir)
+		}
+		opts.Subpath = sub
+	}
+	if key := viper.GetString("verify_manifest"); key != "" {
+		//A verified mount serves the signed state, so it can not be changed
+		opts.Manifest = loadVerifiedManifest(c, key, manifest_id)
+		opts.ReadOnly = true
+		c.VerifyData = true
+	}
+	err = c.CheckFormat(opts.ReadOnly)
+	if err != nil {
+		fail(exitCode(err), "Unable to mount", c.Environment, ":", err)
+	}
+	err = c.CheckFeatures(opts.ReadOnly)
+	if err != nil {
+		fail(exitCode(err), "Unable to mount", c.Environment, "read-write:", err)
+	}
+	if dir := viper.GetString("journal"); dir != "" {
+		opts.Journal, err = cass.NewJournal(dir)
+		if err != nil {
+			fail(exitCode(err), "Unable to open journal:", err)
+		}
+	}
+
+	var slos []*cass.SLO
+	for _, s := range viper.GetStringSlice("slo") {
+		slo, err := cass.ParseSLO(s)
+		if err != nil {
+			fail(EXIT_USAGE, err)
+		}
+		slos = append(slos, slo)
+	}
+	if len(slos) > 0 {
+		opts.SLO = cass.NewSLOTracker(slos)
+		opts.SLO.DegradeAfter = viper.GetInt("slo_degrade")
+	}
 
 	fs := cass.NewCassFs(c, opts)
+	if opts.SLO != nil {
+		opts.SLO.OnDegrade = fs.Degrade
+		go opts.SLO.Run(viper.GetDuration("slo_interval"))
+	}
+	if socket := viper.GetString("control"); socket != "" {
+		err = fs.ServeControl(socket)
+		if err != nil {
+			fail(exitCode(err), "Unable to open control socket:", err)
+		}
+	}
+	if interval := viper.GetDuration("watch_interval"); interval > 0 {
+		go fs.WatchChanges(interval)
+	}
 	//This section is taken directly from the examples - not fully understood
-	nodeFs := pathfs.NewPathNodeFs(fs, &pathfs.PathNodeFsOptions{ClientInodes: true})
+	var root pathfs.FileSystem = fs
+	if len(lowers) > 0 {
+		var lowerFs []*cass.CassFs
+		for _, lower := range lowers {
+			lowerFs = append(lowerFs, cass.NewCassFs(lower, &cass.CassFsOptions{
+				Owner:            owner,
+				Mode:             mode,
+				ReadOnly:         true,
+				CheckPermissions: opts.CheckPermissions,
+			}))
+		}
+		root = cass.NewOverlayFs(fs, lowerFs)
+	}
+	if c.Config.Policy.Versions > 0 {
+		root = cass.NewVersionsFs(root, fs)
+	}
+	fsname := fmt.Sprintf("cassfs:%d/%s", c.OwnerId, c.Environment)
+	if opts.Subpath != "" {
+		root = pathfs.NewPrefixFileSystem(root, opts.Subpath)
+		fsname += "/" + opts.Subpath
+	}
+	if interval := viper.GetDuration("metrics_interval"); interval > 0 {
+		host, err := os.Hostname()
+		if err != nil {
+			fail(EXIT_FAILURE, "Unable to report metrics:", err)
+		}
+		metrics := cass.NewMetricsHook()
+		root = cass.NewHookFs(root, metrics)
+		go c.PushMetrics(metrics, host, interval)
+	}
+	nodeFs := pathfs.NewPathNodeFs(root, &pathfs.PathNodeFsOptions{ClientInodes: true})
 	mOpts := nodefs.Options{
 		EntryTimeout:    time.Duration(entry_ttl * float64(time.Second)),
-		AttrTimeout:     time.Duration(entry_ttl * float64(time.Second)),
+		AttrTimeout:     time.Duration(attr_ttl * float64(time.Second)),
 		NegativeTimeout: time.Duration(negative_ttl * float64(time.Second)),
 		PortableInodes:  false,
 	}
-	mountState, _, err := nodefs.MountRoot(mount, nodeFs.Root(), &mOpts)
+	fuseOpts, err := fuseOptions(viper.GetStringSlice("options"), fsname)
+	if err != nil {
+		fail(EXIT_USAGE, err)
+	}
+	conn := nodefs.NewFileSystemConnector(nodeFs.Root(), &mOpts)
+	mountState, err := fuse.NewServer(conn.RawFS(), mount, fuseOpts)
 	if err != nil {
 		log.Fatal("Mount fail:", err)
 	}
+	if opts.SLO != nil {
+		mountState.RecordLatencies(opts.SLO)
+	}
+	return mountState, fs
+}
 
-	mountState.SetDebug(viper.GetBool("debug"))
-	mountState.Serve()
+//fuseOptions converts -o style mount options into the options of the FUSE server, the
+//file system shows up as fsname of type fuse.cassfs unless they are overridden
+func fuseOptions(options []string, fsname string) (*fuse.MountOptions, error) {
+	opts := &fuse.MountOptions{
+		FsName: fsname,
+		Name:   "cassfs",
+	}
+	allowRoot := false
+	for _, option := range options {
+		name, value := option, ""
+		if idx := strings.Index(option, "="); idx >= 0 {
+			name, value = option[:idx], option[idx+1:]
+		}
+		switch name {
+		case "allow_other":
+			opts.AllowOther = true
+		case "allow_root":
+			allowRoot = true
+			opts.Options = append(opts.Options, name)
+		case "default_permissions":
+			opts.Options = append(opts.Options, name)
+		case "max_read":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || n == 0 {
+				return nil, errors.New("Invalid max_read: " + value)
+			}
+			opts.Options = append(opts.Options, fmt.Sprintf("max_read=%d", n))
+		case "fsname":
+			if value == "" {
+				return nil, errors.New("fsname needs a value")
+			}
+			opts.FsName = value
+		case "subtype":
+			if value == "" {
+				return nil, errors.New("subtype needs a value")
+			}
+			opts.Name = value
+		default:
+			return nil, errors.New("Unsupported mount option: " + option)
+		}
+	}
+	//fusermount refuses the combination
+	if allowRoot && opts.AllowOther {
+		return nil, errors.New("allow_other and allow_root can not be used together")
+	}
+	return opts, nil
 }
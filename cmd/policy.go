@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var PolicyCommand = &cobra.Command{
+	Use:   "policy",
+	Short: "Show or set the storage policy of an environment",
+	Long: `Show or set the maximum file size, the file name patterns
+		that are refused, how long the history of changes is kept, how many
+		previous versions of each file are kept and for how long, how long signed
+		manifests are kept, how long deleted files stay in the trash and how long
+		changes and destructive operations are kept in the changelog and the
+		audit log of an environment.`,
+	Run: policy,
+}
+
+var (
+	policy_max_size     uint64
+	policy_deny         []string
+	policy_clear        bool
+	policy_history      time.Duration
+	policy_versions     int
+	policy_trash        time.Duration
+	policy_changelog    time.Duration
+	policy_audit        time.Duration
+	policy_version_age  time.Duration
+	policy_manifest_age time.Duration
+)
+
+func init() {
+	PolicyCommand.Flags().Uint64Var(&policy_max_size, "max-size", 0, "Largest file in bytes that can be stored, 0 for no limit")
+	PolicyCommand.Flags().StringSliceVar(&policy_deny, "deny", nil, "File name pattern that is refused (e.g. *.log)")
+	PolicyCommand.Flags().BoolVar(&policy_clear, "clear", false, "Remove the policy")
+	PolicyCommand.Flags().DurationVar(&policy_history, "history", 0, "How long the history of changes is kept for --as-of mounts, 0 stops recording it")
+	PolicyCommand.Flags().IntVar(&policy_versions, "versions", 0, "Previous versions kept per file, 0 keeps none")
+	PolicyCommand.Flags().DurationVar(&policy_version_age, "version-age", 0, "Drop versions older than this however many are kept, 0 keeps them")
+	PolicyCommand.Flags().DurationVar(&policy_manifest_age, "manifest-age", 0, "Drop signed manifests older than this except the latest, 0 keeps them")
+	PolicyCommand.Flags().DurationVar(&policy_trash, "trash", 0, "How long deleted files are kept in the trash, 0 removes them right away")
+	PolicyCommand.Flags().DurationVar(&policy_changelog, "changelog", 0, "How long changes are kept in the changelog for watch, 0 stops recording them")
+	PolicyCommand.Flags().DurationVar(&policy_audit, "audit", 0, "How long deletes, renames, chmods and chowns are kept in the audit log, 0 stops recording them")
+	RootCommand.AddCommand(PolicyCommand)
+}
+
+func policy(cmd *cobra.Command, args []string) {
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	config := c.Config
+	changed := false
+	if policy_clear {
+		//History and the audit log are kept, they are only changed with --history and --audit
+		config.Policy = cass.EnvPolicy{
+			History:      config.Policy.History,
+			HistorySince: config.Policy.HistorySince,
+			Audit:        config.Policy.Audit,
+		}
+		changed = true
+	}
+	if cmd.Flags().Changed("max-size") {
+		config.Policy.MaxFileSize = policy_max_size
+		changed = true
+	}
+	if cmd.Flags().Changed("versions") {
+		if policy_versions < 0 {
+			fail(EXIT_USAGE, "The number of versions can not be negative")
+		}
+		config.Policy.Versions = policy_versions
+		changed = true
+	}
+	if cmd.Flags().Changed("version-age") {
+		if policy_version_age < 0 {
+			fail(EXIT_USAGE, "The version age can not be negative")
+		}
+		config.Policy.VersionAge = policy_version_age
+		changed = true
+	}
+	if cmd.Flags().Changed("manifest-age") {
+		if policy_manifest_age < 0 {
+			fail(EXIT_USAGE, "The manifest age can not be negative")
+		}
+		config.Policy.ManifestAge = policy_manifest_age
+		changed = true
+	}
+	if cmd.Flags().Changed("trash") {
+		if policy_trash < 0 {
+			fail(EXIT_USAGE, "The trash retention can not be negative")
+		}
+		config.Policy.Trash = policy_trash
+		changed = true
+	}
+	if cmd.Flags().Changed("changelog") {
+		if policy_changelog < 0 {
+			fail(EXIT_USAGE, "The changelog retention can not be negative")
+		}
+		config.Policy.Changelog = policy_changelog
+		changed = true
+	}
+	if cmd.Flags().Changed("audit") {
+		if policy_audit < 0 {
+			fail(EXIT_USAGE, "The audit retention can not be negative")
+		}
+		config.Policy.Audit = policy_audit
+		changed = true
+	}
+	if len(policy_deny) > 0 {
+		config.Policy.DeniedNames = append(config.Policy.DeniedNames, policy_deny...)
+		changed = true
+	}
+	if changed {
+		err = c.SaveEnvConfig(config)
+		if err != nil {
+			fail(exitCode(err), "Unable to save the environment configuration:", err)
+		}
+	}
+	if cmd.Flags().Changed("history") {
+		if policy_history > 0 {
+			err = c.EnableHistory(policy_history)
+		} else {
+			err = c.DisableHistory()
+		}
+		if err != nil {
+			fail(exitCode(err), "Unable to change the history of the environment:", err)
+		}
+		config = c.Config
+	}
+	fmt.Printf("Max file size: %d\n", config.Policy.MaxFileSize)
+	for _, pattern := range config.Policy.DeniedNames {
+		fmt.Printf("Denied:        %s\n", pattern)
+	}
+	if config.Policy.Versions > 0 {
+		fmt.Printf("Versions:      %d\n", config.Policy.Versions)
+	}
+	if config.Policy.VersionAge > 0 {
+		fmt.Printf("Version age:   %s\n", config.Policy.VersionAge)
+	}
+	if config.Policy.ManifestAge > 0 {
+		fmt.Printf("Manifest age:  %s\n", config.Policy.ManifestAge)
+	}
+	if config.Policy.Trash > 0 {
+		fmt.Printf("Trash:         %s\n", config.Policy.Trash)
+	}
+	if config.Policy.Changelog > 0 {
+		fmt.Printf("Changelog:     %s\n", config.Policy.Changelog)
+	}
+	if config.Policy.Audit > 0 {
+		fmt.Printf("Audit:         %s\n", config.Policy.Audit)
+	}
+	if config.Policy.History > 0 {
+		fmt.Printf("History:       %s since %s\n", config.Policy.History, config.Policy.HistorySince.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+//configProfile returns the options of a profile defined under "profiles" in the
+//config file, or nil when there is no such profile
+func configProfile(name string) map[string]interface{} {
+	profiles := viper.GetStringMap("profiles")
+	for key, options := range profiles {
+		if strings.ToLower(key) == strings.ToLower(name) {
+			return cast.ToStringMap(options)
+		}
+	}
+	return nil
+}
+
+//applyProfile sets the flags of the command from a profile of the config file.  Options
+//given on the command line are kept, so a profile only changes the defaults of a mount
+func applyProfile(cmd *cobra.Command, profile map[string]interface{}) error {
+	keys := make([]string, 0, len(profile))
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		flag := cmd.Flags().Lookup(key)
+		if flag == nil {
+			flag = cmd.Flags().Lookup(strings.Replace(key, "_", "-", -1))
+		}
+		if flag == nil || flag.Name == "profile" {
+			return errors.New("Unknown option in mount profile: " + key)
+		}
+		if flag.Changed {
+			continue
+		}
+		var value string
+		switch v := profile[key].(type) {
+		case []interface{}:
+			value = strings.Join(cast.ToStringSlice(v), ",")
+		default:
+			value = fmt.Sprint(v)
+		}
+		err := cmd.Flags().Set(flag.Name, value)
+		if err != nil {
+			return errors.New("Invalid value for " + key + " in mount profile: " + err.Error())
+		}
+	}
+	return nil
+}
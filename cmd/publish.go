@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/gocql/gocql"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var PublishCommand = &cobra.Command{
+	Use:   "publish <local path> <path>",
+	Short: "Publish a local file or directory tree, only uploading data the store does not have",
+	Long: `Hash the content of the local files, upload only the chunks that are not
+		already stored and then link the files at their path in one step.
+		Publishing a tree that is mostly unchanged only writes metadata.`,
+	Run: publish,
+}
+
+//PUBLISH_CHECKPOINT is the number of files published between checkpoints
+const PUBLISH_CHECKPOINT = 100
+
+//publishCheckpoint is the position of an interrupted publish, every file up to Last in the
+//order the tree is walked in has been published
+type publishCheckpoint struct {
+	Last     string
+	Files    int
+	Uploaded int
+	Total    int64
+}
+
+func init() {
+	addBudgetFlags(PublishCommand)
+	addProgressFlags(PublishCommand)
+	RootCommand.AddCommand(PublishCommand)
+}
+
+//publishFile publishes a single local file at name and returns the bytes uploaded
+func publishFile(c *cass.Cass, local string, name string, info os.FileInfo) (int, error) {
+	data, err := ioutil.ReadFile(local)
+	if err != nil {
+		return 0, err
+	}
+	return publishData(c, data, name, localAttr(info))
+}
+
+//publishData uploads the chunks of data the store does not have yet and links them as
+//the content of name, it returns the number of bytes that had to be uploaded
+func publishData(c *cass.Cass, data []byte, name string, attr *fuse.Attr) (int, error) {
+	bs := c.NewBlockSize()
+	chunks := c.ChunkHashes(data, bs)
+	missing, err := c.MissingChunks(chunks)
+	if err != nil {
+		return 0, err
+	}
+	need := make(map[string]bool, len(missing))
+	for _, hash := range missing {
+		need[string(hash)] = true
+	}
+	uploaded := 0
+	for idx, hash := range chunks {
+		if !need[string(hash)] {
+			continue
+		}
+		start := idx * int(bs)
+		end := start + int(bs)
+		if end > len(data) {
+			end = len(data)
+		}
+		err = c.PutChunk(hash, data[start:end])
+		if err != nil {
+			return uploaded, err
+		}
+		delete(need, string(hash))
+		uploaded += end - start
+	}
+	attr.Size = uint64(len(data))
+	return uploaded, c.LinkChunks(name, chunks, bs, attr)
+}
+
+//localAttr returns the attributes of a local regular file for storing it
+func localAttr(info os.FileInfo) *fuse.Attr {
+	attr := &fuse.Attr{
+		Mode: fuse.S_IFREG | uint32(info.Mode().Perm()),
+	}
+	mtime := info.ModTime()
+	attr.SetTimes(nil, &mtime, &mtime)
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		attr.Uid = st.Uid
+		attr.Gid = st.Gid
+	}
+	return attr
+}
+
+//walkedBefore checks if filepath.Walk visits the relative path a no later than b, the
+//walk sorts the names within each directory so the paths compare component by component
+func walkedBefore(a string, b string) bool {
+	ac := strings.Split(filepath.ToSlash(a), "/")
+	bc := strings.Split(filepath.ToSlash(b), "/")
+	for i := 0; i < len(ac) && i < len(bc); i++ {
+		if ac[i] != bc[i] {
+			return ac[i] < bc[i]
+		}
+	}
+	return len(ac) <= len(bc)
+}
+
+//treeSize counts the regular files below root and their size
+func treeSize(root string) (int64, int64) {
+	var files, bytes int64
+	filepath.Walk(root, func(local string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return files, bytes
+}
+
+func publish(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	root := filepath.Clean(args[0])
+	target := storePath(args[1])
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		abs = root
+	}
+	location := checkpointPath("publish", abs+"\x00"+target)
+	cp := &publishCheckpoint{}
+	if resume && loadCheckpoint(location, cp) {
+		log.Println("Resuming after", cp.Last)
+	} else {
+		cp = &publishCheckpoint{}
+	}
+	progress := cass.NewProgress(treeSize(root))
+	finished := reportProgress("publish", progress)
+	err = filepath.Walk(root, func(local string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, local)
+		if err != nil {
+			return err
+		}
+		name := storePath(path.Join(target, filepath.ToSlash(rel)))
+		switch {
+		case info.IsDir():
+			if name == "" {
+				return nil
+			}
+			_, err := c.GetFiledata(name)
+			if err == gocql.ErrNotFound {
+				return c.MakeDirectory(name, &fuse.Attr{Mode: fuse.S_IFDIR | uint32(info.Mode().Perm())})
+			}
+			return err
+		case info.Mode().IsRegular():
+			if cp.Last != "" && walkedBefore(rel, cp.Last) {
+				progress.Add(1, info.Size())
+				return nil
+			}
+			sent, err := publishFile(c, local, name, info)
+			if err != nil {
+				log.Println("Unable to publish", local, ":", err)
+				return err
+			}
+			progress.Add(1, info.Size())
+			cp.Last = rel
+			cp.Files++
+			cp.Uploaded += sent
+			cp.Total += info.Size()
+			if cp.Files%PUBLISH_CHECKPOINT == 0 {
+				saveCheckpoint(location, cp)
+			}
+		default:
+			log.Println("Skipping", local, "which is not a regular file or directory")
+		}
+		return nil
+	})
+	finished()
+	if err != nil {
+		saveCheckpoint(location, cp)
+		log.Println("Run it again with --resume to continue")
+		fail(exitCode(err), "Publish failed:", err)
+	}
+	os.Remove(location)
+	log.Printf("Published %d files (%d bytes), uploaded %d bytes\n", cp.Files, cp.Total, cp.Uploaded)
+}
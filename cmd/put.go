@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var PutCommand = &cobra.Command{
+	Use:   "put <local file or -> <path>",
+	Short: "Write a single file to an environment without mounting it",
+	Long: `Store a local file, or stdin with -, at the path of the environment.
+		Missing directories above the path are created.  Only the chunks
+		the store does not have yet are uploaded.`,
+	Run: put,
+}
+
+var (
+	put_mode string
+)
+
+func init() {
+	PutCommand.Flags().StringVar(&put_mode, "mode", "", "Permissions of the file in octal (default from the local file, or 0644 for stdin)")
+	addBudgetFlags(PutCommand)
+	RootCommand.AddCommand(PutCommand)
+}
+
+//makeParents creates the directories above name that do not exist yet
+func makeParents(c *cass.Cass, name string) error {
+	dir := path.Dir(name)
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		p := path.Join(parts[:i+1]...)
+		meta, err := c.GetFiledata(p)
+		if err == nil {
+			if meta.Metadata.Attr == nil || meta.Metadata.Attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+				return cass.ErrNotDir
+			}
+			continue
+		}
+		if err != gocql.ErrNotFound {
+			return err
+		}
+		now := time.Now()
+		attr := &fuse.Attr{
+			Mode: fuse.S_IFDIR | 0755,
+			Owner: fuse.Owner{
+				Uid: uint32(os.Getuid()),
+				Gid: uint32(os.Getgid()),
+			},
+		}
+		attr.SetTimes(&now, &now, &now)
+		err = c.MakeDirectory(p, attr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func put(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	name := storePath(args[1])
+	if name == "" {
+		fail(EXIT_USAGE, "The root directory can not be replaced by a file")
+	}
+	var data []byte
+	var attr *fuse.Attr
+	var err error
+	if args[0] == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fail(EXIT_FAILURE, "Unable to read stdin:", err)
+		}
+		now := time.Now()
+		attr = &fuse.Attr{
+			Mode: fuse.S_IFREG | 0644,
+			Owner: fuse.Owner{
+				Uid: uint32(os.Getuid()),
+				Gid: uint32(os.Getgid()),
+			},
+		}
+		attr.SetTimes(&now, &now, &now)
+	} else {
+		info, err := os.Stat(args[0])
+		if err != nil {
+			fail(EXIT_NOT_FOUND, "Unable to read", args[0], ":", err)
+		}
+		if !info.Mode().IsRegular() {
+			fail(EXIT_USAGE, args[0], "is not a regular file")
+		}
+		data, err = ioutil.ReadFile(args[0])
+		if err != nil {
+			fail(EXIT_FAILURE, "Unable to read", args[0], ":", err)
+		}
+		attr = localAttr(info)
+	}
+	if put_mode != "" {
+		mode, err := strconv.ParseUint(put_mode, 8, 32)
+		if err != nil || mode&^07777 != 0 {
+			fail(EXIT_USAGE, "Invalid mode:", put_mode)
+		}
+		attr.Mode = fuse.S_IFREG | uint32(mode)
+	}
+
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	meta, err := c.GetFiledata(name)
+	switch {
+	case err == nil && meta.Metadata.Attr != nil && meta.Metadata.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR:
+		fail(exitCode(cass.ErrIsDir), "Unable to write", args[1], ":", cass.ErrIsDir)
+	case err == nil && (meta.Metadata.Attr == nil || meta.Metadata.Attr.Mode&syscall.S_IFMT != syscall.S_IFREG):
+		fail(exitCode(cass.ErrExists), "Unable to write", args[1], ":", cass.ErrExists)
+	case err == gocql.ErrNotFound:
+		err = makeParents(c, name)
+		if err != nil {
+			fail(exitCode(err), "Unable to create the directories of", args[1], ":", err)
+		}
+	case err != nil:
+		fail(exitCode(err), "Unable to write", args[1], ":", err)
+	}
+	uploaded, err := publishData(c, data, name, attr)
+	if err != nil {
+		fail(exitCode(err), "Unable to write", args[1], ":", err)
+	}
+	fmt.Printf("Stored %d bytes at %s, %d bytes uploaded\n", len(data), name, uploaded)
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var ReaperCommand = &cobra.Command{
+	Use:   "reaper",
+	Short: "Run the background policy engine for an environment",
+	Long: `Periodically enforce the lifecycle rules of an environment and
+		remove the files whose user.cassfs.ttl has passed, then drop the
+		versions, trash entries and signed manifests older than the retention
+		rules of the policy.
+		Use --once to run a single pass and --dry-run to only report.`,
+	Run: reaper,
+}
+
+var (
+	reaper_interval time.Duration
+	reaper_once     bool
+	reaper_dry_run  bool
+)
+
+func init() {
+	ReaperCommand.Flags().DurationVar(&reaper_interval, "interval", time.Hour, "Time between passes")
+	ReaperCommand.Flags().BoolVar(&reaper_once, "once", false, "Run a single pass and exit")
+	ReaperCommand.Flags().BoolVar(&reaper_dry_run, "dry-run", false, "Report what would be removed without removing it")
+	RootCommand.AddCommand(ReaperCommand)
+}
+
+//reap runs a single pass of every policy the reaper enforces
+func reap(c *cass.Cass) error {
+	//Pick up rule changes made since the last pass
+	config, err := c.LoadEnvConfig()
+	if err != nil {
+		return err
+	}
+	c.Config = config
+	report, err := c.ApplyLifecycle(reaper_dry_run)
+	if err != nil {
+		return err
+	}
+	action := "Expired"
+	if reaper_dry_run {
+		action = "Would expire"
+	}
+	for _, path := range report.Expired {
+		fmt.Printf("%s /%s\n", action, path)
+	}
+	log.Printf("Lifecycle: checked %d entries, %s %d files (%d bytes), %d errors\n", report.Checked, action, len(report.Expired), report.Bytes, report.Errors)
+	ttls, err := c.ExpireFiles(reaper_dry_run)
+	if err != nil {
+		return err
+	}
+	for _, path := range ttls.Expired {
+		fmt.Printf("%s /%s\n", action, path)
+	}
+	log.Printf("TTL: checked %d entries, %s %d files, %d errors\n", ttls.Checked, action, len(ttls.Expired), ttls.Errors)
+	retention, err := c.ApplyRetention(reaper_dry_run)
+	if err != nil {
+		return err
+	}
+	log.Printf("Retention: %s %d versions, %d trash entries, %d manifests and %d history states, freeing %d chunks (%d bytes), %d errors\n", action, retention.Versions, retention.Trash, retention.Manifests, retention.History, retention.Freed, retention.FreedBytes, retention.Errors)
+	return nil
+}
+
+func reaper(cmd *cobra.Command, args []string) {
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	for {
+		err = reap(c)
+		if err != nil {
+			if reaper_once {
+				fail(exitCode(err), "Reaper pass failed:", err)
+			}
+			log.Println("Reaper pass failed:", err)
+		}
+		if reaper_once {
+			return
+		}
+		time.Sleep(reaper_interval)
+	}
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var RestoreCommand = &cobra.Command{
+	Use:   "restore <path>",
+	Short: "Restore a deleted file from the trash",
+	Long: `Restore the last deletion of a file that went to the trash because the
+		policy of the environment sets --trash.  The file is restored to its path,
+		or to --as, which must not exist.  Missing directories above it are
+		created.`,
+	Run: restore,
+}
+
+var TrashCommand = &cobra.Command{
+	Use:   "trash [path]",
+	Short: "List the deleted files in the trash",
+	Long: `List the files in the trash below path, or all of them, with the time they
+		were deleted.  A path deleted more than once is listed once per deletion,
+		the newest first.`,
+	Run: trashList,
+}
+
+var TrashEmptyCommand = &cobra.Command{
+	Use:   "empty",
+	Short: "Remove the trash entries older than the retention",
+	Long: `Remove the files that were deleted longer ago than the trash retention of
+		the environment and release their data, or every file in the trash with
+		--all.  The reaper does the former on every pass.`,
+	Run: trashEmpty,
+}
+
+var (
+	restore_as    string
+	trash_all     bool
+	trash_dry_run bool
+)
+
+func init() {
+	RestoreCommand.Flags().StringVar(&restore_as, "as", "", "Path to restore the file to instead of its own")
+	TrashEmptyCommand.Flags().BoolVar(&trash_all, "all", false, "Remove every entry regardless of its age")
+	TrashEmptyCommand.Flags().BoolVar(&trash_dry_run, "dry-run", false, "Report what would be removed without removing it")
+	TrashCommand.AddCommand(TrashEmptyCommand)
+	RootCommand.AddCommand(RestoreCommand)
+	RootCommand.AddCommand(TrashCommand)
+}
+
+func restore(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	name := storePath(args[0])
+	target := name
+	if restore_as != "" {
+		target = storePath(restore_as)
+	}
+	err = makeParents(c, target)
+	if err != nil {
+		fail(exitCode(err), "Unable to create the directories of", target, ":", err)
+	}
+	err = c.RestoreTrash(name, target)
+	if err != nil {
+		fail(exitCode(err), "Unable to restore", args[0], ":", err)
+	}
+	fmt.Printf("Restored /%s\n", target)
+}
+
+func trashList(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = storePath(args[0])
+	}
+	entries, err := c.Trash(prefix)
+	if err != nil {
+		fail(exitCode(err), "Unable to list the trash:", err)
+	}
+	for _, e := range entries {
+		fmt.Printf("%s %12d /%s\n", e.Deleted.Format(time.RFC3339), e.Meta.Attr.Size, e.Path)
+	}
+}
+
+func trashEmpty(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	impact, err := c.EmptyTrash(trash_all, trash_dry_run)
+	if err != nil {
+		fail(exitCode(err), "Unable to empty the trash:", err)
+	}
+	printImpact(impact, trash_dry_run)
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var RmCommand = &cobra.Command{
+	Use:   "rm <path>...",
+	Short: "Remove files, or with -r whole trees, from an environment without mounting it",
+	Long: `Remove the entries directly from the store.  With --recursive a
+		directory is removed with everything below it, each directory is
+		removed with a single delete and the data references are released
+		in batches, which is much faster than rm -r on a mount.`,
+	Run: rm,
+}
+
+var (
+	rm_recursive bool
+)
+
+func init() {
+	RmCommand.Flags().BoolVarP(&rm_recursive, "recursive", "r", false, "Remove directories and everything under them")
+	addBudgetFlags(RmCommand)
+	//An interrupted removal is continued by running it again, so there is no --resume
+	RmCommand.Flags().DurationVar(&progress_interval, "progress", 10*time.Second, "How often progress is reported, 0 disables it")
+	RootCommand.AddCommand(RmCommand)
+}
+
+func rm(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	progress := cass.NewProgress(0, 0)
+	finished := reportProgress("rm", progress)
+	total := &cass.RemoveReport{}
+	code := EXIT_OK
+	for _, arg := range args {
+		name := storePath(arg)
+		if name == "" {
+			fmt.Fprintln(os.Stderr, "Unable to remove", arg, ": the root of the environment can not be removed")
+			code = EXIT_USAGE
+			continue
+		}
+		if !rm_recursive {
+			meta, err := c.GetFiledata(name)
+			if err == nil && meta.Metadata.Attr != nil && meta.Metadata.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+				err = cass.ErrIsDir
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Unable to remove", arg, ":", err)
+				code = exitCode(err)
+				continue
+			}
+		}
+		report, err := c.RemoveTree(name, progress)
+		total.Files += report.Files
+		total.Dirs += report.Dirs
+		total.Released += report.Released
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to remove", arg, ":", err)
+			code = exitCode(err)
+			continue
+		}
+		c.Audit(cass.AUDIT_DELETE, uint32(os.Getuid()), name, fmt.Sprintf("%d files, %d directories", report.Files, report.Dirs))
+	}
+	finished()
+	log.Printf("Removed %d files and %d directories, released %d data references\n", total.Files, total.Dirs, total.Released)
+	if code != EXIT_OK {
+		os.Exit(code)
+	}
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var RmdirCommand = &cobra.Command{
+	Use:   "rmdir <path>",
+	Short: "Remove a directory from an environment",
+	Long: `Remove a directory directly from the store without mounting
+		the environment.  With --recursive all of the contents are removed too.`,
+	Run: rmdir,
+}
+
+var (
+	rmdir_recursive bool
+)
+
+func init() {
+	RmdirCommand.Flags().BoolVarP(&rmdir_recursive, "recursive", "r", false, "Remove the directory and everything under it")
+	RootCommand.AddCommand(RmdirCommand)
+}
+
+func rmdir(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	err = c.RemoveDirectory(storePath(args[0]), rmdir_recursive)
+	if err != nil {
+		fail(exitCode(err), "Unable to remove directory:", err)
+	}
+	c.Audit(cass.AUDIT_RMDIR, uint32(os.Getuid()), storePath(args[0]), "")
+}
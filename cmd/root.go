@@ -1,8 +1,18 @@
 package cmd
 
 import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gocql/gocql"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/cgt212/cassfs/cass"
 )
 
 // These options are for the global flags
@@ -12,6 +22,13 @@ var (
 	environment string
 	statedir    string
 	owner       int
+	quiet       bool
+)
+
+// These options limit the load batch commands put on the cluster
+var (
+	max_bandwidth      string
+	max_ops_per_second float64
 )
 
 // This is the root command that all other commands will be added to
@@ -20,6 +37,12 @@ var RootCommand = &cobra.Command{
 	Short: "CassFS is a user space file system for multi-client mounts",
 	Long:  `A filesystem that uses Cassandra as the datastore
 		and is able to be mounted by multiple clients.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if quiet {
+			//Only the error a command fails on is still reported, the exit code tells what happened
+			log.SetOutput(ioutil.Discard)
+		}
+	},
 }
 
 func init() {
@@ -30,6 +53,21 @@ func init() {
 	RootCommand.PersistentFlags().IntVarP(&owner, "owner", "o", 1, "Owner ID")
 	RootCommand.PersistentFlags().StringVarP(&environment, "environment", "e", "production", "Environment to mount")
 	RootCommand.PersistentFlags().Bool("debug", false, "Enable debugging")
+	RootCommand.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Only report the error a command fails on, see the exit codes in the README")
+	RootCommand.PersistentFlags().Int("symlink_depth", cass.DefaultSymlinkDepth, "Maximum number of symbolic links followed when resolving a path")
+	RootCommand.PersistentFlags().String("compression", "none", "Compression algorithm for new data (none,snappy,zstd)")
+	RootCommand.PersistentFlags().String("hash", "sha512", "Hash algorithm for new data (sha512,blake3)")
+	RootCommand.PersistentFlags().String("blob_scope", "global", "Scope data is stored and deduplicated in (global,owner), owner keeps the data of every owner separate")
+	RootCommand.PersistentFlags().Bool("publish_changes", true, "Publish changes to the invalidation feed read by other mounts")
+	RootCommand.PersistentFlags().Int("chunk_workers", cass.DefaultChunkWorkers, "Number of chunks of a file read or written at the same time")
+	RootCommand.PersistentFlags().String("username", "", "User to authenticate to the cluster as, the password is set with password or password_file in the config file")
+	RootCommand.PersistentFlags().Bool("tls", false, "Connect to the cluster with TLS, implied by the other tls flags")
+	RootCommand.PersistentFlags().String("tls_cert", "", "Client certificate to connect to the cluster with")
+	RootCommand.PersistentFlags().String("tls_key", "", "Key of the client certificate")
+	RootCommand.PersistentFlags().String("tls_ca", "", "CA certificates the nodes are verified with (default the system certificates)")
+	RootCommand.PersistentFlags().String("tls_server_name", "", "Server name sent with SNI and expected in the certificates of the nodes (default the node address)")
+	RootCommand.PersistentFlags().Bool("tls_skip_verify", false, "Accept any certificate from the nodes, only for test clusters")
+	RootCommand.PersistentFlags().String("block-size", "", "Size of the chunks new files are split into, with an optional K or M suffix (default from the environment, or 1M)")
 	//Begin viper configuration
 	viper.SetEnvPrefix("CASSFS")
 	viper.AutomaticEnv()
@@ -47,4 +85,151 @@ func init() {
 	viper.BindPFlag("owner", RootCommand.PersistentFlags().Lookup("owner"))
 	viper.BindPFlag("environment", RootCommand.PersistentFlags().Lookup("environment"))
 	viper.BindPFlag("debug", RootCommand.PersistentFlags().Lookup("debug"))
+	viper.BindPFlag("symlink_depth", RootCommand.PersistentFlags().Lookup("symlink_depth"))
+	viper.BindPFlag("compression", RootCommand.PersistentFlags().Lookup("compression"))
+	viper.BindPFlag("hash", RootCommand.PersistentFlags().Lookup("hash"))
+	viper.BindPFlag("blob_scope", RootCommand.PersistentFlags().Lookup("blob_scope"))
+	viper.BindPFlag("publish_changes", RootCommand.PersistentFlags().Lookup("publish_changes"))
+	viper.BindPFlag("chunk_workers", RootCommand.PersistentFlags().Lookup("chunk_workers"))
+	viper.BindPFlag("username", RootCommand.PersistentFlags().Lookup("username"))
+	viper.BindPFlag("tls", RootCommand.PersistentFlags().Lookup("tls"))
+	viper.BindPFlag("tls_cert", RootCommand.PersistentFlags().Lookup("tls_cert"))
+	viper.BindPFlag("tls_key", RootCommand.PersistentFlags().Lookup("tls_key"))
+	viper.BindPFlag("tls_ca", RootCommand.PersistentFlags().Lookup("tls_ca"))
+	viper.BindPFlag("tls_server_name", RootCommand.PersistentFlags().Lookup("tls_server_name"))
+	viper.BindPFlag("tls_skip_verify", RootCommand.PersistentFlags().Lookup("tls_skip_verify"))
+	viper.BindPFlag("block_size", RootCommand.PersistentFlags().Lookup("block-size"))
+	viper.SetDefault("consistency", "ONE")
+	//Encryption keys are only configured through the config file or the environment
+	viper.SetDefault("key_env", "CASSFS_KEY")
+	viper.SetDefault("vault_field", "key")
+	viper.BindEnv("vault_addr", "VAULT_ADDR")
+	viper.BindEnv("vault_token", "VAULT_TOKEN")
+}
+
+//newStore creates a store configured from the global options, it still needs to be initialized
+func newStore() *cass.Cass {
+	c := cass.NewDefaultCass()
+	c.Host = strings.Split(viper.GetString("server"), ",")
+	c.Keyspace = viper.GetString("keyspace")
+	c.OwnerId = viper.GetInt64("owner")
+	c.Consistency = gocql.ParseConsistency(viper.GetString("consistency"))
+	c.Environment = viper.GetString("environment")
+	c.SymlinkDepth = viper.GetInt("symlink_depth")
+	codec, err := cass.ParseCodec(viper.GetString("compression"))
+	if err != nil {
+		log.Println(err, "- storing data uncompressed")
+	}
+	c.Compression = codec
+	c.PublishChanges = viper.GetBool("publish_changes")
+	c.ChunkWorkers = viper.GetInt("chunk_workers")
+	hasher, err := cass.ParseHasher(viper.GetString("hash"))
+	if err != nil {
+		log.Println(err, "- using", cass.DefaultHasher.Name())
+		hasher = cass.DefaultHasher
+	}
+	c.Hasher = hasher
+	switch viper.GetString("blob_scope") {
+	case "global":
+	case "owner":
+		c.IsolatedBlobs = true
+	default:
+		log.Println("Unknown blob scope:", viper.GetString("blob_scope"), "- using global")
+	}
+	keys, err := cass.NewKeyProvider(&cass.KeyConfig{
+		Provider:      viper.GetString("key_provider"),
+		Env:           viper.GetString("key_env"),
+		File:          viper.GetString("key_file"),
+		VaultAddr:     viper.GetString("vault_addr"),
+		VaultToken:    viper.GetString("vault_token"),
+		VaultPath:     viper.GetString("vault_path"),
+		VaultField:    viper.GetString("vault_field"),
+		KMSRegion:     viper.GetString("kms_region"),
+		KMSCiphertext: viper.GetString("kms_ciphertext"),
+	})
+	if err != nil {
+		log.Println(err, "- no encryption key available")
+	}
+	c.Keys = keys
+	c.Auth = &cass.ClusterAuth{
+		Username:     viper.GetString("username"),
+		Password:     viper.GetString("password"),
+		PasswordFile: viper.GetString("password_file"),
+		TLS:          viper.GetBool("tls"),
+		CertFile:     viper.GetString("tls_cert"),
+		KeyFile:      viper.GetString("tls_key"),
+		CAFile:       viper.GetString("tls_ca"),
+		ServerName:   viper.GetString("tls_server_name"),
+		SkipVerify:   viper.GetBool("tls_skip_verify"),
+	}
+	if c.Auth.CertFile != "" && c.Auth.KeyFile == "" {
+		fail(EXIT_USAGE, errors.New("A client certificate needs its key, set tls_key"))
+	}
+	if s := viper.GetString("block_size"); s != "" {
+		size, err := parseSize(s)
+		if err == nil {
+			err = cass.CheckBlockSize(size)
+		}
+		if err != nil {
+			fail(EXIT_USAGE, err)
+		}
+		c.BlockSize = size
+	}
+	return c
+}
+
+//addBudgetFlags adds the flags that limit the bandwidth and operations a batch command
+//uses, so long running maintenance does not slow down the mounts sharing the cluster
+func addBudgetFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&max_bandwidth, "max-bandwidth", "", "Maximum data transferred per second, with an optional K, M or G suffix (unlimited if not set)")
+	cmd.Flags().Float64Var(&max_ops_per_second, "max-ops-per-second", 0, "Maximum data operations per second, 0 is unlimited")
+}
+
+//parseSize converts a size with an optional K, M or G suffix to bytes
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("Invalid size: " + s)
+	}
+	return n * mult, nil
+}
+
+//openStore creates a store from the global options and connects it to the cluster
+func openStore() (*cass.Cass, error) {
+	c := newStore()
+	bandwidth, err := parseSize(max_bandwidth)
+	if err != nil {
+		return nil, err
+	}
+	c.Limiter = cass.NewRateLimiter(bandwidth, max_ops_per_second)
+	err = c.Init()
+	if err != nil {
+		return nil, err
+	}
+	//Commands may change the data, so they need a format they can write
+	err = c.CheckFormat(false)
+	if err != nil {
+		fail(exitCode(err), "Unable to use the stored data:", err)
+	}
+	return c, nil
+}
+
+//storePath converts a user supplied path into the form used by the store (no leading or trailing slash)
+func storePath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
 }
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var SoakCommand = &cobra.Command{
+	Use:   "soak",
+	Short: "Run a concurrent stress workload against the store",
+	Long: `Start --clients workers that write, read, rename, delete and list files
+		below --root for --duration, then remove the files and check that the
+		reference counts of the data are back where they were.  Run it against
+		an environment of its own, other writers make the reference check fail.
+		Exits with 7 when any operation failed or the check found a problem.`,
+	Run: soak,
+}
+
+var (
+	soak_clients  int
+	soak_duration time.Duration
+	soak_window   time.Duration
+	soak_chunks   int
+	soak_root     string
+)
+
+func init() {
+	SoakCommand.Flags().IntVar(&soak_clients, "clients", 4, "Number of concurrent workers")
+	SoakCommand.Flags().DurationVar(&soak_duration, "duration", 10*time.Minute, "How long the workload runs")
+	SoakCommand.Flags().DurationVar(&soak_window, "window", time.Minute, "Period the latency is averaged over")
+	SoakCommand.Flags().IntVar(&soak_chunks, "max-chunks", 4, "Largest number of chunks a file is written with")
+	SoakCommand.Flags().StringVar(&soak_root, "root", "", "Directory the files are created in, defaults to soak-<time>")
+	addBudgetFlags(SoakCommand)
+	addProgressFlags(SoakCommand)
+	RootCommand.AddCommand(SoakCommand)
+}
+
+func soak(cmd *cobra.Command, args []string) {
+	if len(args) > 0 || soak_clients < 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	root := soak_root
+	if root == "" {
+		root = fmt.Sprintf("soak-%d", time.Now().Unix())
+	}
+	opts := &cass.SoakOptions{
+		Root:      storePath(root),
+		Clients:   soak_clients,
+		Duration:  soak_duration,
+		Window:    soak_window,
+		MaxChunks: soak_chunks,
+		Progress:  cass.NewProgress(0, 0),
+	}
+	finished := reportProgress("soak", opts.Progress)
+	report, err := c.Soak(opts)
+	finished()
+	if err != nil {
+		fail(exitCode(err), "Soak run failed:", err)
+	}
+	var errors int64
+	fmt.Printf("%-8s %10s %8s %12s %12s\n", "op", "count", "errors", "mean", "max")
+	for _, name := range []string{"write", "read", "rename", "delete", "list"} {
+		stats := report.Ops[name]
+		errors += stats.Errors
+		fmt.Printf("%-8s %10d %8d %12s %12s\n", name, stats.Ops, stats.Errors, stats.Mean(), stats.Max)
+	}
+	for i, mean := range report.Windows {
+		fmt.Printf("window %d: mean latency %s\n", i+1, mean)
+	}
+	if n := len(report.Windows); n > 1 && report.Windows[0] > 0 {
+		fmt.Printf("latency drift: %.2fx\n", float64(report.Windows[n-1])/float64(report.Windows[0]))
+	}
+	fmt.Printf("corrupt reads: %d\n", report.Corrupt)
+	fmt.Printf("reference count errors: %d\n", report.RefErrors)
+	if errors > 0 || report.Corrupt > 0 || report.RefErrors > 0 {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
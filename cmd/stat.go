@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var StatCommand = &cobra.Command{
+	Use:   "stat <path>",
+	Short: "Print an entry as it is stored, for debugging damaged metadata",
+	Long: `Print the stored row of the path as JSON: the raw metadata, the hash,
+		the time the metadata was written, the number of chunks and the
+		reference count of every chunk.  Linked files show their inode as well.
+		The raw metadata is printed even when it can not be decoded.  Links in
+		the directories of the path are followed, a link at its end is printed.`,
+	Run: stat,
+}
+
+func init() {
+	RootCommand.AddCommand(StatCommand)
+}
+
+func stat(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	name, err := c.ResolveParent(storePath(args[0]))
+	if err != nil {
+		fail(exitCode(err), "Unable to stat", args[0], ":", err)
+	}
+	st, err := c.Stat(name)
+	if st != nil {
+		out, _ := json.MarshalIndent(st, "", "  ")
+		os.Stdout.Write(append(out, '\n'))
+	}
+	if err != nil {
+		fail(exitCode(err), "Unable to stat", args[0], ":", err)
+	}
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var SwapCommand = &cobra.Command{
+	Use:   "swap <current> <replacement>",
+	Short: "Atomically swap the contents of two directories",
+	Long: `Swap the contents of two directories in a single operation, for example
+		to replace "current" with a prepared "releases/v2".  After the swap
+		the old contents of current are found under the replacement path.`,
+	Run: swap,
+}
+
+func init() {
+	RootCommand.AddCommand(SwapCommand)
+}
+
+func swap(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	err = c.SwapDirectories(storePath(args[0]), storePath(args[1]))
+	if err != nil {
+		fail(exitCode(err), "Unable to swap directories:", err)
+	}
+}
@@ -0,0 +1,489 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/gocql/gocql"
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var SyncCommand = &cobra.Command{
+	Use:   "sync <local directory> <path>",
+	Short: "Bring a directory of the environment in line with a local directory or the other way around",
+	Long: `Compare the local directory with the directory at path and only copy the
+		entries that are missing or differ, by size and modification time or with
+		--checksum by content.  With --direction push (the default) the environment
+		is changed, with pull the local directory.  --delete also removes the
+		entries the source does not have and --dry-run only prints the changes.
+		With --state the tree of the environment is kept in a local file between
+		syncs and only the directories whose Merkle hash changed since are read
+		again.  Exits with 7 when some of the changes could not be made.`,
+	Run: syncTree,
+}
+
+//Directions of a sync
+const (
+	SYNC_PUSH = "push"
+	SYNC_PULL = "pull"
+)
+
+var (
+	sync_direction string
+	sync_delete    bool
+	sync_dry_run   bool
+	sync_checksum  bool
+	sync_state     string
+)
+
+func init() {
+	SyncCommand.Flags().StringVar(&sync_direction, "direction", SYNC_PUSH, "push copies the local directory into the environment, pull the other way around")
+	SyncCommand.Flags().BoolVar(&sync_delete, "delete", false, "Remove the entries the source does not have")
+	SyncCommand.Flags().BoolVarP(&sync_dry_run, "dry-run", "n", false, "Print the changes without making them")
+	SyncCommand.Flags().BoolVarP(&sync_checksum, "checksum", "c", false, "Compare the content of files of the same size instead of their modification time")
+	SyncCommand.Flags().StringVar(&sync_state, "state", "", "File the tree of the environment is kept in between syncs")
+	addBudgetFlags(SyncCommand)
+	RootCommand.AddCommand(SyncCommand)
+}
+
+//syncEntry is an entry of one side of a sync.  Local entries have info and local set,
+//entries of the store hash and meta.
+type syncEntry struct {
+	kind   uint32
+	size   uint64
+	mtime  int64
+	target string
+	local  string
+	info   os.FileInfo
+	hash   []byte
+	meta   *cass.CassMetadata
+}
+
+//syncState is the tree of the environment a sync read, kept with --state.  Hashes are the
+//Merkle hashes of the directories, a directory with the same hash on the next sync is
+//taken from Entries instead of being read again.
+type syncState struct {
+	Owner       int64
+	Environment string
+	Root        string
+	Hashes      map[string][]byte
+	Entries     map[string]*syncStored
+}
+
+//syncStored is an entry of the environment in a syncState
+type syncStored struct {
+	Hash []byte
+	Meta *cass.CassMetadata
+}
+
+//loadSyncState reads the state of the last sync of root, nil when there is none or it was
+//kept for another tree
+func loadSyncState(file string, c *cass.Cass, root string) *syncState {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Unable to read the sync state:", err)
+		}
+		return nil
+	}
+	state := &syncState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		log.Println("Ignoring the sync state:", err)
+		return nil
+	}
+	if state.Owner != c.OwnerId || state.Environment != c.Environment || state.Root != root {
+		return nil
+	}
+	return state
+}
+
+//save writes the state to file, it is replaced at once so an interrupted write leaves the
+//previous state
+func (s *syncState) save(file string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+//syncChange is a change a sync makes to the destination
+type syncChange struct {
+	rel    string
+	action string
+	reason string
+}
+
+//localEntries lists the tree below root by path relative to root in the order it is
+//walked in, a root that does not exist is an empty tree
+func localEntries(root string) ([]string, map[string]*syncEntry, error) {
+	var order []string
+	entries := make(map[string]*syncEntry)
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		return order, entries, nil
+	}
+	err := filepath.Walk(root, func(local string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, local)
+		if err != nil || rel == "." {
+			return err
+		}
+		e := &syncEntry{local: local, info: info, mtime: info.ModTime().Unix()}
+		switch {
+		case info.IsDir():
+			e.kind = syscall.S_IFDIR
+		case info.Mode()&os.ModeSymlink != 0:
+			e.kind = syscall.S_IFLNK
+			e.target, err = os.Readlink(local)
+			if err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			e.kind = syscall.S_IFREG
+			e.size = uint64(info.Size())
+		default:
+			log.Println("Skipping", local, "which is not a regular file, directory or symlink")
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		order = append(order, rel)
+		entries[rel] = e
+		return nil
+	})
+	return order, entries, err
+}
+
+//storeEntry converts an entry of the environment, it returns nil for the types a sync
+//skips
+func storeEntry(name string, hash []byte, meta *cass.CassMetadata) *syncEntry {
+	e := &syncEntry{
+		kind:  meta.Attr.Mode & syscall.S_IFMT,
+		size:  meta.Attr.Size,
+		mtime: int64(meta.Attr.Mtime),
+		hash:  hash,
+		meta:  meta,
+	}
+	switch e.kind {
+	case syscall.S_IFDIR, syscall.S_IFREG:
+	case syscall.S_IFLNK:
+		e.target = meta.SymlinkTarget(hash)
+	default:
+		log.Println("Skipping", name, "which is not a regular file, directory or symlink")
+		return nil
+	}
+	return e
+}
+
+//storeEntries lists the tree below root in the environment like localEntries.  The
+//directories that did not change since previous was kept are taken from it, the tree
+//that was read is returned as the next state.
+func storeEntries(c *cass.Cass, root string, previous *syncState) ([]string, map[string]*syncEntry, *syncState, error) {
+	var order []string
+	entries := make(map[string]*syncEntry)
+	state := &syncState{
+		Owner:       c.OwnerId,
+		Environment: c.Environment,
+		Root:        root,
+		Hashes:      make(map[string][]byte),
+		Entries:     make(map[string]*syncStored),
+	}
+	relative := func(name string) string {
+		if root == "" {
+			return name
+		}
+		if name == root {
+			return ""
+		}
+		return name[len(root)+1:]
+	}
+	add := func(rel string, hash []byte, meta *cass.CassMetadata) {
+		state.Entries[rel] = &syncStored{Hash: hash, Meta: meta}
+		if e := storeEntry(rel, hash, meta); e != nil {
+			order = append(order, rel)
+			entries[rel] = e
+		}
+	}
+	//skip takes a directory that did not change from the previous state
+	skip := func(name string, hash []byte) bool {
+		dir := relative(name)
+		state.Hashes[dir] = hash
+		if previous == nil || !bytes.Equal(previous.Hashes[dir], hash) {
+			return false
+		}
+		var below []string
+		for rel := range previous.Entries {
+			if dir == "" || strings.HasPrefix(rel, dir+"/") {
+				below = append(below, rel)
+			}
+		}
+		//Sorted paths keep every directory ahead of its contents
+		sort.Strings(below)
+		for _, rel := range below {
+			if h, ok := previous.Hashes[rel]; ok {
+				state.Hashes[rel] = h
+			}
+			add(rel, previous.Entries[rel].Hash, previous.Entries[rel].Meta)
+		}
+		return true
+	}
+	if root != "" {
+		meta, err := c.GetFiledata(root)
+		if err == gocql.ErrNotFound {
+			return order, entries, state, nil
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if meta.Metadata.Attr == nil || meta.Metadata.Attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return nil, nil, nil, cass.ErrNotDir
+		}
+	}
+	err := c.WalkTree(root, skip, func(name string, hash []byte, meta *cass.CassMetadata) error {
+		add(relative(name), hash, meta)
+		return nil
+	})
+	return order, entries, state, err
+}
+
+//syncReason returns why dst has to be replaced by src, or "" when it is up to date
+func syncReason(c *cass.Cass, src *syncEntry, dst *syncEntry) (string, error) {
+	switch {
+	case src.kind != dst.kind:
+		return "type", nil
+	case src.kind == syscall.S_IFLNK && src.target != dst.target:
+		return "target", nil
+	case src.kind != syscall.S_IFREG:
+		return "", nil
+	case src.size != dst.size:
+		return "size", nil
+	case !sync_checksum:
+		if src.mtime != dst.mtime {
+			return "mtime", nil
+		}
+		return "", nil
+	}
+	local, stored := src, dst
+	if local.info == nil {
+		local, stored = dst, src
+	}
+	f, err := os.Open(local.local)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	same, err := c.SameContent(stored.hash, stored.meta, f)
+	if err != nil || same {
+		return "", err
+	}
+	return "content", nil
+}
+
+//removedAbove checks if a directory above rel was removed
+func removedAbove(rel string, removed map[string]bool) bool {
+	for p := path.Dir(rel); p != "."; p = path.Dir(p) {
+		if removed[p] {
+			return true
+		}
+	}
+	return false
+}
+
+//storeReader streams the content of a stored file, it has to be closed so the stream ends
+//when the reader stops early
+func storeReader(c *cass.Cass, hash []byte, meta *cass.CassMetadata) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeContent(c, &cass.CassFsMetadata{Metadata: *meta, Hash: hash}, 0, -1, w))
+	}()
+	return r
+}
+
+func syncTree(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	if sync_direction != SYNC_PUSH && sync_direction != SYNC_PULL {
+		fail(EXIT_USAGE, "The direction has to be push or pull")
+	}
+	root := filepath.Clean(args[0])
+	target := storePath(args[1])
+	if info, err := os.Stat(root); err == nil && !info.IsDir() {
+		fail(EXIT_USAGE, root, "is not a directory")
+	} else if err != nil && (sync_direction == SYNC_PUSH || !os.IsNotExist(err)) {
+		fail(exitCode(err), "Unable to read", root, ":", err)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	localOrder, local, err := localEntries(root)
+	if err != nil {
+		fail(exitCode(err), "Unable to read", root, ":", err)
+	}
+	var previous *syncState
+	if sync_state != "" {
+		previous = loadSyncState(sync_state, c, target)
+	}
+	storeOrder, stored, state, err := storeEntries(c, target, previous)
+	if err != nil {
+		fail(exitCode(err), "Unable to read", "/"+target, ":", err)
+	}
+	if sync_state != "" {
+		//The state is what the environment held before this sync, the directories it
+		//changes have new hashes and are read again next time
+		if err = state.save(sync_state); err != nil {
+			log.Println("Unable to save the sync state:", err)
+		}
+	}
+	srcOrder, src, dstOrder, dst := localOrder, local, storeOrder, stored
+	if sync_direction == SYNC_PULL {
+		srcOrder, src, dstOrder, dst = storeOrder, stored, localOrder, local
+	}
+
+	//The entries that are replaced or deleted are removed before anything is copied
+	var removals, copies []syncChange
+	removed := make(map[string]bool)
+	deletes, failed := 0, 0
+	for _, rel := range srcOrder {
+		d, ok := dst[rel]
+		if !ok {
+			copies = append(copies, syncChange{rel: rel, action: "copy", reason: "new"})
+			continue
+		}
+		reason, err := syncReason(c, src[rel], d)
+		if err != nil {
+			log.Println("Unable to compare", rel, ":", err)
+			failed++
+			continue
+		}
+		if reason == "type" {
+			removals = append(removals, syncChange{rel: rel, action: "replace", reason: reason})
+			removed[rel] = true
+		}
+		if reason != "" {
+			copies = append(copies, syncChange{rel: rel, action: "copy", reason: reason})
+		}
+	}
+	if sync_delete {
+		for _, rel := range dstOrder {
+			if _, ok := src[rel]; ok || removedAbove(rel, removed) {
+				continue
+			}
+			removals = append(removals, syncChange{rel: rel, action: "delete"})
+			removed[rel] = true
+			deletes++
+		}
+	}
+	if sync_dry_run {
+		for _, change := range append(removals, copies...) {
+			if change.action == "delete" {
+				fmt.Println("delete", change.rel)
+			} else if change.action == "copy" {
+				fmt.Printf("copy %s (%s)\n", change.rel, change.reason)
+			}
+		}
+		log.Printf("Would copy %d and delete %d entries\n", len(copies), deletes)
+		return
+	}
+
+	var exp *cass.DirExporter
+	if sync_direction == SYNC_PULL {
+		exp, err = cass.NewDirExporter(root)
+	} else if target != "" && len(storeOrder) == 0 {
+		err = makeParents(c, target)
+		if err == nil {
+			info, _ := os.Stat(root)
+			err = importDir(c, target, info)
+		}
+	}
+	if err != nil {
+		fail(exitCode(err), "Unable to create", args[1], ":", err)
+	}
+	deleted, copied := 0, 0
+	for _, change := range removals {
+		if sync_direction == SYNC_PULL {
+			err = os.RemoveAll(filepath.Join(root, filepath.FromSlash(change.rel)))
+		} else {
+			_, err = c.RemoveTree(storePath(path.Join(target, change.rel)), nil)
+		}
+		if err != nil {
+			log.Println("Unable to remove", change.rel, ":", err)
+			failed++
+			continue
+		}
+		if change.action == "delete" {
+			fmt.Println("delete", change.rel)
+			deleted++
+		}
+	}
+	for _, change := range copies {
+		e := src[change.rel]
+		if sync_direction == SYNC_PULL {
+			err = pullEntry(c, exp, change.rel, e)
+		} else {
+			err = pushEntry(c, storePath(path.Join(target, change.rel)), e)
+		}
+		if err != nil {
+			log.Println("Unable to copy", change.rel, ":", err)
+			failed++
+			continue
+		}
+		fmt.Printf("copy %s (%s)\n", change.rel, change.reason)
+		copied++
+	}
+	if exp != nil {
+		err = exp.Close()
+		if err != nil {
+			log.Println("Unable to set the modes and times of the directories:", err)
+			failed++
+		}
+	}
+	log.Printf("Copied %d and deleted %d entries, %d were up to date\n", copied, deleted, len(srcOrder)-len(copies))
+	if failed > 0 {
+		fail(EXIT_PARTIAL, failed, "changes could not be made")
+	}
+}
+
+//pushEntry stores the local entry e at name
+func pushEntry(c *cass.Cass, name string, e *syncEntry) error {
+	switch e.kind {
+	case syscall.S_IFDIR:
+		return importDir(c, name, e.info)
+	case syscall.S_IFLNK:
+		return importSymlink(c, e.local, name, e.info)
+	}
+	_, err := publishFile(c, e.local, name, e.info)
+	return err
+}
+
+//pullEntry writes the stored entry e to the local path rel below the root of exp
+func pullEntry(c *cass.Cass, exp *cass.DirExporter, rel string, e *syncEntry) error {
+	switch e.kind {
+	case syscall.S_IFDIR:
+		return exp.Dir(rel, e.meta)
+	case syscall.S_IFLNK:
+		return exp.Symlink(rel, e.meta, e.target)
+	}
+	content := storeReader(c, e.hash, e.meta)
+	defer content.Close()
+	return exp.File(rel, e.meta, content)
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var (
+	all_owners       bool
+	all_environments bool
+	tenant_workers   int
+)
+
+//addTenantFlags adds the flags that run a per environment command over many environments
+func addTenantFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&all_owners, "all-owners", false, "Run for every environment of every owner")
+	cmd.Flags().BoolVar(&all_environments, "all-environments", false, "Run for every environment of --owner")
+	cmd.Flags().IntVar(&tenant_workers, "concurrency", 4, "Environments handled at the same time with --all-owners or --all-environments")
+}
+
+//manyTenants checks if the command runs for more than the environment of --environment
+func manyTenants() bool {
+	return all_owners || all_environments
+}
+
+//forTenants runs fn for the environments selected by the tenant flags, or only for the
+//environment of c without them, where a failure ends the command with the message what.
+//It returns the number of environments fn failed for.
+func forTenants(c *cass.Cass, what string, fn func(t cass.Tenant, store *cass.Cass) error) int {
+	if !manyTenants() {
+		err := fn(cass.Tenant{Owner: c.OwnerId, Environment: c.Environment}, c)
+		if err != nil {
+			fail(exitCode(err), what+":", err)
+		}
+		return 0
+	}
+	tenants, err := c.Tenants(all_owners)
+	if err != nil {
+		fail(exitCode(err), "Unable to list the environments:", err)
+	}
+	failed := c.ForEachTenant(tenants, tenant_workers, fn)
+	for t, err := range failed {
+		log.Println("Failed for", t, ":", err)
+	}
+	return len(failed)
+}
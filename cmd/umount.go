@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var UmountCommand = &cobra.Command{
+	Use:   "umount [mount point or fsname]...",
+	Short: "Unmount cassfs file systems",
+	Long: `Unmount the given cassfs mounts, or every one with --all.  Without
+		arguments the active mounts are listed.  A mount started with --control
+		is asked to write its held back saves first when --control is given.
+		--force detaches a mount that is busy or whose process has died.`,
+	Run: umount,
+}
+
+//MOUNTS_FILE lists the mounted file systems
+const MOUNTS_FILE = "/proc/mounts"
+
+var (
+	umount_all     bool
+	umount_force   bool
+	umount_control string
+)
+
+func init() {
+	UmountCommand.Flags().BoolVar(&umount_all, "all", false, "Unmount every cassfs mount")
+	UmountCommand.Flags().BoolVar(&umount_force, "force", false, "Detach the mount even if it is busy or not responding")
+	UmountCommand.Flags().StringVar(&umount_control, "control", "", "Control socket of the mount, used to flush it first")
+	RootCommand.AddCommand(UmountCommand)
+}
+
+//cassMount is an entry of the mount table that belongs to cassfs
+type cassMount struct {
+	Source string
+	Point  string
+	Type   string
+}
+
+//unescapeMount decodes the octal escapes the kernel uses for spaces and such in the mount table
+func unescapeMount(s string) string {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(c))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+//cassMounts returns the cassfs mounts in the mount table, which are of type fuse.cassfs or
+//have a cassfs:<owner>/<environment> source when the subtype was changed
+func cassMounts() ([]cassMount, error) {
+	f, err := os.Open(MOUNTS_FILE)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []cassMount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		m := cassMount{Source: unescapeMount(fields[0]), Point: unescapeMount(fields[1]), Type: fields[2]}
+		if m.Type == "fuse.cassfs" || (strings.HasPrefix(m.Type, "fuse") && strings.HasPrefix(m.Source, "cassfs:")) {
+			mounts = append(mounts, m)
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+//flushMount asks the mount behind the control socket to write everything it holds back
+func flushMount(socket string) error {
+	resp, err := controlClient(socket).Post("http://cassfs/flush", "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Flush failed: %s", strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+//unmount detaches the mount at point, a forced unmount is lazy so it also works on a
+//mount that is busy or whose process is gone
+func unmount(point string) error {
+	args := []string{"-u", point}
+	if umount_force {
+		args = []string{"-u", "-z", point}
+	}
+	out, err := exec.Command("fusermount", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func umount(cmd *cobra.Command, args []string) {
+	mounts, err := cassMounts()
+	if err != nil {
+		fail(exitCode(err), "Unable to read the mount table:", err)
+	}
+	if len(args) == 0 && !umount_all {
+		for _, m := range mounts {
+			fmt.Printf("%s\t%s\n", m.Point, m.Source)
+		}
+		return
+	}
+	var targets []cassMount
+	if umount_all {
+		targets = mounts
+	}
+	for _, arg := range args {
+		point, _ := filepath.Abs(arg)
+		found := false
+		for _, m := range mounts {
+			if m.Point == point || m.Source == arg {
+				targets = append(targets, m)
+				found = true
+			}
+		}
+		if !found {
+			fail(EXIT_NOT_FOUND, arg, "is not a cassfs mount")
+		}
+	}
+	if umount_control != "" {
+		err = flushMount(umount_control)
+		if err != nil && !umount_force {
+			fail(EXIT_CONNECTION, "Unable to flush the mount:", err)
+		}
+		if err != nil {
+			log.Println("Unable to flush the mount, unmounting anyway:", err)
+		}
+	}
+	failed := 0
+	for _, m := range targets {
+		if err := unmount(m.Point); err != nil {
+			log.Println("Unable to unmount", m.Point, ":", err)
+			failed++
+			continue
+		}
+		log.Println("Unmounted", m.Point)
+	}
+	if failed > 0 {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var CheckReportCommand = &cobra.Command{
+	Use:   "check-report <report file> <public key file>",
+	Short: "Check the signature of a verification report and print its result",
+	Long: `Import and export write a verification report with --verify-report,
+		signed with --sign-key.  This checks the signature with the public key
+		of the pair and lists the files that did not match.`,
+	Run: checkReport,
+}
+
+var (
+	verify_report   string
+	verify_sign_key string
+	verify_key      ed25519.PrivateKey
+)
+
+func init() {
+	RootCommand.AddCommand(CheckReportCommand)
+}
+
+//addVerifyFlags adds the flags for the verification report of a transfer
+func addVerifyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&verify_report, "verify-report", "", "Compare every file with the store afterwards and write the report to this file")
+	cmd.Flags().StringVar(&verify_sign_key, "sign-key", "", "Private key file the verification report is signed with (see manifest keygen)")
+}
+
+//newVerification returns the report to fill when one was asked for, or nil
+func newVerification(c *cass.Cass, operation string, root string) *cass.VerificationReport {
+	if verify_report == "" {
+		if verify_sign_key != "" {
+			fail(EXIT_USAGE, "--sign-key needs --verify-report")
+		}
+		return nil
+	}
+	if verify_sign_key != "" {
+		key, err := cass.LoadSigningKey(verify_sign_key)
+		if err != nil {
+			fail(exitCode(err), "Unable to read the signing key:", err)
+		}
+		verify_key = key
+	}
+	return c.NewVerificationReport(operation, root)
+}
+
+//verifyLocal compares the local file with the file name of the store and adds the result
+//to the report
+func verifyLocal(c *cass.Cass, report *cass.VerificationReport, local string, name string) {
+	f, err := os.Open(local)
+	if err != nil {
+		report.Add(&cass.VerifiedFile{Path: name, Error: err.Error()})
+		return
+	}
+	defer f.Close()
+	result := c.VerifyFile(name, f)
+	if !result.OK() {
+		log.Println("Verification of", local, "failed")
+	}
+	report.Add(result)
+}
+
+//saveVerification signs and writes the report, a report with failures fails the command
+func saveVerification(report *cass.VerificationReport) {
+	if verify_key != nil {
+		err := report.Sign(verify_key)
+		if err != nil {
+			fail(EXIT_FAILURE, "Unable to sign the verification report:", err)
+		}
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(verify_report, data, 0644)
+	}
+	if err != nil {
+		fail(exitCode(err), "Unable to write the verification report:", err)
+	}
+	log.Printf("Verified %d files, %d did not match\n", report.Verified, report.Failed)
+	if report.Failed > 0 {
+		fail(exitCode(cass.ErrVerifyFailed), report.Failed, "files do not match the store, see", verify_report)
+	}
+}
+
+func checkReport(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		fail(exitCode(err), "Unable to read the report:", err)
+	}
+	report := &cass.VerificationReport{}
+	err = json.Unmarshal(data, report)
+	if err != nil {
+		fail(EXIT_USAGE, "Unable to parse the report:", err)
+	}
+	key, err := cass.LoadVerifyKey(args[1])
+	if err != nil {
+		fail(exitCode(err), "Unable to read the public key:", err)
+	}
+	err = report.Verify(key)
+	if err != nil {
+		fail(exitCode(err), err)
+	}
+	fmt.Printf("%s of %d.%s %s at %s\n", report.Operation, report.Owner, report.Environment, report.Root, report.Created.Format("2006-01-02 15:04:05"))
+	fmt.Printf("%d files verified, %d did not match\n", report.Verified, report.Failed)
+	for _, f := range report.Files {
+		if f.OK() {
+			continue
+		}
+		reason := f.Error
+		switch {
+		case reason != "":
+		case !f.Chunks:
+			reason = "chunks differ"
+		default:
+			reason = "content read back differs"
+		}
+		fmt.Printf("  %s: %s\n", f.Path, reason)
+	}
+	if report.Failed > 0 {
+		os.Exit(exitCode(cass.ErrVerifyFailed))
+	}
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var VersionsCommand = &cobra.Command{
+	Use:   "versions <path>",
+	Short: "List, print or restore the kept versions of a file",
+	Long: `List the previous versions of a file that are kept when the policy of the
+		environment sets --versions, the newest first.  --cat prints a version,
+		--restore makes it the content of the file again (the content it
+		replaces becomes a version) and --purge drops every version.  Versions
+		of a deleted file are kept, so it can be restored as well.`,
+	Run: versions,
+}
+
+var (
+	versions_restore string
+	versions_cat     string
+	versions_purge   bool
+)
+
+func init() {
+	VersionsCommand.Flags().StringVar(&versions_restore, "restore", "", "Version to restore")
+	VersionsCommand.Flags().StringVar(&versions_cat, "cat", "", "Version to print")
+	VersionsCommand.Flags().BoolVar(&versions_purge, "purge", false, "Drop every version and release its data")
+	RootCommand.AddCommand(VersionsCommand)
+}
+
+func versions(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	name := storePath(args[0])
+	switch {
+	case versions_restore != "":
+		err = c.RestoreVersion(name, versions_restore)
+		if err != nil {
+			fail(exitCode(err), "Unable to restore", args[0], ":", err)
+		}
+	case versions_cat != "":
+		v, err := c.Version(name, versions_cat)
+		if err != nil {
+			fail(exitCode(err), "Unable to read", args[0], ":", err)
+		}
+		err = writeContent(c, &cass.CassFsMetadata{Metadata: *v.Meta, Hash: v.Hash}, 0, -1, os.Stdout)
+		if err != nil {
+			fail(exitCode(err), "Unable to read", args[0], ":", err)
+		}
+	case versions_purge:
+		count, err := c.PurgeVersions(name)
+		if err != nil {
+			fail(exitCode(err), "Unable to purge the versions of", args[0], ":", err)
+		}
+		fmt.Println("Dropped", count, "versions")
+	default:
+		list, err := c.Versions(name)
+		if err != nil {
+			fail(exitCode(err), "Unable to list the versions of", args[0], ":", err)
+		}
+		for _, v := range list {
+			mtime := time.Unix(int64(v.Meta.Attr.Mtime), int64(v.Meta.Attr.Mtimensec))
+			fmt.Printf("%s %12d %s\n", v.Name(), v.Meta.Attr.Size, mtime.Format(time.RFC3339))
+		}
+	}
+}
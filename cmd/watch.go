@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cgt212/cassfs/cass"
+)
+
+var WatchCommand = &cobra.Command{
+	Use:   "watch [path]",
+	Short: "Print the changes made to the environment as they happen",
+	Long: `Follow the changelog of the environment, which is recorded when its policy
+		sets --changelog, and print every create, update, delete and rename made
+		through any mount or command below path.  --since starts from changes
+		already recorded, either a duration back or an RFC3339 time, and --once
+		exits after printing them.  --json prints one JSON object per change.`,
+	Run: watch,
+}
+
+var (
+	watch_since    string
+	watch_interval time.Duration
+	watch_once     bool
+	watch_json     bool
+)
+
+func init() {
+	WatchCommand.Flags().StringVar(&watch_since, "since", "", "Print the changes since this duration ago or RFC3339 time first")
+	WatchCommand.Flags().DurationVar(&watch_interval, "interval", time.Second, "Time between polls of the changelog")
+	WatchCommand.Flags().BoolVar(&watch_once, "once", false, "Print the changes recorded so far and exit")
+	WatchCommand.Flags().BoolVar(&watch_json, "json", false, "Print each change as a JSON object")
+	RootCommand.AddCommand(WatchCommand)
+}
+
+//parseSince reads a time given either as a duration back from now or as an RFC3339 time
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+//printChange prints a change of the changelog
+func printChange(change *cass.LogEntry) error {
+	if watch_json {
+		enc, err := json.Marshal(struct {
+			Time time.Time
+			*cass.LogEntry
+		}{change.Time(), change})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(enc))
+		return err
+	}
+	t := change.Time().Format(time.RFC3339Nano)
+	if change.Op == cass.CHANGE_RENAME {
+		_, err := fmt.Printf("%s %s /%s -> /%s\n", t, change.Op, change.Source, change.Path)
+		return err
+	}
+	_, err := fmt.Printf("%s %s /%s\n", t, change.Op, change.Path)
+	return err
+}
+
+func watch(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		cmd.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	p := ""
+	if len(args) == 1 {
+		p = storePath(args[0])
+	}
+	since, err := parseSince(watch_since)
+	if err != nil {
+		fail(EXIT_USAGE, "Invalid --since:", err)
+	}
+	c, err := openStore()
+	if err != nil {
+		fail(EXIT_CONNECTION, "Could not initialize cluster connection:", err)
+	}
+	if c.Config.Policy.Changelog <= 0 {
+		fail(EXIT_USAGE, "The environment does not record a changelog, set one with policy --changelog")
+	}
+	if watch_once {
+		changes, err := c.ChangesSince(since)
+		if err != nil {
+			fail(exitCode(err), "Unable to read the changelog:", err)
+		}
+		for _, change := range changes {
+			if change.Below(p) {
+				printChange(change)
+			}
+		}
+		return
+	}
+	err = c.WatchChangelog(since, watch_interval, func(change *cass.LogEntry) error {
+		if !change.Below(p) {
+			return nil
+		}
+		return printChange(change)
+	})
+	fail(exitCode(err), "Unable to follow the changelog:", err)
+}
@@ -21,6 +21,11 @@ type Mount struct {
 	Owner       int
 	Clients     int
 	Location    string
+	// Base is the environment the volume is layered over
+	Base        string
+	// Overlay is set when the environment was created for the volume
+	// and is deleted along with it
+	Overlay     bool
 }
 
 func NewVolumeDb(config *DriverConfig) (*VolumeDb, error) {
@@ -42,7 +47,9 @@ func NewVolumeDb(config *DriverConfig) (*VolumeDb, error) {
 					'owner' INTEGER,
 					'environment' VARCHAR(256),
 					'clients' INTEGER,
-					'location' VARCHAR(256) )`)
+					'location' VARCHAR(256),
+					'base' VARCHAR(256) DEFAULT '',
+					'overlay' INTEGER DEFAULT 0 )`)
 		if err != nil {
 			return nil, err
 		}
@@ -50,6 +57,16 @@ func NewVolumeDb(config *DriverConfig) (*VolumeDb, error) {
 		if err != nil {
 			return nil, err
 		}
+	} else if _, err := db.Exec("SELECT base, overlay FROM mount LIMIT 1"); err != nil {
+		// Databases of older versions do not have the layering columns yet
+		_, err = db.Exec("ALTER TABLE mount ADD COLUMN base VARCHAR(256) DEFAULT ''")
+		if err != nil {
+			return nil, err
+		}
+		_, err = db.Exec("ALTER TABLE mount ADD COLUMN overlay INTEGER DEFAULT 0")
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &VolumeDb{
 		config: config,
@@ -58,7 +75,7 @@ func NewVolumeDb(config *DriverConfig) (*VolumeDb, error) {
 }
 
 func (v *VolumeDb) FindVolume(name string) (*Mount, error) {
-	stmt, err := v.db.Prepare("SELECT name, hash, clients, owner, environment, location FROM mount WHERE name=?")
+	stmt, err := v.db.Prepare("SELECT name, hash, clients, owner, environment, location, base, overlay FROM mount WHERE name=?")
 	if err != nil {
 		fmt.Printf("SQL Prepare Error: %s\n", err)
 		return nil, err
@@ -73,7 +90,7 @@ func (v *VolumeDb) FindVolume(name string) (*Mount, error) {
 	mount := &Mount{}
 
 	if rows.Next() {
-		err = rows.Scan(&mount.Name, &mount.Hash, &mount.Clients, &mount.Owner, &mount.Environment, &mount.Location)
+		err = rows.Scan(&mount.Name, &mount.Hash, &mount.Clients, &mount.Owner, &mount.Environment, &mount.Location, &mount.Base, &mount.Overlay)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				return nil, nil
@@ -88,7 +105,7 @@ func (v *VolumeDb) FindVolume(name string) (*Mount, error) {
 	return mount, nil
 }
 
-func (v *VolumeDb) CreateVolume(name string, owner int, env string) (*Mount, error) {
+func (v *VolumeDb) CreateVolume(name string, owner int, env string, base string, overlay bool) (*Mount, error) {
 	mount, err := v.FindVolume(name)
 	if err != nil {
 		fmt.Printf("Error finding volume: %s\n", err)
@@ -105,6 +122,8 @@ func (v *VolumeDb) CreateVolume(name string, owner int, env string) (*Mount, err
 			Owner:       owner,
 			Environment: env,
 			Location:    mp,
+			Base:        base,
+			Overlay:     overlay,
 		}
 		return mount, v.insertVolume(mount)
 	}
@@ -150,11 +169,11 @@ func (v *VolumeDb) UnmountVolume(name string) (*Mount, error) {
 }
 
 func (v *VolumeDb) insertVolume(m *Mount) error {
-	stmt, err := v.db.Prepare("INSERT INTO mount (name, hash, clients, owner, environment, location) VALUES(?, ?, ?, ?, ?, ?)")
+	stmt, err := v.db.Prepare("INSERT INTO mount (name, hash, clients, owner, environment, location, base, overlay) VALUES(?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(m.Name, m.Hash, m.Clients, m.Owner, m.Environment, m.Location)
+	_, err = stmt.Exec(m.Name, m.Hash, m.Clients, m.Owner, m.Environment, m.Location, m.Base, m.Overlay)
 	if err != nil {
 		return err
 	}
@@ -213,7 +232,7 @@ func (v *VolumeDb) decrementMount(name string) error {
 
 func (v *VolumeDb) GetAll() ([]*Mount, error) {
 	var ret []*Mount
-	stmt, err := v.db.Prepare("SELECT name, hash, clients, owner, environment, location  FROM mount")
+	stmt, err := v.db.Prepare("SELECT name, hash, clients, owner, environment, location, base, overlay FROM mount")
 	if err != nil {
 		return nil, err
 	}
@@ -223,7 +242,7 @@ func (v *VolumeDb) GetAll() ([]*Mount, error) {
 	}
 	for rows.Next() {
 		var mnt Mount
-		rows.Scan(&mnt.Name, &mnt.Hash, &mnt.Clients, &mnt.Owner, &mnt.Environment, &mnt.Location)
+		rows.Scan(&mnt.Name, &mnt.Hash, &mnt.Clients, &mnt.Owner, &mnt.Environment, &mnt.Location, &mnt.Base, &mnt.Overlay)
 		ret = append(ret, &mnt)
 	}
 	rows.Close()
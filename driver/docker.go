@@ -19,7 +19,7 @@ Wants=docker.service
 
 [Service]
 EnvironmentFile={{.StateDir}}/environments/{{.Hash}}.env
-ExecStart=/usr/local/bin/cassfs mount ${MOUNT}
+ExecStart=/usr/local/bin/cassfs mount --options allow_other ${MOUNT}
 ExecStop=/bin/fusermount -u ${MOUNT}`
 
 var unit_env_tmpl = `
@@ -28,6 +28,8 @@ CASSFS_CONSISTENCY={{.Consistency}}
 CASSFS_KEYSPACE={{.Keyspace}}
 CASSFS_ENVIRONMENT={{.Environment}}
 CASSFS_OWNER={{.Owner}}
+CASSFS_JOURNAL={{.Journal}}
+CASSFS_LOWER={{.Lower}}
 MOUNT={{.Mount}}
 `
 
@@ -37,6 +39,9 @@ type DriverConfig struct {
 	Server      string
 	StateDir    string
 	VolumeDir   string
+	// DeleteEnvironment removes the environment of an overlay volume
+	// when the volume is removed
+	DeleteEnvironment func(owner int, env string) error
 }
 
 type CassFsDriver struct {
@@ -95,7 +100,62 @@ func (c *CassFsDriver) Create(r *volume.CreateRequest) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	return nil
+	// The options are only seen here, volumes created implicitly
+	// by a mount are plain environments
+	return c.create(*r)
+}
+
+// parseVolumeName splits a name in the form of <owner>.<environment>
+func parseVolumeName(name string) (int, string, error) {
+	args := strings.Split(name, ".")
+	if len(args) != 2 {
+		return 0, "", errors.New("Volume name must be in the form of <owner>.<environment>")
+	}
+
+	owner, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, "", errors.New("Owner must be an integer value")
+	}
+	return owner, args[1], nil
+}
+
+// layerOptions reads the base and overlay options of a volume, base=<owner>.<environment>
+// layers the volume over a read only environment and overlay=auto creates a new
+// environment for the volume that is deleted when the volume is removed
+func layerOptions(options map[string]string) (int, string, bool, error) {
+	overlay := false
+	switch options["overlay"] {
+	case "":
+	case "auto":
+		overlay = true
+	default:
+		return 0, "", false, errors.New("Unknown overlay option: " + options["overlay"])
+	}
+	if options["base"] == "" {
+		if overlay {
+			return 0, "", false, errors.New("An overlay volume needs a base")
+		}
+		return 0, "", false, nil
+	}
+	owner, base, err := parseVolumeName(options["base"])
+	if err != nil {
+		return 0, "", false, errors.New("Invalid base: " + err.Error())
+	}
+	return owner, base, overlay, nil
+}
+
+// journalOption reads the journal option of a volume, journal=true checkpoints the dirty
+// open files of the volume to the state directory so they survive the mount dying.  Every
+// write to a volume with a journal is also written to local disk, so it is off by default.
+func journalOption(options map[string]string) (bool, error) {
+	if options["journal"] == "" {
+		return false, nil
+	}
+	journal, err := strconv.ParseBool(options["journal"])
+	if err != nil {
+		return false, errors.New("Invalid journal option: " + options["journal"])
+	}
+	return journal, nil
 }
 
 func (c *CassFsDriver) create(r volume.CreateRequest) error {
@@ -109,19 +169,36 @@ func (c *CassFsDriver) create(r volume.CreateRequest) error {
 	// an owner.environment pattern otherwise there may be
 	// undetectable naming collisions
 
-	args := strings.Split(r.Name, ".")
-	if len(args) != 2 {
-		return errors.New("Volume name must be in the form of <owner>.<environment>")
+	baseOwner, base, overlay, err := layerOptions(r.Options)
+	if err != nil {
+		return err
 	}
-
-	owner, err := strconv.Atoi(args[0])
+	journal, err := journalOption(r.Options)
 	if err != nil {
-		return errors.New("Owner must be an integer value")
+		return err
+	}
+
+	var owner int
+	var env string
+	if overlay {
+		// Docker names anonymous volumes with random ids, so the
+		// environment of an overlay is named after the hash of the
+		// volume name and belongs to the owner of the base
+		_, sum := MountPoint(c.config.VolumeDir, r.Name)
+		owner, env = baseOwner, "overlay-" + sum[:12]
+	} else {
+		owner, env, err = parseVolumeName(r.Name)
+		if err != nil {
+			return err
+		}
+		if base != "" && baseOwner != owner {
+			return errors.New("The base must belong to the owner of the volume")
+		}
 	}
 
 	// Put name format verification here
 	// instead of in the writeEnvFile function
-	mount, err := c.db.CreateVolume(r.Name, owner, args[1])
+	mount, err := c.db.CreateVolume(r.Name, owner, env, base, overlay)
 	if err != nil {
 		fmt.Printf("Error attaching volume: %s\n", err)
 		return err
@@ -131,7 +208,7 @@ func (c *CassFsDriver) create(r volume.CreateRequest) error {
 		// This is the first mount for this name
 		// we have to write the environment path
 		location := filepath.Join(c.config.StateDir, "environments", mount.Hash + ".env")
-		writeEnvFile(location, c.config, mount)
+		writeEnvFile(location, c.config, mount, journal)
 		// Create the template systemd file
 		err = writeUnitFile(filepath.Join(c.config.StateDir, "systemd", "cassfs-" + mount.Hash + ".service"), c.config.StateDir, mount.Hash)
 		if err != nil {
@@ -163,8 +240,15 @@ func (c *CassFsDriver) Remove(r *volume.RemoveRequest) error {
 	}
 	if mount.Clients == 0 {
 		// There are no more containers using the mount, remove it
-		location := filepath.Join(c.config.StateDir, "environment", mount.Hash + ".env")
+		location := filepath.Join(c.config.StateDir, "environments", mount.Hash + ".env")
 		deleteEnvFile(location)
+		if mount.Overlay && c.config.DeleteEnvironment != nil {
+			err = c.config.DeleteEnvironment(mount.Owner, mount.Environment)
+			if err != nil {
+				fmt.Printf("Unable to delete overlay environment %s: %s\n", mount.Environment, err)
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -346,7 +430,7 @@ func writeUnitFile(location string, statedir string, hash string) error {
 	return nil
 }
 
-func writeEnvFile(location string, config *DriverConfig, mount *Mount) error {
+func writeEnvFile(location string, config *DriverConfig, mount *Mount, journal bool) error {
 	// Check to see if the file exists, we will delete it if it does
 	// just in case things have changes
 	if _, err := os.Stat(location); err == nil {
@@ -357,12 +441,20 @@ func writeEnvFile(location string, config *DriverConfig, mount *Mount) error {
 		return err
 	}
 
+	// An empty journal directory mounts without a journal
+	journal_dir := ""
+	if journal {
+		journal_dir = filepath.Join(config.StateDir, "journal", mount.Hash)
+	}
+
 	env_data := struct {
 		Server      string
 		Consistency string
 		Keyspace    string
 		Environment string
 		Owner       int
+		Journal     string
+		Lower       string
 		Mount       string
 	}{
 		config.Server,
@@ -370,6 +462,8 @@ func writeEnvFile(location string, config *DriverConfig, mount *Mount) error {
 		config.Keyspace,
 		mount.Environment,
 		mount.Owner,
+		journal_dir,
+		mount.Base,
 		mount.Location,
 	}
 